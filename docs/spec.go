@@ -22,9 +22,6 @@ var DiagramSpecYAML []byte
 //go:embed ai.yaml
 var AISpecYAML []byte
 
-//go:embed realtime.yaml
-var RealtimeSpecYAML []byte
-
 // ServeAuth writes the auth OpenAPI 3.0 spec (YAML) with content-type application/yaml.
 func ServeAuth(c *gin.Context) {
 	c.Data(http.StatusOK, "application/yaml", AuthSpecYAML)
@@ -45,11 +42,6 @@ func ServeAI(c *gin.Context) {
 	c.Data(http.StatusOK, "application/yaml", AISpecYAML)
 }
 
-// ServeRealtime writes the realtime WebSocket OpenAPI 3.0 spec (YAML) with content-type application/yaml.
-func ServeRealtime(c *gin.Context) {
-	c.Data(http.StatusOK, "application/yaml", RealtimeSpecYAML)
-}
-
 // ServeSwagger writes the interactive Swagger UI page (HTML) for trying endpoints.
 func ServeSwagger(c *gin.Context) {
 	c.Data(http.StatusOK, "text/html; charset=utf-8", SwaggerHTML)
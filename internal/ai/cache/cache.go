@@ -0,0 +1,59 @@
+// Package cache stores generated diagrams so that repeated identical generate requests are answered
+// without calling the AI provider.
+package cache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/devenock/d_weaver/internal/ai/mermaid"
+)
+
+// Entry is a cached generation.
+type Entry struct {
+	Diagram    string         `json:"diagram"`
+	Validation mermaid.Result `json:"validation"`
+	Model      string         `json:"model"`
+}
+
+// Store keeps entries until they expire.
+type Store interface {
+	// Get returns the entry under key; (nil, nil) when it is unknown or expired.
+	Get(ctx context.Context, key string) (*Entry, error)
+	// Put stores e under key for ttl.
+	Put(ctx context.Context, key string, e Entry, ttl time.Duration) error
+}
+
+// KeyInput is everything a generation's output depends on. Scope keeps entries apart that must not
+// be shared, e.g. different workspaces.
+type KeyInput struct {
+	Scope         string
+	Description   string
+	DiagramType   string
+	Model         string
+	PromptVersion string
+	Style         string
+}
+
+// Key returns the cache key for in. Descriptions that differ only in case or whitespace share a key,
+// as do an empty and an "auto" diagram type.
+func Key(in KeyInput) string {
+	diagramType := strings.ToLower(strings.TrimSpace(in.DiagramType))
+	if diagramType == "" {
+		diagramType = "auto"
+	}
+	h := sha256.New()
+	for _, part := range []string{in.Scope, NormalizeDescription(in.Description), diagramType, in.Model, in.PromptVersion, in.Style} {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// NormalizeDescription lower-cases description and collapses its whitespace.
+func NormalizeDescription(description string) string {
+	return strings.ToLower(strings.Join(strings.Fields(description), " "))
+}
@@ -0,0 +1,51 @@
+package cache
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestKey(t *testing.T) {
+	base := KeyInput{Description: "Login  flow\n", Model: "openai m", PromptVersion: "v1"}
+	same := KeyInput{Description: "login flow", DiagramType: "auto", Model: "openai m", PromptVersion: "v1"}
+	if Key(base) != Key(same) {
+		t.Error("case, whitespace or an auto type changed the key")
+	}
+	for _, other := range []KeyInput{
+		{Description: "login flow", DiagramType: "sequence", Model: "openai m", PromptVersion: "v1"},
+		{Description: "login flow", Model: "openai other", PromptVersion: "v1"},
+		{Description: "login flow", Model: "openai m", PromptVersion: "v2"},
+		{Description: "login flow", Model: "openai m", PromptVersion: "v1", Scope: "workspace"},
+		{Description: "login flow", Model: "openai m", PromptVersion: "v1", Style: "LR"},
+	} {
+		if Key(other) == Key(base) {
+			t.Errorf("%+v shares the key of %+v", other, base)
+		}
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	s := NewMemoryStore(2)
+	s.now = func() time.Time { return now }
+
+	_ = s.Put(ctx, "a", Entry{Diagram: "a"}, time.Minute)
+	_ = s.Put(ctx, "b", Entry{Diagram: "b"}, 2*time.Minute)
+	if e, _ := s.Get(ctx, "a"); e == nil || e.Diagram != "a" {
+		t.Fatalf("a = %+v", e)
+	}
+	// Full: the entry closest to expiry makes room.
+	_ = s.Put(ctx, "c", Entry{Diagram: "c"}, 3*time.Minute)
+	if e, _ := s.Get(ctx, "a"); e != nil {
+		t.Error("a was not evicted")
+	}
+	now = now.Add(2 * time.Minute)
+	if e, _ := s.Get(ctx, "b"); e != nil {
+		t.Error("b outlived its ttl")
+	}
+	if e, _ := s.Get(ctx, "c"); e == nil {
+		t.Error("c expired early")
+	}
+}
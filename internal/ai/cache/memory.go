@@ -0,0 +1,74 @@
+package cache
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// DefaultMaxEntries bounds a MemoryStore created with maxEntries <= 0.
+const DefaultMaxEntries = 1000
+
+type memoryEntry struct {
+	entry     Entry
+	expiresAt time.Time
+}
+
+// MemoryStore is the single-node Store (default when REDIS_URL is unset). When full it drops the
+// entry closest to expiry.
+type MemoryStore struct {
+	maxEntries int
+	now        func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]memoryEntry
+}
+
+// NewMemoryStore returns an in-process store holding at most maxEntries entries.
+func NewMemoryStore(maxEntries int) *MemoryStore {
+	if maxEntries <= 0 {
+		maxEntries = DefaultMaxEntries
+	}
+	return &MemoryStore{maxEntries: maxEntries, now: time.Now, entries: make(map[string]memoryEntry)}
+}
+
+// Get returns the entry under key unless it has expired.
+func (s *MemoryStore) Get(ctx context.Context, key string) (*Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[key]
+	if !ok {
+		return nil, nil
+	}
+	if !s.now().Before(e.expiresAt) {
+		delete(s.entries, key)
+		return nil, nil
+	}
+	return &e.entry, nil
+}
+
+// Put stores the entry, pruning expired ones and making room when the store is full.
+func (s *MemoryStore) Put(ctx context.Context, key string, e Entry, ttl time.Duration) error {
+	now := s.now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.entries[key]; !ok && len(s.entries) >= s.maxEntries {
+		var oldest string
+		for k, v := range s.entries {
+			if !now.Before(v.expiresAt) {
+				delete(s.entries, k)
+				continue
+			}
+			if oldest == "" || v.expiresAt.Before(s.entries[oldest].expiresAt) {
+				oldest = k
+			}
+		}
+		if len(s.entries) >= s.maxEntries {
+			delete(s.entries, oldest)
+		}
+	}
+	s.entries[key] = memoryEntry{entry: e, expiresAt: now.Add(ttl)}
+	return nil
+}
+
+var _ Store = (*MemoryStore)(nil)
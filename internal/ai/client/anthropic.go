@@ -0,0 +1,179 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	anthropicVersion = "2023-06-01"
+	// anthropicMaxTokens is sent when the request sets none; the Messages API requires max_tokens.
+	anthropicMaxTokens = 4096
+)
+
+// AnthropicGenerator calls the Anthropic Messages API.
+type AnthropicGenerator struct {
+	apiKey  string
+	baseURL string
+	model   string
+	client  *http.Client
+}
+
+// NewAnthropicGenerator returns a generator that POSTs to baseURL/messages. hc may be nil.
+func NewAnthropicGenerator(apiKey, baseURL, model string, hc *http.Client) *AnthropicGenerator {
+	return &AnthropicGenerator{
+		apiKey:  apiKey,
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		model:   model,
+		client:  httpClientOrDefault(hc),
+	}
+}
+
+type anthropicRequest struct {
+	Model       string        `json:"model"`
+	System      string        `json:"system,omitempty"`
+	Messages    []chatMessage `json:"messages"`
+	MaxTokens   int           `json:"max_tokens"`
+	Temperature float64       `json:"temperature"`
+	Stream      bool          `json:"stream,omitempty"`
+}
+
+type anthropicUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+type anthropicResponse struct {
+	Model   string `json:"model"`
+	Content []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	} `json:"content"`
+	Usage anthropicUsage `json:"usage"`
+}
+
+// anthropicEvent is one streamed Messages API event; which fields are set depends on Type.
+type anthropicEvent struct {
+	Type    string `json:"type"`
+	Message struct {
+		Model string         `json:"model"`
+		Usage anthropicUsage `json:"usage"`
+	} `json:"message"` // message_start
+	Delta struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	} `json:"delta"` // content_block_delta
+	Usage *anthropicUsage `json:"usage"` // message_delta
+	Error *struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// GenerateDiagram calls the Messages API and returns raw Mermaid code (no markdown fences).
+func (g *AnthropicGenerator) GenerateDiagram(ctx context.Context, description, diagramType string) (string, error) {
+	return generateDiagram(ctx, g, description, diagramType)
+}
+
+// Complete sends req to the Messages API and joins the text blocks of the reply.
+func (g *AnthropicGenerator) Complete(ctx context.Context, req Request) (*Response, error) {
+	if g.apiKey == "" {
+		return nil, fmt.Errorf("ai: API key not configured")
+	}
+	var out anthropicResponse
+	if err := postJSON(ctx, g.client, ProviderAnthropic, g.baseURL+"/messages", g.headers(), g.body(req), &out); err != nil {
+		return nil, err
+	}
+	var text strings.Builder
+	for _, block := range out.Content {
+		if block.Type == "text" {
+			text.WriteString(block.Text)
+		}
+	}
+	return &Response{
+		Content:      text.String(),
+		Model:        modelOr(out.Model, g.model),
+		InputTokens:  out.Usage.InputTokens,
+		OutputTokens: out.Usage.OutputTokens,
+	}, nil
+}
+
+// Stream sends req to the Messages API with streaming on and passes each text delta to onDelta.
+func (g *AnthropicGenerator) Stream(ctx context.Context, req Request, onDelta func(text string) error) (*Response, error) {
+	if g.apiKey == "" {
+		return nil, fmt.Errorf("ai: API key not configured")
+	}
+	body := g.body(req)
+	body.Stream = true
+	stream, err := post(ctx, g.client, ProviderAnthropic, g.baseURL+"/messages", g.headers(), body)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	var content strings.Builder
+	out := &Response{Model: g.model}
+	err = eachLine(stream, func(line string) error {
+		data, ok := sseData(line)
+		if !ok {
+			return nil
+		}
+		var ev anthropicEvent
+		if err := json.Unmarshal([]byte(data), &ev); err != nil {
+			return fmt.Errorf("ai: decode stream: %w", err)
+		}
+		switch ev.Type {
+		case "message_start":
+			out.Model = modelOr(ev.Message.Model, g.model)
+			out.InputTokens = ev.Message.Usage.InputTokens
+		case "content_block_delta":
+			if ev.Delta.Type == "text_delta" && ev.Delta.Text != "" {
+				content.WriteString(ev.Delta.Text)
+				return onDelta(ev.Delta.Text)
+			}
+		case "message_delta":
+			if ev.Usage != nil {
+				out.OutputTokens = ev.Usage.OutputTokens
+			}
+		case "error":
+			if ev.Error != nil {
+				switch ev.Error.Type {
+				case "rate_limit_error":
+					return fmt.Errorf("%w: %s", ErrRateLimited, ev.Error.Message)
+				case "overloaded_error", "api_error":
+					return fmt.Errorf("%w: %s", ErrUnavailable, ev.Error.Message)
+				}
+				return fmt.Errorf("ai: anthropic stream error: %s", ev.Error.Message)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	out.Content = content.String()
+	return out, nil
+}
+
+func (g *AnthropicGenerator) headers() map[string]string {
+	return map[string]string{"x-api-key": g.apiKey, "anthropic-version": anthropicVersion}
+}
+
+func (g *AnthropicGenerator) body(req Request) anthropicRequest {
+	body := anthropicRequest{
+		Model:       g.model,
+		System:      req.System,
+		MaxTokens:   req.MaxTokens,
+		Temperature: req.Temperature,
+	}
+	if body.MaxTokens <= 0 {
+		body.MaxTokens = anthropicMaxTokens
+	}
+	for _, m := range req.Messages {
+		body.Messages = append(body.Messages, chatMessage{Role: m.Role, Content: m.Content})
+	}
+	return body
+}
@@ -1,6 +1,7 @@
 package client
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"encoding/json"
@@ -9,129 +10,159 @@ import (
 	"net/http"
 	"strings"
 	"time"
+
+	"github.com/devenock/d_weaver/config"
+	"github.com/devenock/d_weaver/internal/ai/prompt"
+)
+
+// Providers selectable through config.AIConfig.Provider.
+const (
+	ProviderOpenAI    = "openai" // any OpenAI-compatible chat completions endpoint
+	ProviderAnthropic = "anthropic"
+	ProviderOllama    = "ollama"
+)
+
+const (
+	defaultTimeout         = 60 * time.Second
+	defaultBreakerCooldown = 30 * time.Second
 )
 
-// Generator generates Mermaid diagram code from a text description (OpenAI-compatible chat completions).
+// providerDefaults are the base URL and model used when the config leaves them empty.
+var providerDefaults = map[string]struct{ baseURL, model string }{
+	ProviderOpenAI:    {"https://ai.gateway.lovable.dev/v1", "google/gemini-2.5-flash"},
+	ProviderAnthropic: {"https://api.anthropic.com/v1", "claude-3-5-haiku-latest"},
+	ProviderOllama:    {"http://localhost:11434", "llama3.1"},
+}
+
+// Generator generates Mermaid diagram code from a text description. Implementations talk to one
+// provider; Complete is the provider-neutral chat call GenerateDiagram is built on, and Stream is
+// Complete with the reply delivered to onDelta as it arrives. An error from onDelta stops the stream.
 type Generator interface {
 	GenerateDiagram(ctx context.Context, description, diagramType string) (mermaid string, err error)
+	Complete(ctx context.Context, req Request) (*Response, error)
+	Stream(ctx context.Context, req Request, onDelta func(text string) error) (*Response, error)
+}
+
+// Message is one turn of a conversation. Role is "user" or "assistant".
+type Message struct {
+	Role    string
+	Content string
+}
+
+// Request is a chat request in provider-neutral form.
+type Request struct {
+	System      string
+	Messages    []Message
+	Temperature float64
+	MaxTokens   int // 0 for the provider default
+}
+
+// Response is the model's reply and the token usage the provider reported.
+type Response struct {
+	Content      string
+	Model        string
+	InputTokens  int
+	OutputTokens int
+}
+
+// ValidProvider reports whether name is a supported provider.
+func ValidProvider(name string) bool {
+	_, ok := providerDefaults[name]
+	return ok
 }
 
-// HTTPGenerator calls an OpenAI-compatible chat completions endpoint.
-type HTTPGenerator struct {
-	apiKey  string
-	baseURL string
-	model   string
-	client  *http.Client
-}
-
-// NewHTTPGenerator returns a generator that POSTs to baseURL/chat/completions.
-func NewHTTPGenerator(apiKey, baseURL, model string) *HTTPGenerator {
-	baseURL = strings.TrimSuffix(baseURL, "/")
-	return &HTTPGenerator{
-		apiKey:  apiKey,
-		baseURL: baseURL,
-		model:   model,
-		client:  &http.Client{Timeout: 60 * time.Second},
-	}
-}
-
-// chatRequest matches the OpenAI chat completions request shape.
-type chatRequest struct {
-	Model       string    `json:"model"`
-	Messages    []message `json:"messages"`
-	Temperature float64   `json:"temperature"`
-}
-
-type message struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
-}
-
-// chatResponse matches the minimal response shape we need.
-type chatResponse struct {
-	Choices []struct {
-		Message struct {
-			Content string `json:"content"`
-		} `json:"message"`
-	} `json:"choices"`
-}
-
-// GenerateDiagram calls the AI gateway and returns raw Mermaid code (no markdown fences).
-func (g *HTTPGenerator) GenerateDiagram(ctx context.Context, description, diagramType string) (string, error) {
-	if g.apiKey == "" {
-		return "", fmt.Errorf("ai: API key not configured")
-	}
-	systemPrompt := `You are an expert diagram generator. Convert the user's description into Mermaid diagram syntax.
-
-Important rules:
-1. Return ONLY the Mermaid code, no explanations or markdown code blocks
-2. Use the appropriate diagram type based on the context:
-   - flowchart/graph: for processes, workflows, decision trees
-   - sequenceDiagram: for interactions between entities
-   - classDiagram: for class structures and relationships
-   - erDiagram: for database schemas
-   - stateDiagram-v2: for state machines
-   - gantt: for project timelines
-   - mindmap: for hierarchical ideas
-   - C4Context/C4Container/C4Component: for architecture diagrams
-   - gitGraph: for version control flows
-3. Ensure proper syntax and node connections
-4. Use clear, descriptive labels
-5. Make the diagram comprehensive and well-structured`
-
-	userContent := description
-	if diagramType != "" && diagramType != "auto" {
-		userContent = fmt.Sprintf("Create a %s diagram for: %s", diagramType, description)
-	} else {
-		userContent = "Create an appropriate diagram for: " + description
-	}
-
-	body := chatRequest{
-		Model: g.model,
-		Messages: []message{
-			{Role: "system", Content: systemPrompt},
-			{Role: "user", Content: userContent},
-		},
-		Temperature: 0.7,
+// DefaultModel returns the model used for provider when none is configured.
+func DefaultModel(provider string) string {
+	return providerDefaults[provider].model
+}
+
+// New returns the generator for cfg.Provider (openai when empty), filling in the provider's default
+// base URL and model. Unless cfg disables both, calls are retried on 429 and 5xx responses and go
+// through a circuit breaker shared by all generators for the same endpoint.
+func New(cfg config.AIConfig) (Generator, error) {
+	provider := cfg.Provider
+	if provider == "" {
+		provider = ProviderOpenAI
 	}
-	raw, err := json.Marshal(body)
-	if err != nil {
-		return "", fmt.Errorf("ai: marshal request: %w", err)
+	defaults, ok := providerDefaults[provider]
+	if !ok {
+		return nil, fmt.Errorf("ai: unknown provider %q", cfg.Provider)
 	}
-
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, g.baseURL+"/chat/completions", bytes.NewReader(raw))
-	if err != nil {
-		return "", fmt.Errorf("ai: create request: %w", err)
+	baseURL, model := cfg.BaseURL, cfg.Model
+	if baseURL == "" {
+		baseURL = defaults.baseURL
 	}
-	req.Header.Set("Authorization", "Bearer "+g.apiKey)
-	req.Header.Set("Content-Type", "application/json")
+	if model == "" {
+		model = defaults.model
+	}
+	timeout := defaultTimeout
+	if cfg.TimeoutSeconds > 0 {
+		timeout = time.Duration(cfg.TimeoutSeconds) * time.Second
+	}
+	hc := &http.Client{Timeout: timeout}
+	var gen Generator
+	switch provider {
+	case ProviderAnthropic:
+		gen = NewAnthropicGenerator(cfg.APIKey, baseURL, model, hc)
+	case ProviderOllama:
+		gen = NewOllamaGenerator(baseURL, model, hc)
+	default:
+		gen = NewOpenAIGenerator(cfg.APIKey, baseURL, model, hc)
+	}
+	if cfg.MaxRetries <= 0 && cfg.BreakerThreshold <= 0 {
+		return gen, nil
+	}
+	var breaker func() *Breaker
+	if threshold, cooldown := cfg.BreakerThreshold, breakerCooldown(cfg); threshold > 0 {
+		breaker = func() *Breaker { return breakerFor(provider, baseURL, threshold, cooldown) }
+	}
+	return newResilientGenerator(gen, max(cfg.MaxRetries, 0), breaker), nil
+}
 
-	resp, err := g.client.Do(req)
-	if err != nil {
-		return "", fmt.Errorf("ai: request: %w", err)
+// CircuitState returns the circuit breaker state of the endpoint cfg points at, or "" when cfg
+// disables the breaker. See CircuitCounts for the workspaces' endpoints.
+func CircuitState(cfg config.AIConfig) string {
+	if cfg.BreakerThreshold <= 0 {
+		return ""
+	}
+	provider := cfg.Provider
+	if provider == "" {
+		provider = ProviderOpenAI
 	}
-	defer resp.Body.Close()
+	baseURL := cfg.BaseURL
+	if baseURL == "" {
+		baseURL = providerDefaults[provider].baseURL
+	}
+	return breakerState(provider, baseURL)
+}
 
-	respBody, _ := io.ReadAll(resp.Body)
-	if resp.StatusCode != http.StatusOK {
-		if resp.StatusCode == 429 {
-			return "", fmt.Errorf("rate limit exceeded")
-		}
-		if resp.StatusCode == 402 {
-			return "", fmt.Errorf("payment required")
-		}
-		return "", fmt.Errorf("ai: gateway returned %d: %s", resp.StatusCode, string(respBody))
+func breakerCooldown(cfg config.AIConfig) time.Duration {
+	if cfg.BreakerCooldownSeconds > 0 {
+		return time.Duration(cfg.BreakerCooldownSeconds) * time.Second
 	}
+	return defaultBreakerCooldown
+}
 
-	var out chatResponse
-	if err := json.Unmarshal(respBody, &out); err != nil {
-		return "", fmt.Errorf("ai: decode response: %w", err)
+// generateDiagram runs the generate-diagram prompt through g and returns the cleaned Mermaid code.
+func generateDiagram(ctx context.Context, g Generator, description, diagramType string) (string, error) {
+	req, err := DefaultPrompts().Diagram(description, diagramType, prompt.Style{})
+	if err != nil {
+		return "", err
 	}
-	if len(out.Choices) == 0 || out.Choices[0].Message.Content == "" {
+	resp, err := g.Complete(ctx, req)
+	if err != nil {
+		return "", err
+	}
+	content := CleanDiagram(resp.Content)
+	if content == "" {
 		return "", fmt.Errorf("ai: no diagram code in response")
 	}
-	content := strings.TrimSpace(out.Choices[0].Message.Content)
-	// Strip markdown code block if present
+	return content, nil
+}
+
+// CleanDiagram trims the model output and strips a surrounding markdown code block if present.
+func CleanDiagram(content string) string {
+	content = strings.TrimSpace(content)
 	if strings.HasPrefix(content, "```") {
 		lines := strings.SplitN(content, "\n", 2)
 		if len(lines) == 2 {
@@ -140,5 +171,97 @@ Important rules:
 		content = strings.TrimSuffix(content, "```")
 		content = strings.TrimSpace(content)
 	}
-	return content, nil
+	return content
+}
+
+// postJSON sends body to url with headers and decodes a 200 response into out.
+func postJSON(ctx context.Context, hc *http.Client, provider, url string, headers map[string]string, body, out interface{}) error {
+	respBody, err := post(ctx, hc, provider, url, headers, body)
+	if err != nil {
+		return err
+	}
+	defer respBody.Close()
+	raw, err := io.ReadAll(respBody)
+	if err != nil {
+		return fmt.Errorf("ai: read response: %w", err)
+	}
+	if err := json.Unmarshal(raw, out); err != nil {
+		return fmt.Errorf("ai: decode response: %w", err)
+	}
+	return nil
+}
+
+// post sends body to url with headers and returns the body of a 200 response for the caller to read
+// and close; other statuses become errors.
+func post(ctx context.Context, hc *http.Client, provider, url string, headers map[string]string, body interface{}) (io.ReadCloser, error) {
+	raw, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("ai: marshal request: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("ai: create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("ai: request: %w", err)
+		}
+		return nil, fmt.Errorf("%w: %w", ErrUnavailable, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		return nil, statusError(provider, resp, respBody)
+	}
+	return resp.Body, nil
+}
+
+// maxStreamLine bounds one line of a streamed response.
+const maxStreamLine = 1 << 20
+
+// eachLine calls fn with every non-empty line of r until fn returns an error or r ends.
+func eachLine(r io.Reader, fn func(line string) error) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64*1024), maxStreamLine)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		if err := fn(line); err != nil {
+			return err
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return fmt.Errorf("ai: read stream: %w", err)
+	}
+	return nil
+}
+
+// sseData returns the payload of a server-sent event "data:" line.
+func sseData(line string) (string, bool) {
+	if !strings.HasPrefix(line, "data:") {
+		return "", false
+	}
+	return strings.TrimSpace(strings.TrimPrefix(line, "data:")), true
+}
+
+// modelOr returns the model the provider reported, or the configured one.
+func modelOr(reported, configured string) string {
+	if reported == "" {
+		return configured
+	}
+	return reported
+}
+
+func httpClientOrDefault(hc *http.Client) *http.Client {
+	if hc == nil {
+		return &http.Client{Timeout: defaultTimeout}
+	}
+	return hc
 }
@@ -0,0 +1,224 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/devenock/d_weaver/config"
+	"github.com/devenock/d_weaver/internal/ai/prompt"
+)
+
+// stub serves one canned reply at path and records the last request body and headers.
+func stub(t *testing.T, path string, status int, reply string) (*httptest.Server, *map[string]interface{}, *http.Header) {
+	t.Helper()
+	body := map[string]interface{}{}
+	var header http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != path {
+			t.Errorf("path = %s, want %s", r.URL.Path, path)
+		}
+		header = r.Header.Clone()
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(reply))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &body, &header
+}
+
+func TestProviders_GenerateDiagram(t *testing.T) {
+	fenced := "```mermaid\\nflowchart TD\\n  A --> B\\n```"
+	cases := []struct {
+		name      string
+		cfg       config.AIConfig
+		path      string
+		reply     string
+		checkAuth func(h http.Header) bool
+		system    func(body map[string]interface{}) bool
+	}{
+		{
+			name:      "openai",
+			cfg:       config.AIConfig{Provider: ProviderOpenAI, APIKey: "k", Model: "m"},
+			path:      "/chat/completions",
+			reply:     `{"model":"m","choices":[{"message":{"content":"` + fenced + `"}}],"usage":{"prompt_tokens":3,"completion_tokens":5}}`,
+			checkAuth: func(h http.Header) bool { return h.Get("Authorization") == "Bearer k" },
+			system: func(b map[string]interface{}) bool {
+				// The system prompt, the flowchart example exchange and the request.
+				msgs := b["messages"].([]interface{})
+				return len(msgs) == 4 && msgs[0].(map[string]interface{})["role"] == "system"
+			},
+		},
+		{
+			name:      "anthropic",
+			cfg:       config.AIConfig{Provider: ProviderAnthropic, APIKey: "k", Model: "m"},
+			path:      "/messages",
+			reply:     `{"model":"m","content":[{"type":"text","text":"` + fenced + `"}],"usage":{"input_tokens":3,"output_tokens":5}}`,
+			checkAuth: func(h http.Header) bool { return h.Get("x-api-key") == "k" && h.Get("anthropic-version") != "" },
+			system:    func(b map[string]interface{}) bool { return b["system"] != "" && b["max_tokens"].(float64) > 0 },
+		},
+		{
+			name:      "ollama",
+			cfg:       config.AIConfig{Provider: ProviderOllama, Model: "m"},
+			path:      "/api/chat",
+			reply:     `{"model":"m","message":{"role":"assistant","content":"` + fenced + `"},"prompt_eval_count":3,"eval_count":5}`,
+			checkAuth: func(h http.Header) bool { return h.Get("Authorization") == "" },
+			system:    func(b map[string]interface{}) bool { return b["stream"] == false },
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			srv, body, header := stub(t, tc.path, http.StatusOK, tc.reply)
+			tc.cfg.BaseURL = srv.URL
+			gen, err := New(tc.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := gen.GenerateDiagram(context.Background(), "login flow", "flowchart")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != "flowchart TD\n  A --> B" {
+				t.Errorf("diagram = %q", got)
+			}
+			if !tc.checkAuth(*header) {
+				t.Errorf("auth headers = %v", *header)
+			}
+			if (*body)["model"] != "m" || !tc.system(*body) {
+				t.Errorf("request body = %v", *body)
+			}
+
+			resp, err := gen.Complete(context.Background(), Request{Messages: []Message{{Role: "user", Content: "hi"}}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.Model != "m" || resp.InputTokens != 3 || resp.OutputTokens != 5 {
+				t.Errorf("response = %+v, want model and usage", resp)
+			}
+		})
+	}
+}
+
+func TestProviders_StatusErrors(t *testing.T) {
+	for _, tc := range []struct {
+		status int
+		want   error
+	}{
+		{http.StatusTooManyRequests, ErrRateLimited},
+		{http.StatusPaymentRequired, ErrPaymentRequired},
+		{http.StatusInternalServerError, ErrUnavailable},
+	} {
+		srv, _, _ := stub(t, "/messages", tc.status, `{"error":"x"}`)
+		gen := NewAnthropicGenerator("k", srv.URL, "m", nil)
+		_, err := gen.GenerateDiagram(context.Background(), "d", "")
+		var se *StatusError
+		if !errors.Is(err, tc.want) || !errors.As(err, &se) || se.StatusCode != tc.status || se.Provider != ProviderAnthropic {
+			t.Errorf("status %d: err = %v, want %v", tc.status, err, tc.want)
+		}
+	}
+	if _, err := NewAnthropicGenerator("k", "http://127.0.0.1:1", "m", nil).Complete(context.Background(), Request{}); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("unreachable provider: err = %v, want ErrUnavailable", err)
+	}
+}
+
+func TestNew_Defaults(t *testing.T) {
+	gen, err := New(config.AIConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	o, ok := gen.(*OpenAIGenerator)
+	if !ok || o.baseURL != providerDefaults[ProviderOpenAI].baseURL || o.model != DefaultModel(ProviderOpenAI) {
+		t.Errorf("default generator = %#v, want OpenAI-compatible with defaults", gen)
+	}
+	resilient := config.AIConfig{Provider: ProviderOllama, BaseURL: "http://gpu:11434", MaxRetries: 2, BreakerThreshold: 5}
+	if gen, err := New(resilient); err != nil || CircuitState(resilient) != CircuitClosed {
+		t.Errorf("resilient generator = %#v, %v; circuit %q", gen, err, CircuitState(resilient))
+	} else if _, ok := gen.(*resilientGenerator); !ok {
+		t.Errorf("generator = %T, want retries and breaker", gen)
+	}
+	if _, err := New(config.AIConfig{Provider: "nope"}); err == nil {
+		t.Error("unknown provider accepted")
+	}
+	if _, err := NewOpenAIGenerator("", "http://x", "m", nil).Complete(context.Background(), Request{}); err == nil {
+		t.Error("missing API key accepted")
+	}
+}
+
+func TestProviders_Stream(t *testing.T) {
+	cases := []struct {
+		name string
+		cfg  config.AIConfig
+		path string
+		body string
+	}{
+		{"openai", config.AIConfig{Provider: ProviderOpenAI, APIKey: "k", Model: "m"}, "/chat/completions",
+			"data: {\"choices\":[{\"delta\":{\"content\":\"flow\"}}]}\n\n" +
+				"data: {\"choices\":[{\"delta\":{\"content\":\"chart\"}}]}\n\n" +
+				"data: {\"choices\":[],\"usage\":{\"prompt_tokens\":3,\"completion_tokens\":5}}\n\n" +
+				"data: [DONE]\n\n"},
+		{"anthropic", config.AIConfig{Provider: ProviderAnthropic, APIKey: "k", Model: "m"}, "/messages",
+			"event: message_start\ndata: {\"type\":\"message_start\",\"message\":{\"model\":\"m\",\"usage\":{\"input_tokens\":3}}}\n\n" +
+				"event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"delta\":{\"type\":\"text_delta\",\"text\":\"flow\"}}\n\n" +
+				"event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"delta\":{\"type\":\"text_delta\",\"text\":\"chart\"}}\n\n" +
+				"event: message_delta\ndata: {\"type\":\"message_delta\",\"usage\":{\"output_tokens\":5}}\n\n"},
+		{"ollama", config.AIConfig{Provider: ProviderOllama, Model: "m"}, "/api/chat",
+			"{\"message\":{\"content\":\"flow\"}}\n{\"message\":{\"content\":\"chart\"}}\n" +
+				"{\"done\":true,\"prompt_eval_count\":3,\"eval_count\":5}\n"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			srv, body, _ := stub(t, tc.path, http.StatusOK, tc.body)
+			tc.cfg.BaseURL = srv.URL
+			gen, err := New(tc.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var deltas []string
+			resp, err := gen.Stream(context.Background(), Request{Messages: []Message{{Role: "user", Content: "d"}}}, func(text string) error {
+				deltas = append(deltas, text)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(deltas, "|") != "flow|chart" || resp.Content != "flowchart" {
+				t.Errorf("deltas = %q, content = %q", deltas, resp.Content)
+			}
+			if resp.InputTokens != 3 || resp.OutputTokens != 5 {
+				t.Errorf("usage = %d/%d, want 3/5", resp.InputTokens, resp.OutputTokens)
+			}
+			if (*body)["stream"] != true {
+				t.Errorf("request body = %v, want stream on", *body)
+			}
+		})
+	}
+}
+
+func TestPrompts_Conversation(t *testing.T) {
+	turns := []Message{
+		{Role: "user", Content: "checkout"},
+		{Role: "assistant", Content: "flowchart TD\n  A --> B"},
+		{Role: "user", Content: "make it left-to-right"},
+	}
+	req, err := DefaultPrompts().Conversation(turns, "flowchart", prompt.Style{Direction: "LR"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(req.System, "Preferred direction: LR (e.g. flowchart LR)") || req.Temperature != 0.7 {
+		t.Errorf("system = %q, temperature %v", req.System, req.Temperature)
+	}
+	// The flowchart example exchange comes first, then the conversation.
+	if len(req.Messages) != 5 || req.Messages[1].Role != "assistant" || req.Messages[2].Content != "Create a flowchart diagram for: checkout" ||
+		!strings.HasPrefix(req.Messages[4].Content, "Update the diagram: make it left-to-right\n") {
+		t.Errorf("messages = %+v", req.Messages)
+	}
+
+	edit, err := DefaultPrompts().Edit("flowchart TD\n  A --> B", "flowchart", "add C", prompt.Style{})
+	if err != nil || len(edit.Messages) != 1 || edit.Temperature != 0.2 || strings.Contains(edit.System, "style guide") {
+		t.Errorf("edit = %+v, %v", edit, err)
+	}
+}
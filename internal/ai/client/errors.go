@@ -0,0 +1,75 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Errors a Generator returns, possibly wrapped; match them with errors.Is.
+var (
+	ErrRateLimited     = errors.New("ai: rate limit exceeded")
+	ErrPaymentRequired = errors.New("ai: payment required")
+	ErrUnavailable     = errors.New("ai: provider unavailable") // 5xx response or no response at all
+	ErrCircuitOpen     = errors.New("ai: provider circuit open")
+)
+
+// StatusError is a non-200 provider response. It unwraps to ErrRateLimited (429),
+// ErrPaymentRequired (402) or ErrUnavailable (5xx).
+type StatusError struct {
+	Provider   string
+	StatusCode int
+	Body       string
+	RetryAfter time.Duration // from the Retry-After header; 0 when absent
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("ai: %s returned %d: %s", e.Provider, e.StatusCode, e.Body)
+}
+
+func (e *StatusError) Unwrap() error {
+	switch {
+	case e.StatusCode == http.StatusTooManyRequests:
+		return ErrRateLimited
+	case e.StatusCode == http.StatusPaymentRequired:
+		return ErrPaymentRequired
+	case e.StatusCode >= 500:
+		return ErrUnavailable
+	}
+	return nil
+}
+
+// maxErrorBody bounds the response body kept in a StatusError.
+const maxErrorBody = 512
+
+// statusError maps a non-200 provider response to a StatusError.
+func statusError(provider string, resp *http.Response, body []byte) error {
+	text := strings.TrimSpace(string(body))
+	if len(text) > maxErrorBody {
+		text = text[:maxErrorBody] + "..."
+	}
+	return &StatusError{
+		Provider:   provider,
+		StatusCode: resp.StatusCode,
+		Body:       text,
+		RetryAfter: retryAfter(resp.Header.Get("Retry-After"), time.Now()),
+	}
+}
+
+// retryAfter parses a Retry-After header (seconds or an HTTP date) into a delay from now.
+func retryAfter(header string, now time.Time) time.Duration {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(header); err == nil {
+		return time.Duration(max(secs, 0)) * time.Second
+	}
+	if at, err := http.ParseTime(header); err == nil {
+		return max(at.Sub(now), 0)
+	}
+	return 0
+}
@@ -0,0 +1,119 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// OllamaGenerator calls a local Ollama server's chat endpoint. No API key is needed.
+type OllamaGenerator struct {
+	baseURL string
+	model   string
+	client  *http.Client
+}
+
+// NewOllamaGenerator returns a generator that POSTs to baseURL/api/chat. hc may be nil.
+func NewOllamaGenerator(baseURL, model string, hc *http.Client) *OllamaGenerator {
+	return &OllamaGenerator{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		model:   model,
+		client:  httpClientOrDefault(hc),
+	}
+}
+
+type ollamaRequest struct {
+	Model    string        `json:"model"`
+	Messages []chatMessage `json:"messages"`
+	Stream   bool          `json:"stream"`
+	Options  ollamaOptions `json:"options"`
+}
+
+type ollamaOptions struct {
+	Temperature float64 `json:"temperature"`
+	NumPredict  int     `json:"num_predict,omitempty"`
+}
+
+// ollamaResponse is the whole reply, or one line of a streamed reply (counts on the done line).
+type ollamaResponse struct {
+	Model   string `json:"model"`
+	Message struct {
+		Content string `json:"content"`
+	} `json:"message"`
+	Done            bool   `json:"done"`
+	PromptEvalCount int    `json:"prompt_eval_count"`
+	EvalCount       int    `json:"eval_count"`
+	Error           string `json:"error"`
+}
+
+// GenerateDiagram calls Ollama and returns raw Mermaid code (no markdown fences).
+func (g *OllamaGenerator) GenerateDiagram(ctx context.Context, description, diagramType string) (string, error) {
+	return generateDiagram(ctx, g, description, diagramType)
+}
+
+// Complete sends req to /api/chat without streaming; the system prompt goes first as a system message.
+func (g *OllamaGenerator) Complete(ctx context.Context, req Request) (*Response, error) {
+	var out ollamaResponse
+	if err := postJSON(ctx, g.client, ProviderOllama, g.baseURL+"/api/chat", nil, g.body(req, false), &out); err != nil {
+		return nil, err
+	}
+	return &Response{
+		Content:      out.Message.Content,
+		Model:        modelOr(out.Model, g.model),
+		InputTokens:  out.PromptEvalCount,
+		OutputTokens: out.EvalCount,
+	}, nil
+}
+
+// Stream sends req to /api/chat, which streams newline-delimited JSON, and passes each content
+// delta to onDelta.
+func (g *OllamaGenerator) Stream(ctx context.Context, req Request, onDelta func(text string) error) (*Response, error) {
+	stream, err := post(ctx, g.client, ProviderOllama, g.baseURL+"/api/chat", nil, g.body(req, true))
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	var content strings.Builder
+	out := &Response{Model: g.model}
+	err = eachLine(stream, func(line string) error {
+		var chunk ollamaResponse
+		if err := json.Unmarshal([]byte(line), &chunk); err != nil {
+			return fmt.Errorf("ai: decode stream: %w", err)
+		}
+		if chunk.Error != "" {
+			return fmt.Errorf("ai: ollama stream error: %s", chunk.Error)
+		}
+		out.Model = modelOr(chunk.Model, g.model)
+		if chunk.Done {
+			out.InputTokens, out.OutputTokens = chunk.PromptEvalCount, chunk.EvalCount
+		}
+		if chunk.Message.Content == "" {
+			return nil
+		}
+		content.WriteString(chunk.Message.Content)
+		return onDelta(chunk.Message.Content)
+	})
+	if err != nil {
+		return nil, err
+	}
+	out.Content = content.String()
+	return out, nil
+}
+
+func (g *OllamaGenerator) body(req Request, stream bool) ollamaRequest {
+	body := ollamaRequest{
+		Model:   g.model,
+		Stream:  stream,
+		Options: ollamaOptions{Temperature: req.Temperature, NumPredict: req.MaxTokens},
+	}
+	if req.System != "" {
+		body.Messages = append(body.Messages, chatMessage{Role: "system", Content: req.System})
+	}
+	for _, m := range req.Messages {
+		body.Messages = append(body.Messages, chatMessage{Role: m.Role, Content: m.Content})
+	}
+	return body
+}
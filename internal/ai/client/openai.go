@@ -0,0 +1,155 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// OpenAIGenerator calls an OpenAI-compatible chat completions endpoint.
+type OpenAIGenerator struct {
+	apiKey  string
+	baseURL string
+	model   string
+	client  *http.Client
+}
+
+// NewOpenAIGenerator returns a generator that POSTs to baseURL/chat/completions. hc may be nil.
+func NewOpenAIGenerator(apiKey, baseURL, model string, hc *http.Client) *OpenAIGenerator {
+	return &OpenAIGenerator{
+		apiKey:  apiKey,
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		model:   model,
+		client:  httpClientOrDefault(hc),
+	}
+}
+
+// chatRequest matches the OpenAI chat completions request shape.
+type chatRequest struct {
+	Model         string         `json:"model"`
+	Messages      []chatMessage  `json:"messages"`
+	Temperature   float64        `json:"temperature"`
+	MaxTokens     int            `json:"max_tokens,omitempty"`
+	Stream        bool           `json:"stream,omitempty"`
+	StreamOptions *streamOptions `json:"stream_options,omitempty"`
+}
+
+type streamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+type chatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// chatResponse matches the minimal response shape we need.
+type chatResponse struct {
+	Model   string `json:"model"`
+	Choices []struct {
+		Message struct {
+			Content string `json:"content"`
+		} `json:"message"`
+	} `json:"choices"`
+	Usage chatUsage `json:"usage"`
+}
+
+type chatUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+}
+
+// chatChunk is one streamed chat completion event; usage arrives on the last one.
+type chatChunk struct {
+	Model   string `json:"model"`
+	Choices []struct {
+		Delta struct {
+			Content string `json:"content"`
+		} `json:"delta"`
+	} `json:"choices"`
+	Usage *chatUsage `json:"usage"`
+}
+
+// GenerateDiagram calls the AI gateway and returns raw Mermaid code (no markdown fences).
+func (g *OpenAIGenerator) GenerateDiagram(ctx context.Context, description, diagramType string) (string, error) {
+	return generateDiagram(ctx, g, description, diagramType)
+}
+
+// Complete sends req as a chat completion; the system prompt goes first as a system message.
+func (g *OpenAIGenerator) Complete(ctx context.Context, req Request) (*Response, error) {
+	if g.apiKey == "" {
+		return nil, fmt.Errorf("ai: API key not configured")
+	}
+	var out chatResponse
+	if err := postJSON(ctx, g.client, ProviderOpenAI, g.baseURL+"/chat/completions", g.headers(), g.body(req), &out); err != nil {
+		return nil, err
+	}
+	if len(out.Choices) == 0 {
+		return nil, fmt.Errorf("ai: no choices in response")
+	}
+	return &Response{
+		Content:      out.Choices[0].Message.Content,
+		Model:        modelOr(out.Model, g.model),
+		InputTokens:  out.Usage.PromptTokens,
+		OutputTokens: out.Usage.CompletionTokens,
+	}, nil
+}
+
+// Stream sends req as a streamed chat completion and passes each content delta to onDelta.
+func (g *OpenAIGenerator) Stream(ctx context.Context, req Request, onDelta func(text string) error) (*Response, error) {
+	if g.apiKey == "" {
+		return nil, fmt.Errorf("ai: API key not configured")
+	}
+	body := g.body(req)
+	body.Stream = true
+	body.StreamOptions = &streamOptions{IncludeUsage: true}
+	stream, err := post(ctx, g.client, ProviderOpenAI, g.baseURL+"/chat/completions", g.headers(), body)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	var content strings.Builder
+	out := &Response{Model: g.model}
+	err = eachLine(stream, func(line string) error {
+		data, ok := sseData(line)
+		if !ok || data == "[DONE]" {
+			return nil
+		}
+		var chunk chatChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return fmt.Errorf("ai: decode stream: %w", err)
+		}
+		out.Model = modelOr(chunk.Model, g.model)
+		if chunk.Usage != nil {
+			out.InputTokens, out.OutputTokens = chunk.Usage.PromptTokens, chunk.Usage.CompletionTokens
+		}
+		if len(chunk.Choices) == 0 || chunk.Choices[0].Delta.Content == "" {
+			return nil
+		}
+		content.WriteString(chunk.Choices[0].Delta.Content)
+		return onDelta(chunk.Choices[0].Delta.Content)
+	})
+	if err != nil {
+		return nil, err
+	}
+	out.Content = content.String()
+	return out, nil
+}
+
+func (g *OpenAIGenerator) headers() map[string]string {
+	return map[string]string{"Authorization": "Bearer " + g.apiKey}
+}
+
+func (g *OpenAIGenerator) body(req Request) chatRequest {
+	body := chatRequest{Model: g.model, Temperature: req.Temperature, MaxTokens: req.MaxTokens}
+	if req.System != "" {
+		body.Messages = append(body.Messages, chatMessage{Role: "system", Content: req.System})
+	}
+	for _, m := range req.Messages {
+		body.Messages = append(body.Messages, chatMessage{Role: m.Role, Content: m.Content})
+	}
+	return body
+}
@@ -0,0 +1,114 @@
+package client
+
+import (
+	"fmt"
+
+	"github.com/devenock/d_weaver/internal/ai/prompt"
+)
+
+// Prompts builds the provider-neutral requests of the AI features from a prompt set.
+type Prompts struct {
+	set *prompt.Set
+}
+
+// NewPrompts returns request builders for set.
+func NewPrompts(set *prompt.Set) *Prompts {
+	return &Prompts{set: set}
+}
+
+var defaultPrompts = NewPrompts(prompt.Default())
+
+// DefaultPrompts returns request builders for the embedded prompts.
+func DefaultPrompts() *Prompts {
+	return defaultPrompts
+}
+
+// Version identifies the prompt set the requests are built from.
+func (p *Prompts) Version() string {
+	return p.set.Version()
+}
+
+// Diagram builds the chat request for a generate-diagram call. diagramType may be empty or "auto".
+func (p *Prompts) Diagram(description, diagramType string, style prompt.Style) (Request, error) {
+	return p.Conversation([]Message{{Role: "user", Content: description}}, diagramType, style)
+}
+
+// Conversation builds the chat request for the next turn of a diagram conversation. turns alternate
+// user and assistant messages and end with the new user message; the first user message is the
+// original description, later ones ask for changes to the diagram the assistant returned last.
+func (p *Prompts) Conversation(turns []Message, diagramType string, style prompt.Style) (Request, error) {
+	pr := p.set.Get(prompt.Generate, diagramType)
+	messages := make([]Message, 0, len(turns))
+	for i, t := range turns {
+		if t.Role == "user" {
+			content, err := conversationTurn(pr, i == 0, t.Content, diagramType)
+			if err != nil {
+				return Request{}, err
+			}
+			t.Content = content
+		}
+		messages = append(messages, t)
+	}
+	return request(pr, style, messages), nil
+}
+
+func conversationTurn(pr *prompt.Prompt, first bool, text, diagramType string) (string, error) {
+	var content string
+	var err error
+	if first {
+		content, err = pr.User(prompt.DiagramData{Description: text, DiagramType: diagramType})
+	} else {
+		content, err = pr.FollowUp(prompt.FollowUpData{Instruction: text, DiagramType: diagramType})
+	}
+	if err != nil {
+		return "", fmt.Errorf("ai: render prompt: %w", err)
+	}
+	if content == "" {
+		return text, nil
+	}
+	return content, nil
+}
+
+// Edit builds the chat request for changing current (a diagramType diagram) as instruction says.
+func (p *Prompts) Edit(current, diagramType, instruction string, style prompt.Style) (Request, error) {
+	return p.single(prompt.Edit, diagramType, style, prompt.EditData{Current: current, DiagramType: diagramType, Instruction: instruction})
+}
+
+// Explain builds the chat request for explaining a diagram. For whiteboards content is a text outline
+// of the canvas objects rather than Mermaid.
+func (p *Prompts) Explain(content, diagramType string) (Request, error) {
+	return p.single(prompt.Explain, diagramType, prompt.Style{}, prompt.ExplainData{Content: content, DiagramType: diagramType})
+}
+
+// SummarizeComments builds the chat request for summarizing a comment thread about a diagram.
+func (p *Prompts) SummarizeComments(diagramTitle, thread string) (Request, error) {
+	return p.single(prompt.SummarizeComments, "", prompt.Style{}, prompt.CommentsData{Title: diagramTitle, Thread: thread})
+}
+
+// single builds a one-message request from the name prompt.
+func (p *Prompts) single(name, diagramType string, style prompt.Style, data any) (Request, error) {
+	pr := p.set.Get(name, diagramType)
+	content, err := pr.User(data)
+	if err != nil {
+		return Request{}, fmt.Errorf("ai: render prompt: %w", err)
+	}
+	return request(pr, style, []Message{{Role: "user", Content: content}}), nil
+}
+
+// request puts the system prompt, the style guide, the few-shot examples and messages together.
+func request(pr *prompt.Prompt, style prompt.Style, messages []Message) Request {
+	system := pr.System
+	if guide := style.Context(); guide != "" {
+		system += "\n\n" + guide
+	}
+	all := make([]Message, 0, 2*len(pr.Examples)+len(messages))
+	for _, ex := range pr.Examples {
+		all = append(all, Message{Role: "user", Content: ex.User}, Message{Role: "assistant", Content: ex.Assistant})
+	}
+	return Request{
+		System:      system,
+		Messages:    append(all, messages...),
+		Temperature: pr.Temperature,
+		MaxTokens:   pr.MaxTokens,
+	}
+}
@@ -0,0 +1,277 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// Circuit breaker states.
+const (
+	CircuitClosed   = "closed"    // calls go through
+	CircuitOpen     = "open"      // calls fail fast with ErrCircuitOpen until the cooldown ends
+	CircuitHalfOpen = "half_open" // one probe call is let through; its outcome closes or reopens the circuit
+)
+
+const (
+	retryBaseDelay = 500 * time.Millisecond
+	retryMaxDelay  = 8 * time.Second
+	// maxRetryAfter is the longest Retry-After honoured; a provider asking for more is not retried.
+	maxRetryAfter = 30 * time.Second
+)
+
+// Breaker is a consecutive-failure circuit breaker for one provider endpoint. Only ErrUnavailable
+// (5xx or no response) counts as a failure: rate limits and client errors mean the provider is up.
+type Breaker struct {
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu         sync.Mutex
+	state      string
+	failures   int
+	openedAt   time.Time
+	probing    bool
+	generation uint64 // bumped on every state change; outcomes of calls admitted before it are dropped
+}
+
+// admission is a breaker's permission for one call: the generation it was given in and whether the
+// call is the half-open probe.
+type admission struct {
+	generation uint64
+	probe      bool
+}
+
+// NewBreaker returns a closed breaker that opens after threshold consecutive failures and lets a
+// probe through after cooldown.
+func NewBreaker(threshold int, cooldown time.Duration) *Breaker {
+	return &Breaker{threshold: threshold, cooldown: cooldown, now: time.Now, state: CircuitClosed}
+}
+
+// State returns the breaker's current state.
+func (b *Breaker) State() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == CircuitOpen && b.now().Sub(b.openedAt) >= b.cooldown {
+		return CircuitHalfOpen
+	}
+	return b.state
+}
+
+// allow reports whether a call may go ahead; in half-open state only one probe at a time does.
+func (b *Breaker) allow() (admission, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case CircuitOpen:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			return admission{}, false
+		}
+		b.state = CircuitHalfOpen
+		fallthrough
+	case CircuitHalfOpen:
+		if b.probing {
+			return admission{}, false
+		}
+		b.probing = true
+		return admission{generation: b.generation, probe: true}, true
+	}
+	return admission{generation: b.generation}, true
+}
+
+// record updates the breaker with the outcome of a call it admitted. Only the half-open probe moves
+// the breaker out of open or half-open; a call admitted before the last state change (e.g. a slow
+// success that started before the circuit opened) is ignored. A cancelled call says nothing about the
+// provider and only frees the probe slot.
+func (b *Breaker) record(a admission, err error, cancelled bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if a.generation != b.generation {
+		return
+	}
+	if a.probe {
+		b.probing = false
+	}
+	if cancelled {
+		return
+	}
+	if !errors.Is(err, ErrUnavailable) {
+		if b.state != CircuitClosed {
+			b.state = CircuitClosed
+			b.generation++
+		}
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.state == CircuitHalfOpen || b.failures >= b.threshold {
+		b.state, b.openedAt = CircuitOpen, b.now()
+		b.generation++
+	}
+}
+
+// breakerIdleAfter is how long a breaker may go without calls before it is dropped, e.g. because the
+// workspace settings pointing at its endpoint were changed or deleted. A breaker that is still open is
+// kept until its cooldown ends.
+const breakerIdleAfter = time.Hour
+
+// breakers holds one breaker per provider endpoint so that generators built per call (workspace
+// settings) share the state of the endpoint they talk to. Idle breakers are swept out at most once
+// per breakerIdleAfter.
+var breakers = struct {
+	sync.Mutex
+	byKey map[string]*sharedBreaker
+	swept time.Time
+}{byKey: map[string]*sharedBreaker{}}
+
+type sharedBreaker struct {
+	*Breaker
+	lastUsed time.Time
+}
+
+// breakerFor returns the shared breaker for provider at baseURL, creating it on first use. Generators
+// look it up on every call rather than holding on to it, so a swept endpoint starts over with one
+// breaker for all of them.
+func breakerFor(provider, baseURL string, threshold int, cooldown time.Duration) *Breaker {
+	key := breakerKey(provider, baseURL)
+	now := time.Now()
+	breakers.Lock()
+	defer breakers.Unlock()
+	if now.Sub(breakers.swept) >= breakerIdleAfter {
+		for k, b := range breakers.byKey {
+			if now.Sub(b.lastUsed) >= breakerIdleAfter && b.State() != CircuitOpen {
+				delete(breakers.byKey, k)
+			}
+		}
+		breakers.swept = now
+	}
+	b, ok := breakers.byKey[key]
+	if !ok {
+		b = &sharedBreaker{Breaker: NewBreaker(threshold, cooldown)}
+		breakers.byKey[key] = b
+	}
+	b.lastUsed = now
+	return b.Breaker
+}
+
+// breakerState returns the state of the shared breaker for provider at baseURL without creating it;
+// an endpoint without one has not failed lately, so its circuit is closed.
+func breakerState(provider, baseURL string) string {
+	breakers.Lock()
+	b, ok := breakers.byKey[breakerKey(provider, baseURL)]
+	breakers.Unlock()
+	if !ok {
+		return CircuitClosed
+	}
+	return b.State()
+}
+
+func breakerKey(provider, baseURL string) string {
+	return provider + " " + baseURL
+}
+
+// CircuitCounts returns how many provider endpoints, the server default's and workspaces', have a
+// circuit in each state.
+func CircuitCounts() map[string]int {
+	counts := map[string]int{CircuitClosed: 0, CircuitOpen: 0, CircuitHalfOpen: 0}
+	breakers.Lock()
+	defer breakers.Unlock()
+	for _, b := range breakers.byKey {
+		counts[b.State()]++
+	}
+	return counts
+}
+
+// resilientGenerator retries a Generator's rate-limited and 5xx calls with exponential backoff and
+// guards them with a circuit breaker. Streams are only retried before any output was delivered.
+type resilientGenerator struct {
+	Generator
+	maxRetries int
+	breaker    func() *Breaker // the endpoint's breaker for a call; nil disables the breaker
+	baseDelay  time.Duration
+	wait       func(ctx context.Context, d time.Duration) error
+}
+
+func newResilientGenerator(gen Generator, maxRetries int, breaker func() *Breaker) *resilientGenerator {
+	return &resilientGenerator{Generator: gen, maxRetries: maxRetries, breaker: breaker, baseDelay: retryBaseDelay, wait: sleep}
+}
+
+// GenerateDiagram goes through Complete so that it is retried too.
+func (g *resilientGenerator) GenerateDiagram(ctx context.Context, description, diagramType string) (string, error) {
+	return generateDiagram(ctx, g, description, diagramType)
+}
+
+func (g *resilientGenerator) Complete(ctx context.Context, req Request) (*Response, error) {
+	return g.do(ctx, func() (*Response, error) { return g.Generator.Complete(ctx, req) }, nil)
+}
+
+func (g *resilientGenerator) Stream(ctx context.Context, req Request, onDelta func(text string) error) (*Response, error) {
+	delivered := false
+	return g.do(ctx, func() (*Response, error) {
+		return g.Generator.Stream(ctx, req, func(text string) error {
+			delivered = true
+			return onDelta(text)
+		})
+	}, &delivered)
+}
+
+// do runs call until it succeeds, fails for good or the retries run out. delivered, when set, is
+// true once a stream has passed output on, after which the call is not repeated.
+func (g *resilientGenerator) do(ctx context.Context, call func() (*Response, error), delivered *bool) (*Response, error) {
+	var breaker *Breaker
+	if g.breaker != nil {
+		breaker = g.breaker()
+	}
+	for retry := 0; ; retry++ {
+		var admitted admission
+		if breaker != nil {
+			var ok bool
+			if admitted, ok = breaker.allow(); !ok {
+				return nil, ErrCircuitOpen
+			}
+		}
+		resp, err := call()
+		if breaker != nil {
+			breaker.record(admitted, err, ctx.Err() != nil)
+		}
+		if err == nil || retry >= g.maxRetries || (delivered != nil && *delivered) || ctx.Err() != nil {
+			return resp, err
+		}
+		delay, ok := g.retryDelay(err, retry)
+		if !ok {
+			return nil, err
+		}
+		if werr := g.wait(ctx, delay); werr != nil {
+			return nil, err
+		}
+	}
+}
+
+// retryDelay returns how long to wait before retry number retry+1 of a call that failed with err,
+// and false when err is not worth retrying.
+func (g *resilientGenerator) retryDelay(err error, retry int) (time.Duration, bool) {
+	var se *StatusError
+	if !errors.As(err, &se) || !(errors.Is(err, ErrRateLimited) || errors.Is(err, ErrUnavailable)) {
+		return 0, false
+	}
+	if se.RetryAfter > 0 {
+		return se.RetryAfter, se.RetryAfter <= maxRetryAfter
+	}
+	d := min(g.baseDelay<<retry, retryMaxDelay)
+	// Jitter spreads out clients that failed together.
+	return d/2 + rand.N(d/2+1), true
+}
+
+// sleep waits for d or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,208 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// flakyGenerator fails with errs in turn, then succeeds; Stream delivers one delta before failing
+// when deltaFirst is set.
+type flakyGenerator struct {
+	errs       []error
+	deltaFirst bool
+	calls      int
+}
+
+func (g *flakyGenerator) GenerateDiagram(ctx context.Context, description, diagramType string) (string, error) {
+	return generateDiagram(ctx, g, description, diagramType)
+}
+
+func (g *flakyGenerator) Complete(ctx context.Context, req Request) (*Response, error) {
+	g.calls++
+	if g.calls <= len(g.errs) {
+		return nil, g.errs[g.calls-1]
+	}
+	return &Response{Content: "flowchart TD\n  A --> B"}, nil
+}
+
+func (g *flakyGenerator) Stream(ctx context.Context, req Request, onDelta func(string) error) (*Response, error) {
+	if g.deltaFirst {
+		if err := onDelta("flowchart"); err != nil {
+			return nil, err
+		}
+	}
+	return g.Complete(ctx, req)
+}
+
+// testResilient wraps gen and records the waits instead of sleeping.
+func testResilient(gen Generator, maxRetries int, breaker *Breaker) (*resilientGenerator, *[]time.Duration) {
+	waits := &[]time.Duration{}
+	g := newResilientGenerator(gen, maxRetries, nil)
+	if breaker != nil {
+		g.breaker = func() *Breaker { return breaker }
+	}
+	g.wait = func(ctx context.Context, d time.Duration) error {
+		*waits = append(*waits, d)
+		return nil
+	}
+	return g, waits
+}
+
+func TestResilientGenerator_Retries(t *testing.T) {
+	overloaded := &StatusError{Provider: "p", StatusCode: http.StatusServiceUnavailable}
+	limited := &StatusError{Provider: "p", StatusCode: http.StatusTooManyRequests, RetryAfter: 3 * time.Second}
+
+	inner := &flakyGenerator{errs: []error{overloaded, limited}}
+	g, waits := testResilient(inner, 2, nil)
+	if _, err := g.Complete(context.Background(), Request{}); err != nil {
+		t.Fatalf("err = %v, want success on the third call", err)
+	}
+	if inner.calls != 3 || len(*waits) != 2 || (*waits)[0] > retryBaseDelay || (*waits)[1] != 3*time.Second {
+		t.Errorf("calls = %d, waits = %v; want 3 calls, backoff then Retry-After", inner.calls, *waits)
+	}
+
+	inner = &flakyGenerator{errs: []error{overloaded, overloaded, overloaded}}
+	g, _ = testResilient(inner, 2, nil)
+	if _, err := g.Complete(context.Background(), Request{}); !errors.Is(err, ErrUnavailable) || inner.calls != 3 {
+		t.Errorf("err = %v after %d calls, want ErrUnavailable after 3", err, inner.calls)
+	}
+
+	for name, err := range map[string]error{
+		"client error":     &StatusError{Provider: "p", StatusCode: http.StatusBadRequest},
+		"long Retry-After": &StatusError{Provider: "p", StatusCode: http.StatusTooManyRequests, RetryAfter: time.Hour},
+	} {
+		inner = &flakyGenerator{errs: []error{err}}
+		g, _ = testResilient(inner, 2, nil)
+		if _, got := g.Complete(context.Background(), Request{}); got != err || inner.calls != 1 {
+			t.Errorf("%s: err = %v after %d calls, want no retry", name, got, inner.calls)
+		}
+	}
+
+	inner = &flakyGenerator{errs: []error{overloaded}, deltaFirst: true}
+	g, _ = testResilient(inner, 2, nil)
+	if _, err := g.Stream(context.Background(), Request{}, func(string) error { return nil }); err != overloaded || inner.calls != 1 {
+		t.Errorf("stream err = %v after %d calls, want no retry once output was delivered", err, inner.calls)
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	now := time.Now()
+	b := NewBreaker(2, time.Minute)
+	b.now = func() time.Time { return now }
+	down := &StatusError{Provider: "p", StatusCode: http.StatusBadGateway}
+
+	inner := &flakyGenerator{errs: []error{down, down, down}}
+	g, _ := testResilient(inner, 0, b)
+	for i := 0; i < 2; i++ {
+		_, _ = g.Complete(context.Background(), Request{})
+	}
+	if b.State() != CircuitOpen {
+		t.Fatalf("state = %s after 2 failures, want open", b.State())
+	}
+	if _, err := g.Complete(context.Background(), Request{}); !errors.Is(err, ErrCircuitOpen) || inner.calls != 2 {
+		t.Errorf("err = %v after %d calls, want fail fast without calling the provider", err, inner.calls)
+	}
+
+	now = now.Add(time.Minute)
+	if b.State() != CircuitHalfOpen {
+		t.Fatalf("state = %s after cooldown, want half_open", b.State())
+	}
+	if _, err := g.Complete(context.Background(), Request{}); !errors.Is(err, ErrUnavailable) || b.State() != CircuitOpen {
+		t.Errorf("failed probe: err = %v, state = %s; want reopened", err, b.State())
+	}
+
+	now = now.Add(time.Minute)
+	if _, err := g.Complete(context.Background(), Request{}); err != nil || b.State() != CircuitClosed {
+		t.Errorf("successful probe: err = %v, state = %s; want closed", err, b.State())
+	}
+
+	// Rate limits mean the provider is up.
+	inner.errs, inner.calls = []error{&StatusError{StatusCode: http.StatusTooManyRequests}, &StatusError{StatusCode: http.StatusTooManyRequests}}, 0
+	for i := 0; i < 2; i++ {
+		_, _ = g.Complete(context.Background(), Request{})
+	}
+	if b.State() != CircuitClosed {
+		t.Errorf("state = %s after rate limits, want closed", b.State())
+	}
+}
+
+func TestBreaker_OnlyTheProbeLeavesOpen(t *testing.T) {
+	now := time.Now()
+	b := NewBreaker(1, time.Minute)
+	b.now = func() time.Time { return now }
+	down := &StatusError{Provider: "p", StatusCode: http.StatusBadGateway}
+
+	slow, ok := b.allow()
+	if !ok {
+		t.Fatal("closed breaker refused a call")
+	}
+	slower, _ := b.allow()
+	tripping, _ := b.allow()
+	b.record(tripping, down, false)
+	b.record(slow, nil, false) // in flight when the circuit opened
+	if b.State() != CircuitOpen {
+		t.Fatalf("state = %s after a success admitted before the trip, want still open", b.State())
+	}
+
+	now = now.Add(time.Minute)
+	probe, ok := b.allow()
+	if !ok || !probe.probe {
+		t.Fatalf("admission = %+v, %v after cooldown, want the probe", probe, ok)
+	}
+	b.record(slower, nil, false)
+	if _, ok := b.allow(); ok {
+		t.Error("a stale result freed the probe slot: second probe admitted")
+	}
+	if b.State() != CircuitHalfOpen {
+		t.Errorf("state = %s before the probe finished, want half_open", b.State())
+	}
+	b.record(probe, nil, false)
+	if b.State() != CircuitClosed {
+		t.Errorf("state = %s after a successful probe, want closed", b.State())
+	}
+}
+
+func TestBreakerFor_SweepsIdleEndpoints(t *testing.T) {
+	down := &StatusError{Provider: "p", StatusCode: http.StatusBadGateway}
+	idle := breakerFor("sweep", "http://idle", 1, time.Minute)
+	failing := breakerFor("sweep", "http://failing", 1, 2*breakerIdleAfter)
+	a, _ := failing.allow()
+	failing.record(a, down, false)
+	if got := CircuitCounts()[CircuitOpen]; got < 1 {
+		t.Errorf("open circuits = %d, want the failing endpoint counted", got)
+	}
+
+	breakers.Lock()
+	breakers.swept = time.Time{}
+	for _, key := range []string{breakerKey("sweep", "http://idle"), breakerKey("sweep", "http://failing")} {
+		breakers.byKey[key].lastUsed = time.Now().Add(-breakerIdleAfter)
+	}
+	breakers.Unlock()
+	breakerFor("sweep", "http://other", 1, time.Minute)
+
+	if again := breakerFor("sweep", "http://idle", 1, time.Minute); again == idle {
+		t.Error("an idle endpoint's breaker was kept")
+	}
+	if again := breakerFor("sweep", "http://failing", 1, time.Minute); again != failing || breakerState("sweep", "http://failing") != CircuitOpen {
+		t.Error("an open circuit was dropped before its cooldown ended")
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	for header, want := range map[string]time.Duration{
+		"":                              0,
+		"7":                             7 * time.Second,
+		"-1":                            0,
+		"soon":                          0,
+		"Fri, 02 Jan 2026 03:04:35 GMT": 30 * time.Second,
+		"Fri, 02 Jan 2026 03:00:00 GMT": 0,
+	} {
+		if got := retryAfter(header, now); got != want {
+			t.Errorf("retryAfter(%q) = %v, want %v", header, got, want)
+		}
+	}
+}
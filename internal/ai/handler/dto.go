@@ -2,6 +2,49 @@ package handler
 
 // GenerateDiagramRequest is the body for POST /api/v1/ai/generate-diagram.
 type GenerateDiagramRequest struct {
+	Description    string `json:"description" binding:"required,max=4096"`
+	DiagramType    string `json:"diagram_type" binding:"max=50"` // optional: flowchart, sequence, class, er, etc.
+	WorkspaceID    string `json:"workspace_id"`                  // optional: use this workspace's AI settings (members only)
+	ConversationID string `json:"conversation_id"`               // optional: follow up on this conversation; description is then the change to make
+}
+
+// CreateJobRequest is the body for POST /api/v1/ai/jobs.
+type CreateJobRequest struct {
+	WorkspaceID string           `json:"workspace_id" binding:"required"` // diagrams are created here, with its AI settings and quota (members only)
+	DiagramType string           `json:"diagram_type" binding:"max=50"`   // optional: applies to every item
+	Items       []JobItemRequest `json:"items" binding:"required,min=1,dive"`
+}
+
+// JobItemRequest is one description of a batch job.
+type JobItemRequest struct {
 	Description string `json:"description" binding:"required,max=4096"`
-	DiagramType string `json:"diagram_type" binding:"max=50"` // optional: flowchart, sequence, class, er, etc.
+	Title       string `json:"title" binding:"max=255"` // optional: defaults to the description's first line
+}
+
+// UpdateAISettingsRequest is the body for PUT /api/v1/workspaces/:id/ai/settings.
+type UpdateAISettingsRequest struct {
+	Provider string  `json:"provider" binding:"required,oneof=openai anthropic ollama"`
+	Model    string  `json:"model" binding:"max=255"`
+	BaseURL  string  `json:"base_url" binding:"max=2048"`
+	APIKey   *string `json:"api_key" binding:"omitempty,max=1024"` // omit to keep the stored key, "" to clear it
+}
+
+// UpdateStyleGuideRequest is the body for PUT /api/v1/workspaces/:id/ai/style-guide. Empty fields
+// mean no preference.
+type UpdateStyleGuideRequest struct {
+	Direction    string `json:"direction" binding:"max=2"` // TB, TD, BT, LR or RL
+	Naming       string `json:"naming" binding:"max=2000"`
+	Instructions string `json:"instructions" binding:"max=4000"`
+}
+
+// EditDiagramRequest is the body for POST /api/v1/ai/diagrams/:id/edit.
+type EditDiagramRequest struct {
+	Instruction string `json:"instruction" binding:"required,max=2000"`
+	Apply       bool   `json:"apply"` // save a valid proposal as the diagram content (also ?apply=true)
+}
+
+// UpdateConversationRequest is the body for PATCH /api/v1/ai/conversations/:id.
+type UpdateConversationRequest struct {
+	Title     *string `json:"title" binding:"omitempty,max=255"`
+	DiagramID *string `json:"diagram_id"` // link to this diagram; "" removes the link
 }
@@ -3,12 +3,16 @@ package handler
 import (
 	"errors"
 	"net/http"
+	"time"
 
+	"github.com/devenock/d_weaver/internal/ai/mermaid"
 	"github.com/devenock/d_weaver/internal/ai/service"
 	"github.com/devenock/d_weaver/internal/auth/jwt"
 	"github.com/devenock/d_weaver/internal/auth/middleware"
 	"github.com/devenock/d_weaver/internal/common"
+	diagrammodel "github.com/devenock/d_weaver/internal/diagram/model"
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 )
 
 // Handler handles HTTP for AI generate-diagram.
@@ -21,19 +25,209 @@ func New(svc *service.Service) *Handler {
 	return &Handler{svc: svc}
 }
 
-// Register mounts AI routes on g. Path: POST /ai/generate-diagram (RequireAuth).
+// Register mounts AI routes on g (RequireAuth).
+// Paths: POST /ai/generate-diagram, POST /ai/generate-diagram/stream (SSE), POST /ai/diagrams/:id/edit,
+// POST /ai/diagrams/:id/explain, POST /ai/diagrams/:id/summarize-comments, GET /ai/conversations,
+// GET/PATCH/DELETE /ai/conversations/:id, POST /ai/jobs, GET /ai/jobs/:id, GET/PUT/DELETE /workspaces/:id/ai/settings, GET/PUT/DELETE /workspaces/:id/ai/style-guide,
+// GET /workspaces/:id/ai/usage.
 func (h *Handler) Register(g *gin.RouterGroup, issuer *jwt.Issuer) {
 	ai := g.Group("/ai")
 	ai.Use(middleware.RequireAuth(issuer))
 	ai.POST("/generate-diagram", h.generateDiagram)
+	ai.POST("/generate-diagram/stream", h.generateDiagramStream)
+	ai.POST("/diagrams/:id/edit", h.editDiagram)
+	ai.POST("/diagrams/:id/explain", h.explainDiagram)
+	ai.POST("/diagrams/:id/summarize-comments", h.summarizeComments)
+	ai.GET("/conversations", h.listConversations)
+	ai.GET("/conversations/:id", h.getConversation)
+	ai.PATCH("/conversations/:id", h.updateConversation)
+	ai.DELETE("/conversations/:id", h.deleteConversation)
+	ai.POST("/jobs", h.createJob)
+	ai.GET("/jobs/:id", h.getJob)
+
+	workspaces := g.Group("/workspaces")
+	workspaces.Use(middleware.RequireAuth(issuer))
+	workspaces.GET("/:id/ai/settings", h.getSettings)
+	workspaces.PUT("/:id/ai/settings", h.updateSettings)
+	workspaces.DELETE("/:id/ai/settings", h.deleteSettings)
+	workspaces.GET("/:id/ai/style-guide", h.getStyleGuide)
+	workspaces.PUT("/:id/ai/style-guide", h.updateStyleGuide)
+	workspaces.DELETE("/:id/ai/style-guide", h.deleteStyleGuide)
+	workspaces.GET("/:id/ai/usage", h.getUsage)
 }
 
-// GenerateDiagramResponse is the success payload (data envelope).
+// GenerateDiagramResponse is the success payload (data envelope), and the data of the stream's
+// final "done" event.
 type GenerateDiagramResponse struct {
-	Diagram string `json:"diagram"`
+	Diagram        string         `json:"diagram"`
+	Validation     mermaid.Result `json:"validation"`
+	Attempts       int            `json:"attempts"`        // generations it took; more than one means the model was asked to repair its output
+	ConversationID uuid.UUID      `json:"conversation_id"` // send back as conversation_id to follow up
+	Cached         bool           `json:"cached"`          // taken from the response cache; call with ?cache=bypass for a fresh one
+}
+
+// RetryEvent is the data of a streamed "retry" event: the previous diagram failed validation and
+// the deltas that follow belong to a new attempt.
+type RetryEvent struct {
+	Attempt    int            `json:"attempt"`
+	Validation mermaid.Result `json:"validation"`
+}
+
+// DeltaEvent is the data of a streamed "delta" event: the next piece of model output.
+type DeltaEvent struct {
+	Text string `json:"text"`
+}
+
+// EditDiagramResponse is the success payload for an edit: the proposed content, a unified diff from
+// the current content, and, when applied, the saved diagram.
+type EditDiagramResponse struct {
+	DiagramID  uuid.UUID                     `json:"diagram_id"`
+	Proposed   string                        `json:"proposed"`
+	Diff       string                        `json:"diff"`
+	Validation mermaid.Result                `json:"validation"`
+	Attempts   int                           `json:"attempts"`
+	Applied    bool                          `json:"applied"`
+	Diagram    *diagrammodel.DiagramResponse `json:"diagram,omitempty"`
 }
 
 func (h *Handler) generateDiagram(c *gin.Context) {
+	in, ok := bindGenerateRequest(c)
+	if !ok {
+		return
+	}
+	userID := middleware.GetUserID(c)
+	result, err := h.svc.GenerateDiagram(c.Request.Context(), userID, in)
+	if err != nil {
+		writeGenerateError(c, err)
+		return
+	}
+	common.WriteOK(c, generateResponse(result))
+}
+
+// generateDiagramStream streams the model output as server-sent events: "delta" events with text as
+// it arrives, a "retry" event before each repair attempt, then one "done" event with the cleaned
+// diagram and its validation, or an "error" event.
+// Errors before the first delta are plain JSON error responses. When the client disconnects the
+// request context is cancelled, which aborts the provider request.
+func (h *Handler) generateDiagramStream(c *gin.Context) {
+	in, ok := bindGenerateRequest(c)
+	if !ok {
+		return
+	}
+	userID := middleware.GetUserID(c)
+	ctx := c.Request.Context()
+	started := false
+	start := func() {
+		if started {
+			return
+		}
+		started = true
+		c.Header("Content-Type", "text/event-stream")
+		c.Header("Cache-Control", "no-cache")
+		c.Header("X-Accel-Buffering", "no")
+		// Generation can outlast the server's write timeout.
+		_ = http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{})
+		c.Status(http.StatusOK)
+	}
+	result, err := h.svc.StreamDiagram(ctx, userID, in, func(text string) error {
+		start()
+		c.SSEvent("delta", DeltaEvent{Text: text})
+		c.Writer.Flush()
+		return ctx.Err()
+	}, func(attempt int, failed mermaid.Result) error {
+		start()
+		c.SSEvent("retry", RetryEvent{Attempt: attempt, Validation: failed})
+		c.Writer.Flush()
+		return ctx.Err()
+	})
+	if ctx.Err() != nil {
+		return // client went away
+	}
+	if err != nil {
+		if !started {
+			writeGenerateError(c, err)
+			return
+		}
+		c.SSEvent("error", streamErrorBody(err))
+		c.Writer.Flush()
+		return
+	}
+	start()
+	c.SSEvent("done", generateResponse(result))
+	c.Writer.Flush()
+}
+
+func (h *Handler) editDiagram(c *gin.Context) {
+	diagramID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		common.WriteError(c, http.StatusBadRequest, common.ErrorBody{Code: common.CodeInvalidInput, Message: "Invalid diagram ID."})
+		return
+	}
+	var req EditDiagramRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		common.WriteError(c, http.StatusBadRequest, common.ErrorBody{
+			Code:    common.CodeInvalidInput,
+			Message: "Invalid or missing input. Instruction is required.",
+			Details: map[string]interface{}{"error": err.Error()},
+		})
+		return
+	}
+	apply := req.Apply || c.Query("apply") == "true"
+	userID := middleware.GetUserID(c)
+	result, err := h.svc.EditDiagram(c.Request.Context(), diagramID, userID, req.Instruction, apply)
+	if err != nil {
+		writeGenerateError(c, err)
+		return
+	}
+	common.WriteOK(c, EditDiagramResponse{
+		DiagramID:  diagramID,
+		Proposed:   result.Proposed,
+		Diff:       result.Diff,
+		Validation: result.Validation,
+		Attempts:   result.Attempts,
+		Applied:    result.Applied,
+		Diagram:    result.Diagram,
+	})
+}
+
+func (h *Handler) explainDiagram(c *gin.Context) {
+	diagramID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		common.WriteError(c, http.StatusBadRequest, common.ErrorBody{Code: common.CodeInvalidInput, Message: "Invalid diagram ID."})
+		return
+	}
+	userID := middleware.GetUserID(c)
+	resp, err := h.svc.ExplainDiagram(c.Request.Context(), diagramID, userID)
+	if err != nil {
+		writeGenerateError(c, err)
+		return
+	}
+	common.WriteOK(c, resp)
+}
+
+func (h *Handler) summarizeComments(c *gin.Context) {
+	diagramID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		common.WriteError(c, http.StatusBadRequest, common.ErrorBody{Code: common.CodeInvalidInput, Message: "Invalid diagram ID."})
+		return
+	}
+	userID := middleware.GetUserID(c)
+	resp, err := h.svc.SummarizeComments(c.Request.Context(), diagramID, userID)
+	if err != nil {
+		writeGenerateError(c, err)
+		return
+	}
+	common.WriteOK(c, resp)
+}
+
+// bindGenerateRequest binds the generate-diagram body and parses its optional workspace and
+// conversation ids and the ?cache=bypass option, writing a 400 and returning false when any is invalid.
+func bindGenerateRequest(c *gin.Context) (service.GenerateInput, bool) {
+	cacheMode := c.Query("cache")
+	if cacheMode != "" && cacheMode != "bypass" {
+		common.WriteError(c, http.StatusBadRequest, common.ErrorBody{Code: common.CodeInvalidInput, Message: "cache must be bypass when set."})
+		return service.GenerateInput{}, false
+	}
 	var req GenerateDiagramRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		common.WriteError(c, http.StatusBadRequest, common.ErrorBody{
@@ -41,24 +235,313 @@ func (h *Handler) generateDiagram(c *gin.Context) {
 			Message: "Invalid or missing input. Description is required.",
 			Details: map[string]interface{}{"error": err.Error()},
 		})
+		return service.GenerateInput{}, false
+	}
+	in := service.GenerateInput{Description: req.Description, DiagramType: req.DiagramType, BypassCache: cacheMode == "bypass"}
+	if req.WorkspaceID != "" {
+		id, err := uuid.Parse(req.WorkspaceID)
+		if err != nil {
+			common.WriteError(c, http.StatusBadRequest, common.ErrorBody{Code: common.CodeInvalidInput, Message: "Invalid workspace ID."})
+			return service.GenerateInput{}, false
+		}
+		in.WorkspaceID = &id
+	}
+	if req.ConversationID != "" {
+		id, err := uuid.Parse(req.ConversationID)
+		if err != nil {
+			common.WriteError(c, http.StatusBadRequest, common.ErrorBody{Code: common.CodeInvalidInput, Message: "Invalid conversation ID."})
+			return service.GenerateInput{}, false
+		}
+		in.ConversationID = &id
+	}
+	return in, true
+}
+
+func generateResponse(result *service.DiagramResult) GenerateDiagramResponse {
+	return GenerateDiagramResponse{
+		Diagram:        result.Diagram,
+		Validation:     result.Validation,
+		Attempts:       result.Attempts,
+		ConversationID: result.ConversationID,
+		Cached:         result.Cached,
+	}
+}
+
+// writeGenerateError writes a generation error, mapping provider rate limits and exhausted quotas to 429,
+// billing to 402 and an unavailable provider to 503.
+func writeGenerateError(c *gin.Context, err error) {
+	var de *common.DomainError
+	if errors.As(err, &de) {
+		switch de.Code {
+		case "rate_limit_exceeded", service.CodeQuotaExceeded:
+			common.WriteError(c, http.StatusTooManyRequests, common.ErrorBody{Code: de.Code, Message: de.Message})
+			return
+		case "payment_required":
+			common.WriteError(c, http.StatusPaymentRequired, common.ErrorBody{Code: de.Code, Message: de.Message})
+			return
+		case service.CodeUnavailable:
+			common.WriteError(c, http.StatusServiceUnavailable, common.ErrorBody{Code: de.Code, Message: de.Message})
+			return
+		}
+	}
+	common.WriteErrorFromDomain(c, err)
+}
+
+// streamErrorBody is the data of a streamed "error" event.
+func streamErrorBody(err error) common.ErrorBody {
+	var de *common.DomainError
+	if errors.As(err, &de) {
+		return common.ErrorBody{Code: de.Code, Message: de.Message}
+	}
+	return common.ErrorBody{Code: common.CodeInternalError, Message: "An unexpected error occurred."}
+}
+
+func (h *Handler) getSettings(c *gin.Context) {
+	workspaceID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		common.WriteError(c, http.StatusBadRequest, common.ErrorBody{Code: common.CodeInvalidInput, Message: "Invalid workspace ID."})
 		return
 	}
-	diagramType := req.DiagramType
-	diagram, err := h.svc.GenerateDiagram(c.Request.Context(), req.Description, diagramType)
+	userID := middleware.GetUserID(c)
+	resp, err := h.svc.GetWorkspaceSettings(c.Request.Context(), workspaceID, userID)
 	if err != nil {
-		var de *common.DomainError
-		if errors.As(err, &de) {
-			switch de.Code {
-			case "rate_limit_exceeded":
-				common.WriteError(c, http.StatusTooManyRequests, common.ErrorBody{Code: de.Code, Message: de.Message})
-				return
-			case "payment_required":
-				common.WriteError(c, http.StatusPaymentRequired, common.ErrorBody{Code: de.Code, Message: de.Message})
+		common.WriteErrorFromDomain(c, err)
+		return
+	}
+	common.WriteOK(c, resp)
+}
+
+func (h *Handler) updateSettings(c *gin.Context) {
+	workspaceID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		common.WriteError(c, http.StatusBadRequest, common.ErrorBody{Code: common.CodeInvalidInput, Message: "Invalid workspace ID."})
+		return
+	}
+	userID := middleware.GetUserID(c)
+	var req UpdateAISettingsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		common.WriteError(c, http.StatusBadRequest, common.ErrorBody{Code: common.CodeInvalidInput, Message: "Invalid or missing input.", Details: map[string]interface{}{"error": err.Error()}})
+		return
+	}
+	resp, err := h.svc.UpdateWorkspaceSettings(c.Request.Context(), workspaceID, userID, service.SettingsInput{
+		Provider: req.Provider,
+		Model:    req.Model,
+		BaseURL:  req.BaseURL,
+		APIKey:   req.APIKey,
+	})
+	if err != nil {
+		common.WriteErrorFromDomain(c, err)
+		return
+	}
+	common.WriteOK(c, resp)
+}
+
+func (h *Handler) deleteSettings(c *gin.Context) {
+	workspaceID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		common.WriteError(c, http.StatusBadRequest, common.ErrorBody{Code: common.CodeInvalidInput, Message: "Invalid workspace ID."})
+		return
+	}
+	userID := middleware.GetUserID(c)
+	if err := h.svc.DeleteWorkspaceSettings(c.Request.Context(), workspaceID, userID); err != nil {
+		common.WriteErrorFromDomain(c, err)
+		return
+	}
+	common.WriteNoContent(c)
+}
+
+func (h *Handler) getStyleGuide(c *gin.Context) {
+	workspaceID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		common.WriteError(c, http.StatusBadRequest, common.ErrorBody{Code: common.CodeInvalidInput, Message: "Invalid workspace ID."})
+		return
+	}
+	userID := middleware.GetUserID(c)
+	resp, err := h.svc.GetStyleGuide(c.Request.Context(), workspaceID, userID)
+	if err != nil {
+		common.WriteErrorFromDomain(c, err)
+		return
+	}
+	common.WriteOK(c, resp)
+}
+
+func (h *Handler) updateStyleGuide(c *gin.Context) {
+	workspaceID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		common.WriteError(c, http.StatusBadRequest, common.ErrorBody{Code: common.CodeInvalidInput, Message: "Invalid workspace ID."})
+		return
+	}
+	userID := middleware.GetUserID(c)
+	var req UpdateStyleGuideRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		common.WriteError(c, http.StatusBadRequest, common.ErrorBody{Code: common.CodeInvalidInput, Message: "Invalid or missing input.", Details: map[string]interface{}{"error": err.Error()}})
+		return
+	}
+	resp, err := h.svc.UpdateStyleGuide(c.Request.Context(), workspaceID, userID, service.StyleGuideInput{
+		Direction:    req.Direction,
+		Naming:       req.Naming,
+		Instructions: req.Instructions,
+	})
+	if err != nil {
+		common.WriteErrorFromDomain(c, err)
+		return
+	}
+	common.WriteOK(c, resp)
+}
+
+func (h *Handler) deleteStyleGuide(c *gin.Context) {
+	workspaceID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		common.WriteError(c, http.StatusBadRequest, common.ErrorBody{Code: common.CodeInvalidInput, Message: "Invalid workspace ID."})
+		return
+	}
+	userID := middleware.GetUserID(c)
+	if err := h.svc.DeleteStyleGuide(c.Request.Context(), workspaceID, userID); err != nil {
+		common.WriteErrorFromDomain(c, err)
+		return
+	}
+	common.WriteNoContent(c)
+}
+
+// getUsage returns the workspace's AI usage report; ?month=YYYY-MM selects a past month.
+func (h *Handler) getUsage(c *gin.Context) {
+	workspaceID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		common.WriteError(c, http.StatusBadRequest, common.ErrorBody{Code: common.CodeInvalidInput, Message: "Invalid workspace ID."})
+		return
+	}
+	userID := middleware.GetUserID(c)
+	resp, err := h.svc.GetWorkspaceUsage(c.Request.Context(), workspaceID, userID, c.Query("month"))
+	if err != nil {
+		common.WriteErrorFromDomain(c, err)
+		return
+	}
+	common.WriteOK(c, resp)
+}
+
+// listConversations lists the caller's AI conversations; ?diagram_id= keeps those linked to a diagram.
+func (h *Handler) listConversations(c *gin.Context) {
+	var diagramID *uuid.UUID
+	if raw := c.Query("diagram_id"); raw != "" {
+		id, err := uuid.Parse(raw)
+		if err != nil {
+			common.WriteError(c, http.StatusBadRequest, common.ErrorBody{Code: common.CodeInvalidInput, Message: "Invalid diagram ID."})
+			return
+		}
+		diagramID = &id
+	}
+	userID := middleware.GetUserID(c)
+	list, err := h.svc.ListConversations(c.Request.Context(), userID, diagramID)
+	if err != nil {
+		common.WriteErrorFromDomain(c, err)
+		return
+	}
+	common.WriteOK(c, list)
+}
+
+func (h *Handler) getConversation(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		common.WriteError(c, http.StatusBadRequest, common.ErrorBody{Code: common.CodeInvalidInput, Message: "Invalid conversation ID."})
+		return
+	}
+	userID := middleware.GetUserID(c)
+	resp, err := h.svc.GetConversation(c.Request.Context(), id, userID)
+	if err != nil {
+		common.WriteErrorFromDomain(c, err)
+		return
+	}
+	common.WriteOK(c, resp)
+}
+
+func (h *Handler) updateConversation(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		common.WriteError(c, http.StatusBadRequest, common.ErrorBody{Code: common.CodeInvalidInput, Message: "Invalid conversation ID."})
+		return
+	}
+	var req UpdateConversationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		common.WriteError(c, http.StatusBadRequest, common.ErrorBody{Code: common.CodeInvalidInput, Message: "Invalid or missing input.", Details: map[string]interface{}{"error": err.Error()}})
+		return
+	}
+	in := service.ConversationUpdate{Title: req.Title}
+	if req.DiagramID != nil {
+		if *req.DiagramID == "" {
+			in.Unlink = true
+		} else {
+			diagramID, err := uuid.Parse(*req.DiagramID)
+			if err != nil {
+				common.WriteError(c, http.StatusBadRequest, common.ErrorBody{Code: common.CodeInvalidInput, Message: "Invalid diagram ID."})
 				return
 			}
+			in.DiagramID = &diagramID
 		}
+	}
+	userID := middleware.GetUserID(c)
+	resp, err := h.svc.UpdateConversation(c.Request.Context(), id, userID, in)
+	if err != nil {
+		common.WriteErrorFromDomain(c, err)
+		return
+	}
+	common.WriteOK(c, resp)
+}
+
+func (h *Handler) deleteConversation(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		common.WriteError(c, http.StatusBadRequest, common.ErrorBody{Code: common.CodeInvalidInput, Message: "Invalid conversation ID."})
+		return
+	}
+	userID := middleware.GetUserID(c)
+	if err := h.svc.DeleteConversation(c.Request.Context(), id, userID); err != nil {
+		common.WriteErrorFromDomain(c, err)
+		return
+	}
+	common.WriteNoContent(c)
+}
+
+// createJob queues a batch of descriptions and answers 202 with the job; poll GET /ai/jobs/:id for
+// each item's diagram or error.
+func (h *Handler) createJob(c *gin.Context) {
+	var req CreateJobRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		common.WriteError(c, http.StatusBadRequest, common.ErrorBody{
+			Code:    common.CodeInvalidInput,
+			Message: "Invalid or missing input. workspace_id and items with a description are required.",
+			Details: map[string]interface{}{"error": err.Error()},
+		})
+		return
+	}
+	workspaceID, err := uuid.Parse(req.WorkspaceID)
+	if err != nil {
+		common.WriteError(c, http.StatusBadRequest, common.ErrorBody{Code: common.CodeInvalidInput, Message: "Invalid workspace ID."})
+		return
+	}
+	in := service.JobInput{WorkspaceID: workspaceID, DiagramType: req.DiagramType}
+	for _, it := range req.Items {
+		in.Items = append(in.Items, service.JobItemInput{Title: it.Title, Description: it.Description})
+	}
+	userID := middleware.GetUserID(c)
+	resp, err := h.svc.CreateJob(c.Request.Context(), userID, in)
+	if err != nil {
+		common.WriteErrorFromDomain(c, err)
+		return
+	}
+	common.WriteAccepted(c, resp)
+}
+
+func (h *Handler) getJob(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		common.WriteError(c, http.StatusBadRequest, common.ErrorBody{Code: common.CodeInvalidInput, Message: "Invalid job ID."})
+		return
+	}
+	userID := middleware.GetUserID(c)
+	resp, err := h.svc.GetJob(c.Request.Context(), id, userID)
+	if err != nil {
 		common.WriteErrorFromDomain(c, err)
 		return
 	}
-	common.WriteOK(c, GenerateDiagramResponse{Diagram: diagram})
+	common.WriteOK(c, resp)
 }
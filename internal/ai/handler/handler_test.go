@@ -0,0 +1,151 @@
+package handler
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/devenock/d_weaver/config"
+	"github.com/devenock/d_weaver/internal/ai/client"
+	"github.com/devenock/d_weaver/internal/ai/model"
+	"github.com/devenock/d_weaver/internal/ai/service"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// nopRepo discards usage and conversations; the tests use no workspace settings, quotas or follow-ups.
+type nopRepo struct{ service.Repository }
+
+func (nopRepo) CreateUsage(ctx context.Context, u *model.Usage) error { return nil }
+
+func (nopRepo) ReserveUsage(ctx context.Context, u *model.Usage, limits model.UsageLimits) (string, error) {
+	return "", nil
+}
+
+func (nopRepo) FinishUsage(ctx context.Context, u *model.Usage) error { return nil }
+
+func (nopRepo) CreateConversation(ctx context.Context, c *model.Conversation, messages []*model.Message) (*model.Conversation, error) {
+	created := *c
+	created.ID = uuid.New()
+	return &created, nil
+}
+
+// streamServer runs the stream endpoint against an Ollama stub that writes chunks and then, when hold
+// is set, blocks until its request is cancelled (reported on cancelled).
+func streamServer(t *testing.T, chunks []string, hold bool, cancelled chan<- struct{}) *httptest.Server {
+	t.Helper()
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, chunk := range chunks {
+			line, _ := json.Marshal(map[string]interface{}{"message": map[string]string{"content": chunk}})
+			_, _ = w.Write(append(line, '\n'))
+			w.(http.Flusher).Flush()
+		}
+		if hold {
+			<-r.Context().Done()
+			cancelled <- struct{}{}
+			return
+		}
+		_, _ = w.Write([]byte(`{"done":true,"prompt_eval_count":1,"eval_count":2}` + "\n"))
+	}))
+	t.Cleanup(provider.Close)
+
+	gen := client.NewOllamaGenerator(provider.URL, "m", nil)
+	h := New(service.New(gen, config.AIConfig{Provider: client.ProviderOllama, MaxAttempts: 1}, nopRepo{}, nil, nil, nil))
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/stream", h.generateDiagramStream)
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+type sseEvent struct {
+	name, data string
+}
+
+// readEvents reads server-sent events from sc until n have arrived or the stream ends.
+func readEvents(t *testing.T, sc *bufio.Scanner, n int) []sseEvent {
+	t.Helper()
+	var events []sseEvent
+	var ev sseEvent
+	for len(events) < n && sc.Scan() {
+		line := sc.Text()
+		switch {
+		case strings.HasPrefix(line, "event:"):
+			ev.name = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			ev.data = strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		case line == "" && ev.name != "":
+			events = append(events, ev)
+			ev = sseEvent{}
+		}
+	}
+	return events
+}
+
+func TestGenerateDiagramStream(t *testing.T) {
+	srv := streamServer(t, []string{"```mermaid\nflowchart TD\n", "  A[Start --> B\n```"}, false, nil)
+	resp, err := http.Post(srv.URL+"/stream", "application/json", strings.NewReader(`{"description":"login"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/event-stream") {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+	events := readEvents(t, bufio.NewScanner(resp.Body), 3)
+	if len(events) != 3 || events[0].name != "delta" || events[1].name != "delta" || events[2].name != "done" {
+		t.Fatalf("events = %+v, want two deltas and done", events)
+	}
+	var done GenerateDiagramResponse
+	if err := json.Unmarshal([]byte(events[2].data), &done); err != nil {
+		t.Fatal(err)
+	}
+	if done.Diagram != "flowchart TD\n  A[Start --> B" || done.Validation.Valid || len(done.Validation.Errors) != 1 {
+		t.Errorf("done = %+v, want cleaned diagram with one validation error", done)
+	}
+}
+
+func TestGenerateDiagramStream_ClientDisconnectCancelsProvider(t *testing.T) {
+	cancelled := make(chan struct{}, 1)
+	srv := streamServer(t, []string{"flowchart TD\n"}, true, cancelled)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, srv.URL+"/stream", strings.NewReader(`{"description":"login"}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if events := readEvents(t, bufio.NewScanner(resp.Body), 1); len(events) != 1 || events[0].name != "delta" {
+		t.Fatalf("events = %+v, want the first delta", events)
+	}
+	cancel()
+	select {
+	case <-cancelled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("provider request was not cancelled after the client disconnected")
+	}
+}
+
+func TestGenerateDiagramStream_ErrorBeforeFirstDelta(t *testing.T) {
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer provider.Close()
+	h := New(service.New(client.NewOllamaGenerator(provider.URL, "m", nil), config.AIConfig{}, nopRepo{}, nil, nil, nil))
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/stream", h.generateDiagramStream)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/stream", strings.NewReader(`{"description":"login"}`)))
+	if w.Code != http.StatusTooManyRequests || !strings.Contains(w.Body.String(), "rate_limit_exceeded") {
+		t.Errorf("status %d body %s, want 429 rate_limit_exceeded", w.Code, w.Body.String())
+	}
+}
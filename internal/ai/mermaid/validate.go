@@ -0,0 +1,197 @@
+// Package mermaid checks AI-generated Mermaid source for the mistakes that stop it rendering. It is
+// a structural lint (header, block nesting, brackets, stray prose), not a full Mermaid parser.
+package mermaid
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Error is one problem found in the source. Line is 1-based; 0 means the whole document.
+type Error struct {
+	Line    int    `json:"line"`
+	Message string `json:"message"`
+}
+
+func (e Error) String() string {
+	if e.Line == 0 {
+		return e.Message
+	}
+	return fmt.Sprintf("line %d: %s", e.Line, e.Message)
+}
+
+// Result is the outcome of Validate.
+type Result struct {
+	Valid       bool    `json:"valid"`
+	DiagramType string  `json:"diagram_type,omitempty"` // header keyword, e.g. flowchart, sequenceDiagram
+	Errors      []Error `json:"errors,omitempty"`
+}
+
+// headers are the diagram keywords Mermaid accepts on the first line.
+var headers = map[string]bool{
+	"graph": true, "flowchart": true, "sequenceDiagram": true, "classDiagram": true, "classDiagram-v2": true,
+	"stateDiagram": true, "stateDiagram-v2": true, "erDiagram": true, "gantt": true, "pie": true,
+	"journey": true, "gitGraph": true, "mindmap": true, "timeline": true, "quadrantChart": true,
+	"requirementDiagram": true, "C4Context": true, "C4Container": true, "C4Component": true,
+	"C4Dynamic": true, "C4Deployment": true, "xychart-beta": true, "sankey-beta": true,
+	"block-beta": true, "architecture-beta": true, "packet-beta": true, "kanban": true,
+}
+
+var flowchartDirections = map[string]bool{"TB": true, "TD": true, "BT": true, "RL": true, "LR": true}
+
+// sequenceBlocks open a block closed by "end" in sequence diagrams.
+var sequenceBlocks = map[string]bool{
+	"loop": true, "alt": true, "opt": true, "par": true, "critical": true, "break": true, "rect": true, "box": true,
+}
+
+var (
+	// asymmetricNode is a flowchart node like id>label], whose "]" has no "[".
+	asymmetricNode = regexp.MustCompile(`\w>[^\]\n]*\]`)
+	// erCardinality is an erDiagram relationship such as ||--o{ or }|..|{.
+	erCardinality = regexp.MustCompile(`[|}o]{1,2}(--|\.\.)[|{o]{1,2}`)
+)
+
+// line is a source line with its 1-based number.
+type line struct {
+	n    int
+	text string
+}
+
+// Validate checks src and reports every problem found.
+func Validate(src string) Result {
+	var res Result
+	fail := func(n int, format string, args ...interface{}) {
+		res.Errors = append(res.Errors, Error{Line: n, Message: fmt.Sprintf(format, args...)})
+	}
+
+	lines := significantLines(src, fail)
+	if len(lines) == 0 {
+		fail(0, "diagram is empty")
+		return res
+	}
+	header := strings.Fields(lines[0].text)
+	res.DiagramType = header[0]
+	if !headers[res.DiagramType] {
+		fail(lines[0].n, "unknown diagram type %q; the first line must declare one, e.g. flowchart TD", header[0])
+		return res
+	}
+	body := lines[1:]
+	if len(body) == 0 {
+		fail(0, "diagram has a header but no content")
+	}
+
+	switch res.DiagramType {
+	case "graph", "flowchart":
+		if len(header) > 1 && !flowchartDirections[header[1]] {
+			fail(lines[0].n, "unknown flowchart direction %q; use TB, TD, BT, RL or LR", header[1])
+		}
+		checkBlocks(body, map[string]bool{"subgraph": true}, fail)
+		for _, l := range body {
+			checkBrackets(l, asymmetricNode.ReplaceAllString(l.text, "_"), fail)
+		}
+	case "sequenceDiagram":
+		checkBlocks(body, sequenceBlocks, fail)
+	case "erDiagram":
+		checkBraces(body, func(s string) string { return erCardinality.ReplaceAllString(s, "") }, fail)
+	case "classDiagram", "classDiagram-v2", "stateDiagram", "stateDiagram-v2":
+		checkBraces(body, func(s string) string { return s }, fail)
+	}
+	res.Valid = len(res.Errors) == 0
+	return res
+}
+
+// significantLines returns the lines that carry diagram content: comments, blank lines and YAML
+// front matter are skipped, and stray markdown fences are reported.
+func significantLines(src string, fail func(int, string, ...interface{})) []line {
+	var out []line
+	inFrontMatter := false
+	for i, raw := range strings.Split(strings.ReplaceAll(src, "\r\n", "\n"), "\n") {
+		n, text := i+1, strings.TrimSpace(raw)
+		switch {
+		case text == "---" && len(out) == 0:
+			inFrontMatter = !inFrontMatter
+			continue
+		case inFrontMatter, text == "", strings.HasPrefix(text, "%%"):
+			continue
+		case strings.HasPrefix(text, "```"):
+			fail(n, "markdown code fence inside the diagram")
+			continue
+		}
+		out = append(out, line{n, text})
+	}
+	return out
+}
+
+// checkBlocks reports keywords in openers without a matching "end", and "end" without an opener.
+func checkBlocks(body []line, openers map[string]bool, fail func(int, string, ...interface{})) {
+	var open []line
+	for _, l := range body {
+		word := strings.Fields(l.text)[0]
+		switch {
+		case openers[word]:
+			open = append(open, l)
+		case word == "end":
+			if len(open) == 0 {
+				fail(l.n, `"end" without an open block`)
+				continue
+			}
+			open = open[:len(open)-1]
+		}
+	}
+	for _, l := range open {
+		fail(l.n, "%q block is never closed with \"end\"", strings.Fields(l.text)[0])
+	}
+}
+
+// checkBrackets reports unbalanced brackets and quotes within one line (flowchart node shapes).
+func checkBrackets(l line, text string, fail func(int, string, ...interface{})) {
+	if strings.Count(text, `"`)%2 != 0 {
+		fail(l.n, "unterminated quoted label")
+		return
+	}
+	var stack []rune
+	pairs := map[rune]rune{')': '(', ']': '[', '}': '{'}
+	inQuote := false
+	for _, r := range text {
+		switch {
+		case r == '"':
+			inQuote = !inQuote
+		case inQuote:
+		case r == '(' || r == '[' || r == '{':
+			stack = append(stack, r)
+		case pairs[r] != 0:
+			if len(stack) == 0 || stack[len(stack)-1] != pairs[r] {
+				fail(l.n, "unexpected %q", string(r))
+				return
+			}
+			stack = stack[:len(stack)-1]
+		}
+	}
+	if len(stack) > 0 {
+		fail(l.n, "unclosed %q", string(stack[len(stack)-1]))
+	}
+}
+
+// checkBraces reports { } blocks (entity, class or composite state bodies) that do not balance
+// across lines. strip removes syntax that uses braces for something else.
+func checkBraces(body []line, strip func(string) string, fail func(int, string, ...interface{})) {
+	var open []line
+	for _, l := range body {
+		for _, r := range strip(l.text) {
+			switch r {
+			case '{':
+				open = append(open, l)
+			case '}':
+				if len(open) == 0 {
+					fail(l.n, `unexpected "}"`)
+					continue
+				}
+				open = open[:len(open)-1]
+			}
+		}
+	}
+	for _, l := range open {
+		fail(l.n, `"{" is never closed`)
+	}
+}
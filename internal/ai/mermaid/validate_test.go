@@ -0,0 +1,45 @@
+package mermaid
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	cases := []struct {
+		name    string
+		src     string
+		valid   bool
+		errLine int
+		errText string
+	}{
+		{"flowchart", "flowchart TD\n  A[Start] --> B{Ok?}\n  B -->|yes| C((Done))\n  B -->|no| D>Retry]\n  subgraph s\n    C\n  end", true, 0, ""},
+		{"front matter and comments", "---\ntitle: x\n---\n%% comment\nsequenceDiagram\n  loop poll\n    A->>B: hi\n  end", true, 0, ""},
+		{"er cardinality", "erDiagram\n  USER ||--o{ ORDER : places\n  USER {\n    uuid id PK\n  }", true, 0, ""},
+		{"class body", "classDiagram\n  class Animal {\n    +String name\n  }\n  Animal <|-- Dog", true, 0, ""},
+		{"empty", "  \n%% nothing\n", false, 0, "empty"},
+		{"prose", "Here is your diagram:\nflowchart TD\n  A --> B", false, 1, "unknown diagram type"},
+		{"fence", "```mermaid\nflowchart TD\n  A --> B\n```", false, 1, "code fence"},
+		{"direction", "flowchart XY\n  A --> B", false, 1, "direction"},
+		{"unclosed bracket", "graph LR\n  A[Start --> B", false, 2, `unclosed "["`},
+		{"unterminated quote", "graph LR\n  A[\"Start] --> B", false, 2, "quoted"},
+		{"open subgraph", "flowchart TD\n  subgraph one\n  A --> B", false, 2, "never closed"},
+		{"stray end", "sequenceDiagram\n  A->>B: hi\n  end", false, 3, "without an open block"},
+		{"er brace", "erDiagram\n  USER {\n    uuid id", false, 2, "never closed"},
+		{"header only", "pie", false, 0, "no content"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			res := Validate(tc.src)
+			if res.Valid != tc.valid {
+				t.Fatalf("Valid = %v, errors %v", res.Valid, res.Errors)
+			}
+			if tc.valid {
+				return
+			}
+			if len(res.Errors) == 0 || res.Errors[0].Line != tc.errLine || !strings.Contains(res.Errors[0].Message, tc.errText) {
+				t.Errorf("errors = %v, want line %d containing %q", res.Errors, tc.errLine, tc.errText)
+			}
+		})
+	}
+}
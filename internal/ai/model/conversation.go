@@ -0,0 +1,77 @@
+package model
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Message roles in ai_messages.
+const (
+	RoleUser      = "user"
+	RoleAssistant = "assistant"
+)
+
+// Conversation matches the ai_conversations table: a multi-turn diagram generation. WorkspaceID is the
+// workspace whose AI settings and quota the conversation uses; DiagramID the diagram it produced.
+type Conversation struct {
+	ID          uuid.UUID
+	UserID      uuid.UUID
+	WorkspaceID *uuid.UUID
+	DiagramID   *uuid.UUID
+	Title       string
+	DiagramType string
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// Message matches the ai_messages table. User messages are what the user typed; assistant messages
+// are the diagram returned for them.
+type Message struct {
+	ID             uuid.UUID
+	ConversationID uuid.UUID
+	Role           string
+	Content        string
+	CreatedAt      time.Time
+}
+
+// ConversationResponse is the conversation shape for API responses; Messages is only set when a
+// single conversation is fetched.
+type ConversationResponse struct {
+	ID          uuid.UUID         `json:"id"`
+	WorkspaceID *uuid.UUID        `json:"workspace_id,omitempty"`
+	DiagramID   *uuid.UUID        `json:"diagram_id,omitempty"`
+	Title       string            `json:"title"`
+	DiagramType string            `json:"diagram_type,omitempty"`
+	CreatedAt   time.Time         `json:"created_at"`
+	UpdatedAt   time.Time         `json:"updated_at"`
+	Messages    []MessageResponse `json:"messages,omitempty"`
+}
+
+// MessageResponse is the message shape for API responses.
+type MessageResponse struct {
+	ID        uuid.UUID `json:"id"`
+	Role      string    `json:"role"`
+	Content   string    `json:"content"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// FromConversation builds a ConversationResponse from a Conversation and, optionally, its messages.
+func FromConversation(c *Conversation, messages []*Message) ConversationResponse {
+	if c == nil {
+		return ConversationResponse{}
+	}
+	resp := ConversationResponse{
+		ID:          c.ID,
+		WorkspaceID: c.WorkspaceID,
+		DiagramID:   c.DiagramID,
+		Title:       c.Title,
+		DiagramType: c.DiagramType,
+		CreatedAt:   c.CreatedAt,
+		UpdatedAt:   c.UpdatedAt,
+	}
+	for _, m := range messages {
+		resp.Messages = append(resp.Messages, MessageResponse{ID: m.ID, Role: m.Role, Content: m.Content, CreatedAt: m.CreatedAt})
+	}
+	return resp
+}
@@ -0,0 +1,61 @@
+package model
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// WorkspaceSettingsResponse is the AI settings shape for API responses. The API key is never
+// returned; APIKeySet tells whether the workspace has its own.
+type WorkspaceSettingsResponse struct {
+	WorkspaceID uuid.UUID  `json:"workspace_id"`
+	Provider    string     `json:"provider"`
+	Model       string     `json:"model"`
+	BaseURL     string     `json:"base_url,omitempty"`
+	APIKeySet   bool       `json:"api_key_set"`
+	Override    bool       `json:"override"` // false when the workspace uses the server default
+	UpdatedAt   *time.Time `json:"updated_at,omitempty"`
+}
+
+// FromWorkspaceSettings builds a WorkspaceSettingsResponse from a workspace override.
+func FromWorkspaceSettings(s *WorkspaceSettings) WorkspaceSettingsResponse {
+	if s == nil {
+		return WorkspaceSettingsResponse{}
+	}
+	updatedAt := s.UpdatedAt
+	return WorkspaceSettingsResponse{
+		WorkspaceID: s.WorkspaceID,
+		Provider:    s.Provider,
+		Model:       s.Model,
+		BaseURL:     s.BaseURL,
+		APIKeySet:   s.APIKey != "",
+		Override:    true,
+		UpdatedAt:   &updatedAt,
+	}
+}
+
+// StyleGuideResponse is the style guide shape for API responses. UpdatedAt is nil for a workspace
+// without a style guide.
+type StyleGuideResponse struct {
+	WorkspaceID  uuid.UUID  `json:"workspace_id"`
+	Direction    string     `json:"direction"`
+	Naming       string     `json:"naming"`
+	Instructions string     `json:"instructions"`
+	UpdatedAt    *time.Time `json:"updated_at,omitempty"`
+}
+
+// FromStyleGuide builds a StyleGuideResponse from a stored style guide.
+func FromStyleGuide(g *StyleGuide) StyleGuideResponse {
+	if g == nil {
+		return StyleGuideResponse{}
+	}
+	updatedAt := g.UpdatedAt
+	return StyleGuideResponse{
+		WorkspaceID:  g.WorkspaceID,
+		Direction:    g.Direction,
+		Naming:       g.Naming,
+		Instructions: g.Instructions,
+		UpdatedAt:    &updatedAt,
+	}
+}
@@ -0,0 +1,43 @@
+package model
+
+import "github.com/google/uuid"
+
+// Explanation is a walkthrough of a diagram. The JSON shape is also what the model is asked to reply with.
+type Explanation struct {
+	DiagramID   uuid.UUID   `json:"diagram_id"`
+	DiagramType string      `json:"diagram_type"`
+	Summary     string      `json:"summary"`
+	Components  []Component `json:"components"`
+	Flows       []Flow      `json:"flows"`
+	Risks       []Risk      `json:"risks"`
+}
+
+// Component is one element of a diagram and its responsibility.
+type Component struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// Flow is a path through the system, in order.
+type Flow struct {
+	Name  string   `json:"name"`
+	Steps []string `json:"steps"`
+}
+
+// Risk is a concern the diagram suggests. Severity is low, medium or high.
+type Risk struct {
+	Title    string `json:"title"`
+	Detail   string `json:"detail"`
+	Severity string `json:"severity"`
+}
+
+// CommentSummary condenses a diagram's comment thread. OmittedComments counts the oldest comments
+// left out because the thread was too long to send.
+type CommentSummary struct {
+	DiagramID       uuid.UUID `json:"diagram_id"`
+	CommentCount    int       `json:"comment_count"`
+	OmittedComments int       `json:"omitted_comments"`
+	Summary         string    `json:"summary"`
+	Decisions       []string  `json:"decisions"`
+	OpenQuestions   []string  `json:"open_questions"`
+}
@@ -0,0 +1,134 @@
+package model
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Statuses of ai_jobs and ai_job_items. A job is completed once none of its items is pending or
+// running; each item then either succeeded or failed.
+const (
+	JobPending   = "pending"
+	JobRunning   = "running"
+	JobCompleted = "completed" // jobs only
+	JobSucceeded = "succeeded" // items only
+	JobFailed    = "failed"    // items only
+)
+
+// Job matches the ai_jobs table: a batch of descriptions to turn into diagrams in WorkspaceID, with
+// the workspace's AI settings and quota.
+type Job struct {
+	ID          uuid.UUID
+	UserID      uuid.UUID
+	WorkspaceID uuid.UUID
+	DiagramType string
+	Status      string
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	FinishedAt  *time.Time
+}
+
+// JobItem matches the ai_job_items table: one description of a job and, once processed, the diagram
+// created for it or why none was. ConversationID is set whenever a diagram was generated, also when
+// it failed validation, so the user can follow up on it.
+type JobItem struct {
+	ID             uuid.UUID
+	JobID          uuid.UUID
+	Position       int
+	Title          string
+	Description    string
+	Status         string
+	DiagramID      *uuid.UUID
+	ConversationID *uuid.UUID
+	Attempts       int
+	Cached         bool
+	ErrorCode      string
+	ErrorMessage   string
+	CreatedAt      time.Time
+	StartedAt      *time.Time
+	FinishedAt     *time.Time
+}
+
+// JobResponse is the job shape for API responses, with its items in submission order.
+type JobResponse struct {
+	ID          uuid.UUID         `json:"id"`
+	WorkspaceID uuid.UUID         `json:"workspace_id"`
+	DiagramType string            `json:"diagram_type,omitempty"`
+	Status      string            `json:"status"`
+	Total       int               `json:"total"`
+	Pending     int               `json:"pending"` // pending or running
+	Succeeded   int               `json:"succeeded"`
+	Failed      int               `json:"failed"`
+	CreatedAt   time.Time         `json:"created_at"`
+	UpdatedAt   time.Time         `json:"updated_at"`
+	FinishedAt  *time.Time        `json:"finished_at,omitempty"`
+	Items       []JobItemResponse `json:"items"`
+}
+
+// JobItemResponse is the job item shape for API responses.
+type JobItemResponse struct {
+	Position       int           `json:"position"`
+	Title          string        `json:"title"`
+	Description    string        `json:"description"`
+	Status         string        `json:"status"`
+	DiagramID      *uuid.UUID    `json:"diagram_id,omitempty"`
+	ConversationID *uuid.UUID    `json:"conversation_id,omitempty"`
+	Attempts       int           `json:"attempts"`
+	Cached         bool          `json:"cached"`
+	Error          *JobItemError `json:"error,omitempty"`
+	StartedAt      *time.Time    `json:"started_at,omitempty"`
+	FinishedAt     *time.Time    `json:"finished_at,omitempty"`
+}
+
+// JobItemError is why a failed item has no diagram, with the code the same call would have failed
+// with synchronously (e.g. quota_exceeded).
+type JobItemError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// FromJob builds a JobResponse from a job and its items.
+func FromJob(j *Job, items []*JobItem) JobResponse {
+	if j == nil {
+		return JobResponse{}
+	}
+	resp := JobResponse{
+		ID:          j.ID,
+		WorkspaceID: j.WorkspaceID,
+		DiagramType: j.DiagramType,
+		Status:      j.Status,
+		Total:       len(items),
+		CreatedAt:   j.CreatedAt,
+		UpdatedAt:   j.UpdatedAt,
+		FinishedAt:  j.FinishedAt,
+		Items:       make([]JobItemResponse, 0, len(items)),
+	}
+	for _, it := range items {
+		switch it.Status {
+		case JobSucceeded:
+			resp.Succeeded++
+		case JobFailed:
+			resp.Failed++
+		default:
+			resp.Pending++
+		}
+		item := JobItemResponse{
+			Position:       it.Position,
+			Title:          it.Title,
+			Description:    it.Description,
+			Status:         it.Status,
+			DiagramID:      it.DiagramID,
+			ConversationID: it.ConversationID,
+			Attempts:       it.Attempts,
+			Cached:         it.Cached,
+			StartedAt:      it.StartedAt,
+			FinishedAt:     it.FinishedAt,
+		}
+		if it.ErrorCode != "" {
+			item.Error = &JobItemError{Code: it.ErrorCode, Message: it.ErrorMessage}
+		}
+		resp.Items = append(resp.Items, item)
+	}
+	return resp
+}
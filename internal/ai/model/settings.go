@@ -0,0 +1,31 @@
+package model
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// WorkspaceSettings matches the workspace_ai_settings table: a workspace's override of the server's
+// AI provider. Empty Model and BaseURL mean the provider default; empty APIKey means the server key
+// when the provider matches the server's.
+type WorkspaceSettings struct {
+	WorkspaceID uuid.UUID
+	Provider    string
+	Model       string
+	BaseURL     string
+	APIKey      string
+	UpdatedBy   *uuid.UUID
+	UpdatedAt   time.Time
+}
+
+// StyleGuide matches the workspace_ai_style_guides table: conventions every AI-generated or edited
+// diagram in the workspace should follow. Empty fields mean no preference.
+type StyleGuide struct {
+	WorkspaceID  uuid.UUID
+	Direction    string
+	Naming       string
+	Instructions string
+	UpdatedBy    *uuid.UUID
+	UpdatedAt    time.Time
+}
@@ -0,0 +1,119 @@
+package model
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// AI operations recorded in ai_usage.
+const (
+	OperationGenerate          = "generate"
+	OperationEdit              = "edit"
+	OperationExplain           = "explain"
+	OperationSummarizeComments = "summarize_comments"
+)
+
+// Outcomes of an AI call. Only success, invalid and pending count towards request quotas.
+const (
+	OutcomePending         = "pending" // reserved before the provider call; replaced when the call finishes
+	OutcomeSuccess         = "success"
+	OutcomeInvalid         = "invalid" // the model replied but no attempt passed validation
+	OutcomeError           = "error"
+	OutcomeRateLimited     = "rate_limited"
+	OutcomePaymentRequired = "payment_required"
+	OutcomeCancelled       = "cancelled"
+	OutcomeCached          = "cached" // answered from the response cache without calling the provider
+)
+
+// Usage matches the ai_usage table: one AI call with its tokens summed over its attempts. WorkspaceID
+// is nil for calls billed to the user alone.
+type Usage struct {
+	ID           uuid.UUID
+	WorkspaceID  *uuid.UUID
+	UserID       uuid.UUID
+	Operation    string
+	Model        string
+	InputTokens  int
+	OutputTokens int
+	Attempts     int
+	LatencyMs    int
+	Outcome      string
+	CreatedAt    time.Time
+}
+
+// UsageTotals is the quota-relevant usage since a point in time.
+type UsageTotals struct {
+	Requests int // calls with outcome success or invalid, and recent pending ones
+	Tokens   int // input plus output tokens of all calls
+}
+
+// Reached reports whether t has reached either limit; 0 limits are unlimited.
+func (t UsageTotals) Reached(maxRequests, maxTokens int) bool {
+	return (maxRequests > 0 && t.Requests >= maxRequests) || (maxTokens > 0 && t.Tokens >= maxTokens)
+}
+
+// UsageLimits are the monthly quotas a call is reserved against: usage since Since; 0 is unlimited.
+type UsageLimits struct {
+	Since             time.Time
+	WorkspaceRequests int
+	WorkspaceTokens   int
+	UserRequests      int
+	UserTokens        int
+}
+
+// Quotas a reservation can find reached.
+const (
+	QuotaWorkspace = "workspace"
+	QuotaUser      = "user"
+)
+
+// UsageGroup is the usage of one user, model, operation and outcome over a period.
+type UsageGroup struct {
+	UserID       *uuid.UUID
+	Model        string
+	Operation    string
+	Outcome      string
+	Calls        int
+	InputTokens  int
+	OutputTokens int
+	LatencyMs    int
+}
+
+// UsageStats is aggregated usage in API responses.
+type UsageStats struct {
+	Calls        int `json:"calls"`    // all calls, including failed ones
+	Requests     int `json:"requests"` // calls counted against the request quota
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+	TotalTokens  int `json:"total_tokens"`
+	AvgLatencyMs int `json:"avg_latency_ms"`
+}
+
+// UsageBreakdown is the usage of one key (a user id, model, operation or outcome).
+type UsageBreakdown struct {
+	Key string `json:"key"`
+	UsageStats
+}
+
+// UsageQuota is a monthly limit and what is left of it; nil limits are unlimited.
+type UsageQuota struct {
+	MonthlyRequests   *int `json:"monthly_requests"`
+	MonthlyTokens     *int `json:"monthly_tokens"`
+	RemainingRequests *int `json:"remaining_requests"`
+	RemainingTokens   *int `json:"remaining_tokens"`
+}
+
+// UsageReport is a workspace's AI usage for one calendar month (UTC).
+type UsageReport struct {
+	WorkspaceID uuid.UUID        `json:"workspace_id"`
+	Month       string           `json:"month"` // YYYY-MM
+	PeriodStart time.Time        `json:"period_start"`
+	PeriodEnd   time.Time        `json:"period_end"`
+	Totals      UsageStats       `json:"totals"`
+	Quota       UsageQuota       `json:"quota"`
+	ByUser      []UsageBreakdown `json:"by_user,omitempty"` // owners and admins only
+	ByModel     []UsageBreakdown `json:"by_model"`
+	ByOperation []UsageBreakdown `json:"by_operation"`
+	ByOutcome   []UsageBreakdown `json:"by_outcome"`
+}
@@ -0,0 +1,300 @@
+// Package prompt loads the prompt templates the AI features send to the provider. Defaults are
+// embedded in the binary; a directory laid out like templates/ overrides them file by file.
+//
+// Each prompt is a YAML file, templates/<name>.yaml, with the system prompt, temperature, user
+// message template and few-shot examples. templates/<name>/<diagram_type>.yaml is a variant for one
+// diagram type: its guidance is appended to the base system prompt and any other field it sets
+// replaces the base's.
+package prompt
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"text/template"
+
+	"go.yaml.in/yaml/v3"
+)
+
+// Prompt names.
+const (
+	Generate          = "generate"
+	Edit              = "edit"
+	Explain           = "explain"
+	SummarizeComments = "summarize_comments"
+)
+
+//go:embed templates
+var embedded embed.FS
+
+// DiagramData is the data for the generate user template.
+type DiagramData struct {
+	Description string
+	DiagramType string
+}
+
+// FollowUpData is the data for the generate follow_up template.
+type FollowUpData struct {
+	Instruction string
+	DiagramType string
+}
+
+// EditData is the data for the edit user template.
+type EditData struct {
+	Current     string
+	DiagramType string
+	Instruction string
+}
+
+// ExplainData is the data for the explain user template.
+type ExplainData struct {
+	Content     string
+	DiagramType string
+}
+
+// CommentsData is the data for the summarize_comments user template.
+type CommentsData struct {
+	Title  string
+	Thread string
+}
+
+// templateData is the data each prompt's user (and follow_up) templates are checked against at load.
+var templateData = map[string]struct{ user, followUp any }{
+	Generate:          {DiagramData{}, FollowUpData{}},
+	Edit:              {EditData{}, nil},
+	Explain:           {ExplainData{}, nil},
+	SummarizeComments: {CommentsData{}, nil},
+}
+
+// Example is a few-shot exchange sent before the real request.
+type Example struct {
+	User      string `yaml:"user"`
+	Assistant string `yaml:"assistant"`
+}
+
+// file is one template file as written.
+type file struct {
+	System      string    `yaml:"system"`
+	Guidance    string    `yaml:"guidance"`
+	Temperature *float64  `yaml:"temperature"`
+	MaxTokens   int       `yaml:"max_tokens"`
+	User        string    `yaml:"user"`
+	FollowUp    string    `yaml:"follow_up"`
+	Examples    []Example `yaml:"examples"`
+
+	user, followUp *template.Template
+}
+
+// Prompt is a prompt resolved for one diagram type.
+type Prompt struct {
+	System      string
+	Temperature float64
+	MaxTokens   int // 0 for the provider default
+	Examples    []Example
+
+	user, followUp *template.Template
+}
+
+// User renders the user message for data.
+func (p *Prompt) User(data any) (string, error) {
+	return render(p.user, data)
+}
+
+// FollowUp renders a later user message of a conversation; it is empty for prompts without one.
+func (p *Prompt) FollowUp(data any) (string, error) {
+	if p.followUp == nil {
+		return "", nil
+	}
+	return render(p.followUp, data)
+}
+
+// Set is a loaded set of prompts. It is safe for concurrent use.
+type Set struct {
+	files   map[string]*file // by "<name>" and "<name>/<diagram_type>"
+	version string
+}
+
+// Default returns the embedded prompts.
+func Default() *Set {
+	return defaultSet
+}
+
+var defaultSet = mustLoad()
+
+func mustLoad() *Set {
+	s, err := Load("")
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// Load returns the embedded prompts with the files in dir, when set, replacing or adding to them.
+// Every file is parsed and its templates checked, so a bad override fails here rather than on the
+// first request.
+func Load(dir string) (*Set, error) {
+	sources := map[string][]byte{}
+	sub, _ := fs.Sub(embedded, "templates")
+	if err := collect(sub, sources); err != nil {
+		return nil, err
+	}
+	if dir != "" {
+		if err := collect(os.DirFS(dir), sources); err != nil {
+			return nil, fmt.Errorf("prompt: %s: %w", dir, err)
+		}
+	}
+	s := &Set{files: make(map[string]*file, len(sources))}
+	keys := make([]string, 0, len(sources))
+	for key := range sources {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	h := sha256.New()
+	for _, key := range keys {
+		f, err := parse(key, sources[key])
+		if err != nil {
+			return nil, err
+		}
+		s.files[key] = f
+		fmt.Fprintf(h, "%s\x00%s\x00", key, sources[key])
+	}
+	for name := range templateData {
+		base := s.files[name]
+		if base == nil {
+			return nil, fmt.Errorf("prompt: %s.yaml is missing", name)
+		}
+		if base.System == "" || base.user == nil {
+			return nil, fmt.Errorf("prompt: %s.yaml needs system and user", name)
+		}
+	}
+	s.version = hex.EncodeToString(h.Sum(nil))[:12]
+	return s, nil
+}
+
+// collect reads the .yaml files of fsys into sources, keyed by path without the extension.
+func collect(fsys fs.FS, sources map[string][]byte) error {
+	return fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		ext := path.Ext(p)
+		if ext != ".yaml" && ext != ".yml" {
+			return nil
+		}
+		raw, err := fs.ReadFile(fsys, p)
+		if err != nil {
+			return err
+		}
+		sources[strings.TrimSuffix(p, ext)] = raw
+		return nil
+	})
+}
+
+// parse decodes and checks the template file for key.
+func parse(key string, raw []byte) (*file, error) {
+	name, variant, _ := strings.Cut(key, "/")
+	data, ok := templateData[name]
+	if !ok || strings.Contains(variant, "/") {
+		return nil, fmt.Errorf("prompt: unknown prompt %q", key)
+	}
+	var f file
+	dec := yaml.NewDecoder(bytes.NewReader(raw))
+	dec.KnownFields(true)
+	if err := dec.Decode(&f); err != nil {
+		return nil, fmt.Errorf("prompt: %s: %w", key, err)
+	}
+	var err error
+	if f.user, err = compile(key, "user", f.User, data.user); err != nil {
+		return nil, err
+	}
+	if f.FollowUp != "" && data.followUp == nil {
+		return nil, fmt.Errorf("prompt: %s: %s has no follow_up", key, name)
+	}
+	if f.followUp, err = compile(key, "follow_up", f.FollowUp, data.followUp); err != nil {
+		return nil, err
+	}
+	for i, ex := range f.Examples {
+		if strings.TrimSpace(ex.User) == "" || strings.TrimSpace(ex.Assistant) == "" {
+			return nil, fmt.Errorf("prompt: %s: example %d needs user and assistant", key, i+1)
+		}
+	}
+	return &f, nil
+}
+
+// compile parses text and renders it once with the zero data value so that unknown fields fail at load.
+func compile(key, field, text string, data any) (*template.Template, error) {
+	if text == "" {
+		return nil, nil
+	}
+	t, err := template.New(key + "." + field).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("prompt: %s: %w", key, err)
+	}
+	if _, err := render(t, data); err != nil {
+		return nil, fmt.Errorf("prompt: %s: %w", key, err)
+	}
+	return t, nil
+}
+
+func render(t *template.Template, data any) (string, error) {
+	var b strings.Builder
+	if err := t.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(b.String()), nil
+}
+
+// Version identifies the content of the set; it changes whenever a template does.
+func (s *Set) Version() string {
+	return s.version
+}
+
+// Get returns the prompt name resolved for diagramType.
+func (s *Set) Get(name, diagramType string) *Prompt {
+	base := s.files[name]
+	p := &Prompt{System: base.System, MaxTokens: base.MaxTokens, Examples: base.Examples, user: base.user, followUp: base.followUp}
+	if base.Temperature != nil {
+		p.Temperature = *base.Temperature
+	}
+	guidance := []string{p.System, base.Guidance}
+	if v := s.files[name+"/"+strings.ToLower(strings.TrimSpace(diagramType))]; v != nil {
+		if v.System != "" {
+			guidance[0] = v.System
+		}
+		guidance = append(guidance, v.Guidance)
+		if v.Temperature != nil {
+			p.Temperature = *v.Temperature
+		}
+		if v.MaxTokens > 0 {
+			p.MaxTokens = v.MaxTokens
+		}
+		if len(v.Examples) > 0 {
+			p.Examples = v.Examples
+		}
+		if v.user != nil {
+			p.user = v.user
+		}
+		if v.followUp != nil {
+			p.followUp = v.followUp
+		}
+	}
+	p.System = joinNonEmpty(guidance)
+	return p
+}
+
+func joinNonEmpty(parts []string) string {
+	var kept []string
+	for _, part := range parts {
+		if part = strings.TrimSpace(part); part != "" {
+			kept = append(kept, part)
+		}
+	}
+	return strings.Join(kept, "\n\n")
+}
@@ -0,0 +1,113 @@
+package prompt
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/devenock/d_weaver/internal/ai/mermaid"
+)
+
+func TestDefault(t *testing.T) {
+	s := Default()
+	p := s.Get(Generate, "")
+	if !strings.Contains(p.System, "expert diagram generator") || p.Temperature != 0.7 || len(p.Examples) != 0 {
+		t.Errorf("generate = %+v", p)
+	}
+	if got, _ := p.User(DiagramData{Description: "login", DiagramType: "auto"}); got != "Create an appropriate diagram for: login" {
+		t.Errorf("user = %q", got)
+	}
+	if got, _ := p.User(DiagramData{Description: "login", DiagramType: "sequence"}); got != "Create a sequence diagram for: login" {
+		t.Errorf("typed user = %q", got)
+	}
+
+	flow := s.Get(Generate, "Flowchart")
+	if !strings.HasPrefix(flow.System, p.System) || !strings.Contains(flow.System, "Flowchart rules") {
+		t.Errorf("variant system = %q, want the base with flowchart guidance appended", flow.System)
+	}
+	// Every few-shot example must itself be a diagram the validator accepts.
+	for key, f := range s.files {
+		for i, ex := range f.Examples {
+			if res := mermaid.Validate(ex.Assistant); !res.Valid {
+				t.Errorf("%s example %d: %+v", key, i+1, res.Errors)
+			}
+		}
+	}
+	if s.Get(Edit, "flowchart").Temperature != 0.2 || s.Get(Explain, "").Temperature != 0.3 {
+		t.Error("wrong temperatures")
+	}
+	if s.Version() == "" || s.Version() != Default().Version() {
+		t.Errorf("version = %q", s.Version())
+	}
+}
+
+func TestLoad_Override(t *testing.T) {
+	dir := t.TempDir()
+	write(t, dir, "edit.yaml", "temperature: 0.1\nsystem: Edit carefully.\nuser: \"{{.Instruction}} on {{.Current}}\"\n")
+	write(t, dir, "generate/mindmap.yml", "guidance: Keep it three levels deep.\ntemperature: 0.5\nexamples:\n  - user: u\n    assistant: a\n")
+
+	s, err := Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edit := s.Get(Edit, "")
+	if got, _ := edit.User(EditData{Current: "A", Instruction: "add B"}); edit.System != "Edit carefully." || edit.Temperature != 0.1 || got != "add B on A" {
+		t.Errorf("edit = %+v, user %q", edit, got)
+	}
+	mind := s.Get(Generate, "mindmap")
+	if !strings.HasSuffix(mind.System, "Keep it three levels deep.") || mind.Temperature != 0.5 || len(mind.Examples) != 1 {
+		t.Errorf("mindmap = %+v", mind)
+	}
+	if s.Get(Generate, "flowchart").Examples == nil {
+		t.Error("embedded variants were dropped")
+	}
+	if s.Version() == Default().Version() {
+		t.Error("version did not change with the override")
+	}
+}
+
+func TestLoad_Invalid(t *testing.T) {
+	cases := map[string]string{
+		"unknown field":    "edit.yaml:system: s\nuser: u\ntemprature: 1\n",
+		"unknown variable": "explain.yaml:system: s\nuser: \"{{.Description}}\"\n",
+		"bad template":     "explain.yaml:system: s\nuser: \"{{.Content\"\n",
+		"no user":          "summarize_comments.yaml:system: s\n",
+		"unknown prompt":   "translate.yaml:system: s\nuser: u\n",
+		"follow-up":        "edit/er.yaml:follow_up: more\n",
+		"empty example":    "generate/er.yaml:examples:\n  - user: u\n",
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			file, content, _ := strings.Cut(tc, ":")
+			write(t, dir, file, content)
+			if _, err := Load(dir); err == nil {
+				t.Error("want error")
+			}
+		})
+	}
+}
+
+func TestStyleContext(t *testing.T) {
+	if got := (Style{}).Context(); got != "" {
+		t.Errorf("empty style = %q", got)
+	}
+	got := Style{Direction: "LR", Naming: "snake_case ids", Instructions: " Use the company colours. "}.Context()
+	for _, want := range []string{"Preferred direction: LR", "Naming conventions: snake_case ids", "Also: Use the company colours."} {
+		if !strings.Contains(got, want) {
+			t.Errorf("context %q lacks %q", got, want)
+		}
+	}
+}
+
+func write(t *testing.T, dir, name, content string) {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
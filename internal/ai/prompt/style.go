@@ -0,0 +1,32 @@
+package prompt
+
+import "strings"
+
+// Directions a style guide may prefer, as written in a Mermaid flowchart header.
+var Directions = []string{"TB", "TD", "BT", "LR", "RL"}
+
+// Style is a workspace style guide. It is added to the system prompt of the prompts that produce
+// diagrams (generate and edit).
+type Style struct {
+	Direction    string // preferred flowchart direction, one of Directions; empty for no preference
+	Naming       string // naming conventions for nodes, entities and labels
+	Instructions string // anything else the workspace wants every diagram to follow
+}
+
+// Context returns the style guide as a system prompt section, or "" when it is empty.
+func (s Style) Context() string {
+	var b strings.Builder
+	if s.Direction != "" {
+		b.WriteString("\n- Preferred direction: " + s.Direction + " (e.g. flowchart " + s.Direction + ")")
+	}
+	if naming := strings.TrimSpace(s.Naming); naming != "" {
+		b.WriteString("\n- Naming conventions: " + naming)
+	}
+	if instructions := strings.TrimSpace(s.Instructions); instructions != "" {
+		b.WriteString("\n- Also: " + instructions)
+	}
+	if b.Len() == 0 {
+		return ""
+	}
+	return "Workspace style guide (follow it unless the request says otherwise):" + b.String()
+}
@@ -0,0 +1,567 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/devenock/d_weaver/internal/ai/model"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Repository implements AI settings, style guide, usage, conversation and batch job persistence.
+type Repository struct {
+	pool *pgxpool.Pool
+}
+
+// New returns an AI repository using the given pool.
+func New(pool *pgxpool.Pool) *Repository {
+	return &Repository{pool: pool}
+}
+
+func isErrNoRows(err error) bool {
+	return errors.Is(err, pgx.ErrNoRows)
+}
+
+func nullStr(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+func strOrEmpty(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+// GetWorkspaceSettings returns the workspace's AI override or nil if it has none.
+func (r *Repository) GetWorkspaceSettings(ctx context.Context, workspaceID uuid.UUID) (*model.WorkspaceSettings, error) {
+	var s model.WorkspaceSettings
+	var modelName, baseURL, apiKey *string
+	err := r.pool.QueryRow(ctx,
+		`SELECT workspace_id, provider, model, base_url, api_key, updated_by, updated_at
+		 FROM workspace_ai_settings WHERE workspace_id = $1`,
+		workspaceID,
+	).Scan(&s.WorkspaceID, &s.Provider, &modelName, &baseURL, &apiKey, &s.UpdatedBy, &s.UpdatedAt)
+	if err != nil {
+		if isErrNoRows(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	s.Model, s.BaseURL, s.APIKey = strOrEmpty(modelName), strOrEmpty(baseURL), strOrEmpty(apiKey)
+	return &s, nil
+}
+
+// UpsertWorkspaceSettings creates or replaces the workspace's AI override and returns it.
+func (r *Repository) UpsertWorkspaceSettings(ctx context.Context, s *model.WorkspaceSettings) (*model.WorkspaceSettings, error) {
+	out := *s
+	err := r.pool.QueryRow(ctx,
+		`INSERT INTO workspace_ai_settings (workspace_id, provider, model, base_url, api_key, updated_by, updated_at)
+		 VALUES ($1, $2, $3, $4, $5, $6, NOW())
+		 ON CONFLICT (workspace_id) DO UPDATE SET provider = EXCLUDED.provider, model = EXCLUDED.model,
+		   base_url = EXCLUDED.base_url, api_key = EXCLUDED.api_key, updated_by = EXCLUDED.updated_by, updated_at = NOW()
+		 RETURNING updated_at`,
+		s.WorkspaceID, s.Provider, nullStr(s.Model), nullStr(s.BaseURL), nullStr(s.APIKey), s.UpdatedBy,
+	).Scan(&out.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// DeleteWorkspaceSettings removes the workspace's AI override. Returns true if one existed.
+func (r *Repository) DeleteWorkspaceSettings(ctx context.Context, workspaceID uuid.UUID) (bool, error) {
+	cmd, err := r.pool.Exec(ctx, `DELETE FROM workspace_ai_settings WHERE workspace_id = $1`, workspaceID)
+	if err != nil {
+		return false, err
+	}
+	return cmd.RowsAffected() > 0, nil
+}
+
+// GetStyleGuide returns the workspace's style guide or nil if it has none.
+func (r *Repository) GetStyleGuide(ctx context.Context, workspaceID uuid.UUID) (*model.StyleGuide, error) {
+	var g model.StyleGuide
+	var direction, naming, instructions *string
+	err := r.pool.QueryRow(ctx,
+		`SELECT workspace_id, direction, naming, instructions, updated_by, updated_at
+		 FROM workspace_ai_style_guides WHERE workspace_id = $1`,
+		workspaceID,
+	).Scan(&g.WorkspaceID, &direction, &naming, &instructions, &g.UpdatedBy, &g.UpdatedAt)
+	if err != nil {
+		if isErrNoRows(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	g.Direction, g.Naming, g.Instructions = strOrEmpty(direction), strOrEmpty(naming), strOrEmpty(instructions)
+	return &g, nil
+}
+
+// UpsertStyleGuide creates or replaces the workspace's style guide and returns it.
+func (r *Repository) UpsertStyleGuide(ctx context.Context, g *model.StyleGuide) (*model.StyleGuide, error) {
+	out := *g
+	err := r.pool.QueryRow(ctx,
+		`INSERT INTO workspace_ai_style_guides (workspace_id, direction, naming, instructions, updated_by, updated_at)
+		 VALUES ($1, $2, $3, $4, $5, NOW())
+		 ON CONFLICT (workspace_id) DO UPDATE SET direction = EXCLUDED.direction, naming = EXCLUDED.naming,
+		   instructions = EXCLUDED.instructions, updated_by = EXCLUDED.updated_by, updated_at = NOW()
+		 RETURNING updated_at`,
+		g.WorkspaceID, nullStr(g.Direction), nullStr(g.Naming), nullStr(g.Instructions), g.UpdatedBy,
+	).Scan(&out.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// DeleteStyleGuide removes the workspace's style guide. Returns true if one existed.
+func (r *Repository) DeleteStyleGuide(ctx context.Context, workspaceID uuid.UUID) (bool, error) {
+	cmd, err := r.pool.Exec(ctx, `DELETE FROM workspace_ai_style_guides WHERE workspace_id = $1`, workspaceID)
+	if err != nil {
+		return false, err
+	}
+	return cmd.RowsAffected() > 0, nil
+}
+
+// CreateUsage records one AI call.
+func (r *Repository) CreateUsage(ctx context.Context, u *model.Usage) error {
+	_, err := r.pool.Exec(ctx,
+		`INSERT INTO ai_usage (workspace_id, user_id, operation, model, input_tokens, output_tokens, attempts, latency_ms, outcome)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		u.WorkspaceID, u.UserID, u.Operation, nullStr(u.Model), u.InputTokens, u.OutputTokens, u.Attempts, u.LatencyMs, u.Outcome,
+	)
+	return err
+}
+
+// usageTotalsSQL sums quota-relevant usage; callers append the filter on $1 and created_at >= $2. Pending
+// calls count for an hour, so a reservation a crash left unfinished stops counting.
+const usageTotalsSQL = `SELECT COUNT(*) FILTER (WHERE outcome IN ('success', 'invalid')
+	  OR (outcome = 'pending' AND created_at > NOW() - INTERVAL '1 hour')),
+	COALESCE(SUM(input_tokens + output_tokens), 0)
+	FROM ai_usage WHERE `
+
+// ReserveUsage records u as a pending call unless the workspace's or the user's usage has reached a limit,
+// in which case it records nothing and returns the quota reached (model.QuotaWorkspace or QuotaUser).
+// The workspace and user rows are locked while checking, so concurrent reservations cannot all pass.
+func (r *Repository) ReserveUsage(ctx context.Context, u *model.Usage, limits model.UsageLimits) (string, error) {
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback(ctx)
+	if u.WorkspaceID != nil && (limits.WorkspaceRequests > 0 || limits.WorkspaceTokens > 0) {
+		if _, err := tx.Exec(ctx, `SELECT 1 FROM workspaces WHERE id = $1 FOR NO KEY UPDATE`, *u.WorkspaceID); err != nil {
+			return "", err
+		}
+		var t model.UsageTotals
+		if err := tx.QueryRow(ctx, usageTotalsSQL+`workspace_id = $1 AND created_at >= $2`, *u.WorkspaceID, limits.Since).Scan(&t.Requests, &t.Tokens); err != nil {
+			return "", err
+		}
+		if t.Reached(limits.WorkspaceRequests, limits.WorkspaceTokens) {
+			return model.QuotaWorkspace, nil
+		}
+	}
+	if limits.UserRequests > 0 || limits.UserTokens > 0 {
+		if _, err := tx.Exec(ctx, `SELECT 1 FROM users WHERE id = $1 FOR NO KEY UPDATE`, u.UserID); err != nil {
+			return "", err
+		}
+		var t model.UsageTotals
+		if err := tx.QueryRow(ctx, usageTotalsSQL+`user_id = $1 AND created_at >= $2`, u.UserID, limits.Since).Scan(&t.Requests, &t.Tokens); err != nil {
+			return "", err
+		}
+		if t.Reached(limits.UserRequests, limits.UserTokens) {
+			return model.QuotaUser, nil
+		}
+	}
+	err = tx.QueryRow(ctx,
+		`INSERT INTO ai_usage (workspace_id, user_id, operation, outcome) VALUES ($1, $2, $3, $4)
+		 RETURNING id, created_at`,
+		u.WorkspaceID, u.UserID, u.Operation, model.OutcomePending,
+	).Scan(&u.ID, &u.CreatedAt)
+	if err != nil {
+		return "", err
+	}
+	u.Outcome = model.OutcomePending
+	return "", tx.Commit(ctx)
+}
+
+// FinishUsage records the result of a call reserved with ReserveUsage.
+func (r *Repository) FinishUsage(ctx context.Context, u *model.Usage) error {
+	_, err := r.pool.Exec(ctx,
+		`UPDATE ai_usage SET model = $2, input_tokens = $3, output_tokens = $4, attempts = $5, latency_ms = $6, outcome = $7
+		 WHERE id = $1`,
+		u.ID, nullStr(u.Model), u.InputTokens, u.OutputTokens, u.Attempts, u.LatencyMs, u.Outcome,
+	)
+	return err
+}
+
+// ListWorkspaceUsage returns the workspace's usage in [from, to) grouped by user, model, operation and outcome.
+func (r *Repository) ListWorkspaceUsage(ctx context.Context, workspaceID uuid.UUID, from, to time.Time) ([]model.UsageGroup, error) {
+	rows, err := r.pool.Query(ctx,
+		`SELECT user_id, COALESCE(model, ''), operation, outcome, COUNT(*),
+		   SUM(input_tokens), SUM(output_tokens), SUM(latency_ms)
+		 FROM ai_usage WHERE workspace_id = $1 AND created_at >= $2 AND created_at < $3
+		 GROUP BY user_id, model, operation, outcome`,
+		workspaceID, from, to,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []model.UsageGroup
+	for rows.Next() {
+		var g model.UsageGroup
+		if err := rows.Scan(&g.UserID, &g.Model, &g.Operation, &g.Outcome, &g.Calls, &g.InputTokens, &g.OutputTokens, &g.LatencyMs); err != nil {
+			return nil, err
+		}
+		out = append(out, g)
+	}
+	return out, rows.Err()
+}
+
+const conversationColumns = `id, user_id, workspace_id, diagram_id, title, diagram_type, created_at, updated_at`
+
+func scanConversation(row pgx.Row) (*model.Conversation, error) {
+	var c model.Conversation
+	var diagramType *string
+	if err := row.Scan(&c.ID, &c.UserID, &c.WorkspaceID, &c.DiagramID, &c.Title, &diagramType, &c.CreatedAt, &c.UpdatedAt); err != nil {
+		return nil, err
+	}
+	c.DiagramType = strOrEmpty(diagramType)
+	return &c, nil
+}
+
+// CreateConversation creates a conversation with its first messages in one transaction.
+func (r *Repository) CreateConversation(ctx context.Context, c *model.Conversation, messages []*model.Message) (*model.Conversation, error) {
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+	out, err := scanConversation(tx.QueryRow(ctx,
+		`INSERT INTO ai_conversations (user_id, workspace_id, diagram_id, title, diagram_type)
+		 VALUES ($1, $2, $3, $4, $5)
+		 RETURNING `+conversationColumns,
+		c.UserID, c.WorkspaceID, c.DiagramID, c.Title, nullStr(c.DiagramType),
+	))
+	if err != nil {
+		return nil, err
+	}
+	if err := insertMessages(ctx, tx, out.ID, messages); err != nil {
+		return nil, err
+	}
+	return out, tx.Commit(ctx)
+}
+
+// AppendMessages adds messages to a conversation and marks it updated. Returns false if it does not exist.
+func (r *Repository) AppendMessages(ctx context.Context, conversationID uuid.UUID, messages []*model.Message) (bool, error) {
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+	cmd, err := tx.Exec(ctx, `UPDATE ai_conversations SET updated_at = NOW() WHERE id = $1`, conversationID)
+	if err != nil {
+		return false, err
+	}
+	if cmd.RowsAffected() == 0 {
+		return false, nil
+	}
+	if err := insertMessages(ctx, tx, conversationID, messages); err != nil {
+		return false, err
+	}
+	return true, tx.Commit(ctx)
+}
+
+func insertMessages(ctx context.Context, tx pgx.Tx, conversationID uuid.UUID, messages []*model.Message) error {
+	for _, m := range messages {
+		if _, err := tx.Exec(ctx,
+			`INSERT INTO ai_messages (conversation_id, role, content) VALUES ($1, $2, $3)`,
+			conversationID, m.Role, m.Content,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetConversation returns the conversation or nil if not found.
+func (r *Repository) GetConversation(ctx context.Context, id uuid.UUID) (*model.Conversation, error) {
+	c, err := scanConversation(r.pool.QueryRow(ctx,
+		`SELECT `+conversationColumns+` FROM ai_conversations WHERE id = $1`, id))
+	if err != nil {
+		if isErrNoRows(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return c, nil
+}
+
+// ListConversations returns the user's conversations, most recently updated first. A non-nil
+// diagramID keeps only those linked to that diagram.
+func (r *Repository) ListConversations(ctx context.Context, userID uuid.UUID, diagramID *uuid.UUID) ([]*model.Conversation, error) {
+	rows, err := r.pool.Query(ctx,
+		`SELECT `+conversationColumns+` FROM ai_conversations
+		 WHERE user_id = $1 AND ($2::uuid IS NULL OR diagram_id = $2)
+		 ORDER BY updated_at DESC`,
+		userID, diagramID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []*model.Conversation
+	for rows.Next() {
+		c, err := scanConversation(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, c)
+	}
+	return out, rows.Err()
+}
+
+// ListMessages returns the conversation's messages, oldest first.
+func (r *Repository) ListMessages(ctx context.Context, conversationID uuid.UUID) ([]*model.Message, error) {
+	rows, err := r.pool.Query(ctx,
+		`SELECT id, conversation_id, role, content, created_at FROM ai_messages
+		 WHERE conversation_id = $1 ORDER BY created_at, id`,
+		conversationID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []*model.Message
+	for rows.Next() {
+		var m model.Message
+		if err := rows.Scan(&m.ID, &m.ConversationID, &m.Role, &m.Content, &m.CreatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, &m)
+	}
+	return out, rows.Err()
+}
+
+// UpdateConversation sets the conversation's title and linked diagram (nil unlinks). Returns nil if not found.
+func (r *Repository) UpdateConversation(ctx context.Context, id uuid.UUID, title string, diagramID *uuid.UUID) (*model.Conversation, error) {
+	c, err := scanConversation(r.pool.QueryRow(ctx,
+		`UPDATE ai_conversations SET title = $2, diagram_id = $3, updated_at = NOW() WHERE id = $1
+		 RETURNING `+conversationColumns,
+		id, title, diagramID,
+	))
+	if err != nil {
+		if isErrNoRows(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return c, nil
+}
+
+// DeleteConversation removes the conversation and its messages. Returns true if it existed.
+func (r *Repository) DeleteConversation(ctx context.Context, id uuid.UUID) (bool, error) {
+	cmd, err := r.pool.Exec(ctx, `DELETE FROM ai_conversations WHERE id = $1`, id)
+	if err != nil {
+		return false, err
+	}
+	return cmd.RowsAffected() > 0, nil
+}
+
+const jobColumns = `id, user_id, workspace_id, diagram_type, status, created_at, updated_at, finished_at`
+
+func scanJob(row pgx.Row) (*model.Job, error) {
+	var j model.Job
+	var diagramType *string
+	if err := row.Scan(&j.ID, &j.UserID, &j.WorkspaceID, &diagramType, &j.Status, &j.CreatedAt, &j.UpdatedAt, &j.FinishedAt); err != nil {
+		return nil, err
+	}
+	j.DiagramType = strOrEmpty(diagramType)
+	return &j, nil
+}
+
+const jobItemColumns = `id, job_id, position, title, description, status, diagram_id, conversation_id, attempts, cached,
+	error_code, error_message, created_at, started_at, finished_at`
+
+func scanJobItem(row pgx.Row) (*model.JobItem, error) {
+	var it model.JobItem
+	var errorCode, errorMessage *string
+	if err := row.Scan(&it.ID, &it.JobID, &it.Position, &it.Title, &it.Description, &it.Status, &it.DiagramID, &it.ConversationID,
+		&it.Attempts, &it.Cached, &errorCode, &errorMessage, &it.CreatedAt, &it.StartedAt, &it.FinishedAt); err != nil {
+		return nil, err
+	}
+	it.ErrorCode, it.ErrorMessage = strOrEmpty(errorCode), strOrEmpty(errorMessage)
+	return &it, nil
+}
+
+// CreateJob creates a pending job with its items (positions taken from their order) in one transaction.
+func (r *Repository) CreateJob(ctx context.Context, j *model.Job, items []*model.JobItem) (*model.Job, []*model.JobItem, error) {
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback(ctx)
+	out, err := scanJob(tx.QueryRow(ctx,
+		`INSERT INTO ai_jobs (user_id, workspace_id, diagram_type, status)
+		 VALUES ($1, $2, $3, $4)
+		 RETURNING `+jobColumns,
+		j.UserID, j.WorkspaceID, nullStr(j.DiagramType), model.JobPending,
+	))
+	if err != nil {
+		return nil, nil, err
+	}
+	created := make([]*model.JobItem, 0, len(items))
+	for i, it := range items {
+		row, err := scanJobItem(tx.QueryRow(ctx,
+			`INSERT INTO ai_job_items (job_id, position, title, description, status)
+			 VALUES ($1, $2, $3, $4, $5)
+			 RETURNING `+jobItemColumns,
+			out.ID, i, it.Title, it.Description, model.JobPending,
+		))
+		if err != nil {
+			return nil, nil, err
+		}
+		created = append(created, row)
+	}
+	return out, created, tx.Commit(ctx)
+}
+
+// GetJob returns the job or nil if not found.
+func (r *Repository) GetJob(ctx context.Context, id uuid.UUID) (*model.Job, error) {
+	j, err := scanJob(r.pool.QueryRow(ctx, `SELECT `+jobColumns+` FROM ai_jobs WHERE id = $1`, id))
+	if err != nil {
+		if isErrNoRows(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return j, nil
+}
+
+// ListJobItems returns the job's items in submission order.
+func (r *Repository) ListJobItems(ctx context.Context, jobID uuid.UUID) ([]*model.JobItem, error) {
+	rows, err := r.pool.Query(ctx,
+		`SELECT `+jobItemColumns+` FROM ai_job_items WHERE job_id = $1 ORDER BY position`, jobID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []*model.JobItem
+	for rows.Next() {
+		it, err := scanJobItem(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, it)
+	}
+	return out, rows.Err()
+}
+
+// ClaimJobItem marks the oldest pending item running and its job running, and returns it; nil when
+// no item is pending. Items locked by another worker are skipped, so replicas never claim the same one.
+func (r *Repository) ClaimJobItem(ctx context.Context) (*model.JobItem, error) {
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+	it, err := scanJobItem(tx.QueryRow(ctx,
+		`UPDATE ai_job_items SET status = $1, started_at = NOW()
+		 WHERE id = (SELECT id FROM ai_job_items WHERE status = $2 ORDER BY created_at, position
+		             LIMIT 1 FOR UPDATE SKIP LOCKED)
+		 RETURNING `+jobItemColumns,
+		model.JobRunning, model.JobPending,
+	))
+	if err != nil {
+		if isErrNoRows(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if _, err := tx.Exec(ctx,
+		`UPDATE ai_jobs SET status = $2, updated_at = NOW() WHERE id = $1 AND status = $3`,
+		it.JobID, model.JobRunning, model.JobPending,
+	); err != nil {
+		return nil, err
+	}
+	return it, tx.Commit(ctx)
+}
+
+// FinishJobItem runs commit, when set, and records the item's outcome, provided the item is still
+// running under the claim it was handed out with (its started_at). The item is locked throughout, so it
+// cannot be requeued while commit saves its results; commit is not run and false is returned if the
+// item was requeued meanwhile. Completes the job when the item was the last one left.
+func (r *Repository) FinishJobItem(ctx context.Context, it *model.JobItem, commit func(ctx context.Context)) (bool, error) {
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+	cmd, err := tx.Exec(ctx,
+		`SELECT 1 FROM ai_job_items WHERE id = $1 AND status = $2 AND started_at = $3 FOR UPDATE`,
+		it.ID, model.JobRunning, it.StartedAt,
+	)
+	if err != nil {
+		return false, err
+	}
+	if cmd.RowsAffected() == 0 {
+		return false, nil
+	}
+	if commit != nil {
+		commit(ctx)
+	}
+	// Serializes the job's finishing items so that the last one sees all the others finished.
+	if _, err := tx.Exec(ctx, `SELECT 1 FROM ai_jobs WHERE id = $1 FOR UPDATE`, it.JobID); err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec(ctx,
+		`UPDATE ai_job_items SET status = $2, diagram_id = $3, conversation_id = $4, attempts = $5, cached = $6,
+		   error_code = $7, error_message = $8, finished_at = NOW()
+		 WHERE id = $1`,
+		it.ID, it.Status, it.DiagramID, it.ConversationID, it.Attempts, it.Cached,
+		nullStr(it.ErrorCode), nullStr(it.ErrorMessage),
+	); err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec(ctx, `UPDATE ai_jobs SET updated_at = NOW() WHERE id = $1`, it.JobID); err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec(ctx,
+		`UPDATE ai_jobs SET status = $4, finished_at = NOW(), updated_at = NOW()
+		 WHERE id = $1 AND NOT EXISTS (SELECT 1 FROM ai_job_items WHERE job_id = $1 AND status IN ($2, $3))`,
+		it.JobID, model.JobPending, model.JobRunning, model.JobCompleted,
+	); err != nil {
+		return false, err
+	}
+	return true, tx.Commit(ctx)
+}
+
+// ReleaseJobItem puts a running item back to pending, e.g. when its worker is stopped, unless it was
+// requeued and claimed again meanwhile.
+func (r *Repository) ReleaseJobItem(ctx context.Context, it *model.JobItem) error {
+	_, err := r.pool.Exec(ctx,
+		`UPDATE ai_job_items SET status = $2, started_at = NULL WHERE id = $1 AND status = $3 AND started_at = $4`,
+		it.ID, model.JobPending, model.JobRunning, it.StartedAt,
+	)
+	return err
+}
+
+// RequeueStaleJobItems puts items that have been running since before the given time back to pending:
+// their worker is assumed to have died. Returns how many were requeued.
+func (r *Repository) RequeueStaleJobItems(ctx context.Context, startedBefore time.Time) (int64, error) {
+	cmd, err := r.pool.Exec(ctx,
+		`UPDATE ai_job_items SET status = $1, started_at = NULL WHERE status = $2 AND started_at < $3`,
+		model.JobPending, model.JobRunning, startedBefore,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return cmd.RowsAffected(), nil
+}
@@ -0,0 +1,135 @@
+package service
+
+import (
+	"context"
+	"errors"
+
+	"github.com/devenock/d_weaver/config"
+	"github.com/devenock/d_weaver/internal/ai/cache"
+	"github.com/devenock/d_weaver/internal/ai/client"
+	"github.com/devenock/d_weaver/internal/ai/model"
+	"github.com/devenock/d_weaver/internal/ai/prompt"
+	"github.com/devenock/d_weaver/internal/common"
+	"github.com/google/uuid"
+)
+
+// cacheKey returns the response cache key of a new conversation's first generate call. Entries are
+// kept per workspace so that one workspace never gets output generated with another's settings.
+func (s *Service) cacheKey(in GenerateInput, cfg config.AIConfig, style prompt.Style) string {
+	scope := ""
+	if in.WorkspaceID != nil {
+		scope = in.WorkspaceID.String()
+	}
+	return cache.Key(cache.KeyInput{
+		Scope:         scope,
+		Description:   in.Description,
+		DiagramType:   in.DiagramType,
+		Model:         cfg.Provider + " " + cfg.BaseURL + " " + modelName(cfg),
+		PromptVersion: s.prompts.Version(),
+		Style:         style.Context(),
+	})
+}
+
+// modelName returns the model cfg selects.
+func modelName(cfg config.AIConfig) string {
+	if cfg.Model != "" {
+		return cfg.Model
+	}
+	if cfg.Provider == "" {
+		return client.DefaultModel(client.ProviderOpenAI)
+	}
+	return client.DefaultModel(cfg.Provider)
+}
+
+// cachedGenerate answers a generate call from the response cache when it can. Otherwise it runs
+// generate and caches a valid result; identical non-streaming calls that arrive meanwhile wait for
+// that generation instead of starting their own. A cache hit is streamed as a single delta.
+func (s *Service) cachedGenerate(ctx context.Context, userID uuid.UUID, in GenerateInput, key, modelID string, generate func(ctx context.Context) (*DiagramResult, error), onDelta func(string) error) (*DiagramResult, error) {
+	if !in.BypassCache {
+		if e := s.cacheGet(ctx, key); e != nil {
+			s.recordCached(ctx, userID, in.WorkspaceID, e.Model)
+			if onDelta != nil {
+				if err := onDelta(e.Diagram); err != nil {
+					return nil, err
+				}
+			}
+			return &DiagramResult{Diagram: e.Diagram, Validation: e.Validation, Cached: true}, nil
+		}
+	}
+	if onDelta != nil || in.BypassCache {
+		res, err := generate(ctx)
+		if err == nil {
+			s.cachePut(ctx, key, res, modelID)
+		}
+		return res, err
+	}
+	leader := false
+	ch := s.inflight.DoChan(key, func() (any, error) {
+		leader = true
+		// Detached so that the callers waiting on this generation are not failed by the first
+		// caller going away.
+		res, err := generate(context.WithoutCancel(ctx))
+		if err == nil {
+			s.cachePut(ctx, key, res, modelID)
+		}
+		return res, err
+	})
+	select {
+	case <-ctx.Done():
+		return nil, generationError(ctx.Err())
+	case r := <-ch:
+		if r.Err != nil {
+			var de *common.DomainError
+			if !leader && errors.As(r.Err, &de) && de.Code == CodeQuotaExceeded {
+				// The quota that ran out was the first caller's; this caller's may not have.
+				return generate(ctx)
+			}
+			return nil, r.Err
+		}
+		res := *r.Val.(*DiagramResult) // a copy: each caller saves its own conversation
+		if !leader {
+			res.Cached, res.Attempts = true, 0
+			s.recordCached(ctx, userID, in.WorkspaceID, modelID)
+		}
+		return &res, nil
+	}
+}
+
+// cacheGet returns the cached entry under key, or nil. A failing cache is logged and treated as a miss.
+func (s *Service) cacheGet(ctx context.Context, key string) *cache.Entry {
+	if s.cache == nil {
+		return nil
+	}
+	e, err := s.cache.Get(ctx, key)
+	if err != nil {
+		if s.log != nil {
+			s.log.Warn().Err(err).Msg("ai: cache read failed")
+		}
+		return nil
+	}
+	return e
+}
+
+// cachePut caches res under key when it is valid Mermaid.
+func (s *Service) cachePut(ctx context.Context, key string, res *DiagramResult, modelID string) {
+	if s.cache == nil || s.cacheTTL <= 0 || !res.Validation.Valid {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), usageWriteTimeout)
+	defer cancel()
+	e := cache.Entry{Diagram: res.Diagram, Validation: res.Validation, Model: modelID}
+	if err := s.cache.Put(ctx, key, e, s.cacheTTL); err != nil && s.log != nil {
+		s.log.Warn().Err(err).Msg("ai: cache write failed")
+	}
+}
+
+// recordCached records a generate call answered without calling the provider.
+func (s *Service) recordCached(ctx context.Context, userID uuid.UUID, workspaceID *uuid.UUID, modelID string) {
+	s.recordUsage(ctx, &model.Usage{
+		WorkspaceID: workspaceID,
+		UserID:      userID,
+		Operation:   model.OperationGenerate,
+		Model:       modelID,
+		Outcome:     model.OutcomeCached,
+	})
+}
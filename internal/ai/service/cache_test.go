@@ -0,0 +1,155 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/devenock/d_weaver/config"
+	"github.com/devenock/d_weaver/internal/ai/cache"
+	"github.com/devenock/d_weaver/internal/ai/client"
+	"github.com/devenock/d_weaver/internal/ai/model"
+	"github.com/google/uuid"
+)
+
+func TestGenerateDiagram_Cache(t *testing.T) {
+	repo := &fakeRepo{}
+	gen := &scriptedGenerator{replies: []string{"flowchart TD\n  A --> B", "flowchart TD\n  A --> C", "flowchart TD\n  A[x --> D"}}
+	s := New(gen, config.AIConfig{MaxAttempts: 1}, repo, everyoneMember{}, nil, nil)
+	s.SetCache(cache.NewMemoryStore(0), time.Hour)
+	ctx, userID := context.Background(), uuid.New()
+
+	first, err := s.GenerateDiagram(ctx, userID, GenerateInput{Description: "Checkout  flow", DiagramType: "flowchart"})
+	if err != nil || first.Cached {
+		t.Fatalf("first = %+v, %v", first, err)
+	}
+	again, err := s.GenerateDiagram(ctx, uuid.New(), GenerateInput{Description: "checkout flow ", DiagramType: "flowchart"})
+	if err != nil || !again.Cached || again.Diagram != first.Diagram || again.Attempts != 0 || again.ConversationID == first.ConversationID {
+		t.Fatalf("repeat = %+v, %v; want the cached diagram in a new conversation", again, err)
+	}
+	if len(gen.requests) != 1 {
+		t.Errorf("provider called %d times, want 1", len(gen.requests))
+	}
+	if u := repo.usage[1]; u.Outcome != model.OutcomeCached || u.InputTokens != 0 {
+		t.Errorf("cached usage = %+v", u)
+	}
+
+	var streamed []string
+	hit, err := s.StreamDiagram(ctx, userID, GenerateInput{Description: "checkout flow", DiagramType: "flowchart"}, func(text string) error {
+		streamed = append(streamed, text)
+		return nil
+	}, nil)
+	if err != nil || !hit.Cached || len(streamed) != 1 || streamed[0] != first.Diagram {
+		t.Errorf("streamed hit = %+v, deltas %q, %v", hit, streamed, err)
+	}
+
+	// Bypassing generates afresh and replaces the entry.
+	fresh, err := s.GenerateDiagram(ctx, userID, GenerateInput{Description: "checkout flow", DiagramType: "flowchart", BypassCache: true})
+	if err != nil || fresh.Cached || fresh.Diagram != "flowchart TD\n  A --> C" {
+		t.Fatalf("bypass = %+v, %v", fresh, err)
+	}
+	if res, _ := s.GenerateDiagram(ctx, userID, GenerateInput{Description: "checkout flow", DiagramType: "flowchart"}); res.Diagram != fresh.Diagram {
+		t.Errorf("after bypass got %q, want the fresh diagram", res.Diagram)
+	}
+
+	// Another workspace does not share the entry, and invalid output is not cached.
+	workspaceID := uuid.New()
+	invalid, err := s.GenerateDiagram(ctx, userID, GenerateInput{Description: "checkout flow", DiagramType: "flowchart", WorkspaceID: &workspaceID})
+	if err != nil || invalid.Cached || invalid.Validation.Valid {
+		t.Fatalf("workspace call = %+v, %v", invalid, err)
+	}
+	gen.replies = append(gen.replies, "flowchart TD\n  A --> E")
+	if res, _ := s.GenerateDiagram(ctx, userID, GenerateInput{Description: "checkout flow", DiagramType: "flowchart", WorkspaceID: &workspaceID}); res.Cached {
+		t.Error("invalid output was cached")
+	}
+}
+
+// gatedGenerator blocks every call until release is closed.
+type gatedGenerator struct {
+	scriptedGenerator
+	calls   atomic.Int32
+	release chan struct{}
+}
+
+func (g *gatedGenerator) Complete(ctx context.Context, req client.Request) (*client.Response, error) {
+	g.calls.Add(1)
+	<-g.release
+	return &client.Response{Content: "flowchart TD\n  A --> B", Model: "m"}, nil
+}
+
+// lockedRepo serializes the writes concurrent generate calls make.
+type lockedRepo struct {
+	mu sync.Mutex
+	*fakeRepo
+}
+
+func (r *lockedRepo) CreateUsage(ctx context.Context, u *model.Usage) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.fakeRepo.CreateUsage(ctx, u)
+}
+
+func (r *lockedRepo) ReserveUsage(ctx context.Context, u *model.Usage, limits model.UsageLimits) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.fakeRepo.ReserveUsage(ctx, u, limits)
+}
+
+func (r *lockedRepo) FinishUsage(ctx context.Context, u *model.Usage) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.fakeRepo.FinishUsage(ctx, u)
+}
+
+func (r *lockedRepo) CreateConversation(ctx context.Context, c *model.Conversation, messages []*model.Message) (*model.Conversation, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.fakeRepo.CreateConversation(ctx, c, messages)
+}
+
+func TestGenerateDiagram_CoalescesInFlight(t *testing.T) {
+	repo := &lockedRepo{fakeRepo: &fakeRepo{}}
+	gen := &gatedGenerator{release: make(chan struct{})}
+	s := New(gen, config.AIConfig{}, repo, nil, nil, nil)
+	// A caller that only gets going after the generation finished is answered from the cache.
+	s.SetCache(cache.NewMemoryStore(0), time.Hour)
+
+	const callers = 4
+	results := make(chan *DiagramResult, callers)
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := s.GenerateDiagram(context.Background(), uuid.New(), GenerateInput{Description: "login"})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			results <- res
+		}()
+	}
+	// Let the callers join the first one's generation before it finishes.
+	for deadline := time.Now().Add(time.Second); gen.calls.Load() == 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(gen.release)
+	wg.Wait()
+	close(results)
+
+	cached := 0
+	for res := range results {
+		if res.Cached {
+			cached++
+		}
+	}
+	if n := gen.calls.Load(); n != 1 || cached != callers-1 {
+		t.Errorf("provider calls = %d, cached results = %d; want 1 and %d", n, cached, callers-1)
+	}
+	if len(repo.conversations) != callers {
+		t.Errorf("conversations = %d, want one per caller", len(repo.conversations))
+	}
+}
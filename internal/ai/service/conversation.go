@@ -0,0 +1,194 @@
+package service
+
+import (
+	"context"
+	"strings"
+
+	"github.com/devenock/d_weaver/internal/ai/client"
+	"github.com/devenock/d_weaver/internal/ai/model"
+	"github.com/devenock/d_weaver/internal/common"
+	"github.com/google/uuid"
+)
+
+const (
+	// maxContextMessages bounds the history sent with a follow-up: the first exchange (the original
+	// description and its diagram) and the most recent messages, which include the latest diagram.
+	maxContextMessages = 20
+	// maxTitleRunes bounds a conversation title taken from its first description.
+	maxTitleRunes = 80
+)
+
+// ConversationUpdate changes a conversation: a non-nil Title renames it, a non-nil DiagramID links it
+// to that diagram and Unlink removes the link.
+type ConversationUpdate struct {
+	Title     *string
+	DiagramID *uuid.UUID
+	Unlink    bool
+}
+
+// conversationFor loads the conversation in.ConversationID continues, with its messages, and fills in
+// its workspace and diagram type. It returns nil for a new conversation.
+func (s *Service) conversationFor(ctx context.Context, userID uuid.UUID, in *GenerateInput) (*model.Conversation, []*model.Message, error) {
+	if in.ConversationID == nil {
+		return nil, nil, nil
+	}
+	conv, err := s.ownConversation(ctx, *in.ConversationID, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if in.WorkspaceID != nil && (conv.WorkspaceID == nil || *conv.WorkspaceID != *in.WorkspaceID) {
+		return nil, nil, common.NewDomainError(common.CodeInvalidInput, "The conversation belongs to another workspace.", nil)
+	}
+	in.WorkspaceID = conv.WorkspaceID
+	if in.DiagramType == "" {
+		in.DiagramType = conv.DiagramType
+	}
+	messages, err := s.repo.ListMessages(ctx, conv.ID)
+	if err != nil {
+		return nil, nil, common.NewDomainError(common.CodeInternalError, "Failed to load conversation.", err)
+	}
+	return conv, messages, nil
+}
+
+// contextTurns returns the history to send with a follow-up, dropping whole exchanges from the middle
+// of long conversations.
+func contextTurns(history []*model.Message) []client.Message {
+	if len(history) > maxContextMessages {
+		keep := append([]*model.Message{}, history[:2]...)
+		history = append(keep, history[len(history)-(maxContextMessages-2):]...)
+	}
+	turns := make([]client.Message, 0, len(history)+1)
+	for _, m := range history {
+		turns = append(turns, client.Message{Role: m.Role, Content: m.Content})
+	}
+	return turns
+}
+
+// saveTurn stores the description and the diagram returned for it, creating the conversation when conv
+// is nil, and returns the conversation id.
+func (s *Service) saveTurn(ctx context.Context, userID uuid.UUID, conv *model.Conversation, in GenerateInput, diagram string) (uuid.UUID, error) {
+	messages := []*model.Message{
+		{Role: model.RoleUser, Content: in.Description},
+		{Role: model.RoleAssistant, Content: diagram},
+	}
+	if conv != nil {
+		ok, err := s.repo.AppendMessages(ctx, conv.ID, messages)
+		if err != nil {
+			return uuid.Nil, common.NewDomainError(common.CodeInternalError, "Failed to save conversation.", err)
+		}
+		if !ok {
+			return uuid.Nil, common.NewDomainError(common.CodeNotFound, "Conversation not found.", nil)
+		}
+		return conv.ID, nil
+	}
+	created, err := s.repo.CreateConversation(ctx, &model.Conversation{
+		UserID:      userID,
+		WorkspaceID: in.WorkspaceID,
+		Title:       conversationTitle(in.Description),
+		DiagramType: in.DiagramType,
+	}, messages)
+	if err != nil {
+		return uuid.Nil, common.NewDomainError(common.CodeInternalError, "Failed to save conversation.", err)
+	}
+	return created.ID, nil
+}
+
+// conversationTitle is the first line of a description, shortened to maxTitleRunes.
+func conversationTitle(description string) string {
+	title := strings.TrimSpace(strings.SplitN(description, "\n", 2)[0])
+	if r := []rune(title); len(r) > maxTitleRunes {
+		title = strings.TrimSpace(string(r[:maxTitleRunes-1])) + "…"
+	}
+	return title
+}
+
+// ListConversations returns the user's conversations, most recent first; with diagramID only those
+// linked to that diagram.
+func (s *Service) ListConversations(ctx context.Context, userID uuid.UUID, diagramID *uuid.UUID) ([]model.ConversationResponse, error) {
+	list, err := s.repo.ListConversations(ctx, userID, diagramID)
+	if err != nil {
+		return nil, common.NewDomainError(common.CodeInternalError, "Failed to list conversations.", err)
+	}
+	out := make([]model.ConversationResponse, 0, len(list))
+	for _, c := range list {
+		out = append(out, model.FromConversation(c, nil))
+	}
+	return out, nil
+}
+
+// GetConversation returns one of the user's conversations with its messages, oldest first.
+func (s *Service) GetConversation(ctx context.Context, id, userID uuid.UUID) (*model.ConversationResponse, error) {
+	conv, err := s.ownConversation(ctx, id, userID)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := s.repo.ListMessages(ctx, id)
+	if err != nil {
+		return nil, common.NewDomainError(common.CodeInternalError, "Failed to load conversation.", err)
+	}
+	resp := model.FromConversation(conv, messages)
+	if resp.Messages == nil {
+		resp.Messages = []model.MessageResponse{}
+	}
+	return &resp, nil
+}
+
+// UpdateConversation renames one of the user's conversations or links it to a diagram the user can view.
+func (s *Service) UpdateConversation(ctx context.Context, id, userID uuid.UUID, in ConversationUpdate) (*model.ConversationResponse, error) {
+	conv, err := s.ownConversation(ctx, id, userID)
+	if err != nil {
+		return nil, err
+	}
+	title, diagramID := conv.Title, conv.DiagramID
+	if in.Title != nil {
+		if title = strings.TrimSpace(*in.Title); title == "" {
+			return nil, common.NewDomainError(common.CodeInvalidInput, "Title cannot be empty.", nil)
+		}
+	}
+	switch {
+	case in.Unlink:
+		diagramID = nil
+	case in.DiagramID != nil:
+		if _, err := s.diagrams.GetDiagram(ctx, *in.DiagramID, userID); err != nil {
+			return nil, err
+		}
+		diagramID = in.DiagramID
+	}
+	updated, err := s.repo.UpdateConversation(ctx, id, title, diagramID)
+	if err != nil {
+		return nil, common.NewDomainError(common.CodeInternalError, "Failed to update conversation.", err)
+	}
+	if updated == nil {
+		return nil, common.NewDomainError(common.CodeNotFound, "Conversation not found.", nil)
+	}
+	resp := model.FromConversation(updated, nil)
+	return &resp, nil
+}
+
+// DeleteConversation deletes one of the user's conversations and its messages.
+func (s *Service) DeleteConversation(ctx context.Context, id, userID uuid.UUID) error {
+	if _, err := s.ownConversation(ctx, id, userID); err != nil {
+		return err
+	}
+	ok, err := s.repo.DeleteConversation(ctx, id)
+	if err != nil {
+		return common.NewDomainError(common.CodeInternalError, "Failed to delete conversation.", err)
+	}
+	if !ok {
+		return common.NewDomainError(common.CodeNotFound, "Conversation not found.", nil)
+	}
+	return nil
+}
+
+// ownConversation returns the conversation if it belongs to userID. Other users' conversations are
+// reported as not found.
+func (s *Service) ownConversation(ctx context.Context, id, userID uuid.UUID) (*model.Conversation, error) {
+	conv, err := s.repo.GetConversation(ctx, id)
+	if err != nil {
+		return nil, common.NewDomainError(common.CodeInternalError, "Failed to load conversation.", err)
+	}
+	if conv == nil || conv.UserID != userID {
+		return nil, common.NewDomainError(common.CodeNotFound, "Conversation not found.", nil)
+	}
+	return conv, nil
+}
@@ -0,0 +1,132 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/devenock/d_weaver/config"
+	"github.com/devenock/d_weaver/internal/ai/model"
+	"github.com/devenock/d_weaver/internal/common"
+	diagrammodel "github.com/devenock/d_weaver/internal/diagram/model"
+	"github.com/google/uuid"
+)
+
+func TestGenerateDiagram_Conversation(t *testing.T) {
+	repo := &fakeRepo{}
+	gen := &scriptedGenerator{replies: []string{"flowchart TD\n  A --> B", "flowchart LR\n  A --> B"}}
+	s := New(gen, config.AIConfig{}, repo, everyoneMember{}, nil, nil)
+	userID, workspaceID := uuid.New(), uuid.New()
+
+	first, err := s.GenerateDiagram(context.Background(), userID, GenerateInput{Description: "checkout flow", DiagramType: "flowchart", WorkspaceID: &workspaceID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.ConversationID == uuid.Nil || len(repo.conversations) != 1 || repo.conversations[0].Title != "checkout flow" {
+		t.Fatalf("conversation not created: %+v", repo.conversations)
+	}
+
+	second, err := s.GenerateDiagram(context.Background(), userID, GenerateInput{Description: "make it left-to-right", ConversationID: &first.ConversationID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.ConversationID != first.ConversationID {
+		t.Errorf("follow-up conversation = %s, want %s", second.ConversationID, first.ConversationID)
+	}
+	sent := gen.requests[1].Messages[2:] // after the flowchart example exchange
+	if len(sent) != 3 || !strings.Contains(sent[0].Content, "Create a flowchart diagram for: checkout flow") ||
+		sent[1].Role != model.RoleAssistant || sent[1].Content != "flowchart TD\n  A --> B" ||
+		!strings.Contains(sent[2].Content, "make it left-to-right") {
+		t.Errorf("follow-up context = %+v", sent)
+	}
+	if len(repo.messages) != 4 || repo.messages[2].Content != "make it left-to-right" || repo.messages[3].Content != "flowchart LR\n  A --> B" {
+		t.Errorf("stored messages = %d", len(repo.messages))
+	}
+	// Follow-ups stay in the conversation's workspace.
+	if u := repo.usage[1]; u.WorkspaceID == nil || *u.WorkspaceID != workspaceID {
+		t.Errorf("follow-up billed to %v, want the conversation's workspace", u.WorkspaceID)
+	}
+
+	var de *common.DomainError
+	_, err = s.GenerateDiagram(context.Background(), uuid.New(), GenerateInput{Description: "again", ConversationID: &first.ConversationID})
+	if !errors.As(err, &de) || de.Code != common.CodeNotFound {
+		t.Errorf("other user's follow-up err = %v, want not found", err)
+	}
+	other := uuid.New()
+	_, err = s.GenerateDiagram(context.Background(), userID, GenerateInput{Description: "again", WorkspaceID: &other, ConversationID: &first.ConversationID})
+	if !errors.As(err, &de) || de.Code != common.CodeInvalidInput {
+		t.Errorf("other workspace err = %v, want invalid input", err)
+	}
+}
+
+func TestContextTurns(t *testing.T) {
+	var history []*model.Message
+	for i := 0; i < 30; i++ {
+		role := model.RoleUser
+		if i%2 == 1 {
+			role = model.RoleAssistant
+		}
+		history = append(history, &model.Message{Role: role, Content: fmt.Sprint(i)})
+	}
+	turns := contextTurns(history)
+	if len(turns) != maxContextMessages || turns[0].Content != "0" || turns[1].Content != "1" || turns[2].Content != "12" || turns[len(turns)-1].Content != "29" {
+		t.Fatalf("turns = %+v", turns)
+	}
+	for i, m := range turns {
+		if (i%2 == 0) != (m.Role == model.RoleUser) {
+			t.Errorf("turn %d role %s breaks user/assistant alternation", i, m.Role)
+		}
+	}
+}
+
+func TestConversations_Manage(t *testing.T) {
+	repo := &fakeRepo{}
+	diagrams := &fakeDiagrams{diagram: diagrammodel.DiagramResponse{ID: uuid.New()}}
+	gen := &scriptedGenerator{replies: []string{"flowchart TD\n  A --> B", "flowchart TD\n  C --> D"}}
+	s := New(gen, config.AIConfig{}, repo, nil, diagrams, nil)
+	userID := uuid.New()
+	ctx := context.Background()
+
+	a, _ := s.GenerateDiagram(ctx, userID, GenerateInput{Description: strings.Repeat("long title ", 20)})
+	b, _ := s.GenerateDiagram(ctx, userID, GenerateInput{Description: "second"})
+	if title := repo.conversations[0].Title; len([]rune(title)) != maxTitleRunes || !strings.HasSuffix(title, "…") {
+		t.Errorf("title = %q, want shortened to %d runes", title, maxTitleRunes)
+	}
+
+	linked, err := s.UpdateConversation(ctx, a.ConversationID, userID, ConversationUpdate{DiagramID: &diagrams.diagram.ID})
+	if err != nil || linked.DiagramID == nil || *linked.DiagramID != diagrams.diagram.ID {
+		t.Fatalf("link = %+v, %v", linked, err)
+	}
+	missing := uuid.New()
+	if _, err := s.UpdateConversation(ctx, a.ConversationID, userID, ConversationUpdate{DiagramID: &missing}); err == nil {
+		t.Error("linked a diagram the user cannot view")
+	}
+	list, _ := s.ListConversations(ctx, userID, &diagrams.diagram.ID)
+	if len(list) != 1 || list[0].ID != a.ConversationID {
+		t.Errorf("by diagram = %+v", list)
+	}
+
+	got, err := s.GetConversation(ctx, a.ConversationID, userID)
+	if err != nil || len(got.Messages) != 2 || got.Messages[1].Role != model.RoleAssistant {
+		t.Errorf("get = %+v, %v", got, err)
+	}
+	if _, err := s.GetConversation(ctx, a.ConversationID, uuid.New()); err == nil {
+		t.Error("another user read the conversation")
+	}
+
+	title := "Checkout"
+	if resp, err := s.UpdateConversation(ctx, a.ConversationID, userID, ConversationUpdate{Title: &title, Unlink: true}); err != nil || resp.Title != title || resp.DiagramID != nil {
+		t.Errorf("rename and unlink = %+v, %v", resp, err)
+	}
+	if err := s.DeleteConversation(ctx, b.ConversationID, uuid.New()); err == nil {
+		t.Error("another user deleted the conversation")
+	}
+	if err := s.DeleteConversation(ctx, b.ConversationID, userID); err != nil {
+		t.Fatal(err)
+	}
+	if list, _ := s.ListConversations(ctx, userID, nil); len(list) != 1 {
+		t.Errorf("after delete = %+v", list)
+	}
+}
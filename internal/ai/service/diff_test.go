@@ -0,0 +1,34 @@
+package service
+
+import "testing"
+
+func TestUnifiedDiff(t *testing.T) {
+	from := "flowchart LR\n  API --> DB\n  API --> Auth\n  Auth --> DB\n  a\n  b\n  c\n  d\n  e\n  f\n  g\n  h --> i"
+	to := "flowchart LR\n  API --> Cache\n  Cache --> DB\n  API --> Auth\n  Auth --> DB\n  a\n  b\n  c\n  d\n  e\n  f\n  g\n  h --> j"
+	want := `--- current
++++ proposed
+@@ -1,5 +1,6 @@
+ flowchart LR
+-  API --> DB
++  API --> Cache
++  Cache --> DB
+   API --> Auth
+   Auth --> DB
+   a
+@@ -9,4 +10,4 @@
+   e
+   f
+   g
+-  h --> i
++  h --> j
+`
+	if got := unifiedDiff(from, to, "current", "proposed"); got != want {
+		t.Errorf("diff =\n%s\nwant\n%s", got, want)
+	}
+	if got := unifiedDiff(from, from, "current", "proposed"); got != "" {
+		t.Errorf("diff of equal texts = %q", got)
+	}
+	if got := unifiedDiff("", "graph TD", "current", "proposed"); got != "--- current\n+++ proposed\n@@ -0,0 +1 @@\n+graph TD\n" {
+		t.Errorf("diff from empty = %q", got)
+	}
+}
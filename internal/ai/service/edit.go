@@ -0,0 +1,96 @@
+package service
+
+import (
+	"context"
+	"strings"
+
+	"github.com/devenock/d_weaver/internal/ai/client"
+	"github.com/devenock/d_weaver/internal/ai/mermaid"
+	"github.com/devenock/d_weaver/internal/ai/model"
+	"github.com/devenock/d_weaver/internal/common"
+	diagrammodel "github.com/devenock/d_weaver/internal/diagram/model"
+	"github.com/google/uuid"
+)
+
+// EditResult is a proposed change to a diagram. Applied is true when it was saved as a new revision;
+// Diagram is then the saved diagram.
+type EditResult struct {
+	Proposed   string
+	Diff       string // unified diff from the current content to Proposed; empty when unchanged
+	Validation mermaid.Result
+	Attempts   int
+	Applied    bool
+	Diagram    *diagrammodel.DiagramResponse
+}
+
+// EditDiagram asks the model to change a Mermaid diagram as instruction says and returns the proposed
+// content with a diff. Any user who can view the diagram may ask for a proposal. With apply the user
+// needs edit permission and a valid, changed proposal replaces the diagram content as a new revision,
+// unless the content was saved since it was read (Conflict); open collaboration rooms then merge it.
+func (s *Service) EditDiagram(ctx context.Context, diagramID, userID uuid.UUID, instruction string, apply bool) (*EditResult, error) {
+	instruction = strings.TrimSpace(instruction)
+	if instruction == "" {
+		return nil, common.NewDomainError(common.CodeInvalidInput, "Instruction is required.", nil)
+	}
+	d, err := s.diagrams.GetDiagram(ctx, diagramID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if diagrammodel.IsCanvasType(d.DiagramType) {
+		return nil, common.NewDomainError(common.CodeInvalidInput, "AI edits support Mermaid diagrams only.", nil)
+	}
+	if apply {
+		perm, err := s.diagrams.ResolveDiagramPermission(ctx, diagramID, userID)
+		if err != nil {
+			return nil, err
+		}
+		if !perm.CanEdit() {
+			return nil, common.NewDomainError(common.CodeForbidden, "You do not have permission to edit this diagram.", nil)
+		}
+	}
+	gen, workspaceID, err := s.generatorForDiagram(ctx, userID, &d)
+	if err != nil {
+		return nil, err
+	}
+	// The diagram's workspace conventions apply to everyone editing it.
+	style, err := s.styleFor(ctx, d.WorkspaceID)
+	if err != nil {
+		return nil, err
+	}
+	req, err := s.prompts.Edit(d.Content, d.DiagramType, instruction, style)
+	if err != nil {
+		return nil, promptError(err)
+	}
+	var res *DiagramResult
+	err = s.metered(ctx, model.OperationEdit, userID, workspaceID, gen, func(gen client.Generator) (bool, error) {
+		var err error
+		res, err = s.runDiagram(ctx, gen, req, nil, nil)
+		return err == nil && res.Validation.Valid, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	out := &EditResult{
+		Proposed:   res.Diagram,
+		Diff:       unifiedDiff(d.Content, res.Diagram, "current", "proposed"),
+		Validation: res.Validation,
+		Attempts:   res.Attempts,
+	}
+	// Invalid output is only proposed, never saved.
+	if !apply || !res.Validation.Valid || out.Diff == "" {
+		return out, nil
+	}
+	if err := s.diagrams.SaveDiagramRevision(ctx, diagramID, userID, d.Content, res.Diagram, diagrammodel.RevisionSourceAIEdit); err != nil {
+		return nil, err
+	}
+	// Open rooms merge the edit into their live content, so their editors see it and autosave keeps it.
+	if s.live != nil {
+		s.live.ContentReplaced(diagramID, userID, d.Content, res.Diagram)
+	}
+	saved, err := s.diagrams.GetDiagram(ctx, diagramID, userID)
+	if err != nil {
+		return nil, err
+	}
+	out.Applied, out.Diagram = true, &saved
+	return out, nil
+}
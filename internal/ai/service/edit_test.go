@@ -0,0 +1,165 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/devenock/d_weaver/config"
+	"github.com/devenock/d_weaver/internal/common"
+	diagrammodel "github.com/devenock/d_weaver/internal/diagram/model"
+	"github.com/google/uuid"
+)
+
+// fakeDiagrams serves one diagram and its comments with a fixed permission and records saved
+// revisions and created diagrams. savedSince, if set, is content someone else saved after the read.
+type fakeDiagrams struct {
+	diagram    diagrammodel.DiagramResponse
+	comments   []diagrammodel.CommentResponse
+	perm       diagrammodel.Permission
+	saved      []string
+	sources    []string
+	created    []diagrammodel.DiagramResponse
+	savedSince string
+}
+
+// openRoom records the content replacements announced to a collaboration room.
+type openRoom struct {
+	replaced []string
+}
+
+func (r *openRoom) ContentReplaced(diagramID, userID uuid.UUID, base, content string) {
+	r.replaced = append(r.replaced, base+" => "+content)
+}
+
+func (f *fakeDiagrams) CreateDiagram(ctx context.Context, userID uuid.UUID, workspaceID *uuid.UUID, title, content, diagramType string, isPublic bool) (diagrammodel.DiagramResponse, error) {
+	d := diagrammodel.DiagramResponse{ID: uuid.New(), Title: title, Content: content, DiagramType: diagramType, WorkspaceID: workspaceID}
+	f.created = append(f.created, d)
+	return d, nil
+}
+
+func (f *fakeDiagrams) GetDiagram(ctx context.Context, id, userID uuid.UUID) (diagrammodel.DiagramResponse, error) {
+	if id != f.diagram.ID {
+		return diagrammodel.DiagramResponse{}, common.NewDomainError(common.CodeNotFound, "Diagram not found.", nil)
+	}
+	return f.diagram, nil
+}
+
+func (f *fakeDiagrams) ResolveDiagramPermission(ctx context.Context, diagramID, userID uuid.UUID) (diagrammodel.Permission, error) {
+	return f.perm, nil
+}
+
+func (f *fakeDiagrams) SaveDiagramRevision(ctx context.Context, id, userID uuid.UUID, base, content, source string) error {
+	if base != f.diagram.Content || f.savedSince != "" {
+		return common.NewDomainError(common.CodeConflict, "changed", nil)
+	}
+	f.saved = append(f.saved, content)
+	f.sources = append(f.sources, source)
+	f.diagram.Content = content
+	return nil
+}
+
+func (f *fakeDiagrams) ListComments(ctx context.Context, diagramID, userID uuid.UUID) ([]diagrammodel.CommentResponse, error) {
+	return f.comments, nil
+}
+
+func TestEditDiagram(t *testing.T) {
+	current := "flowchart LR\n  API --> DB"
+	proposed := "flowchart LR\n  API --> Cache\n  Cache --> DB"
+	newDiagrams := func(perm diagrammodel.Permission) *fakeDiagrams {
+		return &fakeDiagrams{diagram: diagrammodel.DiagramResponse{ID: uuid.New(), Content: current, DiagramType: "flowchart"}, perm: perm}
+	}
+
+	t.Run("proposes without saving", func(t *testing.T) {
+		diagrams := newDiagrams(diagrammodel.PermissionView)
+		gen := &scriptedGenerator{replies: []string{proposed}}
+		s := New(gen, config.AIConfig{}, &fakeRepo{}, nil, diagrams, nil)
+		res, err := s.EditDiagram(context.Background(), diagrams.diagram.ID, uuid.New(), "add a cache between API and DB", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Proposed != proposed || res.Applied || len(diagrams.saved) != 0 {
+			t.Errorf("result = %+v, saved = %v; want an unsaved proposal", res, diagrams.saved)
+		}
+		if !strings.Contains(res.Diff, "-  API --> DB\n+  API --> Cache\n+  Cache --> DB\n") {
+			t.Errorf("diff = %q", res.Diff)
+		}
+		if msg := gen.requests[0].Messages[0].Content; !strings.Contains(msg, current) || !strings.Contains(msg, "add a cache") {
+			t.Errorf("request = %q, want the current content and the instruction", msg)
+		}
+	})
+
+	t.Run("applies with edit permission", func(t *testing.T) {
+		diagrams := newDiagrams(diagrammodel.PermissionEdit)
+		s := New(&scriptedGenerator{replies: []string{proposed}}, config.AIConfig{}, &fakeRepo{}, nil, diagrams, nil)
+		res, err := s.EditDiagram(context.Background(), diagrams.diagram.ID, uuid.New(), "add a cache", true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !res.Applied || res.Diagram == nil || res.Diagram.Content != proposed || len(diagrams.saved) != 1 || diagrams.sources[0] != diagrammodel.RevisionSourceAIEdit {
+			t.Errorf("result = %+v, saved = %v from %v; want the proposal saved as an AI edit revision", res, diagrams.saved, diagrams.sources)
+		}
+	})
+
+	t.Run("applies through the open room", func(t *testing.T) {
+		diagrams := newDiagrams(diagrammodel.PermissionEdit)
+		room := &openRoom{}
+		s := New(&scriptedGenerator{replies: []string{proposed}}, config.AIConfig{}, &fakeRepo{}, nil, diagrams, nil)
+		s.SetLiveDocuments(room)
+		res, err := s.EditDiagram(context.Background(), diagrams.diagram.ID, uuid.New(), "add a cache", true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !res.Applied || len(room.replaced) != 1 || room.replaced[0] != current+" => "+proposed || len(diagrams.saved) != 1 {
+			t.Errorf("result = %+v, room = %q, saved = %v; want the diagram saved and the room told", res, room.replaced, diagrams.saved)
+		}
+	})
+
+	t.Run("diagram saved since the read is not overwritten", func(t *testing.T) {
+		diagrams := newDiagrams(diagrammodel.PermissionEdit)
+		room := &openRoom{}
+		diagrams.savedSince = current + "\n  DB --> Replica"
+		s := New(&scriptedGenerator{replies: []string{proposed}}, config.AIConfig{}, &fakeRepo{}, nil, diagrams, nil)
+		s.SetLiveDocuments(room)
+		_, err := s.EditDiagram(context.Background(), diagrams.diagram.ID, uuid.New(), "add a cache", true)
+		var de *common.DomainError
+		if !errors.As(err, &de) || de.Code != common.CodeConflict || len(diagrams.saved) != 0 || len(room.replaced) != 0 {
+			t.Errorf("err = %v, saved = %v, room = %q; want conflict and nothing saved or announced", err, diagrams.saved, room.replaced)
+		}
+	})
+
+	t.Run("apply needs edit permission", func(t *testing.T) {
+		diagrams := newDiagrams(diagrammodel.PermissionComment)
+		gen := &scriptedGenerator{replies: []string{proposed}}
+		s := New(gen, config.AIConfig{}, &fakeRepo{}, nil, diagrams, nil)
+		_, err := s.EditDiagram(context.Background(), diagrams.diagram.ID, uuid.New(), "add a cache", true)
+		var de *common.DomainError
+		if !errors.As(err, &de) || de.Code != common.CodeForbidden || len(gen.requests) != 0 {
+			t.Errorf("err = %v, requests = %d; want forbidden before calling the model", err, len(gen.requests))
+		}
+	})
+
+	t.Run("invalid proposal is not applied", func(t *testing.T) {
+		diagrams := newDiagrams(diagrammodel.PermissionEdit)
+		s := New(&scriptedGenerator{replies: []string{"flowchart LR\n  API[x --> DB"}}, config.AIConfig{MaxAttempts: 1}, &fakeRepo{}, nil, diagrams, nil)
+		res, err := s.EditDiagram(context.Background(), diagrams.diagram.ID, uuid.New(), "break it", true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Applied || res.Validation.Valid || len(diagrams.saved) != 0 {
+			t.Errorf("result = %+v, saved = %v; want an invalid, unsaved proposal", res, diagrams.saved)
+		}
+	})
+
+	t.Run("canvas diagrams are rejected", func(t *testing.T) {
+		diagrams := newDiagrams(diagrammodel.PermissionEdit)
+		diagrams.diagram.DiagramType = "whiteboard"
+		s := New(&scriptedGenerator{}, config.AIConfig{}, &fakeRepo{}, nil, diagrams, nil)
+		_, err := s.EditDiagram(context.Background(), diagrams.diagram.ID, uuid.New(), "add a cache", false)
+		var de *common.DomainError
+		if !errors.As(err, &de) || de.Code != common.CodeInvalidInput {
+			t.Errorf("err = %v, want invalid_input", err)
+		}
+	})
+}
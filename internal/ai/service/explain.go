@@ -0,0 +1,250 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/devenock/d_weaver/internal/ai/client"
+	"github.com/devenock/d_weaver/internal/ai/model"
+	"github.com/devenock/d_weaver/internal/common"
+	diagrammodel "github.com/devenock/d_weaver/internal/diagram/model"
+	"github.com/google/uuid"
+)
+
+const (
+	// maxThreadChars bounds the comment thread sent for summarizing; the oldest comments are dropped first.
+	maxThreadChars = 48_000
+	// maxCanvasObjects bounds the whiteboard outline sent for explaining.
+	maxCanvasObjects = 400
+)
+
+// ExplainDiagram returns a walkthrough (components, flows, risks) of a diagram the user can view.
+// Whiteboards are sent as an outline of their objects and text.
+func (s *Service) ExplainDiagram(ctx context.Context, diagramID, userID uuid.UUID) (*model.Explanation, error) {
+	d, err := s.diagrams.GetDiagram(ctx, diagramID, userID)
+	if err != nil {
+		return nil, err
+	}
+	content := strings.TrimSpace(d.Content)
+	if diagrammodel.IsCanvasType(d.DiagramType) {
+		if content, err = describeCanvas(content); err != nil {
+			return nil, common.NewDomainError(common.CodeInvalidInput, "The whiteboard content could not be read.", err)
+		}
+	}
+	if content == "" {
+		return nil, common.NewDomainError(common.CodeInvalidInput, "The diagram is empty.", nil)
+	}
+	gen, workspaceID, err := s.generatorForDiagram(ctx, userID, &d)
+	if err != nil {
+		return nil, err
+	}
+	req, err := s.prompts.Explain(content, d.DiagramType)
+	if err != nil {
+		return nil, promptError(err)
+	}
+	var out model.Explanation
+	err = s.metered(ctx, model.OperationExplain, userID, workspaceID, gen, func(gen client.Generator) (bool, error) {
+		return true, s.completeJSON(ctx, gen, req, &out)
+	})
+	if err != nil {
+		return nil, err
+	}
+	out.DiagramID, out.DiagramType = d.ID, d.DiagramType
+	if out.Components == nil {
+		out.Components = []model.Component{}
+	}
+	if out.Flows == nil {
+		out.Flows = []model.Flow{}
+	}
+	if out.Risks == nil {
+		out.Risks = []model.Risk{}
+	}
+	return &out, nil
+}
+
+// SummarizeComments condenses the comment thread of a diagram the user can view into decisions and
+// open questions. A diagram without comments gets an empty summary without calling the model.
+func (s *Service) SummarizeComments(ctx context.Context, diagramID, userID uuid.UUID) (*model.CommentSummary, error) {
+	d, err := s.diagrams.GetDiagram(ctx, diagramID, userID)
+	if err != nil {
+		return nil, err
+	}
+	comments, err := s.diagrams.ListComments(ctx, diagramID, userID)
+	if err != nil {
+		return nil, err
+	}
+	out := model.CommentSummary{DiagramID: d.ID, CommentCount: len(comments), Decisions: []string{}, OpenQuestions: []string{}}
+	if len(comments) == 0 {
+		return &out, nil
+	}
+	gen, workspaceID, err := s.generatorForDiagram(ctx, userID, &d)
+	if err != nil {
+		return nil, err
+	}
+	thread, omitted := formatThread(comments, maxThreadChars)
+	req, err := s.prompts.SummarizeComments(d.Title, thread)
+	if err != nil {
+		return nil, promptError(err)
+	}
+	err = s.metered(ctx, model.OperationSummarizeComments, userID, workspaceID, gen, func(gen client.Generator) (bool, error) {
+		return true, s.completeJSON(ctx, gen, req, &out)
+	})
+	if err != nil {
+		return nil, err
+	}
+	out.DiagramID, out.CommentCount, out.OmittedComments = d.ID, len(comments), omitted
+	if out.Decisions == nil {
+		out.Decisions = []string{}
+	}
+	if out.OpenQuestions == nil {
+		out.OpenQuestions = []string{}
+	}
+	return &out, nil
+}
+
+// completeJSON sends req and decodes the JSON object in the reply into out. A reply that is not valid
+// JSON is sent back with the decode error until one decodes or the attempts run out.
+func (s *Service) completeJSON(ctx context.Context, gen client.Generator, req client.Request, out interface{}) error {
+	maxAttempts := s.maxAttempts()
+	for n := 1; ; n++ {
+		start := time.Now()
+		resp, err := gen.Complete(ctx, req)
+		if err != nil {
+			s.logAttempt(n, maxAttempts, nil, nil, time.Since(start), err)
+			return generationError(err)
+		}
+		err = json.Unmarshal([]byte(jsonObject(resp.Content)), out)
+		s.logJSONAttempt(n, maxAttempts, resp, time.Since(start), err)
+		if err == nil {
+			return nil
+		}
+		if n == maxAttempts {
+			return common.NewDomainError(common.CodeInternalError, "The AI reply could not be read.", err)
+		}
+		req.Messages = append(req.Messages,
+			client.Message{Role: "assistant", Content: resp.Content},
+			client.Message{Role: "user", Content: fmt.Sprintf("That is not valid JSON (%v). Reply with only the JSON object.", err)})
+	}
+}
+
+// jsonObject returns the outermost {...} of a reply, dropping code fences and surrounding prose.
+func jsonObject(content string) string {
+	start, end := strings.Index(content, "{"), strings.LastIndex(content, "}")
+	if start < 0 || end < start {
+		return strings.TrimSpace(content)
+	}
+	return content[start : end+1]
+}
+
+// logJSONAttempt records one structured-reply attempt; decodeErr is set when the reply was not valid JSON.
+func (s *Service) logJSONAttempt(n, maxAttempts int, resp *client.Response, took time.Duration, decodeErr error) {
+	if s.log == nil {
+		return
+	}
+	ev := s.log.Info().
+		Int("attempt", n).
+		Int("max_attempts", maxAttempts).
+		Str("model", resp.Model).
+		Int("input_tokens", resp.InputTokens).
+		Int("output_tokens", resp.OutputTokens).
+		Dur("took", took).
+		Bool("valid", decodeErr == nil)
+	if decodeErr != nil {
+		ev = ev.Str("first_error", decodeErr.Error())
+	}
+	ev.Msg("ai: json attempt")
+}
+
+// formatThread renders comments oldest first, one per paragraph. When the thread is longer than
+// maxChars the oldest comments are left out; it returns how many.
+func formatThread(comments []diagrammodel.CommentResponse, maxChars int) (string, int) {
+	entries := make([]string, len(comments))
+	for i, c := range comments {
+		entries[i] = fmt.Sprintf("[#%d %s, user %s]\n%s", i+1, c.CreatedAt.UTC().Format("2006-01-02 15:04"), c.UserID.String()[:8], strings.TrimSpace(c.CommentText))
+	}
+	first, size := len(entries), 0
+	for first > 0 && size+len(entries[first-1]) <= maxChars {
+		first--
+		size += len(entries[first]) + 2
+	}
+	if first == len(entries) {
+		// A single comment over the limit is cut rather than dropped.
+		first = len(entries) - 1
+		entries[first] = strings.ToValidUTF8(entries[first][:maxChars], "")
+	}
+	thread := strings.Join(entries[first:], "\n\n")
+	if first > 0 {
+		thread = fmt.Sprintf("(%d earlier comments omitted)\n\n%s", first, thread)
+	}
+	return thread, first
+}
+
+// describeCanvas outlines Fabric canvas JSON as one line per object: type, text, position and size.
+// Group members are indented under their group.
+func describeCanvas(content string) (string, error) {
+	if content == "" {
+		return "", nil
+	}
+	var canvas struct {
+		Objects []canvasObject `json:"objects"`
+	}
+	if err := json.Unmarshal([]byte(content), &canvas); err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	count := 0
+	var walk func(objs []canvasObject, depth int)
+	walk = func(objs []canvasObject, depth int) {
+		for _, o := range objs {
+			if count == maxCanvasObjects {
+				return
+			}
+			count++
+			b.WriteString(strings.Repeat("  ", depth))
+			b.WriteString("- ")
+			b.WriteString(o.describe())
+			b.WriteByte('\n')
+			walk(o.Objects, depth+1)
+		}
+	}
+	walk(canvas.Objects, 0)
+	if count == maxCanvasObjects {
+		b.WriteString("(more objects omitted)\n")
+	}
+	return strings.TrimSuffix(b.String(), "\n"), nil
+}
+
+// canvasObject is the part of a Fabric object that describeCanvas reads.
+type canvasObject struct {
+	Type    string         `json:"type"`
+	Text    string         `json:"text"`
+	Left    float64        `json:"left"`
+	Top     float64        `json:"top"`
+	Width   float64        `json:"width"`
+	Height  float64        `json:"height"`
+	ScaleX  *float64       `json:"scaleX"`
+	ScaleY  *float64       `json:"scaleY"`
+	Objects []canvasObject `json:"objects"`
+}
+
+func (o canvasObject) describe() string {
+	typ := o.Type
+	if typ == "" {
+		typ = "object"
+	}
+	w, h := o.Width, o.Height
+	if o.ScaleX != nil {
+		w *= *o.ScaleX
+	}
+	if o.ScaleY != nil {
+		h *= *o.ScaleY
+	}
+	desc := fmt.Sprintf("%s at (%.0f, %.0f) size %.0fx%.0f", typ, o.Left, o.Top, w, h)
+	if text := strings.TrimSpace(o.Text); text != "" {
+		desc = fmt.Sprintf("%s %q", desc, text)
+	}
+	return desc
+}
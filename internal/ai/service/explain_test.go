@@ -0,0 +1,86 @@
+package service
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/devenock/d_weaver/config"
+	diagrammodel "github.com/devenock/d_weaver/internal/diagram/model"
+	"github.com/google/uuid"
+)
+
+func TestExplainDiagram(t *testing.T) {
+	t.Run("mermaid, repairing a reply that is not json", func(t *testing.T) {
+		diagrams := &fakeDiagrams{diagram: diagrammodel.DiagramResponse{ID: uuid.New(), Content: "flowchart LR\n  API --> DB", DiagramType: "flowchart"}}
+		gen := &scriptedGenerator{replies: []string{
+			"The API talks to the DB.",
+			"```json\n" + `{"summary":"An API backed by a database.","components":[{"name":"API","description":"Serves requests"},{"name":"DB","description":"Stores data"}],"flows":[{"name":"Read","steps":["API queries DB"]}],"risks":[{"title":"Single database","detail":"No replica","severity":"high"}]}` + "\n```",
+		}}
+		s := New(gen, config.AIConfig{}, &fakeRepo{}, nil, diagrams, nil)
+		res, err := s.ExplainDiagram(context.Background(), diagrams.diagram.ID, uuid.New())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.DiagramID != diagrams.diagram.ID || len(res.Components) != 2 || len(res.Flows) != 1 || res.Risks[0].Severity != "high" {
+			t.Errorf("explanation = %+v", res)
+		}
+		if len(gen.requests) != 2 || !strings.Contains(gen.requests[1].Messages[2].Content, "not valid JSON") {
+			t.Errorf("requests = %+v, want the unreadable reply sent back", gen.requests)
+		}
+	})
+
+	t.Run("whiteboard is sent as an outline", func(t *testing.T) {
+		canvas := `{"version":"5.3.0","objects":[{"type":"rect","left":10,"top":20,"width":100,"height":50,"scaleX":2},{"type":"group","left":0,"top":0,"width":10,"height":10,"objects":[{"type":"textbox","text":"Load balancer","left":1,"top":2,"width":3,"height":4}]}]}`
+		diagrams := &fakeDiagrams{diagram: diagrammodel.DiagramResponse{ID: uuid.New(), Content: canvas, DiagramType: "whiteboard"}}
+		gen := &scriptedGenerator{replies: []string{`{"summary":"A load balancer."}`}}
+		s := New(gen, config.AIConfig{}, &fakeRepo{}, nil, diagrams, nil)
+		if _, err := s.ExplainDiagram(context.Background(), diagrams.diagram.ID, uuid.New()); err != nil {
+			t.Fatal(err)
+		}
+		want := "- rect at (10, 20) size 200x50\n- group at (0, 0) size 10x10\n  - textbox at (1, 2) size 3x4 \"Load balancer\""
+		if msg := gen.requests[0].Messages[0].Content; !strings.HasSuffix(msg, want) {
+			t.Errorf("request = %q, want the canvas outline\n%s", msg, want)
+		}
+	})
+}
+
+func TestSummarizeComments(t *testing.T) {
+	at := time.Date(2026, 3, 1, 9, 30, 0, 0, time.UTC)
+	diagrams := &fakeDiagrams{
+		diagram: diagrammodel.DiagramResponse{ID: uuid.New(), Title: "Checkout", DiagramType: "flowchart"},
+		comments: []diagrammodel.CommentResponse{
+			{UserID: uuid.New(), CommentText: "Should the cache sit before the API?", CreatedAt: at},
+			{UserID: uuid.New(), CommentText: "Agreed: put Redis in front of the DB.", CreatedAt: at.Add(time.Hour)},
+		},
+	}
+	gen := &scriptedGenerator{replies: []string{`{"summary":"Caching.","decisions":["Redis in front of the DB"],"open_questions":[]}`}}
+	s := New(gen, config.AIConfig{}, &fakeRepo{}, nil, diagrams, nil)
+	res, err := s.SummarizeComments(context.Background(), diagrams.diagram.ID, uuid.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.CommentCount != 2 || res.OmittedComments != 0 || len(res.Decisions) != 1 {
+		t.Errorf("summary = %+v", res)
+	}
+	if msg := gen.requests[0].Messages[0].Content; !strings.Contains(msg, "[#1 2026-03-01 09:30, user") || !strings.Contains(msg, "Agreed: put Redis") {
+		t.Errorf("request = %q, want the formatted thread", msg)
+	}
+
+	diagrams.comments = nil
+	if res, err := s.SummarizeComments(context.Background(), diagrams.diagram.ID, uuid.New()); err != nil || res.CommentCount != 0 || len(gen.requests) != 1 {
+		t.Errorf("no comments: %+v, %v, %d requests; want an empty summary without a model call", res, err, len(gen.requests))
+	}
+}
+
+func TestFormatThread_DropsOldest(t *testing.T) {
+	var comments []diagrammodel.CommentResponse
+	for i := 0; i < 5; i++ {
+		comments = append(comments, diagrammodel.CommentResponse{UserID: uuid.New(), CommentText: strings.Repeat("x", 100)})
+	}
+	thread, omitted := formatThread(comments, 300)
+	if omitted != 3 || !strings.HasPrefix(thread, "(3 earlier comments omitted)") || !strings.Contains(thread, "[#5 ") || strings.Contains(thread, "[#3 ") {
+		t.Errorf("omitted = %d, thread =\n%s", omitted, thread)
+	}
+}
@@ -0,0 +1,215 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/devenock/d_weaver/internal/ai/client"
+	"github.com/devenock/d_weaver/internal/ai/mermaid"
+	"github.com/devenock/d_weaver/internal/ai/model"
+	"github.com/devenock/d_weaver/internal/common"
+	"github.com/google/uuid"
+)
+
+// defaultMaxAttempts is used when config.AIConfig.MaxAttempts is not set.
+const defaultMaxAttempts = 3
+
+// DiagramResult is a generated diagram with the outcome of validating it. When no attempt produced
+// valid Mermaid it is the attempt with the fewest errors. ConversationID is set for generate calls,
+// which always belong to a conversation. Cached is true when the diagram was not generated for this
+// call but taken from the response cache or an identical call in progress; Attempts is then 0.
+type DiagramResult struct {
+	Diagram        string
+	Validation     mermaid.Result
+	Attempts       int
+	ConversationID uuid.UUID
+	Cached         bool
+}
+
+// GenerateInput is a generate-diagram call. Without ConversationID it starts a new conversation and
+// WorkspaceID, when set, selects the workspace whose AI settings and quota apply. With ConversationID
+// Description is a follow-up ("make it left-to-right") sent with the conversation so far, in the
+// conversation's workspace; DiagramType then defaults to the conversation's. BypassCache forces a
+// fresh generation instead of a cached one.
+type GenerateInput struct {
+	Description    string
+	DiagramType    string
+	WorkspaceID    *uuid.UUID
+	ConversationID *uuid.UUID
+	BypassCache    bool
+}
+
+// GenerateDiagram returns Mermaid diagram code for the given description and optional diagram type.
+// Output that fails validation is sent back to the model with its errors, up to the configured number
+// of attempts. When a workspace applies the user must be a member and the workspace's AI settings apply.
+// The call is refused with CodeQuotaExceeded once the user or workspace has used its monthly quota.
+// A new conversation's first diagram may come from the response cache, which costs no quota.
+func (s *Service) GenerateDiagram(ctx context.Context, userID uuid.UUID, in GenerateInput) (*DiagramResult, error) {
+	return s.generateDiagram(ctx, userID, in, nil, nil)
+}
+
+// StreamDiagram generates a diagram like GenerateDiagram but passes the model's output to onDelta as
+// it arrives. Before each repair attempt onRetry gets the attempt number and the failed validation,
+// and the deltas that follow are a new diagram. Cancelling ctx (or an error from a callback) aborts
+// the provider request.
+func (s *Service) StreamDiagram(ctx context.Context, userID uuid.UUID, in GenerateInput, onDelta func(text string) error, onRetry func(attempt int, failed mermaid.Result) error) (*DiagramResult, error) {
+	return s.generateDiagram(ctx, userID, in, onDelta, onRetry)
+}
+
+// generateDiagram generates the next diagram of a new or existing conversation and saves the turn;
+// onDelta nil means no streaming.
+func (s *Service) generateDiagram(ctx context.Context, userID uuid.UUID, in GenerateInput, onDelta func(string) error, onRetry func(int, mermaid.Result) error) (*DiagramResult, error) {
+	res, conv, in, err := s.draftDiagram(ctx, userID, in, onDelta, onRetry)
+	if err != nil {
+		return nil, err
+	}
+	if res.ConversationID, err = s.saveTurn(ctx, userID, conv, in, res.Diagram); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// draftDiagram generates the next diagram like generateDiagram without saving the turn. It returns the
+// conversation continued (nil for a new one) and the input as normalized, for saveTurn.
+func (s *Service) draftDiagram(ctx context.Context, userID uuid.UUID, in GenerateInput, onDelta func(string) error, onRetry func(int, mermaid.Result) error) (*DiagramResult, *model.Conversation, GenerateInput, error) {
+	in.Description = strings.TrimSpace(in.Description)
+	if in.Description == "" {
+		return nil, nil, in, common.NewDomainError(common.CodeInvalidInput, "Description is required.", nil)
+	}
+	conv, history, err := s.conversationFor(ctx, userID, &in)
+	if err != nil {
+		return nil, nil, in, err
+	}
+	gen, cfg, err := s.generatorFor(ctx, userID, in.WorkspaceID)
+	if err != nil {
+		return nil, nil, in, err
+	}
+	style, err := s.styleFor(ctx, in.WorkspaceID)
+	if err != nil {
+		return nil, nil, in, err
+	}
+	turns := append(contextTurns(history), client.Message{Role: model.RoleUser, Content: in.Description})
+	req, err := s.prompts.Conversation(turns, in.DiagramType, style)
+	if err != nil {
+		return nil, nil, in, promptError(err)
+	}
+	var res *DiagramResult
+	if conv == nil {
+		key := s.cacheKey(in, cfg, style)
+		res, err = s.cachedGenerate(ctx, userID, in, key, modelName(cfg), func(ctx context.Context) (*DiagramResult, error) {
+			return s.generate(ctx, userID, in.WorkspaceID, gen, req, onDelta, onRetry)
+		}, onDelta)
+	} else {
+		res, err = s.generate(ctx, userID, in.WorkspaceID, gen, req, onDelta, onRetry)
+	}
+	if err != nil {
+		return nil, nil, in, err
+	}
+	return res, conv, in, nil
+}
+
+// generate runs a metered generation of req.
+func (s *Service) generate(ctx context.Context, userID uuid.UUID, workspaceID *uuid.UUID, gen client.Generator, req client.Request, onDelta func(string) error, onRetry func(int, mermaid.Result) error) (*DiagramResult, error) {
+	var res *DiagramResult
+	err := s.metered(ctx, model.OperationGenerate, userID, workspaceID, gen, func(gen client.Generator) (bool, error) {
+		var err error
+		res, err = s.runDiagram(ctx, gen, req, onDelta, onRetry)
+		return err == nil && res.Validation.Valid, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// runDiagram sends req and validates the Mermaid in the reply; invalid replies are sent back with
+// their errors until one validates or the attempts run out.
+func (s *Service) runDiagram(ctx context.Context, gen client.Generator, req client.Request, onDelta func(string) error, onRetry func(int, mermaid.Result) error) (*DiagramResult, error) {
+	var err error
+	maxAttempts := s.maxAttempts()
+	var best *DiagramResult
+	for n := 1; n <= maxAttempts; n++ {
+		if n > 1 && onRetry != nil {
+			if err := onRetry(n, best.Validation); err != nil {
+				return nil, err
+			}
+		}
+		start := time.Now()
+		var resp *client.Response
+		if onDelta != nil {
+			resp, err = gen.Stream(ctx, req, onDelta)
+		} else {
+			resp, err = gen.Complete(ctx, req)
+		}
+		if err != nil {
+			s.logAttempt(n, maxAttempts, nil, nil, time.Since(start), err)
+			if best == nil || ctx.Err() != nil {
+				return nil, generationError(err)
+			}
+			break // keep the best earlier attempt
+		}
+		diagram := client.CleanDiagram(resp.Content)
+		validation := mermaid.Validate(diagram)
+		s.logAttempt(n, maxAttempts, resp, &validation, time.Since(start), nil)
+		if best == nil || len(validation.Errors) < len(best.Validation.Errors) {
+			best = &DiagramResult{Diagram: diagram, Validation: validation}
+		}
+		best.Attempts = n
+		if validation.Valid {
+			break
+		}
+		req.Messages = append(req.Messages,
+			client.Message{Role: "assistant", Content: resp.Content},
+			client.Message{Role: "user", Content: repairPrompt(validation)})
+	}
+	if best.Diagram == "" {
+		return nil, common.NewDomainError(common.CodeInternalError, "Failed to generate diagram.", nil)
+	}
+	return best, nil
+}
+
+func (s *Service) maxAttempts() int {
+	if s.cfg.MaxAttempts > 0 {
+		return s.cfg.MaxAttempts
+	}
+	return defaultMaxAttempts
+}
+
+// repairPrompt asks the model to fix the errors validation found in its last reply.
+func repairPrompt(validation mermaid.Result) string {
+	var b strings.Builder
+	b.WriteString("That Mermaid code does not render. Problems found:\n")
+	for _, e := range validation.Errors {
+		fmt.Fprintf(&b, "- %s\n", e)
+	}
+	b.WriteString("Return the complete corrected Mermaid code only, with no explanations or markdown code blocks.")
+	return b.String()
+}
+
+// logAttempt records one attempt's outcome for quality tracking; resp and validation are nil when the
+// provider call failed.
+func (s *Service) logAttempt(n, maxAttempts int, resp *client.Response, validation *mermaid.Result, took time.Duration, err error) {
+	if s.log == nil {
+		return
+	}
+	if err != nil {
+		s.log.Warn().Err(err).Int("attempt", n).Int("max_attempts", maxAttempts).Dur("took", took).Msg("ai: diagram attempt failed")
+		return
+	}
+	ev := s.log.Info().
+		Int("attempt", n).
+		Int("max_attempts", maxAttempts).
+		Str("model", resp.Model).
+		Int("input_tokens", resp.InputTokens).
+		Int("output_tokens", resp.OutputTokens).
+		Dur("took", took).
+		Bool("valid", validation.Valid).
+		Str("diagram_type", validation.DiagramType).
+		Int("errors", len(validation.Errors))
+	if len(validation.Errors) > 0 {
+		ev = ev.Str("first_error", validation.Errors[0].String())
+	}
+	ev.Msg("ai: diagram attempt")
+}
@@ -0,0 +1,104 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/devenock/d_weaver/config"
+	"github.com/devenock/d_weaver/internal/ai/client"
+	"github.com/devenock/d_weaver/internal/ai/mermaid"
+	"github.com/devenock/d_weaver/pkg/logger"
+	"github.com/google/uuid"
+)
+
+// scriptedGenerator replies with one scripted output (or error) per call and records the requests.
+type scriptedGenerator struct {
+	replies  []string
+	errs     []error
+	requests []client.Request
+}
+
+func (g *scriptedGenerator) GenerateDiagram(ctx context.Context, description, diagramType string) (string, error) {
+	return "", errors.New("not used")
+}
+
+func (g *scriptedGenerator) Complete(ctx context.Context, req client.Request) (*client.Response, error) {
+	n := len(g.requests)
+	g.requests = append(g.requests, req)
+	if n < len(g.errs) && g.errs[n] != nil {
+		return nil, g.errs[n]
+	}
+	return &client.Response{Content: g.replies[n], Model: "m", InputTokens: 10, OutputTokens: 5}, nil
+}
+
+func (g *scriptedGenerator) Stream(ctx context.Context, req client.Request, onDelta func(string) error) (*client.Response, error) {
+	resp, err := g.Complete(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return resp, onDelta(resp.Content)
+}
+
+func TestGenerateDiagram_RepairsInvalidOutput(t *testing.T) {
+	gen := &scriptedGenerator{replies: []string{"flowchart TD\n  A[Start --> B", "```mermaid\nflowchart TD\n  A[Start] --> B\n```"}}
+	var logs bytes.Buffer
+	s := New(gen, config.AIConfig{MaxAttempts: 3}, &fakeRepo{}, nil, nil, logger.New("info", &logs))
+
+	res, err := s.GenerateDiagram(context.Background(), uuid.New(), GenerateInput{Description: "login", DiagramType: "flowchart"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Validation.Valid || res.Attempts != 2 || res.Diagram != "flowchart TD\n  A[Start] --> B" {
+		t.Errorf("result = %+v, want the valid second attempt", res)
+	}
+	repair := gen.requests[1].Messages[2:] // after the flowchart example exchange
+	if len(repair) != 3 || repair[1].Role != "assistant" || !strings.Contains(repair[2].Content, `line 2: unclosed "["`) {
+		t.Errorf("repair request messages = %+v, want the reply and its errors fed back", repair)
+	}
+	if n := strings.Count(logs.String(), "ai: diagram attempt"); n != 2 {
+		t.Errorf("logged %d attempts, want 2:\n%s", n, logs.String())
+	}
+}
+
+func TestGenerateDiagram_ReturnsBestAttempt(t *testing.T) {
+	gen := &scriptedGenerator{replies: []string{
+		"Here you go:\nflowchart TD\n  A --> B",
+		"flowchart TD\n  A[x --> B\n  subgraph s",
+		"",
+	}, errs: []error{nil, nil, nil}}
+	s := New(gen, config.AIConfig{MaxAttempts: 3}, &fakeRepo{}, nil, nil, nil)
+
+	res, err := s.GenerateDiagram(context.Background(), uuid.New(), GenerateInput{Description: "login"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Validation.Valid || res.Attempts != 3 || !strings.HasPrefix(res.Diagram, "Here you go") || len(res.Validation.Errors) != 1 {
+		t.Errorf("result = %+v, want the first attempt (fewest errors) after three", res)
+	}
+}
+
+func TestStreamDiagram_ProviderErrorAfterAttemptKeepsBest(t *testing.T) {
+	gen := &scriptedGenerator{replies: []string{"flowchart TD\n  A[x --> B"}, errs: []error{nil, client.ErrRateLimited}}
+	s := New(gen, config.AIConfig{MaxAttempts: 3}, &fakeRepo{}, nil, nil, nil)
+	var retries []int
+	res, err := s.StreamDiagram(context.Background(), uuid.New(), GenerateInput{Description: "login"}, func(string) error { return nil },
+		func(attempt int, failed mermaid.Result) error {
+			retries = append(retries, attempt)
+			return nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Attempts != 1 || res.Validation.Valid || len(retries) != 1 || retries[0] != 2 {
+		t.Errorf("result = %+v, retries = %v; want the first attempt kept", res, retries)
+	}
+
+	gen = &scriptedGenerator{errs: []error{client.ErrRateLimited}}
+	s = New(gen, config.AIConfig{}, &fakeRepo{}, nil, nil, nil)
+	if _, err := s.GenerateDiagram(context.Background(), uuid.New(), GenerateInput{Description: "login"}); err == nil || !strings.Contains(err.Error(), "Rate limit") {
+		t.Errorf("err = %v, want rate limit domain error", err)
+	}
+}
@@ -0,0 +1,326 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/devenock/d_weaver/internal/ai/model"
+	"github.com/devenock/d_weaver/internal/common"
+	"github.com/google/uuid"
+)
+
+const (
+	// defaultJobMaxItems is used when config.AIConfig.JobMaxItems is not set.
+	defaultJobMaxItems = 50
+	// jobPollInterval is how often an idle worker looks for items of jobs created on other replicas.
+	jobPollInterval = 2 * time.Second
+	// jobStaleAfter is how long an item may stay running before its worker is assumed dead and the item
+	// is requeued; well above what a generation with retries and repair attempts takes.
+	jobStaleAfter = 15 * time.Minute
+	// jobStaleCheckInterval is how often RunJobs requeues stale items.
+	jobStaleCheckInterval = time.Minute
+	// jobCommitTimeout bounds saving a generated item's conversation, diagram and outcome, which goes
+	// ahead even while the worker is being stopped.
+	jobCommitTimeout = 10 * time.Second
+	// jobMaxTitleRunes and jobMaxDiagramTypeRunes are the sizes of the title and diagram_type columns.
+	jobMaxTitleRunes       = 255
+	jobMaxDiagramTypeRunes = 50
+)
+
+// CodeInvalidDiagram is the error of a job item for which no attempt produced valid Mermaid.
+const CodeInvalidDiagram = "invalid_diagram"
+
+// JobItemInput is one description of a batch job. Title defaults to the description's first line.
+type JobItemInput struct {
+	Title       string
+	Description string
+}
+
+// JobInput is a batch job: a diagram for each item, created in WorkspaceID with that workspace's AI
+// settings, style guide and quota. DiagramType, when set, applies to every item.
+type JobInput struct {
+	WorkspaceID uuid.UUID
+	DiagramType string
+	Items       []JobItemInput
+}
+
+// CreateJob queues a batch job for the job workers and returns it with every item pending. The user
+// must be a member of the workspace; a job has at most AI_JOB_MAX_ITEMS items.
+func (s *Service) CreateJob(ctx context.Context, userID uuid.UUID, in JobInput) (*model.JobResponse, error) {
+	if len(in.Items) == 0 {
+		return nil, common.NewDomainError(common.CodeInvalidInput, "At least one item is required.", nil)
+	}
+	if max := s.jobMaxItems(); len(in.Items) > max {
+		return nil, common.NewDomainError(common.CodeInvalidInput, fmt.Sprintf("A job can have at most %d items.", max), nil)
+	}
+	diagramType := strings.TrimSpace(in.DiagramType)
+	if utf8.RuneCountInString(diagramType) > jobMaxDiagramTypeRunes {
+		return nil, common.NewDomainError(common.CodeInvalidInput, fmt.Sprintf("Diagram type must be at most %d characters.", jobMaxDiagramTypeRunes), nil)
+	}
+	items := make([]*model.JobItem, 0, len(in.Items))
+	for i, it := range in.Items {
+		description := strings.TrimSpace(it.Description)
+		if description == "" {
+			return nil, common.NewDomainError(common.CodeInvalidInput, fmt.Sprintf("Item %d: description is required.", i), nil)
+		}
+		title := strings.TrimSpace(it.Title)
+		if utf8.RuneCountInString(title) > jobMaxTitleRunes {
+			return nil, common.NewDomainError(common.CodeInvalidInput, fmt.Sprintf("Item %d: title must be at most %d characters.", i, jobMaxTitleRunes), nil)
+		}
+		if title == "" {
+			title = conversationTitle(description)
+		}
+		items = append(items, &model.JobItem{Title: title, Description: description})
+	}
+	if _, err := s.ensureMember(ctx, in.WorkspaceID, userID); err != nil {
+		return nil, err
+	}
+	job, created, err := s.repo.CreateJob(ctx, &model.Job{
+		UserID:      userID,
+		WorkspaceID: in.WorkspaceID,
+		DiagramType: diagramType,
+	}, items)
+	if err != nil {
+		return nil, common.NewDomainError(common.CodeInternalError, "Failed to create job.", err)
+	}
+	s.wakeJobWorker()
+	resp := model.FromJob(job, created)
+	return &resp, nil
+}
+
+// GetJob returns one of the user's jobs with the outcome of each item so far. Other users' jobs are
+// reported as not found.
+func (s *Service) GetJob(ctx context.Context, id, userID uuid.UUID) (*model.JobResponse, error) {
+	job, err := s.repo.GetJob(ctx, id)
+	if err != nil {
+		return nil, common.NewDomainError(common.CodeInternalError, "Failed to load job.", err)
+	}
+	if job == nil || job.UserID != userID {
+		return nil, common.NewDomainError(common.CodeNotFound, "Job not found.", nil)
+	}
+	items, err := s.repo.ListJobItems(ctx, id)
+	if err != nil {
+		return nil, common.NewDomainError(common.CodeInternalError, "Failed to load job.", err)
+	}
+	resp := model.FromJob(job, items)
+	return &resp, nil
+}
+
+// RunJobs processes pending job items, at most workers at a time, until ctx is cancelled and the
+// workers have returned. Items are claimed through the database, so every replica can run workers;
+// an item whose worker is stopped goes back to pending, and one whose replica died is requeued after
+// jobStaleAfter.
+func (s *Service) RunJobs(ctx context.Context, workers int) {
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.jobWorker(ctx)
+		}()
+	}
+	s.requeueStaleJobItems(ctx)
+	ticker := time.NewTicker(jobStaleCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			return
+		case <-ticker.C:
+			s.requeueStaleJobItems(ctx)
+		}
+	}
+}
+
+// jobWorker runs job items one after another, waiting for a nudge or the poll interval when none is pending.
+func (s *Service) jobWorker(ctx context.Context) {
+	for ctx.Err() == nil {
+		if s.runNextJobItem(ctx) {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+		case <-s.jobWake:
+		case <-time.After(jobPollInterval):
+		}
+	}
+}
+
+// wakeJobWorker nudges one idle worker, if any, to look for pending items.
+func (s *Service) wakeJobWorker() {
+	select {
+	case s.jobWake <- struct{}{}:
+	default:
+	}
+}
+
+// runNextJobItem claims a pending item and runs it. It returns false when none was pending.
+func (s *Service) runNextJobItem(ctx context.Context) bool {
+	item, err := s.repo.ClaimJobItem(ctx)
+	if err != nil {
+		if ctx.Err() == nil && s.log != nil {
+			s.log.Warn().Err(err).Msg("ai: claiming job item failed")
+		}
+		return false
+	}
+	if item == nil {
+		return false
+	}
+	// The job may have more items: let another worker take the next one meanwhile.
+	s.wakeJobWorker()
+	s.runJobItem(ctx, item)
+	return true
+}
+
+// runJobItem generates the item's diagram as the job's user and creates it in the job's workspace,
+// then records the outcome. An item whose generation is interrupted by ctx goes back to pending with
+// nothing saved; once generated, its outcome is saved even while the worker stops. The conversation
+// and diagram are saved while the repository holds the item's claim, so an item requeued as stale
+// meanwhile saves nothing: whichever worker runs it next creates its diagram.
+func (s *Service) runJobItem(ctx context.Context, item *model.JobItem) {
+	job, err := s.repo.GetJob(ctx, item.JobID)
+	if err != nil {
+		s.releaseJobItem(ctx, item, err)
+		return
+	}
+	if job == nil {
+		return // deleted with its items
+	}
+	commit, ok := s.processJobItem(ctx, job, item)
+	if !ok {
+		s.releaseJobItem(ctx, item, ctx.Err())
+		return
+	}
+	wctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), jobCommitTimeout)
+	defer cancel()
+	// The commit saves through other connections while the claim holds one; one at a time per
+	// replica, workers cannot exhaust the pool waiting on each other.
+	s.jobMu.Lock()
+	ok, err = s.repo.FinishJobItem(wctx, item, commit)
+	s.jobMu.Unlock()
+	if s.log == nil {
+		return
+	}
+	switch {
+	case err != nil:
+		s.log.Error().Err(err).Str("job_id", job.ID.String()).Int("position", item.Position).Msg("ai: saving job item failed")
+	case !ok:
+		s.log.Warn().Str("job_id", job.ID.String()).Int("position", item.Position).Msg("ai: job item was requeued while running; its result was discarded")
+	default:
+		s.log.Info().Str("job_id", job.ID.String()).Int("position", item.Position).Str("status", item.Status).
+			Str("error_code", item.ErrorCode).Msg("ai: job item finished")
+	}
+}
+
+// processJobItem generates item's diagram and returns the commit that saves it and fills in item's
+// outcome, or nil when generation failed and item already holds the error the same generate call would
+// have returned. It returns false, having saved nothing, when ctx interrupted the generation.
+func (s *Service) processJobItem(ctx context.Context, job *model.Job, item *model.JobItem) (func(context.Context), bool) {
+	workspaceID := job.WorkspaceID
+	res, conv, in, err := s.draftDiagram(ctx, job.UserID, GenerateInput{
+		Description: item.Description,
+		DiagramType: job.DiagramType,
+		WorkspaceID: &workspaceID,
+	}, nil, nil)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, false
+		}
+		s.failJobItem(item, err)
+		return nil, true
+	}
+	return func(ctx context.Context) { s.commitJobItem(ctx, job, item, res, conv, in) }, true
+}
+
+// commitJobItem saves a generated item's conversation and, when the Mermaid is valid, creates its
+// diagram, and fills in item's outcome: succeeded with the created diagram, or failed with the save
+// error or CodeInvalidDiagram.
+func (s *Service) commitJobItem(ctx context.Context, job *model.Job, item *model.JobItem, res *DiagramResult, conv *model.Conversation, in GenerateInput) {
+	conversationID, err := s.saveTurn(ctx, job.UserID, conv, in, res.Diagram)
+	if err != nil {
+		s.failJobItem(item, err)
+		return
+	}
+	item.ConversationID, item.Attempts, item.Cached = &conversationID, res.Attempts, res.Cached
+	if !res.Validation.Valid {
+		item.Status, item.ErrorCode = model.JobFailed, CodeInvalidDiagram
+		item.ErrorMessage = "No attempt produced valid Mermaid; follow up on the conversation to fix it."
+		if len(res.Validation.Errors) > 0 {
+			item.ErrorMessage += " First error: " + res.Validation.Errors[0].String()
+		}
+		return
+	}
+	diagramType := job.DiagramType
+	if diagramType == "" || diagramType == "auto" {
+		diagramType = res.Validation.DiagramType
+	}
+	workspaceID := job.WorkspaceID
+	d, err := s.diagrams.CreateDiagram(ctx, job.UserID, &workspaceID, item.Title, res.Diagram, diagramType, false)
+	if err != nil {
+		s.failJobItem(item, err)
+		return
+	}
+	item.DiagramID, item.Status = &d.ID, model.JobSucceeded
+	// Linked like a conversation the user saved themselves, so follow-ups can be applied to the diagram.
+	if _, err := s.repo.UpdateConversation(ctx, conversationID, item.Title, &d.ID); err != nil && s.log != nil {
+		s.log.Warn().Err(err).Str("job_id", job.ID.String()).Int("position", item.Position).Msg("ai: linking job conversation failed")
+	}
+}
+
+// failJobItem marks item failed with err's code and message.
+func (s *Service) failJobItem(item *model.JobItem, err error) {
+	item.Status = model.JobFailed
+	var de *common.DomainError
+	if !errors.As(err, &de) {
+		de = common.NewDomainError(common.CodeInternalError, "An unexpected error occurred.", err)
+	}
+	item.ErrorCode, item.ErrorMessage = de.Code, de.Message
+	if de.Code == common.CodeInternalError && s.log != nil {
+		s.log.Warn().Err(err).Str("job_id", item.JobID.String()).Int("position", item.Position).Msg("ai: job item failed")
+	}
+}
+
+// releaseJobItem puts an item its worker could not finish back to pending.
+func (s *Service) releaseJobItem(ctx context.Context, item *model.JobItem, cause error) {
+	wctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), usageWriteTimeout)
+	defer cancel()
+	err := s.repo.ReleaseJobItem(wctx, item)
+	if s.log == nil {
+		return
+	}
+	if err != nil {
+		s.log.Error().Err(err).Str("job_id", item.JobID.String()).Int("position", item.Position).Msg("ai: releasing job item failed")
+		return
+	}
+	s.log.Info().AnErr("cause", cause).Str("job_id", item.JobID.String()).Int("position", item.Position).Msg("ai: job item released")
+}
+
+// requeueStaleJobItems puts items whose worker is presumed dead back to pending.
+func (s *Service) requeueStaleJobItems(ctx context.Context) {
+	n, err := s.repo.RequeueStaleJobItems(ctx, time.Now().Add(-jobStaleAfter))
+	if err != nil {
+		if ctx.Err() == nil && s.log != nil {
+			s.log.Warn().Err(err).Msg("ai: requeueing stale job items failed")
+		}
+		return
+	}
+	if n > 0 {
+		s.wakeJobWorker()
+		if s.log != nil {
+			s.log.Warn().Int64("items", n).Msg("ai: requeued stale job items")
+		}
+	}
+}
+
+func (s *Service) jobMaxItems() int {
+	if s.cfg.JobMaxItems > 0 {
+		return s.cfg.JobMaxItems
+	}
+	return defaultJobMaxItems
+}
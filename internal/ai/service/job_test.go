@@ -0,0 +1,232 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/devenock/d_weaver/config"
+	"github.com/devenock/d_weaver/internal/ai/client"
+	"github.com/devenock/d_weaver/internal/ai/model"
+	"github.com/devenock/d_weaver/internal/common"
+	wsmodel "github.com/devenock/d_weaver/internal/workspace/model"
+	"github.com/google/uuid"
+)
+
+// memberOf makes member the only member of every workspace.
+type memberOf struct{ member uuid.UUID }
+
+func (m memberOf) GetMember(ctx context.Context, workspaceID, userID uuid.UUID) (*wsmodel.WorkspaceMember, error) {
+	if userID != m.member {
+		return nil, nil
+	}
+	return &wsmodel.WorkspaceMember{WorkspaceID: workspaceID, UserID: userID, Role: wsmodel.RoleMember}, nil
+}
+
+func TestCreateJob(t *testing.T) {
+	userID, workspaceID := uuid.New(), uuid.New()
+	s := New(nil, config.AIConfig{JobMaxItems: 2}, &fakeRepo{}, memberOf{userID}, nil, nil)
+	ctx := context.Background()
+
+	var de *common.DomainError
+	for name, in := range map[string]JobInput{
+		"no items":          {WorkspaceID: workspaceID},
+		"too many items":    {WorkspaceID: workspaceID, Items: []JobItemInput{{Description: "a"}, {Description: "b"}, {Description: "c"}}},
+		"blank description": {WorkspaceID: workspaceID, Items: []JobItemInput{{Description: "a"}, {Description: "  "}}},
+		"long title":        {WorkspaceID: workspaceID, Items: []JobItemInput{{Title: strings.Repeat("é", jobMaxTitleRunes+1), Description: "a"}}},
+		"long diagram type": {WorkspaceID: workspaceID, DiagramType: strings.Repeat("x", jobMaxDiagramTypeRunes+1), Items: []JobItemInput{{Description: "a"}}},
+	} {
+		if _, err := s.CreateJob(ctx, userID, in); !errors.As(err, &de) || de.Code != common.CodeInvalidInput {
+			t.Errorf("%s: err = %v, want invalid input", name, err)
+		}
+	}
+	in := JobInput{WorkspaceID: workspaceID, Items: []JobItemInput{{Description: "Payments service\nwith Stripe"}, {Title: " Auth ", Description: "Auth service"}}}
+	if _, err := s.CreateJob(ctx, uuid.New(), in); !errors.As(err, &de) || de.Code != common.CodeForbidden {
+		t.Errorf("non-member err = %v, want forbidden", err)
+	}
+
+	job, err := s.CreateJob(ctx, userID, in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Status != model.JobPending || job.Total != 2 || job.Pending != 2 || job.Items[0].Title != "Payments service" || job.Items[1].Title != "Auth" {
+		t.Errorf("job = %+v", job)
+	}
+	select {
+	case <-s.jobWake:
+	default:
+		t.Error("creating a job did not wake a worker")
+	}
+	if _, err := s.GetJob(ctx, job.ID, uuid.New()); !errors.As(err, &de) || de.Code != common.CodeNotFound {
+		t.Errorf("other user's job err = %v, want not found", err)
+	}
+}
+
+func TestRunJobItems(t *testing.T) {
+	repo := &fakeRepo{}
+	diagrams := &fakeDiagrams{}
+	userID, workspaceID := uuid.New(), uuid.New()
+	gen := &scriptedGenerator{
+		replies: []string{"sequenceDiagram\n  A->>B: pay", "flowchart TD\n  A[x --> D", ""},
+		errs:    []error{nil, nil, client.ErrPaymentRequired},
+	}
+	s := New(gen, config.AIConfig{MaxAttempts: 1}, repo, memberOf{userID}, diagrams, nil)
+	ctx := context.Background()
+
+	created, err := s.CreateJob(ctx, userID, JobInput{WorkspaceID: workspaceID, Items: []JobItemInput{
+		{Title: "Payments", Description: "Payments service"},
+		{Description: "Broken"},
+		{Description: "Unpaid"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for s.runNextJobItem(ctx) {
+	}
+
+	job, err := s.GetJob(ctx, created.ID, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Status != model.JobCompleted || job.FinishedAt == nil || job.Succeeded != 1 || job.Failed != 2 || job.Pending != 0 {
+		t.Fatalf("job = %+v, want completed with 1 succeeded and 2 failed", job)
+	}
+	ok, invalid, unpaid := job.Items[0], job.Items[1], job.Items[2]
+
+	if ok.Status != model.JobSucceeded || ok.DiagramID == nil || len(diagrams.created) != 1 {
+		t.Fatalf("first item = %+v, diagrams %+v", ok, diagrams.created)
+	}
+	d := diagrams.created[0]
+	if d.ID != *ok.DiagramID || d.Title != "Payments" || d.DiagramType != "sequenceDiagram" || d.WorkspaceID == nil || *d.WorkspaceID != workspaceID {
+		t.Errorf("created diagram = %+v", d)
+	}
+	if conv, _ := repo.GetConversation(ctx, *ok.ConversationID); conv.DiagramID == nil || *conv.DiagramID != d.ID || conv.WorkspaceID == nil || *conv.WorkspaceID != workspaceID {
+		t.Errorf("conversation = %+v, want it linked to the diagram in the workspace", conv)
+	}
+
+	if invalid.Status != model.JobFailed || invalid.Error == nil || invalid.Error.Code != CodeInvalidDiagram || invalid.ConversationID == nil || invalid.DiagramID != nil {
+		t.Errorf("invalid item = %+v, want failed with its conversation and no diagram", invalid)
+	}
+	if unpaid.Status != model.JobFailed || unpaid.Error == nil || unpaid.Error.Code != "payment_required" {
+		t.Errorf("unpaid item = %+v, want the generate error", unpaid)
+	}
+	for _, u := range repo.usage {
+		if u.WorkspaceID == nil || *u.WorkspaceID != workspaceID || u.UserID != userID {
+			t.Errorf("usage = %+v, want it billed to the job's user and workspace", u)
+		}
+	}
+}
+
+// stoppingGenerator stops the worker (cancels its context) during its first call, which then fails
+// like an aborted provider request; later calls get the scripted replies.
+type stoppingGenerator struct {
+	scriptedGenerator
+	stop    context.CancelFunc
+	stopped bool
+}
+
+func (g *stoppingGenerator) Complete(ctx context.Context, req client.Request) (*client.Response, error) {
+	if !g.stopped {
+		g.stopped = true
+		g.stop()
+		return nil, context.Canceled
+	}
+	return g.scriptedGenerator.Complete(ctx, req)
+}
+
+func TestRunJobItem_WorkerStopped(t *testing.T) {
+	repo, diagrams := &fakeRepo{}, &fakeDiagrams{}
+	userID, workspaceID := uuid.New(), uuid.New()
+	ctx, stop := context.WithCancel(context.Background())
+	gen := &stoppingGenerator{scriptedGenerator: scriptedGenerator{replies: []string{"flowchart TD\n  A --> B"}}, stop: stop}
+	s := New(gen, config.AIConfig{MaxAttempts: 1}, repo, memberOf{userID}, diagrams, nil)
+	created, err := s.CreateJob(context.Background(), userID, JobInput{WorkspaceID: workspaceID, Items: []JobItemInput{{Description: "Payments"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.runNextJobItem(ctx)
+	job, _ := s.GetJob(context.Background(), created.ID, userID)
+	if item := job.Items[0]; item.Status != model.JobPending || item.ConversationID != nil || len(repo.conversations) != 0 || len(diagrams.created) != 0 {
+		t.Fatalf("stopped: item = %+v, %d conversations, %d diagrams; want pending with nothing saved", item, len(repo.conversations), len(diagrams.created))
+	}
+
+	s.runNextJobItem(context.Background())
+	job, _ = s.GetJob(context.Background(), created.ID, userID)
+	if item := job.Items[0]; item.Status != model.JobSucceeded || item.ConversationID == nil || len(repo.conversations) != 1 || len(diagrams.created) != 1 {
+		t.Errorf("rerun: item = %+v, %d conversations, %d diagrams; want one of each", item, len(repo.conversations), len(diagrams.created))
+	}
+}
+
+// lateStopGenerator stops the worker just as its reply is ready.
+type lateStopGenerator struct {
+	scriptedGenerator
+	stop context.CancelFunc
+}
+
+func (g *lateStopGenerator) Complete(ctx context.Context, req client.Request) (*client.Response, error) {
+	g.stop()
+	return g.scriptedGenerator.Complete(ctx, req)
+}
+
+func TestRunJobItem_NoConversationWithoutOutcome(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		repo := &fakeRepo{}
+		userID := uuid.New()
+		ctx, stop := context.WithCancel(context.Background())
+		gen := &lateStopGenerator{scriptedGenerator: scriptedGenerator{replies: []string{"flowchart TD\n  A --> B"}}, stop: stop}
+		s := New(gen, config.AIConfig{MaxAttempts: 1}, repo, memberOf{userID}, &fakeDiagrams{}, nil)
+		created, err := s.CreateJob(context.Background(), userID, JobInput{WorkspaceID: uuid.New(), Items: []JobItemInput{{Description: "Payments"}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.runNextJobItem(ctx)
+		job, _ := s.GetJob(context.Background(), created.ID, userID)
+		// Either outcome is fine as long as a saved conversation belongs to a finished item.
+		if item := job.Items[0]; (item.Status == model.JobPending) != (len(repo.conversations) == 0) {
+			t.Fatalf("item = %+v with %d conversations; a released item must leave none behind", item, len(repo.conversations))
+		}
+	}
+}
+
+// requeueingGenerator requeues every running item as stale while it generates, as if its worker had
+// been presumed dead.
+type requeueingGenerator struct {
+	scriptedGenerator
+	repo     *fakeRepo
+	requeued bool
+}
+
+func (g *requeueingGenerator) Complete(ctx context.Context, req client.Request) (*client.Response, error) {
+	if !g.requeued {
+		g.requeued = true
+		_, _ = g.repo.RequeueStaleJobItems(ctx, time.Now().Add(time.Hour))
+	}
+	return g.scriptedGenerator.Complete(ctx, req)
+}
+
+func TestRunJobItem_RequeuedWhileRunning(t *testing.T) {
+	repo, diagrams := &fakeRepo{}, &fakeDiagrams{}
+	userID := uuid.New()
+	gen := &requeueingGenerator{scriptedGenerator: scriptedGenerator{replies: []string{"flowchart TD\n  A --> B", "flowchart TD\n  A --> C"}}, repo: repo}
+	s := New(gen, config.AIConfig{MaxAttempts: 1}, repo, memberOf{userID}, diagrams, nil)
+	ctx := context.Background()
+	created, err := s.CreateJob(ctx, userID, JobInput{WorkspaceID: uuid.New(), Items: []JobItemInput{{Description: "Payments"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.runNextJobItem(ctx)
+	job, _ := s.GetJob(ctx, created.ID, userID)
+	if item := job.Items[0]; item.Status != model.JobPending || len(repo.conversations) != 0 || len(diagrams.created) != 0 {
+		t.Fatalf("requeued: item = %+v, %d conversations, %d diagrams; want pending with nothing saved", item, len(repo.conversations), len(diagrams.created))
+	}
+
+	s.runNextJobItem(ctx)
+	job, _ = s.GetJob(ctx, created.ID, userID)
+	if item := job.Items[0]; item.Status != model.JobSucceeded || len(repo.conversations) != 1 || len(diagrams.created) != 1 {
+		t.Errorf("rerun: item = %+v, %d conversations, %d diagrams; want one of each", item, len(repo.conversations), len(diagrams.created))
+	}
+}
@@ -2,35 +2,220 @@ package service
 
 import (
 	"context"
+	"errors"
+	"sync"
+	"time"
 
+	"github.com/devenock/d_weaver/config"
+	"github.com/devenock/d_weaver/internal/ai/cache"
 	"github.com/devenock/d_weaver/internal/ai/client"
+	"github.com/devenock/d_weaver/internal/ai/model"
 	"github.com/devenock/d_weaver/internal/common"
+	diagrammodel "github.com/devenock/d_weaver/internal/diagram/model"
+	wsmodel "github.com/devenock/d_weaver/internal/workspace/model"
+	"github.com/devenock/d_weaver/pkg/logger"
+	"github.com/google/uuid"
+	"golang.org/x/sync/singleflight"
 )
 
+// Repository is the AI settings, style guide, usage, conversation and batch job persistence interface.
+type Repository interface {
+	GetWorkspaceSettings(ctx context.Context, workspaceID uuid.UUID) (*model.WorkspaceSettings, error)
+	UpsertWorkspaceSettings(ctx context.Context, s *model.WorkspaceSettings) (*model.WorkspaceSettings, error)
+	DeleteWorkspaceSettings(ctx context.Context, workspaceID uuid.UUID) (bool, error)
+	GetStyleGuide(ctx context.Context, workspaceID uuid.UUID) (*model.StyleGuide, error)
+	UpsertStyleGuide(ctx context.Context, g *model.StyleGuide) (*model.StyleGuide, error)
+	DeleteStyleGuide(ctx context.Context, workspaceID uuid.UUID) (bool, error)
+	CreateUsage(ctx context.Context, u *model.Usage) error
+	ReserveUsage(ctx context.Context, u *model.Usage, limits model.UsageLimits) (string, error)
+	FinishUsage(ctx context.Context, u *model.Usage) error
+	ListWorkspaceUsage(ctx context.Context, workspaceID uuid.UUID, from, to time.Time) ([]model.UsageGroup, error)
+	CreateConversation(ctx context.Context, c *model.Conversation, messages []*model.Message) (*model.Conversation, error)
+	AppendMessages(ctx context.Context, conversationID uuid.UUID, messages []*model.Message) (bool, error)
+	GetConversation(ctx context.Context, id uuid.UUID) (*model.Conversation, error)
+	ListConversations(ctx context.Context, userID uuid.UUID, diagramID *uuid.UUID) ([]*model.Conversation, error)
+	ListMessages(ctx context.Context, conversationID uuid.UUID) ([]*model.Message, error)
+	UpdateConversation(ctx context.Context, id uuid.UUID, title string, diagramID *uuid.UUID) (*model.Conversation, error)
+	DeleteConversation(ctx context.Context, id uuid.UUID) (bool, error)
+	CreateJob(ctx context.Context, j *model.Job, items []*model.JobItem) (*model.Job, []*model.JobItem, error)
+	GetJob(ctx context.Context, id uuid.UUID) (*model.Job, error)
+	ListJobItems(ctx context.Context, jobID uuid.UUID) ([]*model.JobItem, error)
+	ClaimJobItem(ctx context.Context) (*model.JobItem, error)
+	FinishJobItem(ctx context.Context, it *model.JobItem, commit func(ctx context.Context)) (bool, error)
+	ReleaseJobItem(ctx context.Context, it *model.JobItem) error
+	RequeueStaleJobItems(ctx context.Context, startedBefore time.Time) (int64, error)
+}
+
+// WorkspaceMemberRepository is a minimal interface for membership checks (implemented by workspace repo).
+type WorkspaceMemberRepository interface {
+	GetMember(ctx context.Context, workspaceID, userID uuid.UUID) (*wsmodel.WorkspaceMember, error)
+}
+
+// DiagramService loads, creates and saves diagrams through the diagram service's access checks.
+type DiagramService interface {
+	CreateDiagram(ctx context.Context, userID uuid.UUID, workspaceID *uuid.UUID, title, content, diagramType string, isPublic bool) (diagrammodel.DiagramResponse, error)
+	GetDiagram(ctx context.Context, id, userID uuid.UUID) (diagrammodel.DiagramResponse, error)
+	ResolveDiagramPermission(ctx context.Context, diagramID, userID uuid.UUID) (diagrammodel.Permission, error)
+	SaveDiagramRevision(ctx context.Context, id, userID uuid.UUID, base, content, source string) error
+	ListComments(ctx context.Context, diagramID, userID uuid.UUID) ([]diagrammodel.CommentResponse, error)
+}
+
+// LiveDocuments tells a diagram's open collaboration rooms about content saved over base (implemented by
+// the realtime hub), so they merge it instead of autosaving over it.
+type LiveDocuments interface {
+	ContentReplaced(diagramID, userID uuid.UUID, base, content string)
+}
+
 // Service implements AI generate-diagram business logic.
 type Service struct {
-	gen client.Generator
+	gen      client.Generator // server default, from cfg
+	cfg      config.AIConfig
+	repo     Repository
+	wsRepo   WorkspaceMemberRepository
+	diagrams DiagramService
+	live     LiveDocuments // nil when there is no realtime hub
+	prompts  *client.Prompts
+	cache    cache.Store // nil disables response caching
+	cacheTTL time.Duration
+	inflight singleflight.Group // identical generate calls in progress, by cache key
+	jobWake  chan struct{}      // nudges an idle job worker when a job is created
+	jobMu    sync.Mutex         // one job item commits at a time (see runJobItem)
+	log      logger.Logger      // optional; when set, every generation attempt is logged
+}
+
+// New returns an AI service. gen is the server default generator built from cfg; workspaces with
+// their own settings get a generator built from cfg merged with those settings. Requests use the
+// embedded prompts until SetPrompts is called. log is optional.
+func New(gen client.Generator, cfg config.AIConfig, repo Repository, wsRepo WorkspaceMemberRepository, diagrams DiagramService, log logger.Logger) *Service {
+	return &Service{gen: gen, cfg: cfg, repo: repo, wsRepo: wsRepo, diagrams: diagrams, prompts: client.DefaultPrompts(), jobWake: make(chan struct{}, 1), log: log}
 }
 
-// New returns an AI service using the given generator.
-func New(gen client.Generator) *Service {
-	return &Service{gen: gen}
+// SetPrompts replaces the prompts requests are built from, e.g. with ones loaded from AI_PROMPT_DIR.
+func (s *Service) SetPrompts(p *client.Prompts) {
+	s.prompts = p
 }
 
-// GenerateDiagram returns Mermaid diagram code for the given description and optional diagram type.
-func (s *Service) GenerateDiagram(ctx context.Context, description, diagramType string) (string, error) {
-	if description == "" {
-		return "", common.NewDomainError(common.CodeInvalidInput, "Description is required.", nil)
+// CodeUnavailable is returned when the AI provider is down or its circuit breaker is open.
+const CodeUnavailable = "ai_unavailable"
+
+// generationError maps a generator error to a domain error.
+func generationError(err error) error {
+	switch {
+	case errors.Is(err, client.ErrRateLimited):
+		return common.NewDomainError("rate_limit_exceeded", "Rate limit exceeded. Please try again later.", err)
+	case errors.Is(err, client.ErrPaymentRequired):
+		return common.NewDomainError("payment_required", "Payment required. Please add credits to your workspace.", err)
+	case errors.Is(err, client.ErrCircuitOpen), errors.Is(err, client.ErrUnavailable):
+		return common.NewDomainError(CodeUnavailable, "The AI provider is unavailable. Please try again later.", err)
 	}
-	mermaid, err := s.gen.GenerateDiagram(ctx, description, diagramType)
+	return common.NewDomainError(common.CodeInternalError, "Failed to generate diagram.", err)
+}
+
+// SetLiveDocuments makes applied edits reach the diagram's open collaboration rooms, if any.
+func (s *Service) SetLiveDocuments(live LiveDocuments) {
+	s.live = live
+}
+
+// SetCache makes new-conversation generate calls answer from store for ttl after an identical call
+// produced a valid diagram.
+func (s *Service) SetCache(store cache.Store, ttl time.Duration) {
+	s.cache, s.cacheTTL = store, ttl
+}
+
+// promptError maps a failure to render a prompt template to a domain error.
+func promptError(err error) error {
+	return common.NewDomainError(common.CodeInternalError, "Failed to build the AI request.", err)
+}
+
+// generatorFor returns the generator for a call made in workspaceID (nil for none) and the config it
+// was built from: the server default unless the workspace has its own settings.
+func (s *Service) generatorFor(ctx context.Context, userID uuid.UUID, workspaceID *uuid.UUID) (client.Generator, config.AIConfig, error) {
+	if workspaceID == nil {
+		return s.gen, s.cfg, nil
+	}
+	if _, err := s.ensureMember(ctx, *workspaceID, userID); err != nil {
+		return nil, config.AIConfig{}, err
+	}
+	return s.workspaceGenerator(ctx, *workspaceID)
+}
+
+// generatorForDiagram returns the generator for work on a diagram the user can access and the
+// workspace billed for it: for members the diagram's workspace and its settings, for everyone else
+// the server default and no workspace.
+func (s *Service) generatorForDiagram(ctx context.Context, userID uuid.UUID, d *diagrammodel.DiagramResponse) (client.Generator, *uuid.UUID, error) {
+	if d.WorkspaceID == nil {
+		return s.gen, nil, nil
+	}
+	m, err := s.wsRepo.GetMember(ctx, *d.WorkspaceID, userID)
 	if err != nil {
-		if err.Error() == "rate limit exceeded" {
-			return "", common.NewDomainError("rate_limit_exceeded", "Rate limit exceeded. Please try again later.", err)
-		}
-		if err.Error() == "payment required" {
-			return "", common.NewDomainError("payment_required", "Payment required. Please add credits to your workspace.", err)
-		}
-		return "", common.NewDomainError(common.CodeInternalError, "Failed to generate diagram.", err)
-	}
-	return mermaid, nil
+		return nil, nil, common.NewDomainError(common.CodeInternalError, "Failed to check membership.", err)
+	}
+	if m == nil {
+		return s.gen, nil, nil
+	}
+	gen, _, err := s.workspaceGenerator(ctx, *d.WorkspaceID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return gen, d.WorkspaceID, nil
+}
+
+// workspaceGenerator returns the generator for the workspace's AI settings, or the server default,
+// with the config it was built from.
+func (s *Service) workspaceGenerator(ctx context.Context, workspaceID uuid.UUID) (client.Generator, config.AIConfig, error) {
+	settings, err := s.repo.GetWorkspaceSettings(ctx, workspaceID)
+	if err != nil {
+		return nil, config.AIConfig{}, common.NewDomainError(common.CodeInternalError, "Failed to load AI settings.", err)
+	}
+	if settings == nil {
+		return s.gen, s.cfg, nil
+	}
+	cfg := s.effectiveConfig(settings)
+	gen, err := client.New(cfg)
+	if err != nil {
+		return nil, config.AIConfig{}, common.NewDomainError(common.CodeInternalError, "Workspace AI settings are invalid.", err)
+	}
+	return gen, cfg, nil
+}
+
+// effectiveConfig merges a workspace override into the server config. Switching provider drops the
+// server's key, endpoint and model so they are never sent to another provider, and a workspace base
+// URL only ever gets the workspace's own key: the server key is never sent to an endpoint a
+// workspace admin chose.
+func (s *Service) effectiveConfig(settings *model.WorkspaceSettings) config.AIConfig {
+	cfg := s.cfg
+	if settings.Provider != s.provider() {
+		cfg.APIKey, cfg.BaseURL, cfg.Model = "", "", ""
+	}
+	cfg.Provider = settings.Provider
+	if settings.Model != "" {
+		cfg.Model = settings.Model
+	}
+	if settings.APIKey != "" {
+		cfg.APIKey = settings.APIKey
+	}
+	if settings.BaseURL != "" && s.cfg.AllowWorkspaceBaseURL {
+		cfg.BaseURL, cfg.APIKey = settings.BaseURL, settings.APIKey
+	}
+	return cfg
+}
+
+// provider returns the server's configured provider.
+func (s *Service) provider() string {
+	if s.cfg.Provider == "" {
+		return client.ProviderOpenAI
+	}
+	return s.cfg.Provider
+}
+
+// ensureMember returns the member record or ErrForbidden if user is not a member.
+func (s *Service) ensureMember(ctx context.Context, workspaceID, userID uuid.UUID) (*wsmodel.WorkspaceMember, error) {
+	m, err := s.wsRepo.GetMember(ctx, workspaceID, userID)
+	if err != nil {
+		return nil, common.NewDomainError(common.CodeInternalError, "Failed to check membership.", err)
+	}
+	if m == nil {
+		return nil, common.NewDomainError(common.CodeForbidden, "You are not a member of this workspace.", nil)
+	}
+	return m, nil
 }
@@ -0,0 +1,371 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/devenock/d_weaver/config"
+	"github.com/devenock/d_weaver/internal/ai/model"
+	"github.com/devenock/d_weaver/internal/common"
+	wsmodel "github.com/devenock/d_weaver/internal/workspace/model"
+	"github.com/google/uuid"
+)
+
+// fakeRepo keeps AI settings, style guides, usage, conversations and jobs in memory.
+type fakeRepo struct {
+	settings      map[uuid.UUID]*model.WorkspaceSettings
+	styleGuides   map[uuid.UUID]*model.StyleGuide
+	usage         []model.Usage
+	conversations []*model.Conversation
+	messages      []*model.Message
+	jobs          []*model.Job
+	jobItems      []*model.JobItem
+}
+
+func (r *fakeRepo) GetWorkspaceSettings(ctx context.Context, workspaceID uuid.UUID) (*model.WorkspaceSettings, error) {
+	return r.settings[workspaceID], nil
+}
+
+func (r *fakeRepo) UpsertWorkspaceSettings(ctx context.Context, s *model.WorkspaceSettings) (*model.WorkspaceSettings, error) {
+	if r.settings == nil {
+		r.settings = map[uuid.UUID]*model.WorkspaceSettings{}
+	}
+	r.settings[s.WorkspaceID] = s
+	return s, nil
+}
+
+func (r *fakeRepo) DeleteWorkspaceSettings(ctx context.Context, workspaceID uuid.UUID) (bool, error) {
+	_, ok := r.settings[workspaceID]
+	delete(r.settings, workspaceID)
+	return ok, nil
+}
+
+func (r *fakeRepo) GetStyleGuide(ctx context.Context, workspaceID uuid.UUID) (*model.StyleGuide, error) {
+	return r.styleGuides[workspaceID], nil
+}
+
+func (r *fakeRepo) UpsertStyleGuide(ctx context.Context, g *model.StyleGuide) (*model.StyleGuide, error) {
+	if r.styleGuides == nil {
+		r.styleGuides = map[uuid.UUID]*model.StyleGuide{}
+	}
+	r.styleGuides[g.WorkspaceID] = g
+	return g, nil
+}
+
+func (r *fakeRepo) DeleteStyleGuide(ctx context.Context, workspaceID uuid.UUID) (bool, error) {
+	_, ok := r.styleGuides[workspaceID]
+	delete(r.styleGuides, workspaceID)
+	return ok, nil
+}
+
+func (r *fakeRepo) CreateUsage(ctx context.Context, u *model.Usage) error {
+	row := *u
+	row.CreatedAt = time.Now()
+	r.usage = append(r.usage, row)
+	return nil
+}
+
+func (r *fakeRepo) totals(since time.Time, match func(model.Usage) bool) model.UsageTotals {
+	var t model.UsageTotals
+	for _, u := range r.usage {
+		if u.CreatedAt.Before(since) || !match(u) {
+			continue
+		}
+		if u.Outcome == model.OutcomeSuccess || u.Outcome == model.OutcomeInvalid || u.Outcome == model.OutcomePending {
+			t.Requests++
+		}
+		t.Tokens += u.InputTokens + u.OutputTokens
+	}
+	return t
+}
+
+func (r *fakeRepo) ReserveUsage(ctx context.Context, u *model.Usage, limits model.UsageLimits) (string, error) {
+	if u.WorkspaceID != nil {
+		used := r.totals(limits.Since, func(row model.Usage) bool { return row.WorkspaceID != nil && *row.WorkspaceID == *u.WorkspaceID })
+		if used.Reached(limits.WorkspaceRequests, limits.WorkspaceTokens) {
+			return model.QuotaWorkspace, nil
+		}
+	}
+	if r.totals(limits.Since, func(row model.Usage) bool { return row.UserID == u.UserID }).Reached(limits.UserRequests, limits.UserTokens) {
+		return model.QuotaUser, nil
+	}
+	u.ID, u.Outcome = uuid.New(), model.OutcomePending
+	return "", r.CreateUsage(ctx, u)
+}
+
+func (r *fakeRepo) FinishUsage(ctx context.Context, u *model.Usage) error {
+	for i := range r.usage {
+		if r.usage[i].ID == u.ID {
+			created := r.usage[i].CreatedAt
+			r.usage[i] = *u
+			r.usage[i].CreatedAt = created
+		}
+	}
+	return nil
+}
+
+func (r *fakeRepo) ListWorkspaceUsage(ctx context.Context, workspaceID uuid.UUID, from, to time.Time) ([]model.UsageGroup, error) {
+	var out []model.UsageGroup
+	for _, u := range r.usage {
+		if u.WorkspaceID == nil || *u.WorkspaceID != workspaceID || u.CreatedAt.Before(from) || !u.CreatedAt.Before(to) {
+			continue
+		}
+		userID := u.UserID
+		out = append(out, model.UsageGroup{UserID: &userID, Model: u.Model, Operation: u.Operation, Outcome: u.Outcome,
+			Calls: 1, InputTokens: u.InputTokens, OutputTokens: u.OutputTokens, LatencyMs: u.LatencyMs})
+	}
+	return out, nil
+}
+
+// everyoneMember makes every user a member of every workspace.
+type everyoneMember struct{}
+
+func (everyoneMember) GetMember(ctx context.Context, workspaceID, userID uuid.UUID) (*wsmodel.WorkspaceMember, error) {
+	return &wsmodel.WorkspaceMember{WorkspaceID: workspaceID, UserID: userID, Role: wsmodel.RoleMember}, nil
+}
+
+func (r *fakeRepo) CreateConversation(ctx context.Context, c *model.Conversation, messages []*model.Message) (*model.Conversation, error) {
+	created := *c
+	created.ID, created.CreatedAt, created.UpdatedAt = uuid.New(), time.Now(), time.Now()
+	r.conversations = append(r.conversations, &created)
+	_, err := r.AppendMessages(ctx, created.ID, messages)
+	return &created, err
+}
+
+func (r *fakeRepo) AppendMessages(ctx context.Context, conversationID uuid.UUID, messages []*model.Message) (bool, error) {
+	c, _ := r.GetConversation(ctx, conversationID)
+	if c == nil {
+		return false, nil
+	}
+	for _, m := range messages {
+		r.messages = append(r.messages, &model.Message{ID: uuid.New(), ConversationID: conversationID, Role: m.Role, Content: m.Content, CreatedAt: time.Now()})
+	}
+	c.UpdatedAt = time.Now()
+	return true, nil
+}
+
+func (r *fakeRepo) GetConversation(ctx context.Context, id uuid.UUID) (*model.Conversation, error) {
+	for _, c := range r.conversations {
+		if c.ID == id {
+			return c, nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *fakeRepo) ListConversations(ctx context.Context, userID uuid.UUID, diagramID *uuid.UUID) ([]*model.Conversation, error) {
+	var out []*model.Conversation
+	for i := len(r.conversations) - 1; i >= 0; i-- {
+		c := r.conversations[i]
+		if c.UserID == userID && (diagramID == nil || (c.DiagramID != nil && *c.DiagramID == *diagramID)) {
+			out = append(out, c)
+		}
+	}
+	return out, nil
+}
+
+func (r *fakeRepo) ListMessages(ctx context.Context, conversationID uuid.UUID) ([]*model.Message, error) {
+	var out []*model.Message
+	for _, m := range r.messages {
+		if m.ConversationID == conversationID {
+			out = append(out, m)
+		}
+	}
+	return out, nil
+}
+
+func (r *fakeRepo) UpdateConversation(ctx context.Context, id uuid.UUID, title string, diagramID *uuid.UUID) (*model.Conversation, error) {
+	c, _ := r.GetConversation(ctx, id)
+	if c != nil {
+		c.Title, c.DiagramID = title, diagramID
+	}
+	return c, nil
+}
+
+func (r *fakeRepo) DeleteConversation(ctx context.Context, id uuid.UUID) (bool, error) {
+	for i, c := range r.conversations {
+		if c.ID == id {
+			r.conversations = append(r.conversations[:i], r.conversations[i+1:]...)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (r *fakeRepo) CreateJob(ctx context.Context, j *model.Job, items []*model.JobItem) (*model.Job, []*model.JobItem, error) {
+	created := *j
+	created.ID, created.Status, created.CreatedAt, created.UpdatedAt = uuid.New(), model.JobPending, time.Now(), time.Now()
+	r.jobs = append(r.jobs, &created)
+	out := make([]*model.JobItem, 0, len(items))
+	for i, it := range items {
+		row := *it
+		row.ID, row.JobID, row.Position, row.Status, row.CreatedAt = uuid.New(), created.ID, i, model.JobPending, time.Now()
+		r.jobItems = append(r.jobItems, &row)
+		out = append(out, &row)
+	}
+	return &created, out, nil
+}
+
+func (r *fakeRepo) GetJob(ctx context.Context, id uuid.UUID) (*model.Job, error) {
+	for _, j := range r.jobs {
+		if j.ID == id {
+			return j, nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *fakeRepo) ListJobItems(ctx context.Context, jobID uuid.UUID) ([]*model.JobItem, error) {
+	var out []*model.JobItem
+	for _, it := range r.jobItems {
+		if it.JobID == jobID {
+			row := *it
+			out = append(out, &row)
+		}
+	}
+	return out, nil
+}
+
+func (r *fakeRepo) ClaimJobItem(ctx context.Context) (*model.JobItem, error) {
+	for _, it := range r.jobItems {
+		if it.Status == model.JobPending {
+			now := time.Now()
+			it.Status, it.StartedAt = model.JobRunning, &now
+			if j, _ := r.GetJob(ctx, it.JobID); j.Status == model.JobPending {
+				j.Status = model.JobRunning
+			}
+			row := *it
+			return &row, nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *fakeRepo) FinishJobItem(ctx context.Context, it *model.JobItem, commit func(ctx context.Context)) (bool, error) {
+	if !r.claimed(it) {
+		return false, nil
+	}
+	if commit != nil {
+		commit(ctx)
+	}
+	open := 0
+	for i, row := range r.jobItems {
+		if row.ID == it.ID {
+			now := time.Now()
+			done := *it
+			done.FinishedAt = &now
+			r.jobItems[i], row = &done, &done
+		}
+		if row.JobID == it.JobID && (row.Status == model.JobPending || row.Status == model.JobRunning) {
+			open++
+		}
+	}
+	if open == 0 {
+		j, _ := r.GetJob(ctx, it.JobID)
+		now := time.Now()
+		j.Status, j.FinishedAt = model.JobCompleted, &now
+	}
+	return true, nil
+}
+
+func (r *fakeRepo) ReleaseJobItem(ctx context.Context, it *model.JobItem) error {
+	if !r.claimed(it) {
+		return nil
+	}
+	for _, row := range r.jobItems {
+		if row.ID == it.ID {
+			row.Status, row.StartedAt = model.JobPending, nil
+		}
+	}
+	return nil
+}
+
+// claimed reports whether it is still running under the claim it was handed out with.
+func (r *fakeRepo) claimed(it *model.JobItem) bool {
+	for _, row := range r.jobItems {
+		if row.ID == it.ID {
+			return row.Status == model.JobRunning && row.StartedAt != nil && it.StartedAt != nil && row.StartedAt.Equal(*it.StartedAt)
+		}
+	}
+	return false
+}
+
+func (r *fakeRepo) RequeueStaleJobItems(ctx context.Context, startedBefore time.Time) (int64, error) {
+	var n int64
+	for _, it := range r.jobItems {
+		if it.Status == model.JobRunning && it.StartedAt.Before(startedBefore) {
+			it.Status, it.StartedAt = model.JobPending, nil
+			n++
+		}
+	}
+	return n, nil
+}
+
+func TestEffectiveConfig(t *testing.T) {
+	s := New(nil, config.AIConfig{Provider: "openai", APIKey: "server", BaseURL: "https://gw", Model: "m"}, &fakeRepo{}, nil, nil, nil)
+
+	same := s.effectiveConfig(&model.WorkspaceSettings{Provider: "openai", Model: "other"})
+	if same.APIKey != "server" || same.BaseURL != "https://gw" || same.Model != "other" {
+		t.Errorf("same provider = %+v, want server key and endpoint with workspace model", same)
+	}
+
+	switched := s.effectiveConfig(&model.WorkspaceSettings{Provider: "anthropic", APIKey: "ws", BaseURL: "https://evil"})
+	if switched.Provider != "anthropic" || switched.APIKey != "ws" || switched.BaseURL != "" || switched.Model != "" {
+		t.Errorf("switched provider = %+v, want workspace key, provider defaults and base URL ignored", switched)
+	}
+
+	s.cfg.AllowWorkspaceBaseURL = true
+	if got := s.effectiveConfig(&model.WorkspaceSettings{Provider: "ollama", BaseURL: "http://gpu:11434"}); got.BaseURL != "http://gpu:11434" || got.APIKey != "" {
+		t.Errorf("allowed base URL = %+v", got)
+	}
+	if got := s.effectiveConfig(&model.WorkspaceSettings{Provider: "openai", BaseURL: "https://evil"}); got.APIKey != "" {
+		t.Errorf("same provider with base URL = %+v, want the server key dropped", got)
+	}
+}
+
+func TestWorkspaceBaseURL_NeverGetsServerKey(t *testing.T) {
+	var mu sync.Mutex
+	var auth []string
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		auth = append(auth, r.Header.Get("Authorization"))
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"model":"m","choices":[{"message":{"content":"flowchart TD\n  A --> B"}}]}`))
+	}))
+	defer endpoint.Close()
+
+	owner, workspaceID := uuid.New(), uuid.New()
+	repo := &fakeRepo{}
+	s := New(nil, config.AIConfig{Provider: "openai", APIKey: "server-key", AllowWorkspaceBaseURL: true, MaxAttempts: 1}, repo, ownerOf{owner}, nil, nil)
+	ctx := context.Background()
+
+	var de *common.DomainError
+	_, err := s.UpdateWorkspaceSettings(ctx, workspaceID, owner, SettingsInput{Provider: "openai", BaseURL: endpoint.URL})
+	if !errors.As(err, &de) || de.Code != common.CodeInvalidInput {
+		t.Fatalf("base URL without a key err = %v, want invalid input", err)
+	}
+
+	// A row saved before the key was required must not fall back to the server key either.
+	repo.settings = map[uuid.UUID]*model.WorkspaceSettings{workspaceID: {WorkspaceID: workspaceID, Provider: "openai", BaseURL: endpoint.URL}}
+	if _, err := s.GenerateDiagram(ctx, owner, GenerateInput{Description: "login", WorkspaceID: &workspaceID}); err == nil {
+		t.Error("generate with a keyless workspace base URL succeeded, want it refused")
+	}
+	key := "ws-key"
+	if _, err := s.UpdateWorkspaceSettings(ctx, workspaceID, owner, SettingsInput{Provider: "openai", BaseURL: endpoint.URL, APIKey: &key}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GenerateDiagram(ctx, owner, GenerateInput{Description: "signup", WorkspaceID: &workspaceID}); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(auth) != 1 || auth[0] != "Bearer ws-key" {
+		t.Errorf("Authorization headers sent to the workspace endpoint = %q, want only the workspace key", auth)
+	}
+}
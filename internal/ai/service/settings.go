@@ -0,0 +1,114 @@
+package service
+
+import (
+	"context"
+	"net/url"
+
+	"github.com/devenock/d_weaver/internal/ai/client"
+	"github.com/devenock/d_weaver/internal/ai/model"
+	"github.com/devenock/d_weaver/internal/common"
+	wsmodel "github.com/devenock/d_weaver/internal/workspace/model"
+	"github.com/google/uuid"
+)
+
+// SettingsInput is a workspace AI override. A nil APIKey keeps the stored key (when the provider is
+// unchanged); an empty one clears it.
+type SettingsInput struct {
+	Provider string
+	Model    string
+	BaseURL  string
+	APIKey   *string
+}
+
+// GetWorkspaceSettings returns the workspace's AI settings, or the server default (Override false)
+// when it has none. Members only.
+func (s *Service) GetWorkspaceSettings(ctx context.Context, workspaceID, userID uuid.UUID) (*model.WorkspaceSettingsResponse, error) {
+	if _, err := s.ensureMember(ctx, workspaceID, userID); err != nil {
+		return nil, err
+	}
+	settings, err := s.repo.GetWorkspaceSettings(ctx, workspaceID)
+	if err != nil {
+		return nil, common.NewDomainError(common.CodeInternalError, "Failed to load AI settings.", err)
+	}
+	if settings == nil {
+		modelName := s.cfg.Model
+		if modelName == "" {
+			modelName = client.DefaultModel(s.provider())
+		}
+		return &model.WorkspaceSettingsResponse{WorkspaceID: workspaceID, Provider: s.provider(), Model: modelName}, nil
+	}
+	resp := model.FromWorkspaceSettings(settings)
+	return &resp, nil
+}
+
+// UpdateWorkspaceSettings sets the workspace's AI override. Owners and admins only. A base URL needs
+// the workspace's own API key, except for Ollama.
+func (s *Service) UpdateWorkspaceSettings(ctx context.Context, workspaceID, userID uuid.UUID, in SettingsInput) (*model.WorkspaceSettingsResponse, error) {
+	if err := s.ensureAdminOrOwner(ctx, workspaceID, userID); err != nil {
+		return nil, err
+	}
+	if !client.ValidProvider(in.Provider) {
+		return nil, common.NewDomainError(common.CodeInvalidInput, "Provider must be openai, anthropic or ollama.", nil)
+	}
+	if in.BaseURL != "" {
+		if !s.cfg.AllowWorkspaceBaseURL {
+			return nil, common.NewDomainError(common.CodeInvalidInput, "Workspaces may not set a base URL on this server.", nil)
+		}
+		if u, err := url.Parse(in.BaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, common.NewDomainError(common.CodeInvalidInput, "Base URL must be an http or https URL.", nil)
+		}
+	}
+	existing, err := s.repo.GetWorkspaceSettings(ctx, workspaceID)
+	if err != nil {
+		return nil, common.NewDomainError(common.CodeInternalError, "Failed to load AI settings.", err)
+	}
+	settings := &model.WorkspaceSettings{
+		WorkspaceID: workspaceID,
+		Provider:    in.Provider,
+		Model:       in.Model,
+		BaseURL:     in.BaseURL,
+		UpdatedBy:   &userID,
+	}
+	if in.APIKey != nil {
+		settings.APIKey = *in.APIKey
+	} else if existing != nil && existing.Provider == in.Provider {
+		settings.APIKey = existing.APIKey
+	}
+	if settings.BaseURL != "" && settings.APIKey == "" && settings.Provider != client.ProviderOllama {
+		// The server key is never sent to a workspace's endpoint (Ollama takes no key).
+		return nil, common.NewDomainError(common.CodeInvalidInput, "A workspace base URL needs the workspace's own API key.", nil)
+	}
+	saved, err := s.repo.UpsertWorkspaceSettings(ctx, settings)
+	if err != nil {
+		return nil, common.NewDomainError(common.CodeInternalError, "Failed to save AI settings.", err)
+	}
+	resp := model.FromWorkspaceSettings(saved)
+	return &resp, nil
+}
+
+// DeleteWorkspaceSettings removes the workspace's AI override so the server default applies again.
+// Owners and admins only.
+func (s *Service) DeleteWorkspaceSettings(ctx context.Context, workspaceID, userID uuid.UUID) error {
+	if err := s.ensureAdminOrOwner(ctx, workspaceID, userID); err != nil {
+		return err
+	}
+	deleted, err := s.repo.DeleteWorkspaceSettings(ctx, workspaceID)
+	if err != nil {
+		return common.NewDomainError(common.CodeInternalError, "Failed to delete AI settings.", err)
+	}
+	if !deleted {
+		return common.NewDomainError(common.CodeNotFound, "Workspace has no AI settings.", nil)
+	}
+	return nil
+}
+
+func (s *Service) ensureAdminOrOwner(ctx context.Context, workspaceID, userID uuid.UUID) error {
+	m, err := s.ensureMember(ctx, workspaceID, userID)
+	if err != nil {
+		return err
+	}
+	if m.Role != wsmodel.RoleOwner && m.Role != wsmodel.RoleAdmin {
+		return common.NewDomainError(common.CodeForbidden, "Only owners and admins can change AI settings.", nil)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package service
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/devenock/d_weaver/internal/ai/model"
+	"github.com/devenock/d_weaver/internal/ai/prompt"
+	"github.com/devenock/d_weaver/internal/common"
+	"github.com/google/uuid"
+)
+
+const (
+	maxStyleNamingRunes       = 2000
+	maxStyleInstructionsRunes = 4000
+)
+
+// StyleGuideInput is a workspace style guide. Direction is a flowchart direction (TB, TD, BT, LR or
+// RL) or empty for no preference.
+type StyleGuideInput struct {
+	Direction    string
+	Naming       string
+	Instructions string
+}
+
+// GetStyleGuide returns the workspace's style guide; a workspace without one gets an empty guide.
+// Members only.
+func (s *Service) GetStyleGuide(ctx context.Context, workspaceID, userID uuid.UUID) (*model.StyleGuideResponse, error) {
+	if _, err := s.ensureMember(ctx, workspaceID, userID); err != nil {
+		return nil, err
+	}
+	g, err := s.repo.GetStyleGuide(ctx, workspaceID)
+	if err != nil {
+		return nil, common.NewDomainError(common.CodeInternalError, "Failed to load style guide.", err)
+	}
+	if g == nil {
+		return &model.StyleGuideResponse{WorkspaceID: workspaceID}, nil
+	}
+	resp := model.FromStyleGuide(g)
+	return &resp, nil
+}
+
+// UpdateStyleGuide sets the workspace's style guide. Owners and admins only.
+func (s *Service) UpdateStyleGuide(ctx context.Context, workspaceID, userID uuid.UUID, in StyleGuideInput) (*model.StyleGuideResponse, error) {
+	if err := s.ensureAdminOrOwner(ctx, workspaceID, userID); err != nil {
+		return nil, err
+	}
+	g := &model.StyleGuide{
+		WorkspaceID:  workspaceID,
+		Direction:    strings.ToUpper(strings.TrimSpace(in.Direction)),
+		Naming:       strings.TrimSpace(in.Naming),
+		Instructions: strings.TrimSpace(in.Instructions),
+		UpdatedBy:    &userID,
+	}
+	if g.Direction != "" && !slices.Contains(prompt.Directions, g.Direction) {
+		return nil, common.NewDomainError(common.CodeInvalidInput, "Direction must be TB, TD, BT, LR or RL.", nil)
+	}
+	if utf8.RuneCountInString(g.Naming) > maxStyleNamingRunes || utf8.RuneCountInString(g.Instructions) > maxStyleInstructionsRunes {
+		return nil, common.NewDomainError(common.CodeInvalidInput, "Naming is limited to 2000 characters and instructions to 4000.", nil)
+	}
+	saved, err := s.repo.UpsertStyleGuide(ctx, g)
+	if err != nil {
+		return nil, common.NewDomainError(common.CodeInternalError, "Failed to save style guide.", err)
+	}
+	resp := model.FromStyleGuide(saved)
+	return &resp, nil
+}
+
+// DeleteStyleGuide removes the workspace's style guide. Owners and admins only.
+func (s *Service) DeleteStyleGuide(ctx context.Context, workspaceID, userID uuid.UUID) error {
+	if err := s.ensureAdminOrOwner(ctx, workspaceID, userID); err != nil {
+		return err
+	}
+	deleted, err := s.repo.DeleteStyleGuide(ctx, workspaceID)
+	if err != nil {
+		return common.NewDomainError(common.CodeInternalError, "Failed to delete style guide.", err)
+	}
+	if !deleted {
+		return common.NewDomainError(common.CodeNotFound, "Workspace has no style guide.", nil)
+	}
+	return nil
+}
+
+// styleFor returns the style guide of workspaceID for prompts; nil or a workspace without one gets
+// an empty style.
+func (s *Service) styleFor(ctx context.Context, workspaceID *uuid.UUID) (prompt.Style, error) {
+	if workspaceID == nil {
+		return prompt.Style{}, nil
+	}
+	g, err := s.repo.GetStyleGuide(ctx, *workspaceID)
+	if err != nil {
+		return prompt.Style{}, common.NewDomainError(common.CodeInternalError, "Failed to load style guide.", err)
+	}
+	if g == nil {
+		return prompt.Style{}, nil
+	}
+	return prompt.Style{Direction: g.Direction, Naming: g.Naming, Instructions: g.Instructions}, nil
+}
@@ -0,0 +1,69 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/devenock/d_weaver/config"
+	"github.com/devenock/d_weaver/internal/common"
+	wsmodel "github.com/devenock/d_weaver/internal/workspace/model"
+	"github.com/google/uuid"
+)
+
+// ownerOf makes owner the owner of every workspace and everyone else a member.
+type ownerOf struct{ owner uuid.UUID }
+
+func (o ownerOf) GetMember(ctx context.Context, workspaceID, userID uuid.UUID) (*wsmodel.WorkspaceMember, error) {
+	role := wsmodel.RoleMember
+	if userID == o.owner {
+		role = wsmodel.RoleOwner
+	}
+	return &wsmodel.WorkspaceMember{WorkspaceID: workspaceID, UserID: userID, Role: role}, nil
+}
+
+func TestStyleGuide(t *testing.T) {
+	repo := &fakeRepo{}
+	owner, member, workspaceID := uuid.New(), uuid.New(), uuid.New()
+	gen := &scriptedGenerator{replies: []string{"flowchart LR\n  A --> B", "flowchart LR\n  A --> B"}}
+	s := New(gen, config.AIConfig{}, repo, ownerOf{owner}, nil, nil)
+	ctx := context.Background()
+
+	empty, err := s.GetStyleGuide(ctx, workspaceID, member)
+	if err != nil || empty.WorkspaceID != workspaceID || empty.UpdatedAt != nil {
+		t.Fatalf("empty guide = %+v, %v", empty, err)
+	}
+	var de *common.DomainError
+	if _, err := s.UpdateStyleGuide(ctx, workspaceID, member, StyleGuideInput{Direction: "LR"}); !errors.As(err, &de) || de.Code != common.CodeForbidden {
+		t.Errorf("member update err = %v, want forbidden", err)
+	}
+	if _, err := s.UpdateStyleGuide(ctx, workspaceID, owner, StyleGuideInput{Direction: "sideways"}); !errors.As(err, &de) || de.Code != common.CodeInvalidInput {
+		t.Errorf("bad direction err = %v, want invalid input", err)
+	}
+	saved, err := s.UpdateStyleGuide(ctx, workspaceID, owner, StyleGuideInput{Direction: "lr", Naming: " PascalCase services "})
+	if err != nil || saved.Direction != "LR" || saved.Naming != "PascalCase services" {
+		t.Fatalf("saved = %+v, %v", saved, err)
+	}
+
+	// The guide reaches workspace generations only.
+	if _, err := s.GenerateDiagram(ctx, member, GenerateInput{Description: "checkout", WorkspaceID: &workspaceID}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GenerateDiagram(ctx, member, GenerateInput{Description: "checkout"}); err != nil {
+		t.Fatal(err)
+	}
+	if sys := gen.requests[0].System; !strings.Contains(sys, "Preferred direction: LR") || !strings.Contains(sys, "PascalCase services") {
+		t.Errorf("workspace system prompt lacks the style guide:\n%s", sys)
+	}
+	if strings.Contains(gen.requests[1].System, "style guide") {
+		t.Error("style guide sent without a workspace")
+	}
+
+	if err := s.DeleteStyleGuide(ctx, workspaceID, owner); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteStyleGuide(ctx, workspaceID, owner); !errors.As(err, &de) || de.Code != common.CodeNotFound {
+		t.Errorf("second delete err = %v, want not found", err)
+	}
+}
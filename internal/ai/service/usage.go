@@ -0,0 +1,245 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/devenock/d_weaver/internal/ai/client"
+	"github.com/devenock/d_weaver/internal/ai/model"
+	"github.com/devenock/d_weaver/internal/common"
+	wsmodel "github.com/devenock/d_weaver/internal/workspace/model"
+	"github.com/google/uuid"
+)
+
+// CodeQuotaExceeded is returned when a workspace or user has used its monthly AI quota.
+const CodeQuotaExceeded = "quota_exceeded"
+
+// usageWriteTimeout bounds recording a call's usage after its request may have been cancelled.
+const usageWriteTimeout = 5 * time.Second
+
+// meteredGenerator counts the provider calls of one AI operation.
+type meteredGenerator struct {
+	client.Generator
+	model                     string
+	attempts                  int
+	inputTokens, outputTokens int
+}
+
+func (g *meteredGenerator) Complete(ctx context.Context, req client.Request) (*client.Response, error) {
+	resp, err := g.Generator.Complete(ctx, req)
+	g.count(resp)
+	return resp, err
+}
+
+func (g *meteredGenerator) Stream(ctx context.Context, req client.Request, onDelta func(string) error) (*client.Response, error) {
+	resp, err := g.Generator.Stream(ctx, req, onDelta)
+	g.count(resp)
+	return resp, err
+}
+
+func (g *meteredGenerator) count(resp *client.Response) {
+	g.attempts++
+	if resp == nil {
+		return
+	}
+	if resp.Model != "" {
+		g.model = resp.Model
+	}
+	g.inputTokens += resp.InputTokens
+	g.outputTokens += resp.OutputTokens
+}
+
+// metered reserves the call against the user's and workspace's monthly quotas, runs fn with gen wrapped
+// for counting and records the result on the reservation in ai_usage. workspaceID is the workspace billed
+// (nil for the user alone); fn reports whether its result passed validation.
+func (s *Service) metered(ctx context.Context, operation string, userID uuid.UUID, workspaceID *uuid.UUID, gen client.Generator, fn func(gen client.Generator) (bool, error)) error {
+	u := &model.Usage{WorkspaceID: workspaceID, UserID: userID, Operation: operation}
+	if err := s.reserveUsage(ctx, u); err != nil {
+		return err
+	}
+	m := &meteredGenerator{Generator: gen}
+	start := time.Now()
+	valid, err := fn(m)
+	u.Model, u.InputTokens, u.OutputTokens, u.Attempts = m.model, m.inputTokens, m.outputTokens, m.attempts
+	u.LatencyMs = int(time.Since(start).Milliseconds())
+	u.Outcome = usageOutcome(ctx, valid, err)
+	s.finishUsage(ctx, u)
+	return err
+}
+
+// reserveUsage records u as a pending call, or returns CodeQuotaExceeded when the workspace or the user
+// has reached a monthly limit. Pending calls count as requests, so concurrent calls cannot overshoot
+// the request quotas; tokens are only known once calls finish.
+func (s *Service) reserveUsage(ctx context.Context, u *model.Usage) error {
+	limits := model.UsageLimits{
+		Since:             monthStart(time.Now()),
+		WorkspaceRequests: s.cfg.WorkspaceMonthlyRequests,
+		WorkspaceTokens:   s.cfg.WorkspaceMonthlyTokens,
+		UserRequests:      s.cfg.UserMonthlyRequests,
+		UserTokens:        s.cfg.UserMonthlyTokens,
+	}
+	reached, err := s.repo.ReserveUsage(ctx, u, limits)
+	switch {
+	case err != nil:
+		return common.NewDomainError(common.CodeInternalError, "Failed to check AI usage.", err)
+	case reached == model.QuotaWorkspace:
+		return common.NewDomainError(CodeQuotaExceeded, "This workspace has used its monthly AI quota.", nil)
+	case reached == model.QuotaUser:
+		return common.NewDomainError(CodeQuotaExceeded, "You have used your monthly AI quota.", nil)
+	}
+	return nil
+}
+
+// finishUsage records the result of a reserved call. Failures are logged, not returned: the caller
+// already has its result.
+func (s *Service) finishUsage(ctx context.Context, u *model.Usage) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), usageWriteTimeout)
+	defer cancel()
+	if err := s.repo.FinishUsage(ctx, u); err != nil && s.log != nil {
+		s.log.Warn().Err(err).Str("operation", u.Operation).Msg("ai: record usage failed")
+	}
+}
+
+// recordUsage stores u. Failures are logged, not returned: the caller already has its result.
+func (s *Service) recordUsage(ctx context.Context, u *model.Usage) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), usageWriteTimeout)
+	defer cancel()
+	if err := s.repo.CreateUsage(ctx, u); err != nil && s.log != nil {
+		s.log.Warn().Err(err).Str("operation", u.Operation).Msg("ai: record usage failed")
+	}
+}
+
+// usageOutcome classifies a finished AI call for ai_usage.
+func usageOutcome(ctx context.Context, valid bool, err error) string {
+	if err == nil {
+		if valid {
+			return model.OutcomeSuccess
+		}
+		return model.OutcomeInvalid
+	}
+	if ctx.Err() != nil || errors.Is(err, context.Canceled) {
+		return model.OutcomeCancelled
+	}
+	var de *common.DomainError
+	if errors.As(err, &de) {
+		switch de.Code {
+		case "rate_limit_exceeded":
+			return model.OutcomeRateLimited
+		case "payment_required":
+			return model.OutcomePaymentRequired
+		}
+	}
+	return model.OutcomeError
+}
+
+// monthStart returns the start of t's calendar month in UTC.
+func monthStart(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// GetWorkspaceUsage returns the workspace's AI usage for month (YYYY-MM, empty for the current month)
+// broken down by model, operation and outcome, with its quota. Members only; the breakdown by user is
+// for owners and admins.
+func (s *Service) GetWorkspaceUsage(ctx context.Context, workspaceID, userID uuid.UUID, month string) (*model.UsageReport, error) {
+	m, err := s.ensureMember(ctx, workspaceID, userID)
+	if err != nil {
+		return nil, err
+	}
+	from := monthStart(time.Now())
+	if month != "" {
+		t, err := time.Parse("2006-01", month)
+		if err != nil {
+			return nil, common.NewDomainError(common.CodeInvalidInput, "Month must be formatted as YYYY-MM.", err)
+		}
+		from = t
+	}
+	to := from.AddDate(0, 1, 0)
+	groups, err := s.repo.ListWorkspaceUsage(ctx, workspaceID, from, to)
+	if err != nil {
+		return nil, common.NewDomainError(common.CodeInternalError, "Failed to load AI usage.", err)
+	}
+	report := &model.UsageReport{
+		WorkspaceID: workspaceID,
+		Month:       from.Format("2006-01"),
+		PeriodStart: from,
+		PeriodEnd:   to,
+	}
+	byUser, byModel, byOperation, byOutcome := usageAggregator{}, usageAggregator{}, usageAggregator{}, usageAggregator{}
+	for _, g := range groups {
+		report.Totals = addUsage(report.Totals, g)
+		userKey := ""
+		if g.UserID != nil {
+			userKey = g.UserID.String()
+		}
+		byUser.add(userKey, g)
+		byModel.add(g.Model, g)
+		byOperation.add(g.Operation, g)
+		byOutcome.add(g.Outcome, g)
+	}
+	report.Totals = finishUsage(report.Totals)
+	report.ByModel, report.ByOperation, report.ByOutcome = byModel.list(), byOperation.list(), byOutcome.list()
+	if m.Role == wsmodel.RoleOwner || m.Role == wsmodel.RoleAdmin {
+		report.ByUser = byUser.list()
+	}
+	report.Quota = quotaFor(report.Totals, s.cfg.WorkspaceMonthlyRequests, s.cfg.WorkspaceMonthlyTokens)
+	return report, nil
+}
+
+// usageAggregator sums usage groups by key. While summing, AvgLatencyMs holds the latency total.
+type usageAggregator map[string]model.UsageStats
+
+func (a usageAggregator) add(key string, g model.UsageGroup) {
+	a[key] = addUsage(a[key], g)
+}
+
+// list returns the breakdowns by total tokens, most first.
+func (a usageAggregator) list() []model.UsageBreakdown {
+	out := make([]model.UsageBreakdown, 0, len(a))
+	for key, stats := range a {
+		out = append(out, model.UsageBreakdown{Key: key, UsageStats: finishUsage(stats)})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].TotalTokens != out[j].TotalTokens {
+			return out[i].TotalTokens > out[j].TotalTokens
+		}
+		return out[i].Key < out[j].Key
+	})
+	return out
+}
+
+func addUsage(s model.UsageStats, g model.UsageGroup) model.UsageStats {
+	s.Calls += g.Calls
+	if g.Outcome == model.OutcomeSuccess || g.Outcome == model.OutcomeInvalid {
+		s.Requests += g.Calls
+	}
+	s.InputTokens += g.InputTokens
+	s.OutputTokens += g.OutputTokens
+	s.TotalTokens += g.InputTokens + g.OutputTokens
+	s.AvgLatencyMs += g.LatencyMs
+	return s
+}
+
+// finishUsage turns the summed latency into the average per call.
+func finishUsage(s model.UsageStats) model.UsageStats {
+	if s.Calls > 0 {
+		s.AvgLatencyMs /= s.Calls
+	}
+	return s
+}
+
+// quotaFor returns the limits and what used leaves of them; 0 limits are unlimited (nil).
+func quotaFor(used model.UsageStats, maxRequests, maxTokens int) model.UsageQuota {
+	var q model.UsageQuota
+	if maxRequests > 0 {
+		remaining := max(maxRequests-used.Requests, 0)
+		q.MonthlyRequests, q.RemainingRequests = &maxRequests, &remaining
+	}
+	if maxTokens > 0 {
+		remaining := max(maxTokens-used.TotalTokens, 0)
+		q.MonthlyTokens, q.RemainingTokens = &maxTokens, &remaining
+	}
+	return q
+}
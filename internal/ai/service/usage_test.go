@@ -0,0 +1,142 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/devenock/d_weaver/config"
+	"github.com/devenock/d_weaver/internal/ai/client"
+	"github.com/devenock/d_weaver/internal/ai/model"
+	"github.com/devenock/d_weaver/internal/common"
+	"github.com/google/uuid"
+)
+
+func TestGenerateDiagram_RecordsUsage(t *testing.T) {
+	repo := &fakeRepo{}
+	gen := &scriptedGenerator{replies: []string{"flowchart TD\n  A[x --> B", "flowchart TD\n  A --> B"}}
+	s := New(gen, config.AIConfig{MaxAttempts: 3}, repo, everyoneMember{}, nil, nil)
+	workspaceID, userID := uuid.New(), uuid.New()
+
+	if _, err := s.GenerateDiagram(context.Background(), userID, GenerateInput{Description: "login", WorkspaceID: &workspaceID}); err != nil {
+		t.Fatal(err)
+	}
+	if len(repo.usage) != 1 {
+		t.Fatalf("recorded %d calls, want 1", len(repo.usage))
+	}
+	u := repo.usage[0]
+	if u.Operation != model.OperationGenerate || u.Outcome != model.OutcomeSuccess || u.Attempts != 2 ||
+		u.InputTokens != 20 || u.OutputTokens != 10 || u.Model != "m" || u.UserID != userID || *u.WorkspaceID != workspaceID {
+		t.Errorf("usage = %+v", u)
+	}
+
+	gen = &scriptedGenerator{errs: []error{client.ErrRateLimited}}
+	s = New(gen, config.AIConfig{}, repo, nil, nil, nil)
+	if _, err := s.GenerateDiagram(context.Background(), userID, GenerateInput{Description: "login"}); err == nil {
+		t.Fatal("want error")
+	}
+	if u := repo.usage[1]; u.Outcome != model.OutcomeRateLimited || u.WorkspaceID != nil || u.Attempts != 1 {
+		t.Errorf("failed usage = %+v", u)
+	}
+}
+
+func TestGenerateDiagram_Quota(t *testing.T) {
+	workspaceID, userID := uuid.New(), uuid.New()
+	repo := &fakeRepo{usage: []model.Usage{
+		{WorkspaceID: &workspaceID, UserID: uuid.New(), Outcome: model.OutcomeSuccess, InputTokens: 900, OutputTokens: 100, CreatedAt: time.Now()},
+		{WorkspaceID: &workspaceID, UserID: uuid.New(), Outcome: model.OutcomeSuccess, InputTokens: 900, OutputTokens: 100, CreatedAt: monthStart(time.Now()).Add(-time.Hour)},
+	}}
+	gen := &scriptedGenerator{replies: []string{"flowchart TD\n  A --> B"}}
+
+	s := New(gen, config.AIConfig{WorkspaceMonthlyTokens: 1000}, repo, everyoneMember{}, nil, nil)
+	_, err := s.GenerateDiagram(context.Background(), userID, GenerateInput{Description: "login", WorkspaceID: &workspaceID})
+	var de *common.DomainError
+	if !errors.As(err, &de) || de.Code != CodeQuotaExceeded {
+		t.Fatalf("err = %v, want %s", err, CodeQuotaExceeded)
+	}
+	if len(gen.requests) != 0 {
+		t.Error("provider was called over quota")
+	}
+
+	// Last month's usage does not count, and without a workspace only the user quota applies.
+	s = New(gen, config.AIConfig{WorkspaceMonthlyTokens: 2000, UserMonthlyRequests: 1}, repo, everyoneMember{}, nil, nil)
+	if _, err := s.GenerateDiagram(context.Background(), userID, GenerateInput{Description: "login", WorkspaceID: &workspaceID}); err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.GenerateDiagram(context.Background(), userID, GenerateInput{Description: "login"})
+	if !errors.As(err, &de) || de.Code != CodeQuotaExceeded {
+		t.Errorf("second call err = %v, want user quota exceeded", err)
+	}
+}
+
+func TestGetWorkspaceUsage(t *testing.T) {
+	workspaceID, alice, bob := uuid.New(), uuid.New(), uuid.New()
+	now := time.Now()
+	repo := &fakeRepo{usage: []model.Usage{
+		{WorkspaceID: &workspaceID, UserID: alice, Model: "m1", Operation: model.OperationGenerate, Outcome: model.OutcomeSuccess, InputTokens: 100, OutputTokens: 50, LatencyMs: 300, CreatedAt: now},
+		{WorkspaceID: &workspaceID, UserID: alice, Model: "m1", Operation: model.OperationEdit, Outcome: model.OutcomeError, LatencyMs: 100, CreatedAt: now},
+		{WorkspaceID: &workspaceID, UserID: bob, Model: "m2", Operation: model.OperationGenerate, Outcome: model.OutcomeInvalid, InputTokens: 400, OutputTokens: 200, LatencyMs: 800, CreatedAt: now},
+	}}
+	s := New(nil, config.AIConfig{WorkspaceMonthlyRequests: 10}, repo, ownerOf{alice}, nil, nil)
+
+	report, err := s.GetWorkspaceUsage(context.Background(), workspaceID, alice, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := model.UsageStats{Calls: 3, Requests: 2, InputTokens: 500, OutputTokens: 250, TotalTokens: 750, AvgLatencyMs: 400}
+	if report.Totals != want {
+		t.Errorf("totals = %+v, want %+v", report.Totals, want)
+	}
+	if len(report.ByUser) != 2 || report.ByUser[0].Key != bob.String() || report.ByUser[1].Calls != 2 {
+		t.Errorf("by user = %+v", report.ByUser)
+	}
+	if len(report.ByOutcome) != 3 || len(report.ByModel) != 2 || len(report.ByOperation) != 2 {
+		t.Errorf("breakdowns = %+v %+v %+v", report.ByOutcome, report.ByModel, report.ByOperation)
+	}
+	if q := report.Quota; q.MonthlyRequests == nil || *q.RemainingRequests != 8 || q.MonthlyTokens != nil {
+		t.Errorf("quota = %+v", q)
+	}
+
+	past, err := s.GetWorkspaceUsage(context.Background(), workspaceID, alice, "2020-01")
+	if err != nil || past.Totals.Calls != 0 || past.ByUser == nil || !past.PeriodEnd.Equal(time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("past month = %+v, %v", past, err)
+	}
+	if _, err := s.GetWorkspaceUsage(context.Background(), workspaceID, alice, "January"); err == nil {
+		t.Error("want error for a malformed month")
+	}
+	if member, err := s.GetWorkspaceUsage(context.Background(), workspaceID, bob, ""); err != nil || member.ByUser != nil || member.Totals != want {
+		t.Errorf("member report = %+v, %v; want totals without the breakdown by user", member, err)
+	}
+}
+
+func TestGenerateDiagram_ReservesBeforeTheProviderCall(t *testing.T) {
+	repo := &lockedRepo{fakeRepo: &fakeRepo{}}
+	gen := &gatedGenerator{release: make(chan struct{})}
+	s := New(gen, config.AIConfig{UserMonthlyRequests: 1}, repo, nil, nil, nil)
+	userID := uuid.New()
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.GenerateDiagram(context.Background(), userID, GenerateInput{Description: "login"})
+		done <- err
+	}()
+	for gen.calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The first call is still with the provider, but already holds the only request.
+	_, err := s.GenerateDiagram(context.Background(), userID, GenerateInput{Description: "signup"})
+	var de *common.DomainError
+	if !errors.As(err, &de) || de.Code != CodeQuotaExceeded {
+		t.Errorf("concurrent call err = %v, want %s", err, CodeQuotaExceeded)
+	}
+	close(gen.release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	if len(repo.usage) != 1 || repo.usage[0].Outcome != model.OutcomeSuccess || repo.usage[0].Attempts != 1 {
+		t.Errorf("usage = %+v, want the reservation finished as a success", repo.usage)
+	}
+}
@@ -12,8 +12,11 @@ import (
 
 	"github.com/devenock/d_weaver/config"
 	"github.com/devenock/d_weaver/docs"
+	aicache "github.com/devenock/d_weaver/internal/ai/cache"
 	"github.com/devenock/d_weaver/internal/ai/client"
 	aihandler "github.com/devenock/d_weaver/internal/ai/handler"
+	"github.com/devenock/d_weaver/internal/ai/prompt"
+	airepo "github.com/devenock/d_weaver/internal/ai/repository"
 	aisvc "github.com/devenock/d_weaver/internal/ai/service"
 	authemail "github.com/devenock/d_weaver/internal/auth/email"
 	"github.com/devenock/d_weaver/internal/auth/handler"
@@ -39,8 +42,15 @@ import (
 type App struct {
 	Router *gin.Engine
 	Server *http.Server
+	// InternalServer serves operational endpoints on Server.InternalAddr; nil when that is empty.
+	InternalServer *http.Server
 	Config *config.Config
 	Log    pkglogger.Logger
+
+	hub      *realtime.Hub      // drained before the HTTP server stops
+	stopHub  context.CancelFunc // stops the realtime hub loop (final snapshot flush)
+	stopJobs context.CancelFunc // stops the AI batch job workers; running items go back to pending
+	jobsDone <-chan struct{}    // closed once the job workers have returned
 }
 
 // New builds the Gin engine, binds routes and middleware, and returns App and Server.
@@ -48,6 +58,11 @@ type App struct {
 func New(cfg *config.Config, log pkglogger.Logger) (*App, error) {
 	gin.SetMode(gin.ReleaseMode)
 	r := gin.New()
+	// Forwarded client IPs are only believed from configured proxies; gin trusts every peer by default,
+	// which would let clients spoof the IP that rate limits and realtime tickets are bound to.
+	if err := r.SetTrustedProxies(cfg.Server.TrustedProxies); err != nil {
+		return nil, fmt.Errorf("app: trusted proxies: %w", err)
+	}
 	r.Use(gin.Recovery())
 
 	// CORS (from config). Fallback to allow all origins if empty (e.g. env JSON not parsed).
@@ -86,15 +101,14 @@ func New(cfg *config.Config, log pkglogger.Logger) (*App, error) {
 		_ = os.MkdirAll(cfg.Upload.Dir, 0755)
 	}
 
-	// Health and readiness (PDF: /health and /ready)
+	// Health (PDF: /health); /ready is registered with the AI client below
 	r.GET("/health", func(c *gin.Context) { c.JSON(http.StatusOK, gin.H{"status": "ok"}) })
-	r.GET("/ready", func(c *gin.Context) { c.JSON(http.StatusOK, gin.H{"status": "ready"}) })
 	// Swagger/OpenAPI per module (AGENTS: document each module)
 	r.GET("/api-docs/auth", docs.ServeAuth)
 	r.GET("/api-docs/workspace", docs.ServeWorkspace)
 	r.GET("/api-docs/diagram", docs.ServeDiagram)
 	r.GET("/api-docs/ai", docs.ServeAI)
-	r.GET("/api-docs/realtime", docs.ServeRealtime)
+	r.GET("/api-docs/realtime", realtime.ServeSchema)
 	// Interactive Swagger UI — use API port (e.g. http://localhost:8200/swagger), not the frontend port
 	r.GET("/swagger", docs.ServeSwagger)
 	r.GET("/swagger/", docs.ServeSwagger)
@@ -114,17 +128,22 @@ func New(cfg *config.Config, log pkglogger.Logger) (*App, error) {
 		return nil, fmt.Errorf("app: jwt: %w", err)
 	}
 
-	// Rate limiting: Redis-backed when Redis.URL set, else in-memory
-	var limiter middleware.Limiter
-	if cfg.Redis.URL != "" && cfg.RateLimit.Enabled {
+	// Redis (optional): shared by rate limiting and the realtime hub when Redis.URL is set
+	var rdb *redis.Client
+	if cfg.Redis.URL != "" {
 		ropts, err := redis.ParseURL(cfg.Redis.URL)
 		if err == nil {
-			rdb := redis.NewClient(ropts)
-			store := middleware.NewRedisStore(rdb)
-			limiter = middleware.NewRedisLimiter(store, cfg.RateLimit.RequestsPerMinute, time.Minute)
-		} else {
-			limiter = middleware.NewMemoryLimiter(cfg.RateLimit.RequestsPerMinute, time.Minute)
+			rdb = redis.NewClient(ropts)
+		} else if log != nil {
+			log.Warn().Err(err).Msg("invalid REDIS_URL; using in-memory rate limiting and realtime hub")
 		}
+	}
+
+	// Rate limiting: Redis-backed when Redis.URL set, else in-memory
+	var limiter middleware.Limiter
+	if rdb != nil && cfg.RateLimit.Enabled {
+		store := middleware.NewRedisStore(rdb)
+		limiter = middleware.NewRedisLimiter(store, cfg.RateLimit.RequestsPerMinute, time.Minute)
 	} else {
 		limiter = middleware.NewMemoryLimiter(cfg.RateLimit.RequestsPerMinute, time.Minute)
 	}
@@ -170,14 +189,88 @@ func New(cfg *config.Config, log pkglogger.Logger) (*App, error) {
 	diagramHandler := diagramhandler.New(diagramSvc, jwtIssuer, cfg.Upload, log)
 	diagramHandler.Register(v1)
 
-	aiGen := client.NewHTTPGenerator(cfg.AI.APIKey, cfg.AI.BaseURL, cfg.AI.Model)
-	aiSvc := aisvc.New(aiGen)
+	aiGen, err := client.New(cfg.AI)
+	if err != nil {
+		return nil, fmt.Errorf("app: ai: %w", err)
+	}
+	prompts, err := prompt.Load(cfg.AI.PromptDir)
+	if err != nil {
+		return nil, fmt.Errorf("app: ai: %w", err)
+	}
+	if log != nil {
+		log.Info().Str("version", prompts.Version()).Str("dir", cfg.AI.PromptDir).Msg("AI prompts loaded")
+	}
+	aiRepo := airepo.New(pool)
+	aiSvc := aisvc.New(aiGen, cfg.AI, aiRepo, workspaceRepo, diagramSvc, log)
+	aiSvc.SetPrompts(client.NewPrompts(prompts))
+	// Response cache: shared across replicas via Redis when Redis.URL set, else in-process only
+	if cfg.AI.CacheTTLSeconds > 0 {
+		var store aicache.Store
+		if rdb != nil {
+			store = aicache.NewRedisStore(rdb)
+		} else {
+			store = aicache.NewMemoryStore(cfg.AI.CacheMaxEntries)
+		}
+		aiSvc.SetCache(store, time.Duration(cfg.AI.CacheTTLSeconds)*time.Second)
+	}
 	aiHandler := aihandler.New(aiSvc)
 	aiHandler.Register(v1, jwtIssuer)
+	// Batch job workers. Items are claimed through the database, so every replica can run its own.
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	jobsDone := make(chan struct{})
+	go func() {
+		defer close(jobsDone)
+		if cfg.AI.JobWorkers > 0 {
+			aiSvc.RunJobs(jobsCtx, cfg.AI.JobWorkers)
+		}
+	}()
+	// Readiness reports the AI provider's circuit but stays 200 while it is open: the API still serves
+	// everything else.
+	r.GET("/ready", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"status": "ready", "ai": gin.H{
+			"provider":        cfg.AI.Provider,
+			"default_circuit": client.CircuitState(cfg.AI),
+			"circuits":        client.CircuitCounts(),
+		}})
+	})
 
-	realtimeHub := realtime.NewHub()
-	realtimeHandler := realtime.NewHandler(realtimeHub, jwtIssuer, diagramSvc)
+	// Realtime hub: rooms span API replicas via Redis pub/sub when Redis.URL set, else in-process only
+	var hubBackend realtime.Backend
+	if rdb != nil {
+		hubBackend = realtime.NewRedisBackend(rdb, log)
+	} else {
+		hubBackend = realtime.NewMemoryBackend()
+	}
+	realtimeHub := realtime.NewHub(diagramSvc, diagramSvc, hubBackend, cfg.Realtime, log)
+	hubCtx, stopHub := context.WithCancel(context.Background())
+	go realtimeHub.Run(hubCtx)
+	workspaceSvc.SetMembershipObserver(realtimeHub)
+	aiSvc.SetLiveDocuments(realtimeHub)
+	diagramSvc.SetLiveDocuments(realtimeHub)
+	// WebSocket tickets live in Redis when set so any replica can redeem them
+	var tickets realtime.TicketStore
+	if rdb != nil {
+		tickets = realtime.NewRedisTicketStore(rdb)
+	} else {
+		tickets = realtime.NewMemoryTicketStore()
+	}
+	realtimeHandler := realtime.NewHandler(realtimeHub, jwtIssuer, diagramSvc, tickets, cfg.Realtime, allowOrigins)
+	realtimeHandler.Register(v1)
 	r.GET("/ws/collaboration/:diagramId", realtimeHandler.ServeWS)
+	// Operational: this node's slow-consumer counters per room. They name the diagrams being edited, so
+	// they are served on the internal listener only.
+	var internalSrv *http.Server
+	if cfg.Server.InternalAddr != "" {
+		ir := gin.New()
+		ir.Use(gin.Recovery())
+		ir.GET("/realtime/stats", realtimeHandler.Stats)
+		internalSrv = &http.Server{
+			Addr:         cfg.Server.InternalAddr,
+			Handler:      ir,
+			ReadTimeout:  time.Duration(cfg.Server.ReadTimeout) * time.Second,
+			WriteTimeout: time.Duration(cfg.Server.WriteTimeout) * time.Second,
+		}
+	}
 
 	addr := fmt.Sprintf("%s:%d", cfg.Server.Host, cfg.Server.Port)
 	srv := &http.Server{
@@ -187,7 +280,7 @@ func New(cfg *config.Config, log pkglogger.Logger) (*App, error) {
 		WriteTimeout: time.Duration(cfg.Server.WriteTimeout) * time.Second,
 	}
 
-	return &App{Router: r, Server: srv, Config: cfg, Log: log}, nil
+	return &App{Router: r, Server: srv, InternalServer: internalSrv, Config: cfg, Log: log, hub: realtimeHub, stopHub: stopHub, stopJobs: stopJobs, jobsDone: jobsDone}, nil
 }
 
 // Run starts the HTTP server and blocks until SIGTERM/SIGINT, then shuts down gracefully.
@@ -205,6 +298,20 @@ func (a *App) Run() error {
 			}
 		}
 	}()
+	if a.InternalServer != nil {
+		if a.Log != nil {
+			a.Log.Info().Str("addr", a.InternalServer.Addr).Msg("internal server starting")
+		}
+		go func() {
+			if err := a.InternalServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				if a.Log != nil {
+					a.Log.Error().Err(err).Msg("internal server error")
+				} else {
+					_, _ = os.Stderr.WriteString("internal server: " + err.Error() + "\n")
+				}
+			}
+		}()
+	}
 
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGTERM, syscall.SIGINT)
@@ -215,8 +322,32 @@ func (a *App) Run() error {
 	}
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
+	// WebSockets are hijacked, so Server.Shutdown neither waits for nor closes them: drain them first.
+	if a.hub != nil {
+		if err := a.hub.Shutdown(ctx); err != nil && a.Log != nil {
+			a.Log.Warn().Err(err).Msg("realtime drain incomplete")
+		}
+	}
 	if err := a.Server.Shutdown(ctx); err != nil {
 		return fmt.Errorf("server shutdown: %w", err)
 	}
+	if a.InternalServer != nil {
+		if err := a.InternalServer.Shutdown(ctx); err != nil {
+			return fmt.Errorf("internal server shutdown: %w", err)
+		}
+	}
+	if a.stopJobs != nil {
+		a.stopJobs()
+		select {
+		case <-a.jobsDone:
+		case <-ctx.Done():
+			if a.Log != nil {
+				a.Log.Warn().Msg("AI job workers did not stop in time")
+			}
+		}
+	}
+	if a.stopHub != nil {
+		a.stopHub()
+	}
 	return nil
 }
@@ -29,6 +29,11 @@ func WriteCreated(c *gin.Context, data interface{}) {
 	c.JSON(http.StatusCreated, SuccessBody{Data: data})
 }
 
+// WriteAccepted writes a 202 JSON response with a "data" envelope, for work that continues in the background.
+func WriteAccepted(c *gin.Context, data interface{}) {
+	c.JSON(http.StatusAccepted, SuccessBody{Data: data})
+}
+
 // WriteNoContent sends 204 No Content.
 func WriteNoContent(c *gin.Context) {
 	c.Status(http.StatusNoContent)
@@ -0,0 +1,88 @@
+// Package convert turns source artifacts into Mermaid diagrams without AI: Postgres DDL into an
+// erDiagram, Go packages into a classDiagram and OpenAPI documents into a flowchart of endpoints.
+// The output depends only on the input, so regenerating from unchanged sources gives the same diagram.
+package convert
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// Source kinds accepted by Convert.
+const (
+	SourceSQL     = "sql"
+	SourceGo      = "go"
+	SourceOpenAPI = "openapi"
+)
+
+// Result is a generated diagram. DiagramType is the value stored on diagrams (er, class, flowchart).
+type Result struct {
+	Content     string
+	DiagramType string
+}
+
+// Options tune the converters. Unexported includes unexported Go types and members.
+type Options struct {
+	Unexported bool
+}
+
+// ValidSource reports whether source is a supported source kind.
+func ValidSource(source string) bool {
+	return source == SourceSQL || source == SourceGo || source == SourceOpenAPI
+}
+
+// Convert runs the converter for source over data. Go sources are a tar archive, optionally gzipped.
+func Convert(source string, data []byte, opts Options) (*Result, error) {
+	switch source {
+	case SourceSQL:
+		content, err := SQL(string(data))
+		if err != nil {
+			return nil, err
+		}
+		return &Result{Content: content, DiagramType: "er"}, nil
+	case SourceGo:
+		content, err := GoPackages(bytes.NewReader(data), opts)
+		if err != nil {
+			return nil, err
+		}
+		return &Result{Content: content, DiagramType: "class"}, nil
+	case SourceOpenAPI:
+		content, err := OpenAPI(data)
+		if err != nil {
+			return nil, err
+		}
+		return &Result{Content: content, DiagramType: "flowchart"}, nil
+	default:
+		return nil, fmt.Errorf("unknown source %q", source)
+	}
+}
+
+// sanitizeName makes s a Mermaid identifier: letters, digits, "_" and "-"; anything else becomes "_".
+func sanitizeName(s string) string {
+	return strings.Map(func(r rune) rune {
+		if isNameRune(r) {
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// sanitizeType is sanitizeName that also keeps the brackets of array types.
+func sanitizeType(s string) string {
+	return strings.Map(func(r rune) rune {
+		if isNameRune(r) || r == '[' || r == ']' {
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+func isNameRune(r rune) bool {
+	return r == '_' || r == '-' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9'
+}
+
+// escapeLabel escapes text for a quoted Mermaid label.
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`"`, "#quot;", "\n", " ", "\r", "").Replace(s)
+}
@@ -0,0 +1,627 @@
+package convert
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io"
+	"path"
+	"sort"
+	"strings"
+)
+
+const (
+	// maxGoBytes bounds the uncompressed Go source read from an archive.
+	maxGoBytes = 32 << 20
+	// maxGoFiles bounds the number of Go files read from an archive.
+	maxGoFiles = 2000
+	// maxClasses bounds the diagram; larger uploads should be split per package.
+	maxClasses = 500
+)
+
+// GoPackages converts the Go packages in a tar archive (optionally gzipped) into a classDiagram: one
+// class per named type with its fields and methods, interfaces marked <<interface>>. Embedding shows as
+// inheritance, fields of another uploaded type as associations, and types whose method sets cover an
+// interface as realizations. Test files, vendor/, testdata/ and hidden directories are skipped. With
+// several packages each gets a namespace and class names are prefixed with the package name.
+func GoPackages(r io.Reader, opts Options) (string, error) {
+	files, err := readGoArchive(r)
+	if err != nil {
+		return "", err
+	}
+	if len(files) == 0 {
+		return "", errors.New("no Go files found in the archive")
+	}
+	pkgs, err := parseGoPackages(files)
+	if err != nil {
+		return "", err
+	}
+	return renderClasses(pkgs, opts)
+}
+
+type goFile struct {
+	name string
+	src  []byte
+}
+
+// readGoArchive returns the non-test .go files of a tar or tar.gz archive, sorted by name.
+func readGoArchive(r io.Reader) ([]goFile, error) {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("gzip: %w", err)
+		}
+		defer zr.Close()
+		r = zr
+	} else {
+		r = br
+	}
+	tr := tar.NewReader(r)
+	var files []goFile
+	budget := int64(maxGoBytes)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("tar: %w", err)
+		}
+		name := path.Clean(strings.TrimPrefix(hdr.Name, "/"))
+		if hdr.Typeflag != tar.TypeReg || !isGoSource(name) {
+			continue
+		}
+		if len(files) == maxGoFiles {
+			return nil, fmt.Errorf("archive has more than %d Go files", maxGoFiles)
+		}
+		if hdr.Size > budget {
+			return nil, fmt.Errorf("archive has more than %d bytes of Go source", maxGoBytes)
+		}
+		src, err := io.ReadAll(io.LimitReader(tr, hdr.Size))
+		if err != nil {
+			return nil, fmt.Errorf("tar: %w", err)
+		}
+		budget -= int64(len(src))
+		files = append(files, goFile{name: name, src: src})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].name < files[j].name })
+	return files, nil
+}
+
+// isGoSource reports whether an archive path is a Go file the converter reads.
+func isGoSource(name string) bool {
+	if !strings.HasSuffix(name, ".go") || strings.HasSuffix(name, "_test.go") {
+		return false
+	}
+	for _, part := range strings.Split(path.Dir(name), "/") {
+		if part == "vendor" || part == "testdata" || (part != "." && (strings.HasPrefix(part, ".") || strings.HasPrefix(part, "_"))) {
+			return false
+		}
+	}
+	return !strings.HasPrefix(path.Base(name), ".") && !strings.HasPrefix(path.Base(name), "_")
+}
+
+type goPackage struct {
+	name  string
+	dir   string
+	id    string // class name prefix, empty when there is only one package
+	types map[string]*goType
+}
+
+type goType struct {
+	pkg        *goPackage
+	name       string
+	typeParams []string
+	spec       ast.Expr // the type expression after the name
+	methods    []*ast.FuncDecl
+}
+
+func (t *goType) id() string {
+	if t.pkg.id == "" {
+		return sanitizeName(t.name)
+	}
+	return t.pkg.id + "_" + sanitizeName(t.name)
+}
+
+// parseGoPackages parses files and groups their top-level types and methods by directory and package.
+func parseGoPackages(files []goFile) ([]*goPackage, error) {
+	fset := token.NewFileSet()
+	byKey := map[string]*goPackage{}
+	var pkgs []*goPackage
+	var decls []*ast.FuncDecl
+	var declPkgs []*goPackage
+	for _, f := range files {
+		file, err := parser.ParseFile(fset, f.name, f.src, parser.SkipObjectResolution)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %w", f.name, err)
+		}
+		key := path.Dir(f.name) + ":" + file.Name.Name
+		pkg := byKey[key]
+		if pkg == nil {
+			pkg = &goPackage{name: file.Name.Name, dir: path.Dir(f.name), types: map[string]*goType{}}
+			byKey[key] = pkg
+			pkgs = append(pkgs, pkg)
+		}
+		for _, decl := range file.Decls {
+			switch d := decl.(type) {
+			case *ast.GenDecl:
+				if d.Tok != token.TYPE {
+					continue
+				}
+				for _, spec := range d.Specs {
+					ts := spec.(*ast.TypeSpec)
+					if ts.Assign.IsValid() {
+						continue // aliases
+					}
+					t := &goType{pkg: pkg, name: ts.Name.Name, spec: ts.Type}
+					if ts.TypeParams != nil {
+						for _, field := range ts.TypeParams.List {
+							for _, n := range field.Names {
+								t.typeParams = append(t.typeParams, n.Name)
+							}
+						}
+					}
+					pkg.types[t.name] = t
+				}
+			case *ast.FuncDecl:
+				if d.Recv != nil && len(d.Recv.List) == 1 {
+					decls = append(decls, d)
+					declPkgs = append(declPkgs, pkg)
+				}
+			}
+		}
+	}
+	for i, d := range decls {
+		if t := declPkgs[i].types[receiverName(d.Recv.List[0].Type)]; t != nil {
+			t.methods = append(t.methods, d)
+		}
+	}
+	sort.Slice(pkgs, func(i, j int) bool {
+		return pkgs[i].dir < pkgs[j].dir || pkgs[i].dir == pkgs[j].dir && pkgs[i].name < pkgs[j].name
+	})
+	if len(pkgs) > 1 {
+		names := map[string]int{}
+		for _, p := range pkgs {
+			names[p.name]++
+		}
+		for _, p := range pkgs {
+			p.id = sanitizeName(p.name)
+			if names[p.name] > 1 {
+				p.id = sanitizeName(strings.ReplaceAll(p.dir, "/", "_") + "_" + p.name)
+			}
+		}
+	}
+	return pkgs, nil
+}
+
+// receiverName returns the base type name of a method receiver (T, *T, T[P], *T[P]).
+func receiverName(e ast.Expr) string {
+	for {
+		switch x := e.(type) {
+		case *ast.StarExpr:
+			e = x.X
+		case *ast.ParenExpr:
+			e = x.X
+		case *ast.IndexExpr:
+			e = x.X
+		case *ast.IndexListExpr:
+			e = x.X
+		case *ast.Ident:
+			return x.Name
+		default:
+			return ""
+		}
+	}
+}
+
+// classGraph renders the classes of several packages and resolves references between them.
+type classGraph struct {
+	pkgs      []*goPackage
+	opts      Options
+	relations []string
+	seen      map[string]bool
+}
+
+func renderClasses(pkgs []*goPackage, opts Options) (string, error) {
+	g := &classGraph{pkgs: pkgs, opts: opts, seen: map[string]bool{}}
+	total := 0
+	for _, p := range pkgs {
+		total += len(g.visibleTypes(p))
+	}
+	if total == 0 {
+		return "", errors.New("no types found in the Go source")
+	}
+	if total > maxClasses {
+		return "", fmt.Errorf("%d types is more than the %d a diagram can show; upload fewer packages", total, maxClasses)
+	}
+
+	var b strings.Builder
+	b.WriteString("classDiagram\n")
+	for _, p := range pkgs {
+		list := g.visibleTypes(p)
+		if len(list) == 0 {
+			continue
+		}
+		indent := "    "
+		if p.id != "" {
+			fmt.Fprintf(&b, "    namespace %s {\n", p.id)
+			indent = "        "
+		}
+		for _, t := range list {
+			g.writeClass(&b, indent, t)
+		}
+		if p.id != "" {
+			b.WriteString("    }\n")
+		}
+	}
+	for _, p := range pkgs {
+		for _, t := range g.visibleTypes(p) {
+			g.addRelations(t)
+		}
+	}
+	g.addRealizations()
+	for _, r := range g.relations {
+		b.WriteString("    " + r + "\n")
+	}
+	return strings.TrimSuffix(b.String(), "\n"), nil
+}
+
+// visibleTypes returns the package's types the diagram shows, sorted by name.
+func (g *classGraph) visibleTypes(p *goPackage) []*goType {
+	var out []*goType
+	for _, t := range p.types {
+		if g.opts.Unexported || ast.IsExported(t.name) {
+			out = append(out, t)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].name < out[j].name })
+	return out
+}
+
+func (g *classGraph) visible(t *goType) bool {
+	return t != nil && (g.opts.Unexported || ast.IsExported(t.name))
+}
+
+func (g *classGraph) writeClass(b *strings.Builder, indent string, t *goType) {
+	var members []string
+	switch spec := t.spec.(type) {
+	case *ast.StructType:
+		for _, f := range spec.Fields.List {
+			typ := typeString(f.Type)
+			if len(f.Names) == 0 {
+				// Embedded types that are drawn show as inheritance instead.
+				name := embeddedName(f.Type)
+				if !g.visible(g.resolve(t.pkg, f.Type)) && (g.opts.Unexported || ast.IsExported(name)) {
+					members = append(members, visibility(name)+typ)
+				}
+				continue
+			}
+			for _, n := range f.Names {
+				if g.opts.Unexported || n.IsExported() {
+					members = append(members, visibility(n.Name)+n.Name+" "+typ)
+				}
+			}
+		}
+	case *ast.InterfaceType:
+		members = append(members, "<<interface>>")
+		for _, m := range spec.Methods.List {
+			if ft, ok := m.Type.(*ast.FuncType); ok && len(m.Names) > 0 && (g.opts.Unexported || m.Names[0].IsExported()) {
+				members = append(members, visibility(m.Names[0].Name)+m.Names[0].Name+signature(ft))
+			}
+		}
+	default:
+		members = append(members, "<<"+typeString(t.spec)+">>")
+	}
+	for _, m := range t.methods {
+		if g.opts.Unexported || m.Name.IsExported() {
+			members = append(members, visibility(m.Name.Name)+m.Name.Name+signature(m.Type))
+		}
+	}
+	name := t.id()
+	if len(t.typeParams) > 0 {
+		name += "~" + strings.Join(t.typeParams, ",") + "~"
+	}
+	if len(members) == 0 {
+		fmt.Fprintf(b, "%sclass %s\n", indent, name)
+		return
+	}
+	fmt.Fprintf(b, "%sclass %s {\n", indent, name)
+	for _, m := range members {
+		fmt.Fprintf(b, "%s    %s\n", indent, m)
+	}
+	fmt.Fprintf(b, "%s}\n", indent)
+}
+
+// addRelations records embedding as inheritance and fields of drawn types as associations.
+func (g *classGraph) addRelations(t *goType) {
+	switch spec := t.spec.(type) {
+	case *ast.StructType:
+		for _, f := range spec.Fields.List {
+			target := g.resolve(t.pkg, f.Type)
+			if !g.visible(target) || target == t && len(f.Names) == 0 {
+				continue
+			}
+			if len(f.Names) == 0 {
+				g.relate(fmt.Sprintf("%s <|-- %s", target.id(), t.id()))
+				continue
+			}
+			for _, n := range f.Names {
+				if !g.opts.Unexported && !n.IsExported() {
+					continue
+				}
+				if isCollection(f.Type) {
+					g.relate(fmt.Sprintf("%s --> \"*\" %s : %s", t.id(), target.id(), n.Name))
+				} else {
+					g.relate(fmt.Sprintf("%s --> %s : %s", t.id(), target.id(), n.Name))
+				}
+			}
+		}
+	case *ast.InterfaceType:
+		for _, m := range spec.Methods.List {
+			if len(m.Names) == 0 {
+				if target := g.resolve(t.pkg, m.Type); g.visible(target) {
+					g.relate(fmt.Sprintf("%s <|-- %s", target.id(), t.id()))
+				}
+			}
+		}
+	}
+}
+
+// addRealizations links each drawn interface to the drawn types whose method sets cover it.
+func (g *classGraph) addRealizations() {
+	for _, ip := range g.pkgs {
+		for _, iface := range g.visibleTypes(ip) {
+			want, ok := g.interfaceMethods(iface, 0)
+			if !ok || len(want) == 0 {
+				continue
+			}
+			for _, tp := range g.pkgs {
+				for _, t := range g.visibleTypes(tp) {
+					if _, isIface := t.spec.(*ast.InterfaceType); isIface || !implements(t, want) {
+						continue
+					}
+					g.relate(fmt.Sprintf("%s <|.. %s", iface.id(), t.id()))
+				}
+			}
+		}
+	}
+}
+
+// interfaceMethods returns the method signatures of an interface, following embedded interfaces among
+// the uploaded packages. ok is false when an embedded interface cannot be resolved.
+func (g *classGraph) interfaceMethods(t *goType, depth int) (map[string]string, bool) {
+	spec, isIface := t.spec.(*ast.InterfaceType)
+	if !isIface || depth > 10 {
+		return nil, false
+	}
+	out := map[string]string{}
+	for _, m := range spec.Methods.List {
+		if len(m.Names) > 0 {
+			if ft, ok := m.Type.(*ast.FuncType); ok {
+				out[m.Names[0].Name] = signatureKey(ft)
+			}
+			continue
+		}
+		embedded := g.resolve(t.pkg, m.Type)
+		if embedded == nil {
+			return nil, false // type sets and interfaces from other modules
+		}
+		more, ok := g.interfaceMethods(embedded, depth+1)
+		if !ok {
+			return nil, false
+		}
+		for name, sig := range more {
+			out[name] = sig
+		}
+	}
+	return out, true
+}
+
+// implements reports whether t's methods (value and pointer receivers) include every method in want.
+func implements(t *goType, want map[string]string) bool {
+	have := map[string]string{}
+	for _, m := range t.methods {
+		have[m.Name.Name] = signatureKey(m.Type)
+	}
+	for name, sig := range want {
+		if have[name] != sig {
+			return false
+		}
+	}
+	return true
+}
+
+func (g *classGraph) relate(r string) {
+	if !g.seen[r] {
+		g.seen[r] = true
+		g.relations = append(g.relations, r)
+	}
+}
+
+// resolve returns the uploaded type e refers to, looking through pointers, slices, maps (values),
+// channels and type arguments. Qualified names resolve when one uploaded package has that name.
+func (g *classGraph) resolve(pkg *goPackage, e ast.Expr) *goType {
+	for {
+		switch x := e.(type) {
+		case *ast.StarExpr:
+			e = x.X
+		case *ast.ParenExpr:
+			e = x.X
+		case *ast.ArrayType:
+			e = x.Elt
+		case *ast.MapType:
+			e = x.Value
+		case *ast.ChanType:
+			e = x.Value
+		case *ast.Ellipsis:
+			e = x.Elt
+		case *ast.IndexExpr:
+			e = x.X
+		case *ast.IndexListExpr:
+			e = x.X
+		case *ast.Ident:
+			return pkg.types[x.Name]
+		case *ast.SelectorExpr:
+			qual, ok := x.X.(*ast.Ident)
+			if !ok {
+				return nil
+			}
+			var found *goType
+			for _, p := range g.pkgs {
+				if p.name == qual.Name && p.types[x.Sel.Name] != nil {
+					if found != nil {
+						return nil // ambiguous
+					}
+					found = p.types[x.Sel.Name]
+				}
+			}
+			return found
+		default:
+			return nil
+		}
+	}
+}
+
+// embeddedName is the field name of an embedded type: T for T, *T, pkg.T and T[P].
+func embeddedName(e ast.Expr) string {
+	if s, ok := e.(*ast.StarExpr); ok {
+		e = s.X
+	}
+	if x, ok := e.(*ast.IndexExpr); ok {
+		e = x.X
+	}
+	if x, ok := e.(*ast.IndexListExpr); ok {
+		e = x.X
+	}
+	if s, ok := e.(*ast.SelectorExpr); ok {
+		return s.Sel.Name
+	}
+	return receiverName(e)
+}
+
+// isCollection reports whether a field type holds many values (slice, array, map, channel).
+func isCollection(e ast.Expr) bool {
+	for {
+		switch x := e.(type) {
+		case *ast.StarExpr:
+			e = x.X
+		case *ast.ParenExpr:
+			e = x.X
+		case *ast.ArrayType, *ast.MapType, *ast.ChanType:
+			return true
+		default:
+			return false
+		}
+	}
+}
+
+func visibility(name string) string {
+	if ast.IsExported(name) {
+		return "+"
+	}
+	return "-"
+}
+
+// signature renders a method's parameters and results for a class member. Results are not
+// parenthesized because Mermaid reads everything after the last ")" as the return type.
+func signature(ft *ast.FuncType) string {
+	var params []string
+	for _, f := range ft.Params.List {
+		typ := typeString(f.Type)
+		if len(f.Names) == 0 {
+			params = append(params, typ)
+		}
+		for _, n := range f.Names {
+			params = append(params, n.Name+" "+typ)
+		}
+	}
+	out := "(" + strings.Join(params, ", ") + ")"
+	if ft.Results != nil {
+		var results []string
+		for _, f := range ft.Results.List {
+			for range max(len(f.Names), 1) {
+				results = append(results, typeString(f.Type))
+			}
+		}
+		out += " " + strings.Join(results, ", ")
+	}
+	return out
+}
+
+// signatureKey is the exact parameter and result types of a method, for interface matching.
+func signatureKey(ft *ast.FuncType) string {
+	list := func(fl *ast.FieldList) string {
+		if fl == nil {
+			return ""
+		}
+		var parts []string
+		for _, f := range fl.List {
+			for range max(len(f.Names), 1) {
+				parts = append(parts, types.ExprString(f.Type))
+			}
+		}
+		return strings.Join(parts, ",")
+	}
+	return list(ft.Params) + "|" + list(ft.Results)
+}
+
+// typeString renders a type for a class member. Function, struct and interface literals are
+// shortened to a keyword so no parentheses or braces end up inside the member text, and type
+// arguments use Mermaid's ~T~ generics.
+func typeString(e ast.Expr) string {
+	switch x := e.(type) {
+	case *ast.Ident:
+		return x.Name
+	case *ast.SelectorExpr:
+		return typeString(x.X) + "." + x.Sel.Name
+	case *ast.StarExpr:
+		return "*" + typeString(x.X)
+	case *ast.ParenExpr:
+		return typeString(x.X)
+	case *ast.ArrayType:
+		if x.Len == nil {
+			return "[]" + typeString(x.Elt)
+		}
+		if lit, ok := x.Len.(*ast.BasicLit); ok {
+			return "[" + lit.Value + "]" + typeString(x.Elt)
+		}
+		return "[N]" + typeString(x.Elt)
+	case *ast.MapType:
+		return "map[" + typeString(x.Key) + "]" + typeString(x.Value)
+	case *ast.ChanType:
+		switch x.Dir {
+		case ast.SEND:
+			return "chan<- " + typeString(x.Value)
+		case ast.RECV:
+			return "<-chan " + typeString(x.Value)
+		}
+		return "chan " + typeString(x.Value)
+	case *ast.Ellipsis:
+		return "..." + typeString(x.Elt)
+	case *ast.FuncType:
+		return "func"
+	case *ast.StructType:
+		return "struct"
+	case *ast.InterfaceType:
+		if len(x.Methods.List) == 0 {
+			return "any"
+		}
+		return "interface"
+	case *ast.IndexExpr:
+		return typeString(x.X) + "~" + typeString(x.Index) + "~"
+	case *ast.IndexListExpr:
+		args := make([]string, len(x.Indices))
+		for i, a := range x.Indices {
+			args[i] = typeString(a)
+		}
+		return typeString(x.X) + "~" + strings.Join(args, ",") + "~"
+	}
+	return "?"
+}
@@ -0,0 +1,163 @@
+package convert
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/devenock/d_weaver/internal/ai/mermaid"
+)
+
+// tarball archives files (archive path to content), gzipped when zip is set.
+func tarball(t *testing.T, files map[string]string, zip bool) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var tw *tar.Writer
+	var zw *gzip.Writer
+	if zip {
+		zw = gzip.NewWriter(&buf)
+		tw = tar.NewWriter(zw)
+	} else {
+		tw = tar.NewWriter(&buf)
+	}
+	for name, content := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(content))
+	}
+	tw.Close()
+	if zw != nil {
+		zw.Close()
+	}
+	return buf.Bytes()
+}
+
+func TestGoPackages_Testdata(t *testing.T) {
+	files := map[string]string{}
+	paths, _ := filepath.Glob(filepath.Join("testdata", "diagrams", "*", "*.go"))
+	for _, p := range paths {
+		b, err := os.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[filepath.ToSlash(strings.TrimPrefix(p, "testdata"+string(filepath.Separator)))] = string(b)
+	}
+	if len(files) == 0 {
+		t.Fatal("no testdata packages")
+	}
+	out, err := GoPackages(bytes.NewReader(tarball(t, files, true)), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := mermaid.Validate(out); !res.Valid || res.DiagramType != "classDiagram" {
+		t.Fatalf("invalid classDiagram %+v:\n%s", res, out)
+	}
+	for _, want := range []string{
+		"    namespace model {\n",
+		"        class model_Permission {\n            <<string>>\n            +CanComment() bool\n",
+		"            +GetDiagram(ctx context.Context, id uuid.UUID, userID uuid.UUID) model.DiagramResponse, error\n",
+		"        class service_DiagramRepository {\n            <<interface>>\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output lacks %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestGoPackages_Relations(t *testing.T) {
+	src := `package shop
+
+import "context"
+
+type Store interface {
+	Get(ctx context.Context, id string) (*Order, error)
+}
+
+type Named interface{ Name() string }
+
+type Base struct{ ID string }
+
+type Order struct {
+	Base
+	Lines  []Line
+	Buyer  *Customer
+	note   string
+	notify func(string) error
+}
+
+type Line struct{ SKU string; Qty int }
+
+type Customer struct{}
+
+func (c Customer) Name() string { return "" }
+
+type memStore struct{ orders map[string]*Order }
+
+func (s *memStore) Get(ctx context.Context, id string) (*Order, error) { return s.orders[id], nil }
+
+type Page[T any] struct{ Items []T }
+`
+	archive := tarball(t, map[string]string{
+		"shop/shop.go":         src,
+		"shop/shop_test.go":    "package shop\ntype Ignored struct{}",
+		"shop/vendor/x/x.go":   "package x\ntype Vendored struct{}",
+		"shop/testdata/bad.go": "not go",
+	}, false)
+
+	out, err := GoPackages(bytes.NewReader(archive), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `classDiagram
+    class Base {
+        +ID string
+    }
+    class Customer {
+        +Name() string
+    }
+    class Line {
+        +SKU string
+        +Qty int
+    }
+    class Named {
+        <<interface>>
+        +Name() string
+    }
+    class Order {
+        +Lines []Line
+        +Buyer *Customer
+    }
+    class Page~T~ {
+        +Items []T
+    }
+    class Store {
+        <<interface>>
+        +Get(ctx context.Context, id string) *Order, error
+    }
+    Base <|-- Order
+    Order --> "*" Line : Lines
+    Order --> Customer : Buyer
+    Named <|.. Customer`
+	if out != want {
+		t.Errorf("got\n%s\nwant\n%s", out, want)
+	}
+
+	out, err = GoPackages(bytes.NewReader(archive), Options{Unexported: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"-note string", "-notify func", "class memStore {", "Store <|.. memStore", `memStore --> "*" Order : orders`} {
+		if !strings.Contains(out, line) {
+			t.Errorf("with unexported, output lacks %q:\n%s", line, out)
+		}
+	}
+
+	if _, err := GoPackages(bytes.NewReader(tarball(t, map[string]string{"a/a.go": "package a\nfunc ("}, false)), Options{}); err == nil || !strings.Contains(err.Error(), "a/a.go") {
+		t.Errorf("parse error = %v, want it to name the file", err)
+	}
+}
@@ -0,0 +1,127 @@
+package convert
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"go.yaml.in/yaml/v3"
+)
+
+// openAPIMethods are the operation keys of a path item, in display order.
+var openAPIMethods = []string{"get", "post", "put", "patch", "delete", "head", "options", "trace"}
+
+type openAPIDoc struct {
+	OpenAPI string `yaml:"openapi"`
+	Swagger string `yaml:"swagger"`
+	Info    struct {
+		Title string `yaml:"title"`
+	} `yaml:"info"`
+	Paths map[string]map[string]yaml.Node `yaml:"paths"`
+}
+
+type openAPIOperation struct {
+	Summary    string   `yaml:"summary"`
+	Tags       []string `yaml:"tags"`
+	Deprecated bool     `yaml:"deprecated"`
+}
+
+type endpoint struct {
+	method, path string
+	op           openAPIOperation
+}
+
+// OpenAPI converts an OpenAPI 3 or Swagger 2 document (YAML or JSON) into a flowchart: the API at the
+// root, one subgraph per tag (or first path segment when untagged) and one node per operation labelled
+// with its method, path and summary.
+func OpenAPI(spec []byte) (string, error) {
+	var doc openAPIDoc
+	if err := yaml.Unmarshal(spec, &doc); err != nil {
+		return "", fmt.Errorf("openapi: %w", err)
+	}
+	if doc.OpenAPI == "" && doc.Swagger == "" {
+		return "", errors.New("openapi: not an OpenAPI document (no openapi or swagger version)")
+	}
+	groups := map[string][]endpoint{}
+	var order []string
+	paths := make([]string, 0, len(doc.Paths))
+	for p := range doc.Paths {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		item := doc.Paths[p]
+		for _, m := range openAPIMethods {
+			node, ok := item[m]
+			if !ok {
+				continue
+			}
+			var op openAPIOperation
+			if err := node.Decode(&op); err != nil {
+				return "", fmt.Errorf("openapi: %s %s: %w", strings.ToUpper(m), p, err)
+			}
+			group := groupName(p, op.Tags)
+			if _, seen := groups[group]; !seen {
+				order = append(order, group)
+			}
+			groups[group] = append(groups[group], endpoint{method: strings.ToUpper(m), path: p, op: op})
+		}
+	}
+	if len(order) == 0 {
+		return "", errors.New("openapi: no operations under paths")
+	}
+	sort.Strings(order)
+
+	title := doc.Info.Title
+	if title == "" {
+		title = "API"
+	}
+	var b strings.Builder
+	b.WriteString("flowchart LR\n")
+	fmt.Fprintf(&b, "    api([\"%s\"])\n", escapeLabel(title))
+	ids := map[string]bool{}
+	n := 0
+	var edges []string
+	for _, group := range order {
+		id := uniqueID(ids, "tag_"+sanitizeName(group))
+		fmt.Fprintf(&b, "    subgraph %s[\"%s\"]\n", id, escapeLabel(group))
+		for _, e := range groups[group] {
+			n++
+			label := e.method + " " + e.path
+			if e.op.Summary != "" {
+				label += "<br/>" + e.op.Summary
+			}
+			if e.op.Deprecated {
+				label += "<br/>(deprecated)"
+			}
+			fmt.Fprintf(&b, "        op%d[\"%s\"]\n", n, escapeLabel(label))
+		}
+		b.WriteString("    end\n")
+		edges = append(edges, "    api --> "+id)
+	}
+	b.WriteString(strings.Join(edges, "\n"))
+	return b.String(), nil
+}
+
+// groupName is an operation's first tag, else the first segment of its path.
+func groupName(p string, tags []string) string {
+	if len(tags) > 0 && tags[0] != "" {
+		return tags[0]
+	}
+	seg := strings.SplitN(strings.Trim(p, "/"), "/", 2)[0]
+	if seg == "" || strings.HasPrefix(seg, "{") {
+		return "default"
+	}
+	return seg
+}
+
+// uniqueID returns id, or id with a numeric suffix when it is already taken, and marks it taken.
+func uniqueID(taken map[string]bool, id string) string {
+	candidate := id
+	for i := 2; taken[candidate]; i++ {
+		candidate = fmt.Sprintf("%s_%d", id, i)
+	}
+	taken[candidate] = true
+	return candidate
+}
@@ -0,0 +1,65 @@
+package convert
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/devenock/d_weaver/internal/ai/mermaid"
+)
+
+func TestOpenAPI_Docs(t *testing.T) {
+	files, err := filepath.Glob("../../../docs/*.yaml")
+	if err != nil || len(files) == 0 {
+		t.Fatalf("docs: %v", err)
+	}
+	for _, f := range files {
+		spec, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := OpenAPI(spec)
+		if err != nil {
+			t.Errorf("%s: %v", f, err)
+			continue
+		}
+		if res := mermaid.Validate(out); !res.Valid || res.DiagramType != "flowchart" {
+			t.Errorf("%s: invalid flowchart %+v:\n%s", f, res, out)
+		}
+	}
+	spec, _ := os.ReadFile("../../../docs/diagram.yaml")
+	out, _ := OpenAPI(spec)
+	if !strings.Contains(out, `["GET /diagrams/{id}`) || !strings.Contains(out, "api --> tag_") {
+		t.Errorf("diagram.yaml flowchart lacks endpoints:\n%s", out)
+	}
+}
+
+func TestOpenAPI_GroupsAndEscaping(t *testing.T) {
+	spec := `{"swagger": "2.0", "info": {"title": "Pets \"v2\""}, "paths": {
+		"/pets/{id}": {"parameters": [], "delete": {"deprecated": true}, "get": {"summary": "Get a pet"}},
+		"/pets": {"post": {"tags": ["pets"]}},
+		"/{any}": {"get": {}}}}`
+	out, err := OpenAPI([]byte(spec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `flowchart LR
+    api(["Pets #quot;v2#quot;"])
+    subgraph tag_default["default"]
+        op1["GET /{any}"]
+    end
+    subgraph tag_pets["pets"]
+        op2["POST /pets"]
+        op3["GET /pets/{id}<br/>Get a pet"]
+        op4["DELETE /pets/{id}<br/>(deprecated)"]
+    end
+    api --> tag_default
+    api --> tag_pets`
+	if out != want {
+		t.Errorf("got\n%s\nwant\n%s", out, want)
+	}
+	if _, err := OpenAPI([]byte("title: not a spec")); err == nil {
+		t.Error("a document without a version should fail")
+	}
+}
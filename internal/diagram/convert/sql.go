@@ -0,0 +1,709 @@
+package convert
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// SQL converts Postgres DDL into an erDiagram. CREATE TABLE, ALTER TABLE (add, drop and rename columns,
+// add and drop constraints, rename the table) and DROP TABLE are applied in order, so migrations
+// concatenated oldest first give the final schema. Other statements (indexes, functions, triggers) are
+// ignored.
+func SQL(ddl string) (string, error) {
+	tokens, err := lexSQL(ddl)
+	if err != nil {
+		return "", err
+	}
+	s := &schema{}
+	for _, stmt := range splitStatements(tokens) {
+		s.apply(stmt)
+	}
+	if len(s.tables) == 0 {
+		return "", errors.New("no CREATE TABLE statements found")
+	}
+	return s.mermaid(), nil
+}
+
+type sqlTokenKind int
+
+const (
+	tokWord   sqlTokenKind = iota // keyword or unquoted identifier
+	tokQuoted                     // "quoted identifier"
+	tokString                     // 'literal', E'...', $$body$$
+	tokPunct                      // ( ) , ; . [ ]
+	tokOther                      // numbers and operators
+)
+
+type sqlToken struct {
+	kind sqlTokenKind
+	text string // quoted identifiers without quotes, words as written
+}
+
+// is reports whether t is the keyword kw (case-insensitive).
+func (t sqlToken) is(kw string) bool {
+	return t.kind == tokWord && strings.EqualFold(t.text, kw)
+}
+
+// lexSQL splits DDL into tokens, dropping comments and whitespace.
+func lexSQL(src string) ([]sqlToken, error) {
+	var out []sqlToken
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f':
+			i++
+		case strings.HasPrefix(src[i:], "--"):
+			if end := strings.IndexByte(src[i:], '\n'); end >= 0 {
+				i += end
+			} else {
+				i = len(src)
+			}
+		case strings.HasPrefix(src[i:], "/*"):
+			end := strings.Index(src[i+2:], "*/")
+			if end < 0 {
+				return nil, errors.New("unterminated /* comment")
+			}
+			i += 2 + end + 2
+		case c == '\'':
+			j := i + 1
+			for ; j < len(src); j++ {
+				if src[j] == '\'' {
+					if j+1 < len(src) && src[j+1] == '\'' {
+						j++
+						continue
+					}
+					break
+				}
+			}
+			if j >= len(src) {
+				return nil, errors.New("unterminated string literal")
+			}
+			out = append(out, sqlToken{tokString, src[i+1 : j]})
+			i = j + 1
+		case c == '"':
+			end := strings.IndexByte(src[i+1:], '"')
+			if end < 0 {
+				return nil, errors.New("unterminated quoted identifier")
+			}
+			out = append(out, sqlToken{tokQuoted, src[i+1 : i+1+end]})
+			i += end + 2
+		case c == '$' && dollarTag(src[i:]) != "":
+			tag := dollarTag(src[i:])
+			end := strings.Index(src[i+len(tag):], tag)
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated %s quoted string", tag)
+			}
+			out = append(out, sqlToken{tokString, src[i+len(tag) : i+len(tag)+end]})
+			i += len(tag) + end + len(tag)
+		case isIdentByte(c, true):
+			j := i + 1
+			for j < len(src) && isIdentByte(src[j], false) {
+				j++
+			}
+			// E'...' escape strings: drop the prefix and lex the literal.
+			if j == i+1 && (c == 'E' || c == 'e') && j < len(src) && src[j] == '\'' {
+				i = j
+				continue
+			}
+			out = append(out, sqlToken{tokWord, src[i:j]})
+			i = j
+		case strings.IndexByte("(),;.[]", c) >= 0:
+			out = append(out, sqlToken{tokPunct, string(c)})
+			i++
+		default:
+			j := i + 1
+			for c >= '0' && c <= '9' && j < len(src) && (src[j] >= '0' && src[j] <= '9' || src[j] == '.') {
+				j++
+			}
+			out = append(out, sqlToken{tokOther, src[i:j]})
+			i = j
+		}
+	}
+	return out, nil
+}
+
+// isIdentByte reports whether c can start (first) or continue an unquoted identifier. Bytes of
+// multi-byte UTF-8 characters count as letters.
+func isIdentByte(c byte, first bool) bool {
+	switch {
+	case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80:
+		return true
+	case c >= '0' && c <= '9' || c == '$':
+		return !first
+	}
+	return false
+}
+
+// dollarTag returns the $tag$ opening a dollar-quoted string at the start of s, or "".
+func dollarTag(s string) string {
+	for j := 1; j < len(s); j++ {
+		if s[j] == '$' {
+			return s[:j+1]
+		}
+		if !isIdentByte(s[j], j == 1) {
+			return ""
+		}
+	}
+	return ""
+}
+
+// splitStatements splits tokens on top-level semicolons.
+func splitStatements(tokens []sqlToken) [][]sqlToken {
+	var out [][]sqlToken
+	start, depth := 0, 0
+	for i, t := range tokens {
+		if t.kind != tokPunct {
+			continue
+		}
+		switch t.text {
+		case "(":
+			depth++
+		case ")":
+			depth--
+		case ";":
+			if depth == 0 {
+				if i > start {
+					out = append(out, tokens[start:i])
+				}
+				start = i + 1
+			}
+		}
+	}
+	if start < len(tokens) {
+		out = append(out, tokens[start:])
+	}
+	return out
+}
+
+// splitTopLevel splits tokens on commas outside parentheses.
+func splitTopLevel(tokens []sqlToken) [][]sqlToken {
+	var out [][]sqlToken
+	start, depth := 0, 0
+	for i, t := range tokens {
+		if t.kind != tokPunct {
+			continue
+		}
+		switch t.text {
+		case "(":
+			depth++
+		case ")":
+			depth--
+		case ",":
+			if depth == 0 {
+				out = append(out, tokens[start:i])
+				start = i + 1
+			}
+		}
+	}
+	if start < len(tokens) {
+		out = append(out, tokens[start:])
+	}
+	return out
+}
+
+// closeParen returns the index of the parenthesis closing the one at tokens[open], or -1.
+func closeParen(tokens []sqlToken, open int) int {
+	depth := 0
+	for i := open; i < len(tokens); i++ {
+		if tokens[i].kind != tokPunct {
+			continue
+		}
+		switch tokens[i].text {
+		case "(":
+			depth++
+		case ")":
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+type schema struct {
+	tables    []*table
+	relations []*relation
+}
+
+type table struct {
+	name    string
+	columns []*column
+	unique  [][]string // column sets that are unique (primary key included)
+}
+
+type column struct {
+	name    string
+	typ     string
+	pk      bool
+	fk      bool
+	unique  bool
+	notNull bool
+}
+
+// relation is a foreign key from table.columns to refTable.
+type relation struct {
+	name     string // constraint name, when given
+	table    string
+	columns  []string
+	refTable string
+}
+
+func (s *schema) table(name string) *table {
+	for _, t := range s.tables {
+		if t.name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+func (t *table) column(name string) *column {
+	for _, c := range t.columns {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func (s *schema) apply(stmt []sqlToken) {
+	switch {
+	case len(stmt) > 1 && stmt[0].is("CREATE"):
+		rest := skipWords(stmt[1:], "OR", "REPLACE", "GLOBAL", "LOCAL", "TEMP", "TEMPORARY", "UNLOGGED")
+		if len(rest) > 0 && rest[0].is("TABLE") {
+			s.createTable(rest[1:])
+		}
+	case len(stmt) > 2 && stmt[0].is("ALTER") && stmt[1].is("TABLE"):
+		s.alterTable(stmt[2:])
+	case len(stmt) > 2 && stmt[0].is("DROP") && stmt[1].is("TABLE"):
+		rest := skipWords(stmt[2:], "IF", "EXISTS")
+		for _, part := range splitTopLevel(rest) {
+			if name, _ := qualifiedName(part); name != "" {
+				s.dropTable(name)
+			}
+		}
+	}
+}
+
+func (s *schema) createTable(rest []sqlToken) {
+	rest = skipWords(rest, "IF", "NOT", "EXISTS")
+	name, n := qualifiedName(rest)
+	if name == "" || n >= len(rest) || rest[n].text != "(" {
+		return // CREATE TABLE ... AS / PARTITION OF
+	}
+	end := closeParen(rest, n)
+	if end < 0 {
+		return
+	}
+	if s.table(name) != nil {
+		return // IF NOT EXISTS on an existing table
+	}
+	t := &table{name: name}
+	s.tables = append(s.tables, t)
+	for _, def := range splitTopLevel(rest[n+1 : end]) {
+		s.addElement(t, def)
+	}
+}
+
+// addElement adds a column definition or table constraint.
+func (s *schema) addElement(t *table, def []sqlToken) {
+	if len(def) == 0 {
+		return
+	}
+	switch {
+	case def[0].is("CONSTRAINT"), def[0].is("PRIMARY"), def[0].is("FOREIGN"), def[0].is("UNIQUE"),
+		def[0].is("CHECK"), def[0].is("EXCLUDE"), def[0].is("LIKE"):
+		s.addConstraint(t, def)
+	default:
+		s.addColumn(t, def)
+	}
+}
+
+// columnConstraintWords end a column's type.
+var columnConstraintWords = []string{"NOT", "NULL", "DEFAULT", "PRIMARY", "REFERENCES", "UNIQUE", "CHECK",
+	"CONSTRAINT", "GENERATED", "COLLATE"}
+
+func (s *schema) addColumn(t *table, def []sqlToken) {
+	col := &column{name: ident(def[0])}
+	typ, n := columnType(def[1:])
+	col.typ = typ
+	i := 1 + n
+	var constraint string
+	for ; i < len(def); i++ {
+		switch tok := def[i]; {
+		case tok.is("CONSTRAINT") && i+1 < len(def):
+			constraint = ident(def[i+1])
+			i++
+		case tok.is("PRIMARY"):
+			col.pk, col.notNull = true, true
+		case tok.is("NOT") && i+1 < len(def) && def[i+1].is("NULL"):
+			col.notNull = true
+			i++
+		case tok.is("UNIQUE"):
+			col.unique = true
+		case tok.is("REFERENCES"):
+			ref, n := qualifiedName(def[i+1:])
+			if ref != "" {
+				col.fk = true
+				s.relations = append(s.relations, &relation{name: constraint, table: t.name, columns: []string{col.name}, refTable: ref})
+			}
+			i += n
+		case tok.text == "(":
+			if end := closeParen(def, i); end > 0 {
+				i = end // CHECK and DEFAULT expressions
+			}
+		}
+	}
+	t.columns = append(t.columns, col)
+	if col.pk {
+		t.unique = append(t.unique, []string{col.name})
+	}
+	if col.unique {
+		t.unique = append(t.unique, []string{col.name})
+	}
+}
+
+// columnType reads a column type up to the first column constraint and returns it as one Mermaid
+// attribute type (words joined by "_", modifiers such as (255) dropped) with the tokens it used.
+func columnType(tokens []sqlToken) (string, int) {
+	var words []string
+	i := 0
+	for ; i < len(tokens); i++ {
+		tok := tokens[i]
+		if tok.kind == tokWord && isAny(tok, columnConstraintWords...) {
+			break
+		}
+		switch {
+		case tok.text == "(":
+			if end := closeParen(tokens, i); end > 0 {
+				i = end
+			}
+		case tok.text == "[" || tok.text == "]":
+			if len(words) > 0 {
+				words[len(words)-1] += tok.text
+			}
+		case tok.kind == tokWord || tok.kind == tokQuoted:
+			words = append(words, strings.ToLower(tok.text))
+		}
+	}
+	typ := sanitizeType(strings.Join(words, "_"))
+	if typ == "" {
+		typ = "unknown"
+	}
+	return typ, i
+}
+
+func (s *schema) addConstraint(t *table, def []sqlToken) {
+	var name string
+	if def[0].is("CONSTRAINT") && len(def) > 2 {
+		name, def = ident(def[1]), def[2:]
+	}
+	switch {
+	case def[0].is("PRIMARY"):
+		cols := parenIdents(def)
+		for _, c := range cols {
+			if col := t.column(c); col != nil {
+				col.pk, col.notNull = true, true
+			}
+		}
+		t.unique = append(t.unique, cols)
+	case def[0].is("UNIQUE"):
+		cols := parenIdents(def)
+		if len(cols) == 1 {
+			if col := t.column(cols[0]); col != nil {
+				col.unique = true
+			}
+		}
+		t.unique = append(t.unique, cols)
+	case def[0].is("FOREIGN"):
+		cols := parenIdents(def)
+		for i, tok := range def {
+			if !tok.is("REFERENCES") {
+				continue
+			}
+			ref, _ := qualifiedName(def[i+1:])
+			if ref == "" || len(cols) == 0 {
+				return
+			}
+			for _, c := range cols {
+				if col := t.column(c); col != nil {
+					col.fk = true
+				}
+			}
+			s.relations = append(s.relations, &relation{name: name, table: t.name, columns: cols, refTable: ref})
+			return
+		}
+	}
+}
+
+func (s *schema) alterTable(rest []sqlToken) {
+	rest = skipWords(rest, "IF", "EXISTS", "ONLY")
+	name, n := qualifiedName(rest)
+	t := s.table(name)
+	if t == nil {
+		return
+	}
+	for _, action := range splitTopLevel(rest[n:]) {
+		if len(action) < 2 {
+			continue
+		}
+		switch {
+		case action[0].is("ADD"):
+			def := skipWords(action[1:], "COLUMN", "IF", "NOT", "EXISTS")
+			if len(def) > 0 {
+				if isAny(def[0], "CONSTRAINT", "PRIMARY", "FOREIGN", "UNIQUE", "CHECK", "EXCLUDE") {
+					s.addConstraint(t, def)
+				} else if t.column(ident(def[0])) == nil {
+					s.addColumn(t, def)
+				}
+			}
+		case action[0].is("ALTER"):
+			s.alterColumn(t, skipWords(action[1:], "COLUMN"))
+		case action[0].is("DROP") && action[1].is("CONSTRAINT"):
+			rest := skipWords(action[2:], "IF", "EXISTS")
+			if len(rest) > 0 {
+				s.dropConstraint(t, ident(rest[0]))
+			}
+		case action[0].is("DROP"):
+			rest := skipWords(action[1:], "COLUMN", "IF", "EXISTS")
+			if len(rest) > 0 {
+				s.dropColumn(t, ident(rest[0]))
+			}
+		case action[0].is("RENAME") && len(action) >= 3 && action[1].is("TO"):
+			s.renameTable(t, ident(action[2]))
+			return
+		case action[0].is("RENAME"):
+			rest := skipWords(action[1:], "COLUMN")
+			if len(rest) >= 3 && rest[1].is("TO") {
+				s.renameColumn(t, ident(rest[0]), ident(rest[2]))
+			}
+		}
+	}
+}
+
+// alterColumn applies SET/DROP NOT NULL and [SET DATA] TYPE to a column.
+func (s *schema) alterColumn(t *table, action []sqlToken) {
+	if len(action) < 3 {
+		return
+	}
+	c := t.column(ident(action[0]))
+	if c == nil {
+		return
+	}
+	switch action = action[1:]; {
+	case action[0].is("SET") && action[1].is("NOT"):
+		c.notNull = true
+	case action[0].is("DROP") && action[1].is("NOT"):
+		c.notNull = false
+	default:
+		if action = skipWords(action, "SET", "DATA"); len(action) > 1 && action[0].is("TYPE") {
+			c.typ, _ = columnType(action[1:])
+		}
+	}
+}
+
+func (s *schema) dropTable(name string) {
+	for i, t := range s.tables {
+		if t.name == name {
+			s.tables = append(s.tables[:i], s.tables[i+1:]...)
+			break
+		}
+	}
+	kept := s.relations[:0]
+	for _, r := range s.relations {
+		if r.table != name && r.refTable != name {
+			kept = append(kept, r)
+		}
+	}
+	s.relations = kept
+}
+
+func (s *schema) dropColumn(t *table, name string) {
+	for i, c := range t.columns {
+		if c.name == name {
+			t.columns = append(t.columns[:i], t.columns[i+1:]...)
+			break
+		}
+	}
+	kept := s.relations[:0]
+	for _, r := range s.relations {
+		if !(r.table == t.name && contains(r.columns, name)) {
+			kept = append(kept, r)
+		}
+	}
+	s.relations = kept
+}
+
+func (s *schema) dropConstraint(t *table, name string) {
+	kept := s.relations[:0]
+	for _, r := range s.relations {
+		if r.table == t.name && r.name == name {
+			continue
+		}
+		kept = append(kept, r)
+	}
+	s.relations = kept
+}
+
+func (s *schema) renameTable(t *table, name string) {
+	for _, r := range s.relations {
+		if r.table == t.name {
+			r.table = name
+		}
+		if r.refTable == t.name {
+			r.refTable = name
+		}
+	}
+	t.name = name
+}
+
+func (s *schema) renameColumn(t *table, from, to string) {
+	if c := t.column(from); c != nil {
+		c.name = to
+	}
+	for _, set := range t.unique {
+		replace(set, from, to)
+	}
+	for _, r := range s.relations {
+		if r.table == t.name {
+			replace(r.columns, from, to)
+		}
+	}
+}
+
+// mermaid renders the schema: entities in creation order, then one relationship per foreign key whose
+// tables both exist. A foreign key that is unique in its table is one-to-one; a nullable one is optional.
+func (s *schema) mermaid() string {
+	var b strings.Builder
+	b.WriteString("erDiagram\n")
+	for _, t := range s.tables {
+		fmt.Fprintf(&b, "    %s {\n", sanitizeName(t.name))
+		for _, c := range t.columns {
+			fmt.Fprintf(&b, "        %s %s", c.typ, sanitizeName(c.name))
+			var keys []string
+			if c.pk {
+				keys = append(keys, "PK")
+			}
+			if c.fk {
+				keys = append(keys, "FK")
+			}
+			if c.unique && !c.pk {
+				keys = append(keys, "UK")
+			}
+			if len(keys) > 0 {
+				b.WriteString(" " + strings.Join(keys, ", "))
+			}
+			b.WriteByte('\n')
+		}
+		b.WriteString("    }\n")
+	}
+	for _, r := range s.relations {
+		child, parent := s.table(r.table), s.table(r.refTable)
+		if child == nil || parent == nil {
+			continue
+		}
+		many, optional := "}o", "||"
+		for _, set := range child.unique {
+			if sameSet(set, r.columns) {
+				many = "|o"
+			}
+		}
+		for _, name := range r.columns {
+			if c := child.column(name); c != nil && !c.notNull {
+				optional = "o|"
+			}
+		}
+		fmt.Fprintf(&b, "    %s %s--%s %s : %q\n", sanitizeName(child.name), many, optional, sanitizeName(parent.name), strings.Join(r.columns, ", "))
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// qualifiedName reads [schema.]name and returns the name without its schema and how many tokens it used.
+func qualifiedName(tokens []sqlToken) (string, int) {
+	if len(tokens) == 0 || (tokens[0].kind != tokWord && tokens[0].kind != tokQuoted) {
+		return "", 0
+	}
+	name, n := ident(tokens[0]), 1
+	for n+1 < len(tokens) && tokens[n].text == "." && (tokens[n+1].kind == tokWord || tokens[n+1].kind == tokQuoted) {
+		name = ident(tokens[n+1])
+		n += 2
+	}
+	return name, n
+}
+
+// parenIdents returns the identifiers in the first parenthesized list of tokens.
+func parenIdents(tokens []sqlToken) []string {
+	for i, t := range tokens {
+		if t.text != "(" || t.kind != tokPunct {
+			continue
+		}
+		end := closeParen(tokens, i)
+		if end < 0 {
+			return nil
+		}
+		var out []string
+		for _, part := range splitTopLevel(tokens[i+1 : end]) {
+			if len(part) > 0 {
+				out = append(out, ident(part[0]))
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+// ident returns an identifier as Postgres stores it: unquoted names fold to lower case.
+func ident(t sqlToken) string {
+	if t.kind == tokQuoted {
+		return t.text
+	}
+	return strings.ToLower(t.text)
+}
+
+// skipWords drops leading tokens that are any of the keywords.
+func skipWords(tokens []sqlToken, words ...string) []sqlToken {
+	for len(tokens) > 0 && isAny(tokens[0], words...) {
+		tokens = tokens[1:]
+	}
+	return tokens
+}
+
+func isAny(t sqlToken, words ...string) bool {
+	for _, w := range words {
+		if t.is(w) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func replace(list []string, from, to string) {
+	for i, v := range list {
+		if v == from {
+			list[i] = to
+		}
+	}
+}
+
+func sameSet(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, v := range a {
+		if !contains(b, v) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,82 @@
+package convert
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/devenock/d_weaver/internal/ai/mermaid"
+)
+
+func TestSQL_Migrations(t *testing.T) {
+	files, err := filepath.Glob("../../../migrations/*.up.sql")
+	if err != nil || len(files) == 0 {
+		t.Fatalf("migrations: %v", err)
+	}
+	var ddl strings.Builder
+	for _, f := range files {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ddl.Write(b)
+	}
+	out, err := SQL(ddl.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := mermaid.Validate(out); !res.Valid || res.DiagramType != "erDiagram" {
+		t.Fatalf("invalid erDiagram %+v:\n%s", res, out)
+	}
+	for _, want := range []string{
+		"    users {\n        uuid id PK\n        varchar email UK\n",
+		"        text[] tags\n",
+		"        uuid diagram_id PK, FK\n",
+		`    refresh_tokens }o--|| users : "user_id"`,
+		`    diagrams }o--o| workspaces : "workspace_id"`,        // nullable foreign key
+		`    diagram_crdt_states |o--|| diagrams : "diagram_id"`, // foreign key that is the primary key
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output lacks %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "idx_") {
+		t.Errorf("indexes should be ignored:\n%s", out)
+	}
+}
+
+func TestSQL_AlterAndDrop(t *testing.T) {
+	ddl := `
+CREATE TABLE public."Teams" (id bigint GENERATED ALWAYS AS IDENTITY, name text NOT NULL, CONSTRAINT teams_pk PRIMARY KEY (id));
+CREATE TABLE players (id serial PRIMARY KEY, team_id bigint, nickname character varying(40) DEFAULT 'x;y');
+CREATE TABLE scratch (id int);
+ALTER TABLE players ADD CONSTRAINT players_team_fk FOREIGN KEY (team_id) REFERENCES "Teams" (id) ON DELETE SET NULL;
+ALTER TABLE players ALTER COLUMN team_id SET NOT NULL, ADD COLUMN joined_at timestamp with time zone;
+ALTER TABLE players RENAME COLUMN nickname TO handle;
+DROP TABLE IF EXISTS scratch;
+CREATE FUNCTION touch() RETURNS trigger AS $$ BEGIN NEW.updated_at = now(); RETURN NEW; END; $$ LANGUAGE plpgsql;
+`
+	out, err := SQL(ddl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `erDiagram
+    Teams {
+        bigint id PK
+        text name
+    }
+    players {
+        serial id PK
+        bigint team_id FK
+        character_varying handle
+        timestamp_with_time_zone joined_at
+    }
+    players }o--|| Teams : "team_id"`
+	if out != want {
+		t.Errorf("got\n%s\nwant\n%s", out, want)
+	}
+	if _, err := SQL("CREATE INDEX i ON t(x);"); err == nil {
+		t.Error("DDL without tables should fail")
+	}
+}
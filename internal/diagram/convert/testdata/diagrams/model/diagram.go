@@ -0,0 +1,23 @@
+package model
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Diagram is a stored diagram.
+type Diagram struct {
+	ID          uuid.UUID
+	OwnerID     uuid.UUID
+	Title       string
+	Content     string
+	DiagramType string
+	UpdatedAt   time.Time
+}
+
+// DiagramResponse is a diagram with the caller's permission on it.
+type DiagramResponse struct {
+	Diagram
+	Permission Permission
+}
@@ -0,0 +1,15 @@
+package model
+
+// Permission is what a user may do with a diagram.
+type Permission string
+
+const (
+	PermissionView    Permission = "view"
+	PermissionComment Permission = "comment"
+	PermissionEdit    Permission = "edit"
+)
+
+// CanComment reports whether p allows commenting.
+func (p Permission) CanComment() bool {
+	return p == PermissionComment || p == PermissionEdit
+}
@@ -0,0 +1,33 @@
+package service
+
+import (
+	"context"
+
+	"example.com/diagrams/model"
+	"github.com/google/uuid"
+)
+
+// DiagramRepository is the diagram persistence interface.
+type DiagramRepository interface {
+	GetByID(ctx context.Context, id uuid.UUID) (*model.Diagram, error)
+	Update(ctx context.Context, d *model.Diagram) (*model.Diagram, error)
+}
+
+// Service is the diagram business logic.
+type Service struct {
+	repo DiagramRepository
+}
+
+// New returns a Service backed by repo.
+func New(repo DiagramRepository) *Service {
+	return &Service{repo: repo}
+}
+
+// GetDiagram returns the diagram if userID may view it.
+func (s *Service) GetDiagram(ctx context.Context, id, userID uuid.UUID) (model.DiagramResponse, error) {
+	d, err := s.repo.GetByID(ctx, id)
+	if err != nil || d == nil {
+		return model.DiagramResponse{}, err
+	}
+	return model.DiagramResponse{Diagram: *d, Permission: model.PermissionView}, nil
+}
@@ -40,13 +40,15 @@ func New(svc *service.Service, issuer *jwt.Issuer, upload config.UploadConfig, l
 }
 
 // Register mounts diagram routes on g with RequireAuth where needed.
-// Paths: /diagrams, /diagrams/:id, /diagrams/:id/image, /diagrams/:id/comments, /diagrams/:id/comments/:commentId.
+// Paths: /diagrams, /diagrams/generate, /diagrams/:id, /diagrams/:id/image, /diagrams/:id/comments, /diagrams/:id/comments/:commentId,
+// /diagrams/:id/presence, /workspaces/:id/presence.
 func (h *Handler) Register(g *gin.RouterGroup) {
 	diagrams := g.Group("/diagrams")
 	diagrams.Use(middleware.RequireAuth(h.issuer))
 	diagrams.GET("", h.list)
 	diagrams.POST("", h.create)
 	diagrams.GET("/public", h.listPublic)
+	diagrams.POST("/generate", h.generate)
 	diagrams.GET("/:id", h.get)
 	diagrams.PUT("/:id", h.update)
 	diagrams.DELETE("/:id", h.delete)
@@ -55,6 +57,11 @@ func (h *Handler) Register(g *gin.RouterGroup) {
 	diagrams.POST("/:id/comments", h.addComment)
 	diagrams.PUT("/:id/comments/:commentId", h.updateComment)
 	diagrams.DELETE("/:id/comments/:commentId", h.deleteComment)
+	diagrams.GET("/:id/presence", h.diagramPresence)
+
+	workspaces := g.Group("/workspaces")
+	workspaces.Use(middleware.RequireAuth(h.issuer))
+	workspaces.GET("/:id/presence", h.workspacePresence)
 }
 
 func (h *Handler) list(c *gin.Context) {
@@ -103,6 +110,76 @@ func (h *Handler) create(c *gin.Context) {
 	common.WriteCreated(c, resp)
 }
 
+// generate converts an uploaded source artifact into a diagram. Multipart form: source (sql, go or
+// openapi), file (Go: a .tar or .tar.gz of the package) or content (SQL and OpenAPI text), and
+// optionally include_unexported, save, title, workspace_id and is_public.
+func (h *Handler) generate(c *gin.Context) {
+	userID := middleware.GetUserID(c)
+	data, ok := h.readSource(c)
+	if !ok {
+		return
+	}
+	in := service.GenerateInput{
+		Source:     c.PostForm("source"),
+		Data:       data,
+		Unexported: c.PostForm("include_unexported") == "true",
+		Save:       c.PostForm("save") == "true",
+		Title:      strings.TrimSpace(c.PostForm("title")),
+		IsPublic:   c.PostForm("is_public") == "true",
+	}
+	if len(in.Title) > 255 {
+		common.WriteError(c, http.StatusBadRequest, common.ErrorBody{Code: common.CodeInvalidInput, Message: "Title must be at most 255 characters."})
+		return
+	}
+	if ws := c.PostForm("workspace_id"); ws != "" {
+		id, err := uuid.Parse(ws)
+		if err != nil {
+			common.WriteError(c, http.StatusBadRequest, common.ErrorBody{Code: common.CodeInvalidInput, Message: "Invalid workspace ID."})
+			return
+		}
+		in.WorkspaceID = &id
+	}
+	resp, err := h.svc.GenerateFromSource(c.Request.Context(), userID, in)
+	if err != nil {
+		common.WriteErrorFromDomain(c, err)
+		return
+	}
+	if resp.Diagram != nil {
+		common.WriteCreated(c, resp)
+		return
+	}
+	common.WriteOK(c, resp)
+}
+
+// readSource returns the uploaded file, or the content form field when there is no file, writing a 400
+// and returning false when neither is given or the input is larger than the upload limit.
+func (h *Handler) readSource(c *gin.Context) ([]byte, bool) {
+	file, header, err := c.Request.FormFile("file")
+	if err != nil {
+		content := c.PostForm("content")
+		if content == "" {
+			common.WriteError(c, http.StatusBadRequest, common.ErrorBody{Code: common.CodeInvalidInput, Message: "Missing source. Use multipart form field 'file' or 'content'."})
+			return nil, false
+		}
+		if len(content) > h.upload.MaxBytes {
+			common.WriteError(c, http.StatusBadRequest, common.ErrorBody{Code: common.CodeInvalidInput, Message: fmt.Sprintf("Content exceeds maximum of %d bytes.", h.upload.MaxBytes)})
+			return nil, false
+		}
+		return []byte(content), true
+	}
+	defer file.Close()
+	if header.Size > int64(h.upload.MaxBytes) {
+		common.WriteError(c, http.StatusBadRequest, common.ErrorBody{Code: common.CodeInvalidInput, Message: fmt.Sprintf("File size exceeds maximum of %d bytes.", h.upload.MaxBytes)})
+		return nil, false
+	}
+	data, err := io.ReadAll(io.LimitReader(file, int64(h.upload.MaxBytes)))
+	if err != nil {
+		common.WriteError(c, http.StatusBadRequest, common.ErrorBody{Code: common.CodeInvalidInput, Message: "Failed to read file."})
+		return nil, false
+	}
+	return data, true
+}
+
 func (h *Handler) get(c *gin.Context) {
 	id, err := uuid.Parse(c.Param("id"))
 	if err != nil {
@@ -306,3 +383,33 @@ func (h *Handler) deleteComment(c *gin.Context) {
 	}
 	common.WriteNoContent(c)
 }
+
+func (h *Handler) diagramPresence(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		common.WriteError(c, http.StatusBadRequest, common.ErrorBody{Code: common.CodeInvalidInput, Message: "Invalid diagram ID."})
+		return
+	}
+	userID := middleware.GetUserID(c)
+	list, err := h.svc.ListDiagramPresence(c.Request.Context(), id, userID)
+	if err != nil {
+		common.WriteErrorFromDomain(c, err)
+		return
+	}
+	common.WriteOK(c, list)
+}
+
+func (h *Handler) workspacePresence(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		common.WriteError(c, http.StatusBadRequest, common.ErrorBody{Code: common.CodeInvalidInput, Message: "Invalid workspace ID."})
+		return
+	}
+	userID := middleware.GetUserID(c)
+	list, err := h.svc.ListWorkspacePresence(c.Request.Context(), id, userID)
+	if err != nil {
+		common.WriteErrorFromDomain(c, err)
+		return
+	}
+	common.WriteOK(c, list)
+}
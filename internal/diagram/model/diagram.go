@@ -19,3 +19,9 @@ type Diagram struct {
 	CreatedAt    time.Time
 	UpdatedAt    time.Time
 }
+
+// IsCanvasType reports whether diagrams of diagramType hold Fabric canvas JSON (whiteboard and
+// visual) rather than Mermaid text.
+func IsCanvasType(diagramType string) bool {
+	return diagramType == "whiteboard" || diagramType == "visual"
+}
@@ -1,6 +1,7 @@
 package model
 
 import (
+	"encoding/json"
 	"time"
 
 	"github.com/google/uuid"
@@ -63,3 +64,36 @@ func FromComment(c *Comment) CommentResponse {
 		UpdatedAt:   c.UpdatedAt,
 	}
 }
+
+// PresenceResponse is a user currently viewing a diagram.
+type PresenceResponse struct {
+	DiagramID      uuid.UUID       `json:"diagram_id"`
+	DiagramTitle   string          `json:"diagram_title"`
+	UserID         uuid.UUID       `json:"user_id"`
+	Email          string          `json:"email"`
+	CursorPosition json.RawMessage `json:"cursor_position,omitempty"`
+	LastSeen       time.Time       `json:"last_seen"`
+}
+
+// FromSession builds a PresenceResponse from a CollaborationSession.
+func FromSession(s *CollaborationSession) PresenceResponse {
+	if s == nil {
+		return PresenceResponse{}
+	}
+	return PresenceResponse{
+		DiagramID:      s.DiagramID,
+		DiagramTitle:   s.DiagramTitle,
+		UserID:         s.UserID,
+		Email:          s.Email,
+		CursorPosition: s.CursorPosition,
+		LastSeen:       s.LastSeen,
+	}
+}
+
+// GeneratedDiagramResponse is a diagram converted from a source artifact; Diagram is set when it was saved.
+type GeneratedDiagramResponse struct {
+	Source      string           `json:"source"`
+	DiagramType string           `json:"diagram_type"`
+	Content     string           `json:"content"`
+	Diagram     *DiagramResponse `json:"diagram,omitempty"`
+}
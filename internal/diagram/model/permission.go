@@ -0,0 +1,20 @@
+package model
+
+// Permission is a user's effective access to a diagram.
+type Permission string
+
+const (
+	PermissionView    Permission = "view"    // read and follow along (public visitors, workspace viewers)
+	PermissionComment Permission = "comment" // view plus comments (workspace members)
+	PermissionEdit    Permission = "edit"    // change content (diagram owner, workspace owners and admins)
+)
+
+// CanComment reports whether the permission allows commenting (and chatting in collaboration rooms).
+func (p Permission) CanComment() bool {
+	return p == PermissionComment || p == PermissionEdit
+}
+
+// CanEdit reports whether the permission allows changing diagram content.
+func (p Permission) CanEdit() bool {
+	return p == PermissionEdit
+}
@@ -0,0 +1,21 @@
+package model
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// RevisionSourceAIEdit marks a revision saved from an applied AI edit.
+const RevisionSourceAIEdit = "ai_edit"
+
+// Revision matches the diagram_revisions table: content a diagram was given by a whole-document
+// change, by whom and through which feature (Source).
+type Revision struct {
+	ID        uuid.UUID
+	DiagramID uuid.UUID
+	UserID    *uuid.UUID
+	Source    string
+	Content   string
+	CreatedAt time.Time
+}
@@ -0,0 +1,24 @@
+package model
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// SessionTTL is how long a collaboration session counts as active without a refresh.
+// Connected clients are refreshed well within it; older rows are expired.
+const SessionTTL = 2 * time.Minute
+
+// CollaborationSession matches the collaboration_sessions table (one row per user per diagram),
+// joined with the user's email and the diagram title for presence listings.
+type CollaborationSession struct {
+	ID             uuid.UUID
+	DiagramID      uuid.UUID
+	DiagramTitle   string
+	UserID         uuid.UUID
+	Email          string
+	CursorPosition json.RawMessage
+	LastSeen       time.Time
+}
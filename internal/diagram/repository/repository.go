@@ -2,7 +2,9 @@ package repository
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"time"
 
 	"github.com/devenock/d_weaver/internal/diagram/model"
 	"github.com/google/uuid"
@@ -125,10 +127,16 @@ func (r *Repository) ListPublic(ctx context.Context, limit int) ([]*model.Diagra
 	return scanDiagrams(rows)
 }
 
-// Update updates title, content, diagram_type, is_public and returns the diagram.
+// Update updates title, content, diagram_type, is_public and returns the diagram. In the same transaction
+// it drops the canvas CRDT update log, so the next room load starts from the new content.
 func (r *Repository) Update(ctx context.Context, id uuid.UUID, title, content, diagramType string, isPublic bool) (*model.Diagram, error) {
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
 	var d model.Diagram
-	err := r.pool.QueryRow(ctx,
+	err = tx.QueryRow(ctx,
 		`UPDATE diagrams SET title = $1, content = $2, diagram_type = $3, is_public = $4, updated_at = NOW()
 		 WHERE id = $5
 		 RETURNING id, title, content, diagram_type, image_url, is_public, user_id, workspace_id, created_at, updated_at`,
@@ -140,9 +148,97 @@ func (r *Repository) Update(ctx context.Context, id uuid.UUID, title, content, d
 		}
 		return nil, err
 	}
+	if _, err := tx.Exec(ctx, `DELETE FROM diagram_crdt_states WHERE diagram_id = $1`, id); err != nil {
+		return nil, err
+	}
+	return &d, tx.Commit(ctx)
+}
+
+// UpdateContent sets content only (realtime snapshots) and returns the diagram.
+func (r *Repository) UpdateContent(ctx context.Context, id uuid.UUID, content string) (*model.Diagram, error) {
+	var d model.Diagram
+	err := r.pool.QueryRow(ctx,
+		`UPDATE diagrams SET content = $1, updated_at = NOW() WHERE id = $2
+		 RETURNING id, title, content, diagram_type, image_url, is_public, user_id, workspace_id, created_at, updated_at`,
+		content, id,
+	).Scan(&d.ID, &d.Title, &d.Content, &d.DiagramType, &d.ImageURL, &d.IsPublic, &d.UserID, &d.WorkspaceID, &d.CreatedAt, &d.UpdatedAt)
+	if err != nil {
+		if isErrNoRows(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
 	return &d, nil
 }
 
+// SaveRevision replaces content that is still base and records it as a revision by userID in one
+// transaction. It returns false, saving nothing, if the diagram does not exist or its content is no
+// longer base.
+func (r *Repository) SaveRevision(ctx context.Context, diagramID, userID uuid.UUID, base, content, source string) (bool, error) {
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+	cmd, err := tx.Exec(ctx, `UPDATE diagrams SET content = $1, updated_at = NOW() WHERE id = $2 AND content = $3`, content, diagramID, base)
+	if err != nil {
+		return false, err
+	}
+	if cmd.RowsAffected() == 0 {
+		return false, nil
+	}
+	_, err = tx.Exec(ctx,
+		`INSERT INTO diagram_revisions (diagram_id, user_id, source, content) VALUES ($1, $2, $3, $4)`,
+		diagramID, userID, source, content,
+	)
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit(ctx)
+}
+
+// GetCRDTUpdateLog returns the stored canvas CRDT update log, or nil if there is none.
+func (r *Repository) GetCRDTUpdateLog(ctx context.Context, diagramID uuid.UUID) (json.RawMessage, error) {
+	var log json.RawMessage
+	err := r.pool.QueryRow(ctx,
+		`SELECT update_log FROM diagram_crdt_states WHERE diagram_id = $1`,
+		diagramID,
+	).Scan(&log)
+	if err != nil {
+		if isErrNoRows(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return log, nil
+}
+
+// SaveCanvasState sets the diagram content and upserts its CRDT update log in one transaction.
+func (r *Repository) SaveCanvasState(ctx context.Context, diagramID uuid.UUID, content string, updateLog json.RawMessage) (bool, error) {
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+	cmd, err := tx.Exec(ctx, `UPDATE diagrams SET content = $1, updated_at = NOW() WHERE id = $2`, content, diagramID)
+	if err != nil {
+		return false, err
+	}
+	if cmd.RowsAffected() == 0 {
+		return false, nil
+	}
+	_, err = tx.Exec(ctx,
+		`INSERT INTO diagram_crdt_states (diagram_id, update_log, updated_at)
+		 VALUES ($1, $2, NOW())
+		 ON CONFLICT (diagram_id) DO UPDATE SET update_log = EXCLUDED.update_log, updated_at = NOW()`,
+		diagramID, updateLog,
+	)
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit(ctx)
+}
+
 // UpdateImageURL sets image_url for the diagram.
 func (r *Repository) UpdateImageURL(ctx context.Context, id uuid.UUID, imageURL string) (*model.Diagram, error) {
 	var d model.Diagram
@@ -260,3 +356,78 @@ func (r *Repository) DeleteComment(ctx context.Context, id uuid.UUID) (bool, err
 	}
 	return cmd.RowsAffected() > 0, nil
 }
+
+// UpsertSession records that the user is in the diagram now. A nil cursor keeps the stored one.
+func (r *Repository) UpsertSession(ctx context.Context, diagramID, userID uuid.UUID, cursor json.RawMessage) error {
+	_, err := r.pool.Exec(ctx,
+		`INSERT INTO collaboration_sessions (diagram_id, user_id, cursor_position, last_seen)
+		 VALUES ($1, $2, $3, NOW())
+		 ON CONFLICT (diagram_id, user_id) DO UPDATE
+		 SET cursor_position = COALESCE(EXCLUDED.cursor_position, collaboration_sessions.cursor_position), last_seen = NOW()`,
+		diagramID, userID, cursor,
+	)
+	return err
+}
+
+// DeleteSession removes the user's session on the diagram.
+func (r *Repository) DeleteSession(ctx context.Context, diagramID, userID uuid.UUID) error {
+	_, err := r.pool.Exec(ctx, `DELETE FROM collaboration_sessions WHERE diagram_id = $1 AND user_id = $2`, diagramID, userID)
+	return err
+}
+
+// DeleteSessionsSeenBefore removes sessions not refreshed since before and returns how many were removed.
+func (r *Repository) DeleteSessionsSeenBefore(ctx context.Context, before time.Time) (int64, error) {
+	cmd, err := r.pool.Exec(ctx, `DELETE FROM collaboration_sessions WHERE last_seen < $1`, before)
+	if err != nil {
+		return 0, err
+	}
+	return cmd.RowsAffected(), nil
+}
+
+// ListSessionsByDiagramID returns sessions on the diagram seen since since, most recent first.
+func (r *Repository) ListSessionsByDiagramID(ctx context.Context, diagramID uuid.UUID, since time.Time) ([]*model.CollaborationSession, error) {
+	rows, err := r.pool.Query(ctx,
+		`SELECT s.id, s.diagram_id, d.title, s.user_id, u.email, s.cursor_position, s.last_seen
+		 FROM collaboration_sessions s
+		 JOIN diagrams d ON d.id = s.diagram_id
+		 JOIN users u ON u.id = s.user_id
+		 WHERE s.diagram_id = $1 AND s.last_seen >= $2
+		 ORDER BY s.last_seen DESC`,
+		diagramID, since,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanSessions(rows)
+}
+
+// ListSessionsByWorkspaceID returns sessions on the workspace's diagrams seen since since, most recent first.
+func (r *Repository) ListSessionsByWorkspaceID(ctx context.Context, workspaceID uuid.UUID, since time.Time) ([]*model.CollaborationSession, error) {
+	rows, err := r.pool.Query(ctx,
+		`SELECT s.id, s.diagram_id, d.title, s.user_id, u.email, s.cursor_position, s.last_seen
+		 FROM collaboration_sessions s
+		 JOIN diagrams d ON d.id = s.diagram_id
+		 JOIN users u ON u.id = s.user_id
+		 WHERE d.workspace_id = $1 AND s.last_seen >= $2
+		 ORDER BY s.last_seen DESC`,
+		workspaceID, since,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanSessions(rows)
+}
+
+func scanSessions(rows pgx.Rows) ([]*model.CollaborationSession, error) {
+	var list []*model.CollaborationSession
+	for rows.Next() {
+		var s model.CollaborationSession
+		if err := rows.Scan(&s.ID, &s.DiagramID, &s.DiagramTitle, &s.UserID, &s.Email, &s.CursorPosition, &s.LastSeen); err != nil {
+			return nil, err
+		}
+		list = append(list, &s)
+	}
+	return list, rows.Err()
+}
@@ -0,0 +1,47 @@
+package service
+
+import (
+	"context"
+
+	"github.com/devenock/d_weaver/internal/common"
+	"github.com/devenock/d_weaver/internal/diagram/convert"
+	"github.com/devenock/d_weaver/internal/diagram/model"
+	"github.com/google/uuid"
+)
+
+// GenerateInput is a source artifact to convert into a diagram. Save creates the diagram (Title is
+// then required); WorkspaceID and IsPublic apply as in CreateDiagram.
+type GenerateInput struct {
+	Source      string // convert.SourceSQL, SourceGo or SourceOpenAPI
+	Data        []byte
+	Unexported  bool // Go: include unexported types and members
+	Save        bool
+	Title       string
+	WorkspaceID *uuid.UUID
+	IsPublic    bool
+}
+
+// GenerateFromSource converts a source artifact into a Mermaid diagram without AI and, when asked,
+// saves it as a new diagram.
+func (s *Service) GenerateFromSource(ctx context.Context, userID uuid.UUID, in GenerateInput) (model.GeneratedDiagramResponse, error) {
+	if !convert.ValidSource(in.Source) {
+		return model.GeneratedDiagramResponse{}, common.NewDomainError(common.CodeInvalidInput, "Source must be sql, go or openapi.", nil)
+	}
+	if in.Save && in.Title == "" {
+		return model.GeneratedDiagramResponse{}, common.NewDomainError(common.CodeInvalidInput, "Title is required to save the diagram.", nil)
+	}
+	res, err := convert.Convert(in.Source, in.Data, convert.Options{Unexported: in.Unexported})
+	if err != nil {
+		return model.GeneratedDiagramResponse{}, common.NewDomainError(common.CodeInvalidInput, "Could not convert the source: "+err.Error(), err)
+	}
+	out := model.GeneratedDiagramResponse{Source: in.Source, DiagramType: res.DiagramType, Content: res.Content}
+	if !in.Save {
+		return out, nil
+	}
+	d, err := s.CreateDiagram(ctx, userID, in.WorkspaceID, in.Title, res.Content, res.DiagramType, in.IsPublic)
+	if err != nil {
+		return model.GeneratedDiagramResponse{}, err
+	}
+	out.Diagram = &d
+	return out, nil
+}
@@ -2,6 +2,8 @@ package service
 
 import (
 	"context"
+	"encoding/json"
+	"time"
 
 	"github.com/devenock/d_weaver/internal/common"
 	"github.com/devenock/d_weaver/internal/diagram/model"
@@ -16,13 +18,22 @@ type DiagramRepository interface {
 	ListVisibleByUserID(ctx context.Context, userID uuid.UUID) ([]*model.Diagram, error)
 	ListPublic(ctx context.Context, limit int) ([]*model.Diagram, error)
 	Update(ctx context.Context, id uuid.UUID, title, content, diagramType string, isPublic bool) (*model.Diagram, error)
+	UpdateContent(ctx context.Context, id uuid.UUID, content string) (*model.Diagram, error)
+	SaveRevision(ctx context.Context, diagramID, userID uuid.UUID, base, content, source string) (bool, error)
 	UpdateImageURL(ctx context.Context, id uuid.UUID, imageURL string) (*model.Diagram, error)
+	GetCRDTUpdateLog(ctx context.Context, diagramID uuid.UUID) (json.RawMessage, error)
+	SaveCanvasState(ctx context.Context, diagramID uuid.UUID, content string, updateLog json.RawMessage) (bool, error)
 	Delete(ctx context.Context, id uuid.UUID) (bool, error)
 	CreateComment(ctx context.Context, diagramID, userID uuid.UUID, commentText string) (*model.Comment, error)
 	GetCommentByID(ctx context.Context, id uuid.UUID) (*model.Comment, error)
 	ListCommentsByDiagramID(ctx context.Context, diagramID uuid.UUID) ([]*model.Comment, error)
 	UpdateComment(ctx context.Context, id uuid.UUID, commentText string) (*model.Comment, error)
 	DeleteComment(ctx context.Context, id uuid.UUID) (bool, error)
+	UpsertSession(ctx context.Context, diagramID, userID uuid.UUID, cursor json.RawMessage) error
+	DeleteSession(ctx context.Context, diagramID, userID uuid.UUID) error
+	DeleteSessionsSeenBefore(ctx context.Context, before time.Time) (int64, error)
+	ListSessionsByDiagramID(ctx context.Context, diagramID uuid.UUID, since time.Time) ([]*model.CollaborationSession, error)
+	ListSessionsByWorkspaceID(ctx context.Context, workspaceID uuid.UUID, since time.Time) ([]*model.CollaborationSession, error)
 }
 
 // WorkspaceMemberRepository is a minimal interface for membership checks (implemented by workspace repo).
@@ -30,10 +41,17 @@ type WorkspaceMemberRepository interface {
 	GetMember(ctx context.Context, workspaceID, userID uuid.UUID) (*wsmodel.WorkspaceMember, error)
 }
 
+// LiveDocuments is told about content saved over base outside a diagram's collaboration rooms, so open
+// rooms take it instead of autosaving over it (implemented by the realtime hub). Optional.
+type LiveDocuments interface {
+	ContentReplaced(diagramID, userID uuid.UUID, base, content string)
+}
+
 // Service implements diagram business logic and access control (owner, workspace member, public).
 type Service struct {
 	repo   DiagramRepository
 	wsRepo WorkspaceMemberRepository
+	live   LiveDocuments // optional
 }
 
 // New returns a diagram service using the given repositories.
@@ -41,6 +59,11 @@ func New(repo DiagramRepository, wsRepo WorkspaceMemberRepository) *Service {
 	return &Service{repo: repo, wsRepo: wsRepo}
 }
 
+// SetLiveDocuments makes full updates reach the diagram's open collaboration rooms.
+func (s *Service) SetLiveDocuments(live LiveDocuments) {
+	s.live = live
+}
+
 // canAccessDiagram returns nil if user can view the diagram (owner, workspace member, or public).
 func (s *Service) canAccessDiagram(ctx context.Context, d *model.Diagram, userID uuid.UUID) error {
 	if d.IsPublic {
@@ -78,6 +101,42 @@ func (s *Service) canEditDiagram(ctx context.Context, d *model.Diagram, userID u
 	return common.NewDomainError(common.CodeForbidden, "You do not have permission to edit this diagram.", nil)
 }
 
+// ResolveDiagramPermission returns the user's effective permission on the diagram: edit for the owner and
+// workspace owners/admins (as canEditDiagram), comment for workspace members, view for workspace viewers
+// and visitors of public diagrams. Anyone else gets ErrForbidden.
+func (s *Service) ResolveDiagramPermission(ctx context.Context, diagramID, userID uuid.UUID) (model.Permission, error) {
+	d, err := s.repo.GetByID(ctx, diagramID)
+	if err != nil {
+		return "", common.NewDomainError(common.CodeInternalError, "Failed to get diagram.", err)
+	}
+	if d == nil {
+		return "", common.NewDomainError(common.CodeNotFound, "Diagram not found.", nil)
+	}
+	if d.UserID != nil && *d.UserID == userID {
+		return model.PermissionEdit, nil
+	}
+	if d.WorkspaceID != nil {
+		m, err := s.wsRepo.GetMember(ctx, *d.WorkspaceID, userID)
+		if err != nil {
+			return "", common.NewDomainError(common.CodeInternalError, "Failed to check membership.", err)
+		}
+		if m != nil {
+			switch m.Role {
+			case wsmodel.RoleOwner, wsmodel.RoleAdmin:
+				return model.PermissionEdit, nil
+			case wsmodel.RoleMember:
+				return model.PermissionComment, nil
+			default:
+				return model.PermissionView, nil
+			}
+		}
+	}
+	if d.IsPublic {
+		return model.PermissionView, nil
+	}
+	return "", common.NewDomainError(common.CodeForbidden, "You do not have access to this diagram.", nil)
+}
+
 // CreateDiagram creates a diagram. If workspaceID is set, user must be a member.
 func (s *Service) CreateDiagram(ctx context.Context, userID uuid.UUID, workspaceID *uuid.UUID, title, content, diagramType string, isPublic bool) (model.DiagramResponse, error) {
 	if workspaceID != nil {
@@ -136,7 +195,8 @@ func (s *Service) ListDiagrams(ctx context.Context, userID uuid.UUID) ([]model.D
 	return out, nil
 }
 
-// UpdateDiagram updates a diagram if the user has edit permission.
+// UpdateDiagram updates a diagram if the user has edit permission, replacing the content of its open
+// collaboration rooms.
 func (s *Service) UpdateDiagram(ctx context.Context, id, userID uuid.UUID, title, content, diagramType string, isPublic bool) (model.DiagramResponse, error) {
 	d, err := s.repo.GetByID(ctx, id)
 	if err != nil {
@@ -148,13 +208,172 @@ func (s *Service) UpdateDiagram(ctx context.Context, id, userID uuid.UUID, title
 	if err := s.canEditDiagram(ctx, d, userID); err != nil {
 		return model.DiagramResponse{}, err
 	}
+	// A full PUT replaces the canvas: the repository drops the collaboration log with the update so it
+	// does not override the new content.
 	updated, err := s.repo.Update(ctx, id, title, content, diagramType, isPublic)
 	if err != nil {
 		return model.DiagramResponse{}, common.NewDomainError(common.CodeInternalError, "Failed to update diagram.", err)
 	}
+	if updated == nil {
+		return model.DiagramResponse{}, common.NewDomainError(common.CodeNotFound, "Diagram not found.", nil)
+	}
+	if s.live != nil {
+		s.live.ContentReplaced(id, userID, d.Content, updated.Content)
+	}
 	return model.FromDiagram(updated), nil
 }
 
+// GetDiagramContent returns the content and type of a diagram the user can access (realtime room load).
+func (s *Service) GetDiagramContent(ctx context.Context, id, userID uuid.UUID) (string, string, error) {
+	d, err := s.GetDiagram(ctx, id, userID)
+	if err != nil {
+		return "", "", err
+	}
+	return d.Content, d.DiagramType, nil
+}
+
+// SaveDiagramContent replaces only the content of a diagram the user can edit (realtime snapshots).
+func (s *Service) SaveDiagramContent(ctx context.Context, id, userID uuid.UUID, content string) error {
+	d, err := s.repo.GetByID(ctx, id)
+	if err != nil {
+		return common.NewDomainError(common.CodeInternalError, "Failed to get diagram.", err)
+	}
+	if d == nil {
+		return common.NewDomainError(common.CodeNotFound, "Diagram not found.", nil)
+	}
+	if err := s.canEditDiagram(ctx, d, userID); err != nil {
+		return err
+	}
+	updated, err := s.repo.UpdateContent(ctx, id, content)
+	if err != nil {
+		return common.NewDomainError(common.CodeInternalError, "Failed to save diagram content.", err)
+	}
+	if updated == nil {
+		return common.NewDomainError(common.CodeNotFound, "Diagram not found.", nil)
+	}
+	return nil
+}
+
+// SaveDiagramRevision replaces the content of a diagram the user can edit, computed from base, and records
+// it as a revision from source (e.g. model.RevisionSourceAIEdit). It returns a Conflict domain error,
+// saving nothing, when the content was changed since it was base.
+func (s *Service) SaveDiagramRevision(ctx context.Context, id, userID uuid.UUID, base, content, source string) error {
+	d, err := s.repo.GetByID(ctx, id)
+	if err != nil {
+		return common.NewDomainError(common.CodeInternalError, "Failed to get diagram.", err)
+	}
+	if d == nil {
+		return common.NewDomainError(common.CodeNotFound, "Diagram not found.", nil)
+	}
+	if err := s.canEditDiagram(ctx, d, userID); err != nil {
+		return err
+	}
+	ok, err := s.repo.SaveRevision(ctx, id, userID, base, content, source)
+	if err != nil {
+		return common.NewDomainError(common.CodeInternalError, "Failed to save diagram content.", err)
+	}
+	if !ok {
+		return common.NewDomainError(common.CodeConflict, "The diagram was changed since it was read. Please try again.", nil)
+	}
+	return nil
+}
+
+// GetCanvasUpdateLog returns the persisted CRDT update log of a canvas diagram the user can access (nil if none).
+func (s *Service) GetCanvasUpdateLog(ctx context.Context, id, userID uuid.UUID) (json.RawMessage, error) {
+	if err := s.CheckDiagramAccess(ctx, id, userID); err != nil {
+		return nil, err
+	}
+	log, err := s.repo.GetCRDTUpdateLog(ctx, id)
+	if err != nil {
+		return nil, common.NewDomainError(common.CodeInternalError, "Failed to get canvas state.", err)
+	}
+	return log, nil
+}
+
+// SaveCanvasState stores the merged canvas content and its compacted CRDT update log if the user can edit.
+func (s *Service) SaveCanvasState(ctx context.Context, id, userID uuid.UUID, content string, updateLog json.RawMessage) error {
+	d, err := s.repo.GetByID(ctx, id)
+	if err != nil {
+		return common.NewDomainError(common.CodeInternalError, "Failed to get diagram.", err)
+	}
+	if d == nil {
+		return common.NewDomainError(common.CodeNotFound, "Diagram not found.", nil)
+	}
+	if err := s.canEditDiagram(ctx, d, userID); err != nil {
+		return err
+	}
+	ok, err := s.repo.SaveCanvasState(ctx, id, content, updateLog)
+	if err != nil {
+		return common.NewDomainError(common.CodeInternalError, "Failed to save canvas state.", err)
+	}
+	if !ok {
+		return common.NewDomainError(common.CodeNotFound, "Diagram not found.", nil)
+	}
+	return nil
+}
+
+// TouchSession records that the user is in the diagram room (realtime join, cursor and heartbeat).
+// A nil cursor keeps the stored position.
+func (s *Service) TouchSession(ctx context.Context, diagramID, userID uuid.UUID, cursor json.RawMessage) error {
+	if err := s.repo.UpsertSession(ctx, diagramID, userID, cursor); err != nil {
+		return common.NewDomainError(common.CodeInternalError, "Failed to record session.", err)
+	}
+	return nil
+}
+
+// EndSession removes the user's session on the diagram (realtime leave).
+func (s *Service) EndSession(ctx context.Context, diagramID, userID uuid.UUID) error {
+	if err := s.repo.DeleteSession(ctx, diagramID, userID); err != nil {
+		return common.NewDomainError(common.CodeInternalError, "Failed to end session.", err)
+	}
+	return nil
+}
+
+// ExpireSessions removes sessions not refreshed within model.SessionTTL and returns how many were removed.
+func (s *Service) ExpireSessions(ctx context.Context) (int64, error) {
+	n, err := s.repo.DeleteSessionsSeenBefore(ctx, time.Now().Add(-model.SessionTTL))
+	if err != nil {
+		return 0, common.NewDomainError(common.CodeInternalError, "Failed to expire sessions.", err)
+	}
+	return n, nil
+}
+
+// ListDiagramPresence returns who is viewing the diagram now, if the user can access it.
+func (s *Service) ListDiagramPresence(ctx context.Context, diagramID, userID uuid.UUID) ([]model.PresenceResponse, error) {
+	if err := s.CheckDiagramAccess(ctx, diagramID, userID); err != nil {
+		return nil, err
+	}
+	list, err := s.repo.ListSessionsByDiagramID(ctx, diagramID, time.Now().Add(-model.SessionTTL))
+	if err != nil {
+		return nil, common.NewDomainError(common.CodeInternalError, "Failed to list presence.", err)
+	}
+	return fromSessions(list), nil
+}
+
+// ListWorkspacePresence returns who is viewing which of the workspace's diagrams now, if the user is a member.
+func (s *Service) ListWorkspacePresence(ctx context.Context, workspaceID, userID uuid.UUID) ([]model.PresenceResponse, error) {
+	m, err := s.wsRepo.GetMember(ctx, workspaceID, userID)
+	if err != nil {
+		return nil, common.NewDomainError(common.CodeInternalError, "Failed to check membership.", err)
+	}
+	if m == nil {
+		return nil, common.NewDomainError(common.CodeForbidden, "You are not a member of this workspace.", nil)
+	}
+	list, err := s.repo.ListSessionsByWorkspaceID(ctx, workspaceID, time.Now().Add(-model.SessionTTL))
+	if err != nil {
+		return nil, common.NewDomainError(common.CodeInternalError, "Failed to list presence.", err)
+	}
+	return fromSessions(list), nil
+}
+
+func fromSessions(list []*model.CollaborationSession) []model.PresenceResponse {
+	out := make([]model.PresenceResponse, len(list))
+	for i, sess := range list {
+		out[i] = model.FromSession(sess)
+	}
+	return out
+}
+
 // UpdateDiagramImage sets image_url for the diagram (after upload).
 func (s *Service) UpdateDiagramImage(ctx context.Context, id, userID uuid.UUID, imageURL string) (model.DiagramResponse, error) {
 	d, err := s.repo.GetByID(ctx, id)
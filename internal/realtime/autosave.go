@@ -0,0 +1,195 @@
+package realtime
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	defaultAutosaveDebounce = 2 * time.Second
+	// autosaveCheckInterval is how often the Run loop looks for rooms due an autosave.
+	autosaveCheckInterval = 500 * time.Millisecond
+)
+
+// markDirty records an edit by userID. Caller holds r.mu.
+func (r *room) markDirty(userID uuid.UUID) {
+	now := time.Now()
+	if !r.dirty {
+		r.dirtySince = now
+	}
+	r.dirty = true
+	r.lastEdit = now
+	r.lastEditor = userID
+}
+
+// PushSnapshot replaces the room document with content from a client that has seen revision, then
+// lets autosave persist it. The other clients receive the new document as a snapshot; the sender is
+// acked with the new revision, or gets an error and the current snapshot when revision is stale.
+// On a node that is not the room's sequencer Mermaid content is forwarded to it as one text op.
+func (h *Hub) PushSnapshot(c *Client, id string, revision int, content string) {
+	r := h.roomOf(c.diagramID)
+	if r == nil {
+		h.sendError(c, id, errNoDocument)
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.doc == nil {
+		h.sendError(c, id, errNoDocument)
+		return
+	}
+	if r.isTextRoom() && !r.sequencer {
+		switch {
+		case !r.synced:
+			h.sendError(c, id, errResyncing)
+		case revision != r.doc.revision:
+			h.sendError(c, id, &protocolError{ErrCodeStaleRevision, ErrStaleRevision.Error()})
+			h.sendSnapshotTo(c, r)
+		case content == r.doc.text:
+			h.sendAck(c, r, &Message{Type: "ack", ID: id, Revision: revision})
+		default:
+			h.forwardTextOp(c, r, id, revision, diffText(r.doc.text, content))
+		}
+		return
+	}
+	changed, rev, err := r.doc.replaceContent(revision, content)
+	if err != nil {
+		h.sendError(c, id, &protocolError{opErrorCode(err), err.Error()})
+		h.sendSnapshotTo(c, r)
+		return
+	}
+	if changed {
+		r.markDirty(c.userID)
+		h.broadcastToRoom(c.diagramID, &Message{Type: "snapshot", UserID: c.userID.String(), DiagramType: r.doc.diagramType, Content: r.doc.content(), Revision: rev, Updates: r.doc.updateLog()}, c)
+	}
+	h.sendAck(c, r, &Message{Type: "ack", ID: id, Revision: rev})
+}
+
+// contentReplaced is the node message announcing content saved outside the socket.
+type contentReplaced struct {
+	Type    string `json:"type"` // "content_replaced"
+	UserID  string `json:"user_id"`
+	Base    string `json:"base"`
+	Content string `json:"content"`
+}
+
+// ContentReplaced tells the diagram's rooms on every node that userID saved content over base outside
+// the socket (e.g. an applied AI edit or a full update), so their autosave does not revert it. Call it
+// only after the save succeeded.
+func (h *Hub) ContentReplaced(diagramID, userID uuid.UUID, base, content string) {
+	payload, err := json.Marshal(contentReplaced{Type: "content_replaced", UserID: userID.String(), Base: base, Content: content})
+	if err != nil {
+		return
+	}
+	h.applyReplaced(diagramID, userID, base, content)
+	h.publish(diagramID, payload)
+}
+
+// applyReplaced brings this node's room up to content saved over base. For Mermaid the room's sequencer
+// transforms the change from base to content against the live edits made since base and applies it as a
+// text op, so neither is lost. A canvas is replaced outright on every node, its clients resynced.
+func (h *Hub) applyReplaced(diagramID, userID uuid.UUID, base, content string) {
+	r := h.roomOf(diagramID)
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.doc == nil {
+		return
+	}
+	if r.doc.isCanvas() {
+		h.resetCanvas(diagramID, r, userID, content)
+		return
+	}
+	live := r.doc.content()
+	if !r.sequencer || live == content {
+		return
+	}
+	// The saved change goes first where both insert at one place.
+	theirs, _, err := TransformText(diffText(base, content), diffText(base, live))
+	var applied TextOperation
+	var rev int
+	if err == nil {
+		applied, rev, err = r.doc.applyText(r.doc.revision, theirs)
+	}
+	if err != nil {
+		if h.log != nil {
+			h.log.Warn().Err(err).Str("diagram_id", diagramID.String()).Msg("realtime: merge replaced content failed")
+		}
+		return
+	}
+	r.markDirty(userID) // saves the merge, and the content again if an autosave in flight wrote over it
+	h.broadcastToRoom(diagramID, &Message{Type: "text_op", UserID: userID.String(), Revision: rev, Ops: applied}, nil)
+}
+
+// resetCanvas replaces the room's canvas with content, starting a new CRDT log as a room loaded from it
+// would, and resyncs the room's clients on this node. Caller holds r.mu.
+func (h *Hub) resetCanvas(diagramID uuid.UUID, r *room, userID uuid.UUID, content string) {
+	if r.doc.content() == content {
+		return
+	}
+	doc, err := newDocument(content, r.doc.diagramType, nil, h.site)
+	if err != nil {
+		if h.log != nil {
+			h.log.Warn().Err(err).Str("diagram_id", diagramID.String()).Msg("realtime: replace canvas failed")
+		}
+		return
+	}
+	doc.revision = r.doc.revision + 1
+	r.doc = doc
+	r.markDirty(userID) // saves the new log, and the content again if an autosave in flight wrote over it
+	h.deliverLocal(diagramID, &Message{Type: "resync"}, nil)
+	h.deliverLocal(diagramID, &Message{Type: "snapshot", UserID: userID.String(), DiagramType: doc.diagramType, Content: doc.content(), Revision: doc.revision, Updates: doc.updateLog()}, nil)
+}
+
+// autosave persists rooms whose edits have settled for the debounce period, or that have had unsaved
+// edits for a whole snapshot interval while editing continues.
+func (h *Hub) autosave(ctx context.Context) {
+	now := time.Now()
+	h.mu.RLock()
+	due := make(map[uuid.UUID]*room)
+	for id, r := range h.rooms {
+		due[id] = r
+	}
+	h.mu.RUnlock()
+	for id, r := range due {
+		r.mu.Lock()
+		ready := r.dirty && (now.Sub(r.lastEdit) >= h.autosaveDebounce || now.Sub(r.dirtySince) >= h.snapshotInterval)
+		r.mu.Unlock()
+		if ready {
+			h.saveSnapshot(ctx, id, r)
+		}
+	}
+}
+
+// lastSaved returns when this room was last saved (here or on another node), zero if not yet.
+func (r *room) lastSaved() time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.savedAt
+}
+
+// announceSaved tells the room which revision is now persisted.
+func (h *Hub) announceSaved(diagramID uuid.UUID, revision int, at time.Time) {
+	h.broadcastToRoom(diagramID, &Message{Type: "saved", Revision: revision, SavedAt: at.UTC().Format(time.RFC3339)}, nil)
+}
+
+// dropIfIdle removes the room when it has no clients and nothing left to save.
+func (h *Hub) dropIfIdle(diagramID uuid.UUID, r *room) {
+	r.mu.Lock()
+	h.mu.Lock()
+	dropped, sequencer := false, false
+	if len(r.clients) == 0 && !r.dirty && h.rooms[diagramID] == r {
+		delete(h.rooms, diagramID)
+		dropped, sequencer = true, r.sequencer
+	}
+	h.mu.Unlock()
+	r.mu.Unlock()
+	if dropped {
+		h.roomDropped(diagramID, sequencer)
+	}
+}
@@ -0,0 +1,214 @@
+package realtime
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/devenock/d_weaver/config"
+	"github.com/google/uuid"
+)
+
+// memoryStore holds one diagram's content and counts saves.
+type memoryStore struct {
+	DiagramStore
+	mu          sync.Mutex
+	diagramType string
+	content     string
+	saves       int
+}
+
+func (s *memoryStore) GetDiagramContent(ctx context.Context, diagramID, userID uuid.UUID) (string, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.content, s.diagramType, nil
+}
+
+func (s *memoryStore) GetCanvasUpdateLog(ctx context.Context, diagramID, userID uuid.UUID) (json.RawMessage, error) {
+	return nil, nil
+}
+
+func (s *memoryStore) SaveDiagramContent(ctx context.Context, diagramID, userID uuid.UUID, content string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.content = content
+	s.saves++
+	return nil
+}
+
+func (s *memoryStore) SaveCanvasState(ctx context.Context, diagramID, userID uuid.UUID, content string, updateLog json.RawMessage) error {
+	return s.SaveDiagramContent(ctx, diagramID, userID, content)
+}
+
+func (s *memoryStore) saved() (string, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.content, s.saves
+}
+
+func TestHub_PushSnapshotAndAutosave(t *testing.T) {
+	store := &memoryStore{diagramType: "flowchart", content: "graph LR"}
+	hub := NewHub(store, nil, nil, config.RealtimeConfig{AutosaveDebounceMs: 1}, nil)
+	diagramID := uuid.New()
+	a, b := newTestClient(hub, diagramID), newTestClient(hub, diagramID)
+	hub.Register(a)
+	hub.Register(b)
+	drain(t, a)
+	drain(t, b)
+
+	hub.PushSnapshot(a, "s1", 0, "graph TD\n  A-->B")
+	if acks := framesOfType(drain(t, a), "ack"); len(acks) != 1 || acks[0].Revision != 1 {
+		t.Fatalf("acks = %+v, want revision 1", acks)
+	}
+	if snaps := framesOfType(drain(t, b), "snapshot"); len(snaps) != 1 || snaps[0].Content != "graph TD\n  A-->B" || snaps[0].UserID != a.userID.String() {
+		t.Fatalf("snapshots to others = %+v", snaps)
+	}
+	hub.PushSnapshot(b, "s2", 0, "graph LR")
+	if errs := framesOfType(drain(t, b), "error"); len(errs) != 1 || errs[0].Code != ErrCodeStaleRevision {
+		t.Errorf("stale snapshot errors = %+v, want stale_revision", errs)
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	hub.autosave(context.Background())
+	if content, saves := store.saved(); saves != 1 || !strings.HasPrefix(content, "graph TD") {
+		t.Fatalf("store = %q after %d saves, want the pushed snapshot", content, saves)
+	}
+	if saved := framesOfType(drain(t, b), "saved"); len(saved) != 1 || saved[0].Revision != 1 || saved[0].SavedAt == "" {
+		t.Errorf("saved frames = %+v", saved)
+	}
+	late := newTestClient(hub, diagramID)
+	hub.Register(late)
+	if p := framesOfType(drain(t, late), "presence"); len(p) != 1 || p[0].SavedAt == "" {
+		t.Errorf("presence = %+v, want saved_at", p)
+	}
+}
+
+func TestHub_SavesWhenLastClientLeaves(t *testing.T) {
+	store := &memoryStore{diagramType: "flowchart", content: "graph LR"}
+	hub := NewHub(store, nil, nil, config.RealtimeConfig{AutosaveDebounceMs: int(time.Hour / time.Millisecond)}, nil)
+	diagramID := uuid.New()
+	a, b := newTestClient(hub, diagramID), newTestClient(hub, diagramID)
+	hub.Register(a)
+	hub.Register(b)
+	hub.PushSnapshot(a, "", 0, "graph TD")
+	hub.Unregister(a)
+	if _, saves := store.saved(); saves != 0 {
+		t.Fatalf("saved with a client still in the room")
+	}
+	hub.Unregister(b)
+	if content, saves := store.saved(); saves != 1 || content != "graph TD" {
+		t.Errorf("store = %q after %d saves, want final save", content, saves)
+	}
+	if hub.roomOf(diagramID) != nil {
+		t.Error("room kept after its final save")
+	}
+}
+
+func TestHub_ContentReplacedMergesLiveEdits(t *testing.T) {
+	store := &memoryStore{diagramType: "flowchart", content: "graph LR"}
+	hub := NewHub(store, nil, nil, config.RealtimeConfig{AutosaveDebounceMs: 1}, nil)
+	diagramID, editor := uuid.New(), uuid.New()
+	a := newTestClient(hub, diagramID)
+	hub.Register(a)
+	hub.ApplyTextOp(a, "a1", 0, TextOperation{{Retain: 8}, {Insert: "\n  A"}})
+	drain(t, a)
+
+	// Saved elsewhere from the content before a's unsaved edit.
+	store.mu.Lock()
+	store.content = "graph TD"
+	store.mu.Unlock()
+	hub.ContentReplaced(diagramID, editor, "graph LR", "graph TD")
+	ops := framesOfType(drain(t, a), "text_op")
+	if len(ops) != 1 || ops[0].Revision != 2 || ops[0].UserID != editor.String() {
+		t.Fatalf("text ops = %+v, want the replacement as revision 2", ops)
+	}
+	want := "graph TD\n  A"
+	if got := hub.roomOf(diagramID).doc.content(); got != want {
+		t.Errorf("room = %q, want %q", got, want)
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	hub.autosave(context.Background())
+	if content, _ := store.saved(); content != want {
+		t.Errorf("store = %q after autosave, want both edits kept", content)
+	}
+}
+
+func TestHub_ContentReplacedOnOtherNode(t *testing.T) {
+	c := &cluster{}
+	store := &memoryStore{diagramType: "flowchart", content: "graph LR"}
+	hubA, hubB := c.join(store), c.join(store)
+	diagramID := uuid.New()
+	a, b := newTestClient(hubA, diagramID), newTestClient(hubB, diagramID)
+	hubA.Register(a)
+	hubB.Register(b)
+	c.settle(t)
+	drain(t, b)
+
+	// Announced on the node that is not the sequencer.
+	hubB.ContentReplaced(diagramID, uuid.New(), "graph LR", "graph TD")
+	c.settle(t)
+	for name, h := range map[string]*Hub{"A": hubA, "B": hubB} {
+		if got := h.roomOf(diagramID).doc.content(); got != "graph TD" {
+			t.Errorf("node %s document = %q, want the replaced content", name, got)
+		}
+	}
+	if ops := framesOfType(drain(t, b), "text_op"); len(ops) != 1 || ops[0].Revision != 1 {
+		t.Errorf("text ops on node B = %+v, want the sequencer's op", ops)
+	}
+}
+
+func TestHub_ContentReplacedResetsCanvas(t *testing.T) {
+	store := &memoryStore{diagramType: "whiteboard", content: `{"objects":[{"id":"a","fill":"red"}]}`}
+	hub := NewHub(store, nil, nil, config.RealtimeConfig{}, nil)
+	diagramID := uuid.New()
+	a := newTestClient(hub, diagramID)
+	hub.Register(a)
+	drain(t, a)
+
+	replaced := `{"objects":[{"fill":"blue","id":"b"}]}`
+	hub.ContentReplaced(diagramID, uuid.New(), store.content, replaced)
+	frames := drain(t, a)
+	snaps := framesOfType(frames, "snapshot")
+	if len(framesOfType(frames, "resync")) != 1 || len(snaps) != 1 || snaps[0].Content != replaced || snaps[0].Revision != 1 {
+		t.Fatalf("frames = %+v, want resync and the replaced canvas at revision 1", frames)
+	}
+	r := hub.roomOf(diagramID)
+	if replay := crdtReplay(t, r.doc); replay != `[{"fill":"blue","id":"b"}]` || !r.dirty {
+		t.Errorf("room log replays to %s (dirty %v), want the replaced objects to be saved", replay, r.dirty)
+	}
+}
+
+func TestDocument_ReplaceCanvas(t *testing.T) {
+	doc, err := newDocument(`{"version":"5","objects":[{"id":"a","fill":"red"},{"id":"b","fill":"blue"}]}`, "whiteboard", nil, "server:test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed, rev, err := doc.replaceContent(0, `{"version":"6","objects":[{"id":"c","fill":"green"},{"id":"a","fill":"black"}]}`)
+	if err != nil || !changed || rev != 1 {
+		t.Fatalf("replaceContent = %v, %d, %v", changed, rev, err)
+	}
+	want := `{"objects":[{"fill":"green","id":"c"},{"fill":"black","id":"a"}],"version":"6"}`
+	if got := doc.content(); got != want {
+		t.Errorf("content = %s, want %s", got, want)
+	}
+	replay := crdtReplay(t, doc)
+	if replay != `[{"fill":"green","id":"c"},{"fill":"black","id":"a"}]` {
+		t.Errorf("update log replays to %s", replay)
+	}
+	if _, _, err := doc.replaceContent(0, `{"objects":[]}`); err != ErrStaleRevision {
+		t.Errorf("stale replace err = %v", err)
+	}
+}
+
+func crdtReplay(t *testing.T, d *document) string {
+	replay, err := parseCanvas("", d.updateLog(), "server:replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, _ := json.Marshal(replay.objs.Objects())
+	return string(out)
+}
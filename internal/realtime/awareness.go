@@ -0,0 +1,208 @@
+package realtime
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// awarenessInterval is the minimum gap between two selection, viewport or follow broadcasts from
+	// one connection; updates in between are folded into one trailing broadcast of the latest state.
+	awarenessInterval = 100 * time.Millisecond
+	// maxSelection caps the element ids in one selection message.
+	maxSelection = 1000
+)
+
+// Awareness kinds, each throttled on its own.
+const (
+	awarenessSelection = "selection"
+	awarenessViewport  = "viewport"
+	awarenessFollow    = "follow"
+)
+
+// Viewport is the visible part of a diagram: zoom factor and pan offset.
+type Viewport struct {
+	Zoom float64 `json:"zoom"`
+	X    float64 `json:"x"`
+	Y    float64 `json:"y"`
+}
+
+// awareness is what a connection is looking at. Guarded by Client.mu.
+type awareness struct {
+	selection []string
+	viewport  *Viewport
+	following string // user id, empty when not following
+
+	sentAt map[string]time.Time   // kind -> last broadcast
+	timers map[string]*time.Timer // kind -> pending trailing broadcast
+	left   bool                   // unregistered; no more broadcasts
+}
+
+// presence returns the client as listed in presence snapshots.
+func (c *Client) presence() UserPresence {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return UserPresence{
+		UserID:    c.userID.String(),
+		Email:     c.email,
+		Position:  c.cursor,
+		Selection: c.awareness.selection,
+		Viewport:  c.awareness.viewport,
+		Following: c.awareness.following,
+	}
+}
+
+// UpdateSelection records the element ids the client has selected and broadcasts them, throttled.
+func (h *Hub) UpdateSelection(c *Client, id string, selection []string) {
+	if len(selection) > maxSelection {
+		h.sendError(c, id, &protocolError{ErrCodeBadMessage, fmt.Sprintf("A selection may hold at most %d ids.", maxSelection)})
+		return
+	}
+	c.mu.Lock()
+	c.awareness.selection = selection
+	c.mu.Unlock()
+	h.throttleAwareness(c, awarenessSelection)
+	h.ackIfRequested(c, id)
+}
+
+// UpdateViewport records the client's zoom and pan and broadcasts it, throttled.
+func (h *Hub) UpdateViewport(c *Client, id string, vp *Viewport) {
+	if vp == nil || vp.Zoom <= 0 {
+		h.sendError(c, id, &protocolError{ErrCodeBadMessage, "A viewport requires a positive zoom."})
+		return
+	}
+	c.mu.Lock()
+	c.awareness.viewport = vp
+	c.mu.Unlock()
+	h.throttleAwareness(c, awarenessViewport)
+	h.ackIfRequested(c, id)
+}
+
+// Follow makes the client follow another user's viewport and tells the room, throttled.
+func (h *Hub) Follow(c *Client, id string, following string) {
+	target, err := uuid.Parse(following)
+	if err != nil || target == c.userID {
+		h.sendError(c, id, &protocolError{ErrCodeBadMessage, "following must be the id of another user."})
+		return
+	}
+	h.setFollowing(c, target.String())
+	h.ackIfRequested(c, id)
+}
+
+// Unfollow stops the client following anyone and tells the room, throttled.
+func (h *Hub) Unfollow(c *Client, id string) {
+	h.setFollowing(c, "")
+	h.ackIfRequested(c, id)
+}
+
+func (h *Hub) setFollowing(c *Client, following string) {
+	c.mu.Lock()
+	c.awareness.following = following
+	c.mu.Unlock()
+	h.throttleAwareness(c, awarenessFollow)
+}
+
+// ackIfRequested acks the client message id when the client set one.
+func (h *Hub) ackIfRequested(c *Client, id string) {
+	if id != "" {
+		h.sendTo(c, &Message{Type: "ack", ID: id})
+	}
+}
+
+// throttleAwareness broadcasts the client's current state of kind now, or schedules one trailing
+// broadcast when the last one went out less than awarenessInterval ago.
+func (h *Hub) throttleAwareness(c *Client, kind string) {
+	c.mu.Lock()
+	if c.awareness.left || c.awareness.timers[kind] != nil {
+		c.mu.Unlock()
+		return
+	}
+	if c.awareness.sentAt == nil {
+		c.awareness.sentAt = make(map[string]time.Time)
+		c.awareness.timers = make(map[string]*time.Timer)
+	}
+	if wait := awarenessInterval - time.Since(c.awareness.sentAt[kind]); wait > 0 {
+		c.awareness.timers[kind] = time.AfterFunc(wait, func() { h.flushAwareness(c, kind) })
+		c.mu.Unlock()
+		return
+	}
+	c.awareness.sentAt[kind] = time.Now()
+	c.mu.Unlock()
+	h.broadcastAwareness(c, kind, c)
+}
+
+// flushAwareness sends the trailing broadcast scheduled by throttleAwareness.
+func (h *Hub) flushAwareness(c *Client, kind string) {
+	c.mu.Lock()
+	delete(c.awareness.timers, kind)
+	if c.awareness.left {
+		c.mu.Unlock()
+		return
+	}
+	c.awareness.sentAt[kind] = time.Now()
+	c.mu.Unlock()
+	h.broadcastAwareness(c, kind, c)
+}
+
+// broadcastAwareness sends the client's current state of kind to the room except skip and updates the
+// client's shared presence entry so newcomers on every node see it.
+func (h *Hub) broadcastAwareness(c *Client, kind string, skip *Client) {
+	p := c.presence()
+	msg := Message{Type: kind, UserID: p.UserID}
+	switch kind {
+	case awarenessSelection:
+		msg.Selection = p.Selection
+	case awarenessViewport:
+		msg.Viewport = p.Viewport
+	case awarenessFollow:
+		msg.Following = p.Following
+		if p.Following == "" {
+			msg.Type = "unfollow"
+		}
+	}
+	h.broadcastToRoom(c.diagramID, &msg, skip)
+
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	if err := h.backend.Join(ctx, c.diagramID, c.id, p); err != nil && h.log != nil {
+		h.log.Warn().Err(err).Str("diagram_id", c.diagramID.String()).Msg("realtime: update presence failed")
+	}
+}
+
+// endAwareness stops the client's pending broadcasts; called on Unregister.
+func (c *Client) endAwareness() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.awareness.left = true
+	for kind, t := range c.awareness.timers {
+		t.Stop()
+		delete(c.awareness.timers, kind)
+	}
+}
+
+// releaseFollowers stops this node's clients in the room from following a user who left, telling the
+// room (the followers included). Followers on other nodes learn it from the leave frame.
+func (h *Hub) releaseFollowers(diagramID, userID uuid.UUID) {
+	h.mu.RLock()
+	var followers []*Client
+	if r := h.rooms[diagramID]; r != nil {
+		for cl := range r.clients {
+			followers = append(followers, cl)
+		}
+	}
+	h.mu.RUnlock()
+	for _, cl := range followers {
+		cl.mu.Lock()
+		following := cl.awareness.following == userID.String()
+		if following {
+			cl.awareness.following = ""
+		}
+		cl.mu.Unlock()
+		if following {
+			h.broadcastAwareness(cl, awarenessFollow, nil)
+		}
+	}
+}
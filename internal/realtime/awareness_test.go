@@ -0,0 +1,131 @@
+package realtime
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/devenock/d_weaver/config"
+	"github.com/google/uuid"
+)
+
+func framesOfType(msgs []Message, typ string) []Message {
+	var out []Message
+	for _, m := range msgs {
+		if m.Type == typ {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+func TestHub_SelectionThrottled(t *testing.T) {
+	hub := NewHub(nil, nil, nil, config.RealtimeConfig{}, nil)
+	diagramID := uuid.New()
+	a, b := newTestClient(hub, diagramID), newTestClient(hub, diagramID)
+	hub.Register(a)
+	hub.Register(b)
+	drain(t, b)
+
+	hub.UpdateSelection(a, "", []string{"n1"})
+	hub.UpdateSelection(a, "", []string{"n2"})
+	hub.UpdateSelection(a, "s3", []string{"n3"})
+	if got := framesOfType(drain(t, b), "selection"); len(got) != 1 || got[0].Selection[0] != "n1" {
+		t.Fatalf("immediate selections = %+v, want only n1", got)
+	}
+	if acks := framesOfType(drain(t, a), "ack"); len(acks) != 1 || acks[0].ID != "s3" {
+		t.Errorf("acks = %+v, want s3", acks)
+	}
+
+	time.Sleep(2 * awarenessInterval)
+	if got := framesOfType(drain(t, b), "selection"); len(got) != 1 || got[0].Selection[0] != "n3" {
+		t.Fatalf("trailing selections = %+v, want latest n3", got)
+	}
+
+	hub.UpdateSelection(a, "s4", make([]string, maxSelection+1))
+	if errs := framesOfType(drain(t, a), "error"); len(errs) != 1 || errs[0].Code != ErrCodeBadMessage {
+		t.Errorf("oversized selection errors = %+v, want bad_message", errs)
+	}
+}
+
+func TestHub_PresenceCarriesAwareness(t *testing.T) {
+	hub := NewHub(nil, nil, nil, config.RealtimeConfig{}, nil)
+	diagramID := uuid.New()
+	presenter, viewer := newTestClient(hub, diagramID), newTestClient(hub, diagramID)
+	hub.Register(presenter)
+	hub.Register(viewer)
+	hub.UpdateViewport(presenter, "", &Viewport{Zoom: 2, X: 10, Y: 20})
+	hub.Follow(viewer, "", presenter.userID.String())
+
+	late := newTestClient(hub, diagramID)
+	hub.Register(late)
+	presence := framesOfType(drain(t, late), "presence")
+	if len(presence) != 1 {
+		t.Fatalf("presence frames = %d, want 1", len(presence))
+	}
+	var sawViewport, sawFollow bool
+	for _, u := range presence[0].Users {
+		if u.UserID == presenter.userID.String() && u.Viewport != nil && u.Viewport.Zoom == 2 {
+			sawViewport = true
+		}
+		if u.UserID == viewer.userID.String() && u.Following == presenter.userID.String() {
+			sawFollow = true
+		}
+	}
+	if !sawViewport || !sawFollow {
+		t.Errorf("presence = %+v, want presenter viewport and viewer following", presence[0].Users)
+	}
+
+	drain(t, viewer)
+	hub.Unregister(presenter)
+	if got := framesOfType(drain(t, viewer), "unfollow"); len(got) != 1 || got[0].UserID != viewer.userID.String() {
+		t.Errorf("unfollow frames after presenter left = %+v", got)
+	}
+	if p := viewer.presence(); p.Following != "" {
+		t.Errorf("viewer still following %s", p.Following)
+	}
+}
+
+// endedSessions records ended sessions.
+type endedSessions struct {
+	mu    sync.Mutex
+	ended []uuid.UUID
+}
+
+func (s *endedSessions) TouchSession(ctx context.Context, diagramID, userID uuid.UUID, cursor json.RawMessage) error {
+	return nil
+}
+
+func (s *endedSessions) EndSession(ctx context.Context, diagramID, userID uuid.UUID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ended = append(s.ended, userID)
+	return nil
+}
+
+func (s *endedSessions) ExpireSessions(ctx context.Context) (int64, error) {
+	return 0, nil
+}
+
+func TestHub_SessionEndsWhenUserLeftEveryNode(t *testing.T) {
+	// Two nodes sharing presence, as through Redis.
+	backend, sessions := NewMemoryBackend(), &endedSessions{}
+	hubA := NewHub(nil, sessions, backend, config.RealtimeConfig{}, nil)
+	hubB := NewHub(nil, sessions, backend, config.RealtimeConfig{}, nil)
+	diagramID := uuid.New()
+	a, b := newTestClient(hubA, diagramID), newTestClient(hubB, diagramID)
+	b.userID = a.userID
+	hubA.Register(a)
+	hubB.Register(b)
+
+	hubA.Unregister(a)
+	if len(sessions.ended) != 0 {
+		t.Fatalf("ended %v while the user is still connected to another node", sessions.ended)
+	}
+	hubB.Unregister(b)
+	if len(sessions.ended) != 1 || sessions.ended[0] != a.userID {
+		t.Errorf("ended %v, want the user's session once they left", sessions.ended)
+	}
+}
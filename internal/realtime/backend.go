@@ -0,0 +1,111 @@
+package realtime
+
+import (
+	"context"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// Backend fans room events out to other API replicas and tracks who is in each room across them.
+// The hub always delivers to its own clients directly; Publish only needs to reach other nodes.
+type Backend interface {
+	// Publish sends an encoded room message to the other nodes.
+	Publish(ctx context.Context, diagramID uuid.UUID, payload []byte) error
+	// Subscribe calls deliver for every message other nodes publish to a room this node subscribed to,
+	// until ctx is done.
+	Subscribe(ctx context.Context, deliver func(diagramID uuid.UUID, payload []byte))
+	// SubscribeRoom starts receiving the room's messages; UnsubscribeRoom stops. Calls are counted: the
+	// node stays subscribed until every SubscribeRoom has been matched by an UnsubscribeRoom.
+	SubscribeRoom(ctx context.Context, diagramID uuid.UUID) error
+	UnsubscribeRoom(ctx context.Context, diagramID uuid.UUID) error
+	// Join records or updates a connection in the room's presence list; Leave removes it.
+	Join(ctx context.Context, diagramID uuid.UUID, connID string, p UserPresence) error
+	Leave(ctx context.Context, diagramID uuid.UUID, connID string) error
+	// Presence returns everyone in the room on every node.
+	Presence(ctx context.Context, diagramID uuid.UUID) ([]UserPresence, error)
+	// ClaimSequencer makes this node the one that orders the room's Mermaid text ops, or renews its
+	// claim, and reports whether it holds the claim (another node may). Claims lapse unless renewed.
+	ClaimSequencer(ctx context.Context, diagramID uuid.UUID) (bool, error)
+	// ReleaseSequencer gives up this node's claim on the room, if it holds it.
+	ReleaseSequencer(ctx context.Context, diagramID uuid.UUID) error
+}
+
+// MemoryBackend is the single-node Backend: nothing is published and presence is this process only.
+type MemoryBackend struct {
+	mu       sync.RWMutex
+	presence map[uuid.UUID]map[string]UserPresence // diagramID -> connID -> user
+}
+
+// NewMemoryBackend returns the in-process backend (default when REDIS_URL is unset).
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{presence: make(map[uuid.UUID]map[string]UserPresence)}
+}
+
+// Publish is a no-op: there are no other nodes.
+func (m *MemoryBackend) Publish(ctx context.Context, diagramID uuid.UUID, payload []byte) error {
+	return nil
+}
+
+// Subscribe blocks until ctx is done; no remote messages ever arrive.
+func (m *MemoryBackend) Subscribe(ctx context.Context, deliver func(diagramID uuid.UUID, payload []byte)) {
+	<-ctx.Done()
+}
+
+// SubscribeRoom is a no-op.
+func (m *MemoryBackend) SubscribeRoom(ctx context.Context, diagramID uuid.UUID) error {
+	return nil
+}
+
+// UnsubscribeRoom is a no-op.
+func (m *MemoryBackend) UnsubscribeRoom(ctx context.Context, diagramID uuid.UUID) error {
+	return nil
+}
+
+// Join adds the connection to the room presence.
+func (m *MemoryBackend) Join(ctx context.Context, diagramID uuid.UUID, connID string, p UserPresence) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.presence[diagramID] == nil {
+		m.presence[diagramID] = make(map[string]UserPresence)
+	}
+	m.presence[diagramID][connID] = p
+	return nil
+}
+
+// Leave removes the connection from the room presence.
+func (m *MemoryBackend) Leave(ctx context.Context, diagramID uuid.UUID, connID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if room, ok := m.presence[diagramID]; ok {
+		delete(room, connID)
+		if len(room) == 0 {
+			delete(m.presence, diagramID)
+		}
+	}
+	return nil
+}
+
+// Presence returns the users connected to the room.
+func (m *MemoryBackend) Presence(ctx context.Context, diagramID uuid.UUID) ([]UserPresence, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	room := m.presence[diagramID]
+	users := make([]UserPresence, 0, len(room))
+	for _, p := range room {
+		users = append(users, p)
+	}
+	return users, nil
+}
+
+// ClaimSequencer always succeeds: this node orders every room.
+func (m *MemoryBackend) ClaimSequencer(ctx context.Context, diagramID uuid.UUID) (bool, error) {
+	return true, nil
+}
+
+// ReleaseSequencer is a no-op.
+func (m *MemoryBackend) ReleaseSequencer(ctx context.Context, diagramID uuid.UUID) error {
+	return nil
+}
+
+var _ Backend = (*MemoryBackend)(nil)
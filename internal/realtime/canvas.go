@@ -0,0 +1,167 @@
+package realtime
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/devenock/d_weaver/internal/realtime/crdt"
+	"github.com/google/uuid"
+)
+
+// Canvas op kinds for Fabric canvas JSON (whiteboard and visual diagrams).
+const (
+	CanvasOpAdd    = "add"
+	CanvasOpModify = "modify"
+	CanvasOpRemove = "remove"
+)
+
+// serverSite is the CRDT site of the stored snapshot; each hub stamps canvas_op updates with its own
+// "server:<node>" site so replicas never issue identical clocks.
+const serverSite = "server"
+
+// ErrUnknownObject is returned when a modify or remove targets an object that is not on the canvas.
+var ErrUnknownObject = errors.New("realtime: unknown canvas object")
+
+// CanvasOp is an object-level change to a Fabric canvas. Objects are addressed by their "id" property.
+// Add carries the full object (and optional z-index); modify carries only the changed properties.
+type CanvasOp struct {
+	Op     string          `json:"op"`
+	ID     string          `json:"id"`
+	Object json.RawMessage `json:"object,omitempty"`
+	Index  *int            `json:"index,omitempty"`
+}
+
+// canvasDoc is a Fabric canvas (toJSON shape): objects live in a CRDT, other top-level keys are kept as-is.
+type canvasDoc struct {
+	extra map[string]json.RawMessage
+	objs  *crdt.Doc
+	site  string // CRDT site for updates stamped by this hub
+}
+
+// parseCanvas builds the canvas from its persisted CRDT update log when there is one, otherwise from
+// Fabric canvas JSON. Objects without an id are given one so they can be addressed.
+func parseCanvas(content string, updateLog []crdt.Update, site string) (*canvasDoc, error) {
+	doc := &canvasDoc{extra: map[string]json.RawMessage{}, objs: crdt.New(), site: site}
+	if content == "" {
+		doc.objs.Merge(updateLog)
+		return doc, nil
+	}
+	if err := json.Unmarshal([]byte(content), &doc.extra); err != nil {
+		return nil, fmt.Errorf("realtime: canvas json: %w", err)
+	}
+	raw, ok := doc.extra["objects"]
+	delete(doc.extra, "objects")
+	if len(updateLog) > 0 {
+		doc.objs.Merge(updateLog)
+		return doc, nil
+	}
+	if !ok {
+		return doc, nil
+	}
+	var objs []map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &objs); err != nil {
+		return nil, fmt.Errorf("realtime: canvas objects: %w", err)
+	}
+	// Seed with clock counter 0 so any client write wins over the stored snapshot.
+	pos := ""
+	for _, props := range objs {
+		id := objectID(props)
+		if id == "" {
+			id = uuid.New().String()
+			props["id"], _ = json.Marshal(id)
+		}
+		value, err := json.Marshal(props)
+		if err != nil {
+			return nil, fmt.Errorf("realtime: canvas object: %w", err)
+		}
+		pos = crdt.KeyBetween(pos, "")
+		doc.objs.Apply(crdt.Update{Op: crdt.OpSet, ID: id, Value: value, Pos: pos, Clock: crdt.Clock{Site: serverSite}})
+	}
+	return doc, nil
+}
+
+func objectID(props map[string]json.RawMessage) string {
+	var id string
+	if raw, ok := props["id"]; ok {
+		_ = json.Unmarshal(raw, &id)
+	}
+	return id
+}
+
+// toUpdates converts an object-level op into CRDT updates stamped by the server.
+func (d *canvasDoc) toUpdates(op CanvasOp) ([]crdt.Update, error) {
+	current := d.objs.Value(op.ID)
+	switch op.Op {
+	case CanvasOpAdd:
+		props := map[string]json.RawMessage{}
+		if err := json.Unmarshal(op.Object, &props); err != nil {
+			return nil, ErrOpInvalid
+		}
+		props["id"], _ = json.Marshal(op.ID)
+		value, err := json.Marshal(props)
+		if err != nil {
+			return nil, ErrOpInvalid
+		}
+		u := crdt.Update{Op: crdt.OpSet, ID: op.ID, Value: value}
+		if current == nil || op.Index != nil {
+			idx := -1
+			if op.Index != nil {
+				idx = *op.Index
+			}
+			u.Pos = d.objs.PosBetween(idx)
+		}
+		u.Clock = d.objs.Tick(d.site)
+		return []crdt.Update{u}, nil
+	case CanvasOpModify:
+		if current == nil {
+			return nil, ErrUnknownObject
+		}
+		var props, changes map[string]json.RawMessage
+		if err := json.Unmarshal(current, &props); err != nil {
+			return nil, ErrOpInvalid
+		}
+		if err := json.Unmarshal(op.Object, &changes); err != nil {
+			return nil, ErrOpInvalid
+		}
+		for k, v := range changes {
+			if k != "id" {
+				props[k] = v
+			}
+		}
+		value, err := json.Marshal(props)
+		if err != nil {
+			return nil, ErrOpInvalid
+		}
+		return []crdt.Update{{Op: crdt.OpSet, ID: op.ID, Value: value, Clock: d.objs.Tick(d.site)}}, nil
+	case CanvasOpRemove:
+		if current == nil {
+			return nil, ErrUnknownObject
+		}
+		return []crdt.Update{{Op: crdt.OpDelete, ID: op.ID, Clock: d.objs.Tick(d.site)}}, nil
+	}
+	return nil, ErrOpInvalid
+}
+
+// apply applies a single object-level op and returns the CRDT updates it produced.
+func (d *canvasDoc) apply(op CanvasOp) ([]crdt.Update, error) {
+	updates, err := d.toUpdates(op)
+	if err != nil {
+		return nil, err
+	}
+	return d.objs.Merge(updates), nil
+}
+
+// String encodes the canvas back to Fabric JSON.
+func (d *canvasDoc) String() string {
+	out := make(map[string]interface{}, len(d.extra)+1)
+	for k, v := range d.extra {
+		out[k] = v
+	}
+	out["objects"] = d.objs.Objects()
+	b, err := json.Marshal(out)
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
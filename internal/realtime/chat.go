@@ -0,0 +1,196 @@
+package realtime
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/devenock/d_weaver/internal/common"
+)
+
+const (
+	maxChatLength  = 2000 // runes
+	maxEmojiLength = 32   // bytes; one emoji sequence or a short shortcode
+)
+
+// Per-connection rate limits: a steady rate per second with a burst allowance.
+var (
+	chatLimit     = rateLimit{perSecond: 1, burst: 5}
+	reactionLimit = rateLimit{perSecond: 4, burst: 10}
+)
+
+// ChatEntry is one chat message in a room's history.
+type ChatEntry struct {
+	UserID string `json:"user_id"`
+	Email  string `json:"email,omitempty"`
+	Text   string `json:"text"`
+	SentAt string `json:"sent_at"` // RFC 3339, set by the server
+}
+
+type rateLimit struct {
+	perSecond float64
+	burst     float64
+}
+
+// tokenBucket enforces a rateLimit. Guarded by Client.mu.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// allow takes a token for kind from the client's bucket, reporting false when it is empty.
+func (c *Client) allow(kind string, limit rateLimit) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if c.limits == nil {
+		c.limits = make(map[string]*tokenBucket)
+	}
+	b := c.limits[kind]
+	if b == nil {
+		b = &tokenBucket{tokens: limit.burst, last: now}
+		c.limits[kind] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * limit.perSecond
+	if b.tokens > limit.burst {
+		b.tokens = limit.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// requireComment reports whether the client may chat or save transcripts; view clients get a forbidden error.
+func (c *Client) requireComment(msg *Message) bool {
+	if c.Permission().CanComment() {
+		return true
+	}
+	c.hub.sendError(c, msg.ID, &protocolError{common.CodeForbidden, msg.Type + " requires comment access to this diagram."})
+	return false
+}
+
+func rateLimitedError(msgType string) *protocolError {
+	return &protocolError{ErrCodeRateLimited, "Too many " + msgType + " messages; slow down."}
+}
+
+// Chat broadcasts a chat message to the room (sender included, so every client shows the server
+// timestamp) and keeps it in the room's history.
+func (h *Hub) Chat(c *Client, id, text string) {
+	text = strings.TrimSpace(text)
+	if text == "" || utf8.RuneCountInString(text) > maxChatLength {
+		h.sendError(c, id, &protocolError{ErrCodeBadMessage, fmt.Sprintf("Chat text must be 1 to %d characters.", maxChatLength)})
+		return
+	}
+	if !c.allow("chat", chatLimit) {
+		h.sendError(c, id, rateLimitedError("chat"))
+		return
+	}
+	msg := Message{Type: "chat", UserID: c.userID.String(), Email: c.email, Text: text, SentAt: time.Now().UTC().Format(time.RFC3339)}
+	if r := h.roomOf(c.diagramID); r != nil {
+		h.recordChat(r, &msg)
+	}
+	h.broadcastToRoom(c.diagramID, &msg, nil)
+	h.ackIfRequested(c, id)
+}
+
+// React broadcasts an ephemeral reaction to the others in the room; reactions are not kept.
+func (h *Hub) React(c *Client, id, emoji string, position json.RawMessage) {
+	if emoji == "" || len(emoji) > maxEmojiLength {
+		h.sendError(c, id, &protocolError{ErrCodeBadMessage, fmt.Sprintf("A reaction requires an emoji of at most %d bytes.", maxEmojiLength)})
+		return
+	}
+	if !c.allow("reaction", reactionLimit) {
+		h.sendError(c, id, rateLimitedError("reaction"))
+		return
+	}
+	h.broadcastToRoom(c.diagramID, &Message{Type: "reaction", UserID: c.userID.String(), Emoji: emoji, Position: position}, c)
+	h.ackIfRequested(c, id)
+}
+
+// SaveTranscript saves the room's chat history as a comment on the diagram, on behalf of the client.
+func (h *Hub) SaveTranscript(c *Client, id string) {
+	r := h.roomOf(c.diagramID)
+	var history []ChatEntry
+	if r != nil {
+		history = r.chatHistory()
+	}
+	if len(history) == 0 {
+		h.sendError(c, id, &protocolError{common.CodeInvalidInput, "There is no chat to save."})
+		return
+	}
+	if h.store == nil {
+		h.sendError(c, id, &protocolError{common.CodeInternalError, "Comments are not available."})
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	if _, err := h.store.AddComment(ctx, c.diagramID, c.userID, formatTranscript(history)); err != nil {
+		if h.log != nil {
+			h.log.Warn().Err(err).Str("diagram_id", c.diagramID.String()).Msg("realtime: save chat transcript failed")
+		}
+		code, message := common.CodeInternalError, "Failed to save the chat transcript."
+		var de *common.DomainError
+		if errors.As(err, &de) {
+			code, message = de.Code, de.Message
+		}
+		h.sendError(c, id, &protocolError{code, message})
+		return
+	}
+	h.ackIfRequested(c, id)
+}
+
+// recordChat appends a chat message to the room history, dropping the oldest past the configured size.
+func (h *Hub) recordChat(r *room, msg *Message) {
+	if h.chatHistorySize <= 0 {
+		return
+	}
+	r.chatMu.Lock()
+	defer r.chatMu.Unlock()
+	r.chat = append(r.chat, ChatEntry{UserID: msg.UserID, Email: msg.Email, Text: msg.Text, SentAt: msg.SentAt})
+	if over := len(r.chat) - h.chatHistorySize; over > 0 {
+		r.chat = append(r.chat[:0:0], r.chat[over:]...)
+	}
+}
+
+// chatHistory returns a copy of the room's chat history, oldest first.
+func (r *room) chatHistory() []ChatEntry {
+	r.chatMu.Lock()
+	defer r.chatMu.Unlock()
+	return append([]ChatEntry(nil), r.chat...)
+}
+
+// sendChatHistoryTo sends the room's chat history to a client that just joined.
+func (h *Hub) sendChatHistoryTo(c *Client) {
+	r := h.roomOf(c.diagramID)
+	if r == nil {
+		return
+	}
+	if history := r.chatHistory(); len(history) > 0 {
+		h.sendTo(c, &Message{Type: "chat_history", Chat: history})
+	}
+}
+
+// formatTranscript renders chat history as comment text.
+func formatTranscript(history []ChatEntry) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Chat transcript (%d messages)\n", len(history))
+	for _, e := range history {
+		who := e.Email
+		if who == "" {
+			who = e.UserID
+		}
+		when := e.SentAt
+		if t, err := time.Parse(time.RFC3339, e.SentAt); err == nil {
+			when = t.Format("2006-01-02 15:04 UTC")
+		}
+		fmt.Fprintf(&b, "\n[%s] %s: %s", when, who, e.Text)
+	}
+	return b.String()
+}
@@ -0,0 +1,75 @@
+package realtime
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/devenock/d_weaver/config"
+	diagrammodel "github.com/devenock/d_weaver/internal/diagram/model"
+	"github.com/google/uuid"
+)
+
+// commentStore records comments; rooms have no document.
+type commentStore struct {
+	DiagramStore
+	comments []string
+}
+
+func (s *commentStore) GetDiagramContent(ctx context.Context, diagramID, userID uuid.UUID) (string, string, error) {
+	return "", "", errors.New("no content")
+}
+
+func (s *commentStore) AddComment(ctx context.Context, diagramID, userID uuid.UUID, text string) (diagrammodel.CommentResponse, error) {
+	s.comments = append(s.comments, text)
+	return diagrammodel.CommentResponse{CommentText: text}, nil
+}
+
+func TestHub_ChatHistoryAndTranscript(t *testing.T) {
+	store := &commentStore{}
+	hub := NewHub(store, nil, nil, config.RealtimeConfig{ChatHistorySize: 2}, nil)
+	diagramID := uuid.New()
+	a := newTestClient(hub, diagramID)
+	a.email = "a@example.com"
+	hub.Register(a)
+	for _, text := range []string{"one", "two", "three"} {
+		hub.Chat(a, "", text)
+	}
+	if got := framesOfType(drain(t, a), "chat"); len(got) != 3 || got[2].SentAt == "" {
+		t.Fatalf("sender chat frames = %+v, want 3 stamped", got)
+	}
+
+	late := newTestClient(hub, diagramID)
+	hub.Register(late)
+	history := framesOfType(drain(t, late), "chat_history")
+	if len(history) != 1 || len(history[0].Chat) != 2 || history[0].Chat[0].Text != "two" {
+		t.Fatalf("chat_history = %+v, want the last two messages", history)
+	}
+
+	hub.SaveTranscript(late, "t1")
+	if acks := framesOfType(drain(t, late), "ack"); len(acks) != 1 || acks[0].ID != "t1" {
+		t.Errorf("save_transcript acks = %+v", acks)
+	}
+	if len(store.comments) != 1 || !strings.Contains(store.comments[0], "a@example.com: three") {
+		t.Errorf("comments = %q, want transcript", store.comments)
+	}
+}
+
+func TestHub_ChatRateLimitAndPermission(t *testing.T) {
+	hub := NewHub(nil, nil, nil, config.RealtimeConfig{}, nil)
+	c := newTestClient(hub, uuid.New())
+	hub.Register(c)
+	drain(t, c)
+	for i := 0; i < int(chatLimit.burst)+1; i++ {
+		hub.Chat(c, "", "hi")
+	}
+	if errs := framesOfType(drain(t, c), "error"); len(errs) != 1 || errs[0].Code != ErrCodeRateLimited {
+		t.Errorf("errors after burst = %+v, want one rate_limit_exceeded", errs)
+	}
+
+	c.permission = diagrammodel.PermissionView
+	if c.requireComment(&Message{Type: "chat", ID: "c1"}) {
+		t.Error("view client allowed to chat")
+	}
+}
@@ -3,8 +3,10 @@ package realtime
 import (
 	"encoding/json"
 	"log"
+	"sync"
 	"time"
 
+	diagrammodel "github.com/devenock/d_weaver/internal/diagram/model"
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 )
@@ -14,17 +16,28 @@ const (
 	pongWait        = 60 * time.Second
 	pingPeriod      = (pongWait * 9) / 10
 	maxMessageSize  = 64 * 1024 // 64KB
-	sendBufferSize  = 256
 )
 
 // Client is a WebSocket connection in a diagram room.
 type Client struct {
 	hub      *Hub
+	id       string // connection id (presence entries are per connection)
 	conn     *websocket.Conn
-	send     chan []byte
+	out      *outbox
 	diagramID uuid.UUID
 	userID   uuid.UUID
 	email    string
+
+	stats *roomStats // slow-consumer counters of the client's room (set in Register)
+
+	mu            sync.Mutex // guards the fields below
+	permission    diagrammodel.Permission // re-evaluated when the user's workspace role changes
+	joinSeq       uint64                  // room sequence number when the client joined (set in Register)
+	cursor        json.RawMessage // last cursor position, saved to the session on heartbeat
+	cursorSavedAt time.Time
+	awareness     awareness // selection, viewport and follow state
+	limits        map[string]*tokenBucket // chat and reaction rate limits
+	closeFrame    []byte                  // close frame payload sent once the outbox is closed (empty: no status)
 }
 
 // Run registers the client with the hub and runs read/write pumps until disconnect.
@@ -48,15 +61,67 @@ func (c *Client) Run() {
 
 // Send queues a message to be sent to the client (non-blocking).
 func (c *Client) Send(data []byte) {
-	select {
-	case c.send <- data:
-	default:
-		// buffer full; skip to avoid blocking hub
+	c.enqueue(data, "")
+}
+
+// enqueue queues a frame under the hub's slow-consumer policy and counts what the policy did.
+// key lets newer frames replace queued ones under the coalesce policy (cursor updates per user).
+func (c *Client) enqueue(data []byte, key string) {
+	result := c.out.push(data, key)
+	if result == pushQueued || result == pushClosed {
+		return
+	}
+	if c.stats != nil {
+		c.stats.record(result)
+	}
+	c.hub.totals.record(result)
+	if result == pushOverflow {
+		if c.hub.log != nil {
+			c.hub.log.Warn().Str("diagram_id", c.diagramID.String()).Str("conn_id", c.id).Int("max_lag", c.out.maxLag).Msg("realtime: disconnecting slow client")
+		}
+		go c.disconnect(websocket.ClosePolicyViolation, "client too slow")
 	}
 }
 
+// Permission returns the client's current access to the diagram.
+func (c *Client) Permission() diagrammodel.Permission {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.permission
+}
+
+// setPermission updates the client's access and reports whether it changed.
+func (c *Client) setPermission(p diagrammodel.Permission) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	changed := c.permission != p
+	c.permission = p
+	return changed
+}
+
+// disconnect sends a close frame with code and reason and closes the connection; the read pump then
+// unregisters the client.
+func (c *Client) disconnect(code int, reason string) {
+	_ = c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(writeWait))
+	_ = c.conn.Close()
+}
+
+// requireEdit reports whether the client may change content; view and comment clients get a forbidden error.
+func (c *Client) requireEdit(msg *Message) bool {
+	if c.Permission().CanEdit() {
+		return true
+	}
+	c.hub.sendError(c, msg.ID, forbiddenError(msg.Type))
+	return false
+}
+
+// closeSend stops the write pump once queued frames are written; later Sends are dropped.
+func (c *Client) closeSend() {
+	c.out.close()
+}
+
 func (c *Client) readPump() {
-	defer close(c.send)
+	defer c.closeSend()
 	for {
 		_, raw, err := c.conn.ReadMessage()
 		if err != nil {
@@ -65,29 +130,82 @@ func (c *Client) readPump() {
 			}
 			break
 		}
-		var msg Message
-		if err := json.Unmarshal(raw, &msg); err != nil {
+		msg, perr := decodeClientMessage(raw)
+		if perr != nil {
+			c.hub.sendError(c, msg.ID, perr)
 			continue
 		}
 		switch msg.Type {
 		case "cursor":
 			c.hub.BroadcastCursor(c, msg.Position)
+			if msg.ID != "" {
+				c.hub.sendTo(c, &Message{Type: "ack", ID: msg.ID})
+			}
+		case "selection":
+			c.hub.UpdateSelection(c, msg.ID, msg.Selection)
+		case "viewport":
+			c.hub.UpdateViewport(c, msg.ID, msg.Viewport)
+		case "follow":
+			c.hub.Follow(c, msg.ID, msg.Following)
+		case "unfollow":
+			c.hub.Unfollow(c, msg.ID)
+		case "chat":
+			if c.requireComment(msg) {
+				c.hub.Chat(c, msg.ID, msg.Text)
+			}
+		case "reaction":
+			c.hub.React(c, msg.ID, msg.Emoji, msg.Position)
+		case "save_transcript":
+			if c.requireComment(msg) {
+				c.hub.SaveTranscript(c, msg.ID)
+			}
+		case "text_op":
+			if c.requireEdit(msg) {
+				c.hub.ApplyTextOp(c, msg.ID, msg.Revision, msg.Ops)
+			}
+		case "canvas_op":
+			if c.requireEdit(msg) {
+				c.hub.ApplyCanvasOps(c, msg.ID, msg.CanvasOps)
+			}
+		case "crdt_update":
+			if c.requireEdit(msg) {
+				c.hub.MergeCanvasUpdates(c, msg.ID, msg.Updates)
+			}
+		case "snapshot":
+			if c.requireEdit(msg) {
+				c.hub.PushSnapshot(c, msg.ID, msg.Revision, msg.Content)
+			}
+		case "resume":
+			c.hub.Resume(c, msg.ID, msg.Seq, msg.ConnID, msg.Epoch)
 		}
 	}
 }
 
+// site is the CRDT site the client's canvas updates are stamped with: unique per connection and chosen
+// by the server, so a client cannot win ties under another replica's site.
+func (c *Client) site() string {
+	return "client:" + c.userID.String() + ":" + c.id
+}
+
 func (c *Client) writePump() {
 	ticker := time.NewTicker(pingPeriod)
 	defer ticker.Stop()
 	for {
 		select {
-		case data, ok := <-c.send:
-			_ = c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if !ok {
-				_ = c.conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
+		case <-c.out.ready:
+			frames, closed := c.out.take()
+			for _, data := range frames {
+				_ = c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+				if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+					return
+				}
 			}
-			if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+			if closed {
+				c.mu.Lock()
+				closeFrame := c.closeFrame
+				c.mu.Unlock()
+				_ = c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+				_ = c.conn.WriteMessage(websocket.CloseMessage, closeFrame)
 				return
 			}
 		case <-ticker.C:
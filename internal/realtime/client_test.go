@@ -0,0 +1,37 @@
+package realtime
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/devenock/d_weaver/config"
+	"github.com/devenock/d_weaver/internal/common"
+	diagrammodel "github.com/devenock/d_weaver/internal/diagram/model"
+)
+
+func TestClient_RequireEdit(t *testing.T) {
+	hub := NewHub(nil, nil, nil, config.RealtimeConfig{}, nil)
+	viewer := &Client{hub: hub, out: hub.newOutbox(), permission: diagrammodel.PermissionView}
+	if viewer.requireEdit(&Message{Type: "text_op", ID: "m1"}) {
+		t.Fatal("view client allowed to edit")
+	}
+	frames, _ := viewer.out.take()
+	var msg Message
+	if len(frames) != 1 {
+		t.Fatalf("got %d frames, want 1", len(frames))
+	}
+	if err := json.Unmarshal(frames[0], &msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != "error" || msg.Code != common.CodeForbidden || msg.ID != "m1" {
+		t.Errorf("got %+v, want forbidden error", msg)
+	}
+
+	editor := &Client{hub: hub, out: hub.newOutbox(), permission: diagrammodel.PermissionEdit}
+	if !editor.requireEdit(&Message{Type: "text_op"}) || editor.out.pending() != 0 {
+		t.Error("edit client rejected")
+	}
+	if !editor.setPermission(diagrammodel.PermissionComment) || editor.requireEdit(&Message{Type: "canvas_op"}) {
+		t.Error("downgraded client still allowed to edit")
+	}
+}
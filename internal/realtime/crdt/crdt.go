@@ -0,0 +1,233 @@
+// Package crdt is a state-based CRDT for a whiteboard canvas: a map of objects where each object
+// holds a last-writer-wins value register and a last-writer-wins z-order position. Replicas that
+// have seen the same set of updates render the same canvas regardless of delivery order.
+package crdt
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+)
+
+// Update kinds.
+const (
+	OpSet    = "set"    // replace the object value (and position when Pos is set)
+	OpDelete = "delete" // tombstone the object value
+	OpMove   = "move"   // change only the z-order position
+)
+
+// MaxClockSkew is how far past the highest counter a document has seen an untrusted update's counter
+// may be (see Doc.CheckClocks): ample for edits made offline, and keeps Tick far from overflowing.
+const MaxClockSkew = 1 << 20
+
+// ErrClockSkew is returned by Doc.CheckClocks for an update whose counter is too far ahead.
+var ErrClockSkew = errors.New("crdt: update clock is too far ahead of the document")
+
+// Clock is a Lamport timestamp. Ties on Counter are broken by Site so every replica picks the same winner.
+type Clock struct {
+	Counter uint64 `json:"counter"`
+	Site    string `json:"site"`
+}
+
+// Less reports whether c happened before (or loses to) o.
+func (c Clock) Less(o Clock) bool {
+	if c.Counter != o.Counter {
+		return c.Counter < o.Counter
+	}
+	return c.Site < o.Site
+}
+
+// Update is one change to a canvas object. Pos is a fractional index (see KeyBetween).
+type Update struct {
+	Op    string          `json:"op"`
+	ID    string          `json:"id"`
+	Value json.RawMessage `json:"value,omitempty"`
+	Pos   string          `json:"pos,omitempty"`
+	Clock Clock           `json:"clock"`
+}
+
+type valueRegister struct {
+	value   json.RawMessage // nil when deleted
+	deleted bool
+	clock   Clock
+}
+
+type posRegister struct {
+	key   string
+	clock Clock
+}
+
+type entry struct {
+	value valueRegister
+	pos   posRegister
+}
+
+// Doc is a canvas replica. The zero value is not usable; call New.
+type Doc struct {
+	entries map[string]*entry
+	counter uint64 // highest counter seen, for issuing local clocks
+}
+
+// New returns an empty document.
+func New() *Doc {
+	return &Doc{entries: make(map[string]*entry)}
+}
+
+// Tick returns a clock for a new local update at site, greater than every clock seen so far.
+func (d *Doc) Tick(site string) Clock {
+	d.counter++
+	return Clock{Counter: d.counter, Site: site}
+}
+
+// CheckClocks returns ErrClockSkew if any update's counter is more than MaxClockSkew past the highest
+// counter d has seen. Updates from untrusted replicas must pass it before Merge; a persisted log need not.
+func (d *Doc) CheckClocks(updates []Update) error {
+	for _, u := range updates {
+		if u.Clock.Counter > d.counter && u.Clock.Counter-d.counter > MaxClockSkew {
+			return ErrClockSkew
+		}
+	}
+	return nil
+}
+
+// Apply merges one update and reports whether it changed the document (i.e. it won its register).
+// Updates with an unknown kind, empty id or invalid position are ignored.
+func (d *Doc) Apply(u Update) bool {
+	if u.ID == "" {
+		return false
+	}
+	if u.Pos != "" && !ValidKey(u.Pos) {
+		return false
+	}
+	if u.Clock.Counter > d.counter {
+		d.counter = u.Clock.Counter
+	}
+	e := d.entries[u.ID]
+	if e == nil {
+		e = &entry{}
+		d.entries[u.ID] = e
+	}
+	changed := false
+	switch u.Op {
+	case OpSet:
+		if len(u.Value) == 0 {
+			return false
+		}
+		if e.value.clock.Less(u.Clock) {
+			e.value = valueRegister{value: u.Value, clock: u.Clock}
+			changed = true
+		}
+		if u.Pos != "" && e.pos.clock.Less(u.Clock) {
+			e.pos = posRegister{key: u.Pos, clock: u.Clock}
+			changed = true
+		}
+	case OpDelete:
+		if e.value.clock.Less(u.Clock) {
+			e.value = valueRegister{deleted: true, clock: u.Clock}
+			changed = true
+		}
+	case OpMove:
+		if u.Pos != "" && e.pos.clock.Less(u.Clock) {
+			e.pos = posRegister{key: u.Pos, clock: u.Clock}
+			changed = true
+		}
+	}
+	return changed
+}
+
+// Merge applies updates in order and returns those that took effect.
+func (d *Doc) Merge(updates []Update) []Update {
+	won := make([]Update, 0, len(updates))
+	for _, u := range updates {
+		if d.Apply(u) {
+			won = append(won, u)
+		}
+	}
+	return won
+}
+
+// Value returns the current value of the object, or nil if it is absent or deleted.
+func (d *Doc) Value(id string) json.RawMessage {
+	e := d.entries[id]
+	if e == nil || e.value.deleted {
+		return nil
+	}
+	return e.value.value
+}
+
+// IDs returns visible object ids in z-order (position key, then id).
+func (d *Doc) IDs() []string {
+	ids := make([]string, 0, len(d.entries))
+	for id, e := range d.entries {
+		if e.value.value != nil && !e.value.deleted {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		pi, pj := d.entries[ids[i]].pos.key, d.entries[ids[j]].pos.key
+		if pi != pj {
+			return pi < pj
+		}
+		return ids[i] < ids[j]
+	})
+	return ids
+}
+
+// Objects returns visible object values in z-order.
+func (d *Doc) Objects() []json.RawMessage {
+	ids := d.IDs()
+	out := make([]json.RawMessage, len(ids))
+	for i, id := range ids {
+		out[i] = d.entries[id].value.value
+	}
+	return out
+}
+
+// PosBetween returns a position that sorts between the visible objects at z-index i-1 and i.
+// i <= 0 places before the first object, i >= len places after the last.
+func (d *Doc) PosBetween(i int) string {
+	ids := d.IDs()
+	lo, hi := "", ""
+	if i > len(ids) || i < 0 {
+		i = len(ids)
+	}
+	if i > 0 {
+		lo = d.entries[ids[i-1]].pos.key
+	}
+	if i < len(ids) {
+		hi = d.entries[ids[i]].pos.key
+	}
+	if hi != "" && lo >= hi {
+		// Equal keys from concurrent inserts; place after lo instead of between.
+		hi = ""
+	}
+	return KeyBetween(lo, hi)
+}
+
+// Updates returns the compacted update log: the winning write of every register, ordered by clock.
+// Replaying it into a new Doc reproduces this document.
+func (d *Doc) Updates() []Update {
+	out := make([]Update, 0, len(d.entries)*2)
+	for id, e := range d.entries {
+		switch {
+		case e.value.deleted:
+			out = append(out, Update{Op: OpDelete, ID: id, Clock: e.value.clock})
+		case e.value.value != nil:
+			u := Update{Op: OpSet, ID: id, Value: e.value.value, Clock: e.value.clock}
+			if e.pos.clock == e.value.clock {
+				u.Pos = e.pos.key
+			}
+			out = append(out, u)
+		}
+		if e.pos.key != "" && (e.value.deleted || e.pos.clock != e.value.clock) {
+			out = append(out, Update{Op: OpMove, ID: id, Pos: e.pos.key, Clock: e.pos.clock})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Clock != out[j].Clock {
+			return out[i].Clock.Less(out[j].Clock)
+		}
+		return out[i].ID < out[j].ID
+	})
+	return out
+}
@@ -0,0 +1,64 @@
+package crdt
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestKeyBetween(t *testing.T) {
+	cases := [][2]string{{"", ""}, {"V", ""}, {"", "V"}, {"V", "W"}, {"", "1"}, {"V", "VV"}, {"a", "a1"}, {"zz", ""}}
+	for _, c := range cases {
+		k := KeyBetween(c[0], c[1])
+		if !ValidKey(k) {
+			t.Errorf("KeyBetween(%q, %q) = %q is not a valid key", c[0], c[1], k)
+		}
+		if k <= c[0] || (c[1] != "" && k >= c[1]) {
+			t.Errorf("KeyBetween(%q, %q) = %q is not between", c[0], c[1], k)
+		}
+	}
+}
+
+func TestDoc_ConvergesInAnyOrder(t *testing.T) {
+	updates := []Update{
+		{Op: OpSet, ID: "a", Value: json.RawMessage(`{"fill":"red"}`), Pos: "V", Clock: Clock{Counter: 1, Site: "x"}},
+		{Op: OpSet, ID: "b", Value: json.RawMessage(`{"fill":"blue"}`), Pos: "V", Clock: Clock{Counter: 1, Site: "y"}},
+		{Op: OpSet, ID: "a", Value: json.RawMessage(`{"fill":"green"}`), Clock: Clock{Counter: 2, Site: "y"}},
+		{Op: OpSet, ID: "a", Value: json.RawMessage(`{"fill":"black"}`), Clock: Clock{Counter: 2, Site: "x"}},
+		{Op: OpMove, ID: "b", Pos: "F", Clock: Clock{Counter: 3, Site: "x"}},
+		{Op: OpDelete, ID: "c", Clock: Clock{Counter: 4, Site: "x"}},
+		{Op: OpSet, ID: "c", Value: json.RawMessage(`{}`), Pos: "k", Clock: Clock{Counter: 3, Site: "y"}},
+	}
+	forward, backward := New(), New()
+	forward.Merge(updates)
+	for i := len(updates) - 1; i >= 0; i-- {
+		backward.Apply(updates[i])
+	}
+	want := `[{"fill":"blue"},{"fill":"green"}]`
+	for _, d := range []*Doc{forward, backward} {
+		got, _ := json.Marshal(d.Objects())
+		if string(got) != want {
+			t.Errorf("objects = %s, want %s", got, want)
+		}
+	}
+
+	replay := New()
+	replay.Merge(forward.Updates())
+	got, _ := json.Marshal(replay.Objects())
+	if string(got) != want {
+		t.Errorf("replayed compacted log = %s, want %s", got, want)
+	}
+	if c := replay.Tick("server"); c.Counter != 5 {
+		t.Errorf("tick after replay = %d, want 5", c.Counter)
+	}
+}
+
+func TestDoc_CheckClocks(t *testing.T) {
+	d := New()
+	d.Apply(Update{Op: OpSet, ID: "a", Value: json.RawMessage(`{}`), Clock: Clock{Counter: 10, Site: "x"}})
+	if err := d.CheckClocks([]Update{{Clock: Clock{Counter: 10 + MaxClockSkew}}, {Clock: Clock{Counter: 3}}}); err != nil {
+		t.Errorf("counters within the skew: %v", err)
+	}
+	if err := d.CheckClocks([]Update{{Clock: Clock{Counter: 11 + MaxClockSkew}}}); err != ErrClockSkew {
+		t.Errorf("counter past the skew: err = %v, want ErrClockSkew", err)
+	}
+}
@@ -0,0 +1,66 @@
+package crdt
+
+import "strings"
+
+// digits are the position key alphabet, in byte order.
+const digits = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// ValidKey reports whether k is a usable position key: non-empty, only key digits, no trailing '0'
+// (a trailing zero would leave no room to insert before it).
+func ValidKey(k string) bool {
+	if k == "" || k[len(k)-1] == '0' {
+		return false
+	}
+	for i := 0; i < len(k); i++ {
+		if strings.IndexByte(digits, k[i]) < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// KeyBetween returns a key that sorts strictly between a and b. An empty a means "before everything"
+// and an empty b "after everything". a must sort before b when both are set.
+func KeyBetween(a, b string) string {
+	if b != "" {
+		// Keep the common prefix (a is padded with '0') and recurse on the rest.
+		n := 0
+		for n < len(b) {
+			ca := byte('0')
+			if n < len(a) {
+				ca = a[n]
+			}
+			if ca != b[n] {
+				break
+			}
+			n++
+		}
+		if n > 0 {
+			rest := ""
+			if n < len(a) {
+				rest = a[n:]
+			}
+			return b[:n] + KeyBetween(rest, b[n:])
+		}
+	}
+	da := 0
+	if a != "" {
+		da = strings.IndexByte(digits, a[0])
+	}
+	db := len(digits)
+	if b != "" {
+		db = strings.IndexByte(digits, b[0])
+	}
+	if db-da > 1 {
+		return string(digits[(da+db)/2])
+	}
+	// First digits are adjacent.
+	if b != "" && len(b) > 1 {
+		return b[:1]
+	}
+	rest := ""
+	if a != "" {
+		rest = a[1:]
+	}
+	return string(digits[da]) + KeyBetween(rest, "")
+}
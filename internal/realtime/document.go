@@ -0,0 +1,249 @@
+package realtime
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+
+	diagrammodel "github.com/devenock/d_weaver/internal/diagram/model"
+	"github.com/devenock/d_weaver/internal/realtime/crdt"
+)
+
+// maxOpHistory bounds how many applied text operations a room keeps for transforming late ops.
+const maxOpHistory = 500
+
+// ErrStaleRevision is returned when an op is based on a revision older than the kept history.
+var ErrStaleRevision = errors.New("realtime: revision is too old; resync required")
+
+// document is the authoritative content of a room. Revision counts ops applied since load.
+type document struct {
+	diagramType string
+	revision    int
+	text        string
+	history     []TextOperation // last applied text ops; history[i] produced revision historyBase+i+1
+	historyBase int
+	canvas      *canvasDoc
+}
+
+// newDocument builds the room document. updateLog is the persisted CRDT log for canvas diagrams (may be nil);
+// site stamps the CRDT updates this hub creates.
+func newDocument(content, diagramType string, updateLog []crdt.Update, site string) (*document, error) {
+	d := &document{diagramType: diagramType}
+	if diagrammodel.IsCanvasType(diagramType) {
+		c, err := parseCanvas(content, updateLog, site)
+		if err != nil {
+			return nil, err
+		}
+		d.canvas = c
+		return d, nil
+	}
+	d.text = content
+	return d, nil
+}
+
+// isCanvas reports whether the document holds Fabric canvas JSON.
+func (d *document) isCanvas() bool { return d.canvas != nil }
+
+// content returns the current document as it is stored in diagrams.content.
+func (d *document) content() string {
+	if d.canvas != nil {
+		return d.canvas.String()
+	}
+	return d.text
+}
+
+// applyText transforms op (based on revision base) against ops applied since, applies it,
+// and returns the transformed op and the new revision.
+func (d *document) applyText(base int, op TextOperation) (TextOperation, int, error) {
+	if d.canvas != nil {
+		return nil, 0, ErrOpInvalid
+	}
+	if base < d.historyBase || base > d.revision {
+		return nil, 0, ErrStaleRevision
+	}
+	for _, concurrent := range d.history[base-d.historyBase:] {
+		var err error
+		op, _, err = TransformText(op, concurrent)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	text, err := op.Apply(d.text)
+	if err != nil {
+		return nil, 0, err
+	}
+	d.text = text
+	d.revision++
+	d.history = append(d.history, op)
+	if len(d.history) > maxOpHistory {
+		drop := len(d.history) - maxOpHistory
+		d.history = append([]TextOperation(nil), d.history[drop:]...)
+		d.historyBase += drop
+	}
+	return op, d.revision, nil
+}
+
+// updateLog returns the compacted CRDT log of a canvas document (nil for text).
+func (d *document) updateLog() []crdt.Update {
+	if d.canvas == nil {
+		return nil
+	}
+	return d.canvas.objs.Updates()
+}
+
+// applyCanvas applies object ops in order and returns the ops that took effect, the CRDT updates
+// they produced and the new revision. Modify/remove of an object someone else already removed is
+// dropped rather than failing the batch.
+func (d *document) applyCanvas(ops []CanvasOp) ([]CanvasOp, []crdt.Update, int, error) {
+	if d.canvas == nil {
+		return nil, nil, 0, ErrOpInvalid
+	}
+	for _, op := range ops {
+		if err := validateCanvasOp(op); err != nil {
+			return nil, nil, 0, err
+		}
+	}
+	applied := make([]CanvasOp, 0, len(ops))
+	var updates []crdt.Update
+	for _, op := range ops {
+		us, err := d.canvas.apply(op)
+		if err != nil {
+			// Only ErrUnknownObject is possible after validation.
+			continue
+		}
+		applied = append(applied, op)
+		updates = append(updates, us...)
+	}
+	if len(applied) > 0 {
+		d.revision++
+	}
+	return applied, updates, d.revision, nil
+}
+
+// mergeClientUpdates merges CRDT updates from a client (possibly made offline) and returns those that
+// won. Each update is stamped with the client's site, whatever the client sent, and a batch whose clocks
+// run too far ahead of the document is refused so a client cannot push the counter towards overflow.
+func (d *document) mergeClientUpdates(updates []crdt.Update, site string) ([]crdt.Update, int, error) {
+	if d.canvas == nil {
+		return nil, 0, ErrOpInvalid
+	}
+	if err := d.canvas.objs.CheckClocks(updates); err != nil {
+		return nil, 0, err
+	}
+	stamped := make([]crdt.Update, len(updates))
+	for i, u := range updates {
+		u.Clock.Site = site
+		stamped[i] = u
+	}
+	return d.mergeUpdates(stamped)
+}
+
+// mergeUpdates merges CRDT updates already stamped by a hub and returns those that won.
+func (d *document) mergeUpdates(updates []crdt.Update) ([]crdt.Update, int, error) {
+	if d.canvas == nil {
+		return nil, 0, ErrOpInvalid
+	}
+	won := d.canvas.objs.Merge(updates)
+	if len(won) > 0 {
+		d.revision++
+	}
+	return won, d.revision, nil
+}
+
+// validateCanvasOp checks the op kind, id, and that add/modify carry a JSON object.
+func validateCanvasOp(op CanvasOp) error {
+	if op.ID == "" {
+		return ErrOpInvalid
+	}
+	switch op.Op {
+	case CanvasOpAdd, CanvasOpModify:
+		var props map[string]json.RawMessage
+		if err := json.Unmarshal(op.Object, &props); err != nil || props == nil {
+			return ErrOpInvalid
+		}
+	case CanvasOpRemove:
+	default:
+		return ErrOpInvalid
+	}
+	return nil
+}
+
+// replaceContent replaces the document with content pushed by a client that has seen revision base, and
+// reports whether anything changed. Text becomes one op from the current text; canvas objects are diffed
+// into CRDT updates (new objects at their index, changed ones replaced, missing ones removed) so
+// concurrent CRDT merges stay consistent. A stale base is rejected rather than overwriting edits the
+// client has not seen.
+func (d *document) replaceContent(base int, content string) (bool, int, error) {
+	if base != d.revision {
+		return false, 0, ErrStaleRevision
+	}
+	if d.canvas == nil {
+		if content == d.text {
+			return false, d.revision, nil
+		}
+		_, rev, err := d.applyText(base, diffText(d.text, content))
+		return err == nil, rev, err
+	}
+	next, err := parseCanvas(content, nil, d.canvas.site)
+	if err != nil {
+		return false, 0, ErrOpInvalid
+	}
+	changed := !rawMapsEqual(d.canvas.extra, next.extra)
+	d.canvas.extra = next.extra
+	keep := make(map[string]bool)
+	var ops []CanvasOp
+	for i, id := range next.objs.IDs() {
+		keep[id] = true
+		value := next.objs.Value(id)
+		switch current := d.canvas.objs.Value(id); {
+		case current == nil:
+			idx := i
+			ops = append(ops, CanvasOp{Op: CanvasOpAdd, ID: id, Object: value, Index: &idx})
+		case !bytes.Equal(current, value):
+			ops = append(ops, CanvasOp{Op: CanvasOpAdd, ID: id, Object: value})
+		}
+	}
+	var removes []CanvasOp
+	for _, id := range d.canvas.objs.IDs() {
+		if !keep[id] {
+			removes = append(removes, CanvasOp{Op: CanvasOpRemove, ID: id})
+		}
+	}
+	for _, op := range append(removes, ops...) {
+		if _, err := d.canvas.apply(op); err == nil {
+			changed = true
+		}
+	}
+	if changed {
+		d.revision++
+	}
+	return changed, d.revision, nil
+}
+
+// reset adopts a whole-document replacement made on another node: text is taken as-is, canvas
+// updates are merged and the top-level canvas keys taken from content.
+func (d *document) reset(content string, updates []crdt.Update, revision int) {
+	if d.canvas != nil {
+		d.canvas.objs.Merge(updates)
+		if next, err := parseCanvas(content, updates, d.canvas.site); err == nil {
+			d.canvas.extra = next.extra
+		}
+	} else {
+		d.text = content
+		d.history = nil
+		d.historyBase = revision
+	}
+	d.revision = revision
+}
+
+func rawMapsEqual(a, b map[string]json.RawMessage) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || !bytes.Equal(v, w) {
+			return false
+		}
+	}
+	return true
+}
@@ -1,43 +1,104 @@
 package realtime
 
 import (
-	"context"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/devenock/d_weaver/config"
 	"github.com/devenock/d_weaver/internal/auth/jwt"
+	"github.com/devenock/d_weaver/internal/auth/middleware"
 	"github.com/devenock/d_weaver/internal/common"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 )
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		return true // allow same-origin and configured origins; tighten in prod via CORS
-	},
+// Handler handles WebSocket upgrade for /ws/collaboration/:diagramId and issues the tickets used to open it.
+type Handler struct {
+	hub             *Hub
+	issuer          *jwt.Issuer
+	permissions     PermissionResolver
+	tickets         TicketStore
+	upgrader        websocket.Upgrader
+	origins         map[string]bool // allowed browser origins (lowercased); "*" allows any
+	allowQueryToken bool            // accept ?token=<access_token> (leaks into proxy logs)
 }
 
-// DiagramAccessChecker returns nil if the user can access the diagram (for WebSocket join).
-type DiagramAccessChecker interface {
-	CheckDiagramAccess(ctx context.Context, diagramID, userID uuid.UUID) error
+// NewHandler returns a realtime WebSocket handler. allowedOrigins are the CORS origins browsers may
+// open sockets from.
+func NewHandler(hub *Hub, issuer *jwt.Issuer, permissions PermissionResolver, tickets TicketStore, cfg config.RealtimeConfig, allowedOrigins []string) *Handler {
+	h := &Handler{
+		hub:             hub,
+		issuer:          issuer,
+		permissions:     permissions,
+		tickets:         tickets,
+		origins:         make(map[string]bool, len(allowedOrigins)),
+		allowQueryToken: cfg.AllowQueryToken,
+	}
+	for _, o := range allowedOrigins {
+		h.origins[strings.ToLower(strings.TrimRight(o, "/"))] = true
+	}
+	h.upgrader = websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		Subprotocols:    Subprotocols,
+		CheckOrigin:     h.checkOrigin,
+	}
+	return h
 }
 
-// Handler handles WebSocket upgrade for /ws/collaboration/:diagramId.
-type Handler struct {
-	hub     *Hub
-	issuer  *jwt.Issuer
-	checker DiagramAccessChecker
+// Register mounts ticket routes on g. Path: POST /realtime/tickets (RequireAuth).
+func (h *Handler) Register(g *gin.RouterGroup) {
+	rt := g.Group("/realtime")
+	rt.Use(middleware.RequireAuth(h.issuer))
+	rt.POST("/tickets", h.createTicket)
+}
+
+// CreateTicketRequest is the body for POST /realtime/tickets.
+type CreateTicketRequest struct {
+	DiagramID uuid.UUID `json:"diagram_id" binding:"required"`
+}
+
+// TicketResponse is the issued ticket; pass it as ?ticket= when opening the socket.
+type TicketResponse struct {
+	Ticket    string    `json:"ticket"`
+	ExpiresAt time.Time `json:"expires_at"`
 }
 
-// NewHandler returns a realtime WebSocket handler.
-func NewHandler(hub *Hub, issuer *jwt.Issuer, checker DiagramAccessChecker) *Handler {
-	return &Handler{hub: hub, issuer: issuer, checker: checker}
+func (h *Handler) createTicket(c *gin.Context) {
+	var req CreateTicketRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		common.WriteError(c, http.StatusBadRequest, common.ErrorBody{
+			Code:    common.CodeInvalidInput,
+			Message: "Invalid or missing input. diagram_id is required.",
+			Details: map[string]interface{}{"error": err.Error()},
+		})
+		return
+	}
+	userID := middleware.GetUserID(c)
+	// Fail early: no ticket for a diagram the user could not join anyway.
+	if _, err := h.permissions.ResolveDiagramPermission(c.Request.Context(), req.DiagramID, userID); err != nil {
+		common.WriteErrorFromDomain(c, err)
+		return
+	}
+	id, err := newTicketID()
+	if err != nil {
+		common.WriteErrorFromDomain(c, err)
+		return
+	}
+	t := Ticket{UserID: userID, Email: middleware.GetUserEmail(c), DiagramID: req.DiagramID, ClientIP: c.ClientIP()}
+	if err := h.tickets.Put(c.Request.Context(), id, t, TicketTTL); err != nil {
+		common.WriteErrorFromDomain(c, err)
+		return
+	}
+	common.WriteCreated(c, TicketResponse{Ticket: id, ExpiresAt: time.Now().Add(TicketTTL).UTC()})
 }
 
-// ServeWS upgrades the connection and runs the client. Auth via query param: ?token=<access_token>.
+// ServeWS upgrades the connection and runs the client. Auth via ?ticket=<ticket> (preferred),
+// Authorization: Bearer, the access_token cookie, or ?token=<access_token> when allowed by config.
 func (h *Handler) ServeWS(c *gin.Context) {
 	diagramIDStr := c.Param("diagramId")
 	diagramID, err := uuid.Parse(diagramIDStr)
@@ -45,7 +106,76 @@ func (h *Handler) ServeWS(c *gin.Context) {
 		common.WriteError(c, http.StatusBadRequest, common.ErrorBody{Code: common.CodeInvalidInput, Message: "Invalid diagram ID."})
 		return
 	}
-	token := strings.TrimSpace(c.Query("token"))
+	if h.hub.Closing() {
+		c.Header("Retry-After", strconv.Itoa(int(restartRetryMax/time.Second)))
+		common.WriteError(c, http.StatusServiceUnavailable, common.ErrorBody{Code: "service_unavailable", Message: "Server is restarting; reconnect shortly."})
+		return
+	}
+	userID, email, ok := h.authenticate(c, diagramID)
+	if !ok {
+		return
+	}
+	if !supportsProtocol(websocket.Subprotocols(c.Request)) {
+		common.WriteError(c, http.StatusBadRequest, common.ErrorBody{Code: common.CodeInvalidInput, Message: "Unsupported realtime protocol version.", Details: map[string]interface{}{"supported": Subprotocols}})
+		return
+	}
+	permission, err := h.permissions.ResolveDiagramPermission(c.Request.Context(), diagramID, userID)
+	if err != nil {
+		common.WriteErrorFromDomain(c, err)
+		return
+	}
+	conn, err := h.upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		return
+	}
+	client := &Client{
+		hub:      h.hub,
+		id:       uuid.New().String(),
+		conn:     conn,
+		out:      h.hub.newOutbox(),
+		diagramID: diagramID,
+		userID:   userID,
+		email:    email,
+		permission: permission,
+	}
+	client.Run()
+}
+
+// supportsProtocol reports whether the offered subprotocols (none means the default, v1) include a supported version.
+func supportsProtocol(offered []string) bool {
+	if len(offered) == 0 {
+		return true
+	}
+	for _, o := range offered {
+		for _, p := range Subprotocols {
+			if o == p {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// authenticate resolves the socket's user from a ticket or an access token, writing a 401 on failure.
+// A ticket must be redeemed from the IP it was issued to; c.ClientIP only honours forwarding headers
+// from the engine's trusted proxies (server.trusted_proxies), so clients cannot spoof it.
+func (h *Handler) authenticate(c *gin.Context, diagramID uuid.UUID) (uuid.UUID, string, bool) {
+	if id := strings.TrimSpace(c.Query("ticket")); id != "" {
+		t, err := h.tickets.Take(c.Request.Context(), id)
+		if err != nil {
+			common.WriteErrorFromDomain(c, err)
+			return uuid.Nil, "", false
+		}
+		if t == nil || t.DiagramID != diagramID || t.ClientIP != c.ClientIP() {
+			common.WriteError(c, http.StatusUnauthorized, common.ErrorBody{Code: common.CodeUnauthorized, Message: "Invalid or expired ticket."})
+			return uuid.Nil, "", false
+		}
+		return t.UserID, t.Email, true
+	}
+	token := ""
+	if h.allowQueryToken {
+		token = strings.TrimSpace(c.Query("token"))
+	}
 	if token == "" {
 		auth := c.GetHeader("Authorization")
 		if strings.HasPrefix(auth, "Bearer ") {
@@ -53,34 +183,35 @@ func (h *Handler) ServeWS(c *gin.Context) {
 		}
 	}
 	if token == "" {
-		if t, _ := c.Cookie("access_token"); t != "" {
+		if t, _ := c.Cookie(middleware.CookieName); t != "" {
 			token = t
 		}
 	}
 	if token == "" {
-		common.WriteError(c, http.StatusUnauthorized, common.ErrorBody{Code: common.CodeUnauthorized, Message: "Missing token. Use query ?token=<access_token>, Authorization: Bearer <token>, or access_token cookie."})
-		return
+		common.WriteError(c, http.StatusUnauthorized, common.ErrorBody{Code: common.CodeUnauthorized, Message: "Missing credentials. Use ?ticket=<ticket> from POST /api/v1/realtime/tickets, Authorization: Bearer <token>, or access_token cookie."})
+		return uuid.Nil, "", false
 	}
 	userID, email, err := h.issuer.ValidateAccessToken(token)
 	if err != nil {
 		common.WriteError(c, http.StatusUnauthorized, common.ErrorBody{Code: common.CodeUnauthorized, Message: "Invalid or expired token."})
-		return
+		return uuid.Nil, "", false
 	}
-	if err := h.checker.CheckDiagramAccess(c.Request.Context(), diagramID, userID); err != nil {
-		common.WriteErrorFromDomain(c, err)
-		return
+	return userID, email, true
+}
+
+// checkOrigin allows requests without an Origin header (non-browser clients), same-host origins and
+// the configured CORS origins.
+func (h *Handler) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || h.origins["*"] {
+		return true
 	}
-	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	u, err := url.Parse(origin)
 	if err != nil {
-		return
+		return false
 	}
-	client := &Client{
-		hub:      h.hub,
-		conn:     conn,
-		send:     make(chan []byte, sendBufferSize),
-		diagramID: diagramID,
-		userID:   userID,
-		email:    email,
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
 	}
-	client.Run()
+	return h.origins[strings.ToLower(strings.TrimRight(origin, "/"))]
 }
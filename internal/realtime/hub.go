@@ -1,124 +1,813 @@
 package realtime
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"sync"
+	"time"
 
+	"github.com/devenock/d_weaver/config"
+	"github.com/devenock/d_weaver/internal/common"
+	diagrammodel "github.com/devenock/d_weaver/internal/diagram/model"
+	"github.com/devenock/d_weaver/internal/realtime/crdt"
+	wsmodel "github.com/devenock/d_weaver/internal/workspace/model"
+	"github.com/devenock/d_weaver/pkg/logger"
 	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
 )
 
-// Message is a JSON payload sent over the WebSocket (client <-> server).
-type Message struct {
-	Type    string          `json:"type"`    // join, leave, cursor, presence
-	UserID  string          `json:"user_id,omitempty"`
-	Email   string          `json:"email,omitempty"`
-	Position json.RawMessage `json:"position,omitempty"` // cursor position (opaque JSON)
-	Users   []UserPresence  `json:"users,omitempty"`     // for presence list
+const (
+	defaultSnapshotInterval = 10 * time.Second
+	storeTimeout            = 10 * time.Second
+	// sessionHeartbeat is how often connected users' sessions are refreshed and stale ones expired;
+	// it must stay well under the diagram module's SessionTTL.
+	sessionHeartbeat = 30 * time.Second
+	// cursorPersistInterval throttles how often a client's cursor is written to its session.
+	cursorPersistInterval = 5 * time.Second
+)
+
+// PermissionResolver returns a user's effective permission on a diagram, or a Forbidden/NotFound domain
+// error when they have no access (implemented by the diagram service).
+type PermissionResolver interface {
+	ResolveDiagramPermission(ctx context.Context, diagramID, userID uuid.UUID) (diagrammodel.Permission, error)
+}
+
+// CommentStore adds a comment to a diagram on behalf of a user (implemented by the diagram service).
+type CommentStore interface {
+	AddComment(ctx context.Context, diagramID, userID uuid.UUID, commentText string) (diagrammodel.CommentResponse, error)
+}
+
+// DiagramStore loads and saves room content (implemented by the diagram service, which enforces access).
+// Canvas diagrams also persist their compacted CRDT update log (JSON array of crdt.Update); chat
+// transcripts are saved as comments.
+type DiagramStore interface {
+	PermissionResolver
+	CommentStore
+	GetDiagramContent(ctx context.Context, diagramID, userID uuid.UUID) (content, diagramType string, err error)
+	SaveDiagramContent(ctx context.Context, diagramID, userID uuid.UUID, content string) error
+	GetCanvasUpdateLog(ctx context.Context, diagramID, userID uuid.UUID) (json.RawMessage, error)
+	SaveCanvasState(ctx context.Context, diagramID, userID uuid.UUID, content string, updateLog json.RawMessage) error
+}
+
+// SessionStore persists who is in which room (implemented by the diagram service, backed by
+// collaboration_sessions) so presence can be read over HTTP without opening a socket.
+type SessionStore interface {
+	TouchSession(ctx context.Context, diagramID, userID uuid.UUID, cursor json.RawMessage) error
+	EndSession(ctx context.Context, diagramID, userID uuid.UUID) error
+	ExpireSessions(ctx context.Context) (int64, error)
 }
 
-// UserPresence is a user in the room (for presence broadcasts).
-type UserPresence struct {
-	UserID   string          `json:"user_id"`
-	Email    string          `json:"email,omitempty"`
-	Position json.RawMessage `json:"position,omitempty"`
+// room is the set of clients on one diagram plus the shared document they edit.
+// Lock order: room.mu before room.replayMu before Hub.mu; Hub.pubMu is taken alone.
+type room struct {
+	clients map[*Client]struct{}
+
+	mu         sync.Mutex // sequences ops and guards the fields below
+	doc        *document  // nil when no store is configured or loading failed
+	dirty      bool       // doc changed since the last snapshot was persisted
+	lastEditor uuid.UUID  // snapshot is saved on behalf of the last user who changed the doc
+	dirtySince time.Time  // first edit since the last save
+	lastEdit   time.Time  // latest edit; autosave waits for edits to settle
+	savedAt    time.Time  // last successful save of this room on any node
+	sequencer  bool       // this node orders the room's text ops (see sequencer.go)
+	synced     bool       // doc matches the sequencer's; text edits wait for a snapshot otherwise
+
+	stats roomStats // slow-consumer counters
+	// counters as of the last stats log line (only touched by the Run loop)
+	loggedDropped, loggedCoalesced, loggedDisconnected uint64
+
+	replayMu sync.Mutex    // orders frame delivery and guards the fields below
+	epoch    string        // identifies this room instance; sequence numbers restart with a new one
+	seq      uint64        // last sequence number assigned
+	replay   []replayEntry // most recent frames, oldest first
+
+	chatMu sync.Mutex  // guards chat
+	chat   []ChatEntry // recent chat messages, oldest first (bounded by Hub.chatHistorySize)
 }
 
 // Hub holds rooms keyed by diagram ID and broadcasts messages to room members.
 type Hub struct {
-	mu    sync.RWMutex
-	rooms map[uuid.UUID]map[*Client]struct{} // diagramID -> set of clients
+	mu      sync.RWMutex
+	rooms   map[uuid.UUID]*room
+	closing bool // Shutdown started; no new clients join
+
+	store            DiagramStore
+	sessions         SessionStore
+	backend          Backend
+	site             string        // CRDT site for canvas updates stamped by this node
+	snapshotInterval time.Duration // longest edits stay unsaved while editing continues
+	autosaveDebounce time.Duration // quiet period after an edit before autosaving
+	slowPolicy       string
+	maxLag           int
+	chatHistorySize  int       // chat messages kept per room for newcomers; 0 keeps none
+	totals           roomStats // slow-consumer counters since start, across all rooms
+	log              logger.Logger
+
+	pubMu      sync.Mutex               // guards publishers
+	publishers map[uuid.UUID]*publisher // rooms with frames waiting to be published
 }
 
-// NewHub returns a new Hub.
-func NewHub() *Hub {
+// NewHub returns a new Hub. store may be nil to relay cursors only; sessions may be nil to skip
+// persisting presence; backend nil means a single-node MemoryBackend; log may be nil.
+func NewHub(store DiagramStore, sessions SessionStore, backend Backend, cfg config.RealtimeConfig, log logger.Logger) *Hub {
+	interval := time.Duration(cfg.SnapshotIntervalSeconds) * time.Second
+	if interval <= 0 {
+		interval = defaultSnapshotInterval
+	}
+	debounce := time.Duration(cfg.AutosaveDebounceMs) * time.Millisecond
+	if debounce <= 0 {
+		debounce = defaultAutosaveDebounce
+	}
+	if backend == nil {
+		backend = NewMemoryBackend()
+	}
+	policy := cfg.SlowConsumerPolicy
+	if policy != PolicyDropOldest && policy != PolicyDisconnect {
+		policy = PolicyCoalesce
+	}
+	maxLag := cfg.SlowConsumerMaxLag
+	if maxLag <= 0 {
+		maxLag = defaultMaxLag
+	}
+	chatHistory := cfg.ChatHistorySize
+	if chatHistory < 0 {
+		chatHistory = 0
+	}
 	return &Hub{
-		rooms: make(map[uuid.UUID]map[*Client]struct{}),
+		rooms:            make(map[uuid.UUID]*room),
+		publishers:       make(map[uuid.UUID]*publisher),
+		store:            store,
+		sessions:         sessions,
+		backend:          backend,
+		site:             serverSite + ":" + uuid.New().String(),
+		snapshotInterval: interval,
+		autosaveDebounce: debounce,
+		slowPolicy:       policy,
+		maxLag:           maxLag,
+		chatHistorySize:  chatHistory,
+		log:              log,
 	}
 }
 
-// Register adds a client to the diagram room and broadcasts join to others.
+// Run receives messages from other nodes, autosaves rooms once their edits settle (or after a snapshot
+// interval of continuous editing) and refreshes sessions and sequencer claims every heartbeat until ctx
+// is done, then flushes once more.
+func (h *Hub) Run(ctx context.Context) {
+	go h.backend.Subscribe(ctx, h.deliverRemote)
+	ticker := time.NewTicker(autosaveCheckInterval)
+	defer ticker.Stop()
+	heartbeat := time.NewTicker(sessionHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			h.flush(context.Background())
+			return
+		case <-ticker.C:
+			h.autosave(ctx)
+		case <-heartbeat.C:
+			h.refreshSessions(ctx)
+			h.renewSequencers()
+			h.logStats()
+		}
+	}
+}
+
+// Register adds a client to the diagram room, sends it the current snapshot and presence,
+// and broadcasts join to others.
 func (h *Hub) Register(c *Client) {
-	h.mu.Lock()
-	if h.rooms[c.diagramID] == nil {
-		h.rooms[c.diagramID] = make(map[*Client]struct{})
+	for {
+		h.mu.Lock()
+		r := h.rooms[c.diagramID]
+		created := r == nil
+		if created {
+			r = newRoom()
+			h.rooms[c.diagramID] = r
+		}
+		h.mu.Unlock()
+		if created {
+			h.subscribeRoom(c.diagramID)
+		}
+
+		r.mu.Lock()
+		r.replayMu.Lock()
+		h.mu.Lock()
+		if h.rooms[c.diagramID] != r {
+			// Room was dropped after it emptied; retry with a fresh one.
+			h.mu.Unlock()
+			r.replayMu.Unlock()
+			r.mu.Unlock()
+			continue
+		}
+		if h.closing {
+			h.mu.Unlock()
+			r.replayMu.Unlock()
+			r.mu.Unlock()
+			h.sendRestart(c)
+			return
+		}
+		c.stats = &r.stats
+		r.clients[c] = struct{}{}
+		h.mu.Unlock()
+		// Frames after joinSeq reach c live; Resume replays those before it.
+		c.joinSeq = r.seq
+		h.sendTo(c, &Message{Type: "welcome", ConnID: c.id, Epoch: r.epoch, Seq: c.joinSeq})
+		r.replayMu.Unlock()
+		h.loadDocument(r, c)
+		if r.doc != nil {
+			h.sendSnapshotTo(c, r)
+		}
+		claim := r.isTextRoom() && !r.sequencer
+		r.mu.Unlock()
+		if claim {
+			h.claimSequencer(c.diagramID)
+		}
+		break
 	}
-	h.rooms[c.diagramID][c] = struct{}{}
-	room := make([]*Client, 0, len(h.rooms[c.diagramID]))
-	for cl := range h.rooms[c.diagramID] {
-		room = append(room, cl)
+
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	if err := h.backend.Join(ctx, c.diagramID, c.id, UserPresence{UserID: c.userID.String(), Email: c.email}); err != nil && h.log != nil {
+		h.log.Warn().Err(err).Str("diagram_id", c.diagramID.String()).Msg("realtime: record presence failed")
 	}
-	h.mu.Unlock()
+	h.touchSession(ctx, c, nil)
+
+	h.sendTo(c, &Message{Type: "permission", Permission: string(c.Permission())})
 
 	// Notify others in room that this user joined
 	joinMsg := Message{Type: "join", UserID: c.userID.String(), Email: c.email}
 	h.broadcastToRoom(c.diagramID, &joinMsg, c)
 
-	// Send current presence list to the new client
+	// Send current presence list and recent chat to the new client
 	h.sendPresenceTo(c)
+	h.sendChatHistoryTo(c)
 }
 
-// Unregister removes the client from the room and broadcasts leave.
+// Unregister removes the client from the room and broadcasts leave; its pending awareness broadcasts
+// are dropped and, once the user has no other connection to the room on any node, their session ends
+// and local followers are released.
+// A room with unsaved changes is kept until its snapshot is persisted.
 func (h *Hub) Unregister(c *Client) {
-	h.mu.Lock()
-	if room, ok := h.rooms[c.diagramID]; ok {
-		delete(room, c)
-		if len(room) == 0 {
+	c.endAwareness()
+	h.mu.RLock()
+	r := h.rooms[c.diagramID]
+	h.mu.RUnlock()
+	joined := false       // Register added the client (it is refused during Shutdown)
+	stillPresent := false // the user has another connection to this room, on this node or another
+	unsaved := false      // the client was the last one here and the room has unsaved edits
+	dropped := false      // the client was the last one here and the room had nothing left to save
+	sequencer := false    // the dropped room's text ops were ordered by this node
+	if r != nil {
+		r.mu.Lock()
+		h.mu.Lock()
+		_, joined = r.clients[c]
+		delete(r.clients, c)
+		for cl := range r.clients {
+			if cl.userID == c.userID {
+				stillPresent = true
+				break
+			}
+		}
+		if len(r.clients) == 0 && !r.dirty && h.rooms[c.diagramID] == r {
 			delete(h.rooms, c.diagramID)
+			dropped, sequencer = true, r.sequencer
+		}
+		unsaved = len(r.clients) == 0 && r.dirty
+		h.mu.Unlock()
+		r.mu.Unlock()
+	}
+	if dropped {
+		h.roomDropped(c.diagramID, sequencer)
+	}
+	if !joined {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	if unsaved {
+		// Last one out: save now rather than waiting for autosave.
+		h.saveSnapshot(ctx, c.diagramID, r)
+		h.dropIfIdle(c.diagramID, r)
+	}
+	if err := h.backend.Leave(ctx, c.diagramID, c.id); err != nil && h.log != nil {
+		h.log.Warn().Err(err).Str("diagram_id", c.diagramID.String()).Msg("realtime: clear presence failed")
+	}
+	if !stillPresent {
+		stillPresent = h.presentElsewhere(ctx, c.diagramID, c.userID)
+	}
+	if h.sessions != nil && !stillPresent {
+		if err := h.sessions.EndSession(ctx, c.diagramID, c.userID); err != nil && h.log != nil {
+			h.log.Warn().Err(err).Str("diagram_id", c.diagramID.String()).Msg("realtime: end session failed")
 		}
 	}
-	h.mu.Unlock()
 
 	leaveMsg := Message{Type: "leave", UserID: c.userID.String()}
 	h.broadcastToRoom(c.diagramID, &leaveMsg, nil)
+	if !stillPresent {
+		h.releaseFollowers(c.diagramID, c.userID)
+	}
 }
 
-// BroadcastCursor sends a cursor update from the client to others in the room.
+// presentElsewhere reports whether the user is still connected to the room on another node. When
+// presence cannot be read it assumes so: a session left open expires, one ended early is lost.
+func (h *Hub) presentElsewhere(ctx context.Context, diagramID, userID uuid.UUID) bool {
+	users, err := h.backend.Presence(ctx, diagramID)
+	if err != nil {
+		if h.log != nil {
+			h.log.Warn().Err(err).Str("diagram_id", diagramID.String()).Msg("realtime: read presence failed")
+		}
+		return true
+	}
+	for _, u := range users {
+		if u.UserID == userID.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// BroadcastCursor sends a cursor update from the client to others in the room and, at most every
+// cursorPersistInterval, saves it to the user's session.
 func (h *Hub) BroadcastCursor(c *Client, position json.RawMessage) {
 	msg := Message{Type: "cursor", UserID: c.userID.String(), Position: position}
 	h.broadcastToRoom(c.diagramID, &msg, c)
+
+	c.mu.Lock()
+	c.cursor = position
+	persist := time.Since(c.cursorSavedAt) >= cursorPersistInterval
+	if persist {
+		c.cursorSavedAt = time.Now()
+	}
+	c.mu.Unlock()
+	if persist {
+		ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+		defer cancel()
+		h.touchSession(ctx, c, position)
+	}
+}
+
+// ApplyTextOp sequences a Mermaid text operation based on revision, transforms it against
+// concurrent ops, broadcasts it to the other clients and acks the sender (echoing id) with the new
+// revision. If the op cannot be applied the sender gets an error and a fresh snapshot to resync from.
+// On a node that is not the room's sequencer the op is forwarded to it instead.
+func (h *Hub) ApplyTextOp(c *Client, id string, revision int, op TextOperation) {
+	r := h.roomOf(c.diagramID)
+	if r == nil {
+		h.sendError(c, id, errNoDocument)
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.doc == nil {
+		h.sendError(c, id, errNoDocument)
+		return
+	}
+	if r.isTextRoom() && !r.sequencer {
+		h.forwardTextOp(c, r, id, revision, op)
+		return
+	}
+	applied, rev, err := r.doc.applyText(revision, op)
+	if err != nil {
+		h.sendError(c, id, &protocolError{opErrorCode(err), err.Error()})
+		h.sendSnapshotTo(c, r)
+		return
+	}
+	r.markDirty(c.userID)
+	h.broadcastToRoom(c.diagramID, &Message{Type: "text_op", UserID: c.userID.String(), Revision: rev, Ops: applied}, c)
+	h.sendAck(c, r, &Message{Type: "ack", ID: id, Revision: rev})
 }
 
-// broadcastToRoom sends msg to all clients in the diagram room except skip.
+// ApplyCanvasOps applies object-level Fabric canvas ops in arrival order, broadcasts the ops
+// that took effect and acks the sender (echoing id) with the new revision.
+func (h *Hub) ApplyCanvasOps(c *Client, id string, ops []CanvasOp) {
+	r := h.roomOf(c.diagramID)
+	if r == nil {
+		h.sendError(c, id, errNoDocument)
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.doc == nil {
+		h.sendError(c, id, errNoDocument)
+		return
+	}
+	applied, updates, rev, err := r.doc.applyCanvas(ops)
+	if err != nil {
+		h.sendError(c, id, &protocolError{opErrorCode(err), err.Error()})
+		h.sendSnapshotTo(c, r)
+		return
+	}
+	if len(applied) > 0 {
+		r.markDirty(c.userID)
+		h.broadcastToRoom(c.diagramID, &Message{Type: "canvas_op", UserID: c.userID.String(), Revision: rev, CanvasOps: applied, Updates: updates}, c)
+	}
+	h.sendAck(c, r, &Message{Type: "ack", ID: id, Revision: rev, Updates: updates})
+}
+
+// MergeCanvasUpdates merges client CRDT updates (including edits made while offline) into the room
+// canvas under the connection's own site, broadcasts the updates that won and acks the sender (echoing
+// id) with them as stamped. Merging is order-independent, so every client that applies the same updates
+// converges on the same canvas.
+func (h *Hub) MergeCanvasUpdates(c *Client, id string, updates []crdt.Update) {
+	r := h.roomOf(c.diagramID)
+	if r == nil {
+		h.sendError(c, id, errNoDocument)
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.doc == nil {
+		h.sendError(c, id, errNoDocument)
+		return
+	}
+	won, rev, err := r.doc.mergeClientUpdates(updates, c.site())
+	if err != nil {
+		h.sendError(c, id, &protocolError{opErrorCode(err), err.Error()})
+		h.sendSnapshotTo(c, r)
+		return
+	}
+	if len(won) > 0 {
+		r.markDirty(c.userID)
+		h.broadcastToRoom(c.diagramID, &Message{Type: "crdt_update", UserID: c.userID.String(), Revision: rev, Updates: won}, c)
+	}
+	h.sendAck(c, r, &Message{Type: "ack", ID: id, Revision: rev, Updates: won})
+}
+
+func (h *Hub) roomOf(diagramID uuid.UUID) *room {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.rooms[diagramID]
+}
+
+// loadDocument loads the room document from the store on first join. Caller holds r.mu.
+func (h *Hub) loadDocument(r *room, c *Client) {
+	if r.doc != nil || h.store == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	content, diagramType, err := h.store.GetDiagramContent(ctx, c.diagramID, c.userID)
+	if err != nil {
+		if h.log != nil {
+			h.log.Error().Err(err).Str("diagram_id", c.diagramID.String()).Msg("realtime: load document failed")
+		}
+		return
+	}
+	var updateLog []crdt.Update
+	if diagrammodel.IsCanvasType(diagramType) {
+		raw, err := h.store.GetCanvasUpdateLog(ctx, c.diagramID, c.userID)
+		if err == nil && len(raw) > 0 {
+			err = json.Unmarshal(raw, &updateLog)
+		}
+		if err != nil {
+			if h.log != nil {
+				h.log.Error().Err(err).Str("diagram_id", c.diagramID.String()).Msg("realtime: load canvas update log failed")
+			}
+			return
+		}
+	}
+	doc, err := newDocument(content, diagramType, updateLog, h.site)
+	if err != nil {
+		if h.log != nil {
+			h.log.Warn().Err(err).Str("diagram_id", c.diagramID.String()).Msg("realtime: diagram content is not editable over the socket")
+		}
+		return
+	}
+	r.doc = doc
+}
+
+// touchSession refreshes the client's session; cursor nil keeps the stored position.
+func (h *Hub) touchSession(ctx context.Context, c *Client, cursor json.RawMessage) {
+	if h.sessions == nil {
+		return
+	}
+	if err := h.sessions.TouchSession(ctx, c.diagramID, c.userID, cursor); err != nil && h.log != nil {
+		h.log.Warn().Err(err).Str("diagram_id", c.diagramID.String()).Msg("realtime: touch session failed")
+	}
+}
+
+// refreshSessions keeps every connected client's session alive (with its latest cursor) and expires
+// sessions left behind by closed or crashed connections.
+func (h *Hub) refreshSessions(ctx context.Context) {
+	if h.sessions == nil {
+		return
+	}
+	h.mu.RLock()
+	var clients []*Client
+	for _, r := range h.rooms {
+		for c := range r.clients {
+			clients = append(clients, c)
+		}
+	}
+	h.mu.RUnlock()
+	for _, c := range clients {
+		c.mu.Lock()
+		cursor := c.cursor
+		c.cursorSavedAt = time.Now()
+		c.mu.Unlock()
+		tctx, cancel := context.WithTimeout(ctx, storeTimeout)
+		h.touchSession(tctx, c, cursor)
+		cancel()
+	}
+	tctx, cancel := context.WithTimeout(ctx, storeTimeout)
+	defer cancel()
+	n, err := h.sessions.ExpireSessions(tctx)
+	if err != nil {
+		if h.log != nil {
+			h.log.Warn().Err(err).Msg("realtime: expire sessions failed")
+		}
+		return
+	}
+	if n > 0 && h.log != nil {
+		h.log.Debug().Int64("expired", n).Msg("realtime: expired stale sessions")
+	}
+}
+
+// flush persists every dirty room and drops rooms that are empty and saved.
+func (h *Hub) flush(ctx context.Context) {
+	h.mu.RLock()
+	ids := make([]uuid.UUID, 0, len(h.rooms))
+	rooms := make([]*room, 0, len(h.rooms))
+	for id, r := range h.rooms {
+		ids = append(ids, id)
+		rooms = append(rooms, r)
+	}
+	h.mu.RUnlock()
+
+	for i, r := range rooms {
+		h.saveSnapshot(ctx, ids[i], r)
+		h.dropIfIdle(ids[i], r)
+	}
+}
+
+// saveSnapshot writes the room document through the store if it changed since the last save.
+func (h *Hub) saveSnapshot(ctx context.Context, diagramID uuid.UUID, r *room) {
+	r.mu.Lock()
+	if !r.dirty || r.doc == nil || h.store == nil {
+		r.mu.Unlock()
+		return
+	}
+	content := r.doc.content()
+	isCanvas := r.doc.isCanvas()
+	var updateLog json.RawMessage
+	if isCanvas {
+		updateLog, _ = json.Marshal(r.doc.updateLog())
+	}
+	editor := r.lastEditor
+	revision := r.doc.revision
+	r.dirty = false
+	r.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, storeTimeout)
+	defer cancel()
+	var err error
+	if isCanvas {
+		err = h.store.SaveCanvasState(ctx, diagramID, editor, content, updateLog)
+	} else {
+		err = h.store.SaveDiagramContent(ctx, diagramID, editor, content)
+	}
+	if err == nil {
+		now := time.Now()
+		r.mu.Lock()
+		r.savedAt = now
+		r.mu.Unlock()
+		h.announceSaved(diagramID, revision, now)
+		return
+	}
+	if h.log != nil {
+		h.log.Error().Err(err).Str("diagram_id", diagramID.String()).Msg("realtime: save snapshot failed")
+	}
+	var de *common.DomainError
+	if errors.As(err, &de) && (de.Code == common.CodeForbidden || de.Code == common.CodeNotFound) {
+		return // retrying cannot succeed
+	}
+	r.mu.Lock()
+	r.dirty = true
+	r.mu.Unlock()
+}
+
+// sendSnapshotTo sends the room document to c, with the sequence number it is current as of.
+// Caller holds r.mu.
+func (h *Hub) sendSnapshotTo(c *Client, r *room) {
+	if r.doc == nil {
+		return
+	}
+	r.replayMu.Lock()
+	defer r.replayMu.Unlock()
+	h.sendTo(c, &Message{Type: "snapshot", DiagramType: r.doc.diagramType, Content: r.doc.content(), Revision: r.doc.revision, Updates: r.doc.updateLog(), Seq: r.seq})
+}
+
+// sendError answers the client message id with an error frame.
+func (h *Hub) sendError(c *Client, id string, perr *protocolError) {
+	h.sendTo(c, &Message{Type: "error", ID: id, Code: perr.code, Error: perr.message})
+}
+
+func (h *Hub) sendTo(c *Client, msg *Message) {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	c.Send(payload)
+}
+
+// broadcastToRoom sends msg to all clients in the diagram room except skip, on this node and
+// (through the backend) on every other node. It does no I/O, so callers may hold r.mu: frames are
+// sequenced here and queued for the room's publisher in the same order.
 func (h *Hub) broadcastToRoom(diagramID uuid.UUID, msg *Message, skip *Client) {
 	payload, err := json.Marshal(msg)
 	if err != nil {
 		return
 	}
-	h.mu.RLock()
-	room := h.rooms[diagramID]
-	if room == nil {
-		h.mu.RUnlock()
+	h.deliverLocal(diagramID, msg, skip)
+	h.publish(diagramID, payload)
+}
+
+// deliverLocal sequences msg in the room and sends it to this node's clients in the room except skip.
+func (h *Hub) deliverLocal(diagramID uuid.UUID, msg *Message, skip *Client) {
+	r := h.roomOf(diagramID)
+	if r == nil {
+		return
+	}
+	r.replayMu.Lock()
+	defer r.replayMu.Unlock()
+	origin := ""
+	if skip != nil {
+		origin = skip.id
+	}
+	payload, err := r.sequence(msg, origin, "")
+	if err != nil {
 		return
 	}
-	clients := make([]*Client, 0, len(room))
-	for cl := range room {
+	h.mu.RLock()
+	clients := make([]*Client, 0, len(r.clients))
+	for cl := range r.clients {
 		if cl != skip {
 			clients = append(clients, cl)
 		}
 	}
 	h.mu.RUnlock()
+	key := ""
+	switch msg.Type {
+	case "cursor", "selection", "viewport":
+		key = msg.Type + ":" + msg.UserID
+	}
 	for _, cl := range clients {
-		cl.Send(payload)
+		cl.enqueue(payload, key)
 	}
 }
 
-// sendPresenceTo sends the current list of users in the room to the given client.
-func (h *Hub) sendPresenceTo(c *Client) {
-	h.mu.RLock()
-	room := h.rooms[c.diagramID]
-	if room == nil {
-		h.mu.RUnlock()
+// MemberRoleChanged re-checks the user's open collaboration sockets on every node after a workspace role change.
+func (h *Hub) MemberRoleChanged(workspaceID, userID uuid.UUID, role wsmodel.Role) {
+	h.membershipChanged(userID)
+}
+
+// MemberRemoved re-checks the user's open collaboration sockets on every node after removal from a workspace.
+func (h *Hub) MemberRemoved(workspaceID, userID uuid.UUID) {
+	h.membershipChanged(userID)
+}
+
+// membershipChanged tells the other nodes (on the nil-diagram control channel) and re-checks local sockets.
+func (h *Hub) membershipChanged(userID uuid.UUID) {
+	go func() {
+		payload, err := json.Marshal(Message{Type: "membership_changed", UserID: userID.String()})
+		if err != nil {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+		defer cancel()
+		if err := h.backend.Publish(ctx, uuid.Nil, payload); err != nil && h.log != nil {
+			h.log.Warn().Err(err).Msg("realtime: publish membership change failed")
+		}
+		h.reevaluateUser(userID)
+	}()
+}
+
+// reevaluateUser resolves the permission of each of the user's clients on this node again: clients that
+// lost access are disconnected, the others are told about a changed permission.
+func (h *Hub) reevaluateUser(userID uuid.UUID) {
+	if h.store == nil {
 		return
 	}
-	users := make([]UserPresence, 0, len(room))
-	for cl := range room {
-		users = append(users, UserPresence{UserID: cl.userID.String(), Email: cl.email})
+	h.mu.RLock()
+	var clients []*Client
+	for _, r := range h.rooms {
+		for c := range r.clients {
+			if c.userID == userID {
+				clients = append(clients, c)
+			}
+		}
 	}
 	h.mu.RUnlock()
-	msg := Message{Type: "presence", Users: users}
-	payload, err := json.Marshal(msg)
-	if err != nil {
+	for _, c := range clients {
+		ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+		perm, err := h.store.ResolveDiagramPermission(ctx, c.diagramID, c.userID)
+		cancel()
+		if err != nil {
+			var de *common.DomainError
+			if errors.As(err, &de) && (de.Code == common.CodeForbidden || de.Code == common.CodeNotFound) {
+				c.disconnect(websocket.ClosePolicyViolation, "access to this diagram was revoked")
+				continue
+			}
+			if h.log != nil {
+				h.log.Warn().Err(err).Str("diagram_id", c.diagramID.String()).Msg("realtime: re-check permission failed")
+			}
+			continue
+		}
+		if c.setPermission(perm) {
+			h.sendTo(c, &Message{Type: "permission", Permission: string(perm)})
+		}
+	}
+}
+
+// deliverRemote handles a message published by another node: canvas updates are merged into this
+// node's copy of the document and text sequencing messages handled (see deliverRemoteText), then room
+// events are relayed to local clients. Text ops that were not applied here are never relayed.
+func (h *Hub) deliverRemote(diagramID uuid.UUID, payload []byte) {
+	var msg Message
+	if err := json.Unmarshal(payload, &msg); err != nil {
 		return
 	}
-	c.Send(payload)
+	if diagramID == uuid.Nil {
+		// Control message between nodes, not for clients.
+		if msg.Type == "membership_changed" {
+			if userID, err := uuid.Parse(msg.UserID); err == nil {
+				h.reevaluateUser(userID)
+			}
+		}
+		return
+	}
+	if msg.Type == "content_replaced" {
+		var cr contentReplaced
+		if userID, err := uuid.Parse(msg.UserID); err == nil && json.Unmarshal(payload, &cr) == nil {
+			h.applyReplaced(diagramID, userID, cr.Base, cr.Content)
+		}
+		return
+	}
+	r := h.roomOf(diagramID)
+	if r == nil {
+		return // no clients here
+	}
+	// Hold r.mu through delivery so the frame is sequenced in the same order as local edits.
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch msg.Type {
+	case "chat":
+		h.recordChat(r, &msg)
+	case "saved":
+		if t, err := time.Parse(time.RFC3339, msg.SavedAt); err == nil {
+			r.savedAt = t
+		}
+	}
+	if r.isTextRoom() && h.deliverRemoteText(diagramID, r, &msg) {
+		return
+	}
+	if nodeMessageTypes[msg.Type] || msg.Type == "text_op" {
+		return // no text document here to apply it to
+	}
+	if r.doc != nil {
+		switch msg.Type {
+		case "snapshot":
+			r.doc.reset(msg.Content, msg.Updates, msg.Revision)
+		case "canvas_op", "crdt_update":
+			_, _, _ = r.doc.mergeUpdates(msg.Updates)
+		}
+	}
+	h.deliverLocal(diagramID, &msg, nil)
+}
+
+// sendPresenceTo sends the list of users in the room on every node to the given client.
+func (h *Hub) sendPresenceTo(c *Client) {
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	users, err := h.backend.Presence(ctx, c.diagramID)
+	if err != nil {
+		if h.log != nil {
+			h.log.Warn().Err(err).Str("diagram_id", c.diagramID.String()).Msg("realtime: read presence failed")
+		}
+		users = h.localPresence(c.diagramID)
+	}
+	msg := Message{Type: "presence", Users: users}
+	if r := h.roomOf(c.diagramID); r != nil {
+		if saved := r.lastSaved(); !saved.IsZero() {
+			msg.SavedAt = saved.UTC().Format(time.RFC3339)
+		}
+	}
+	h.sendTo(c, &msg)
+}
+
+// localPresence lists the users connected to this node's room.
+func (h *Hub) localPresence(diagramID uuid.UUID) []UserPresence {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	r := h.rooms[diagramID]
+	if r == nil {
+		return nil
+	}
+	users := make([]UserPresence, 0, len(r.clients))
+	for cl := range r.clients {
+		users = append(users, cl.presence())
+	}
+	return users
 }
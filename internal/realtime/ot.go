@@ -0,0 +1,201 @@
+package realtime
+
+import (
+	"errors"
+	"unicode/utf8"
+)
+
+// Errors returned when a text operation does not fit the document it is applied to.
+var (
+	ErrOpBaseLength = errors.New("realtime: operation base length does not match document")
+	ErrOpInvalid    = errors.New("realtime: invalid operation component")
+)
+
+// TextOp is one component of a text operation. Exactly one field is set:
+// Retain skips n characters, Insert adds a string, Delete removes n characters.
+// Lengths are counted in Unicode code points.
+type TextOp struct {
+	Retain int    `json:"retain,omitempty"`
+	Insert string `json:"insert,omitempty"`
+	Delete int    `json:"delete,omitempty"`
+}
+
+func (c TextOp) isRetain() bool { return c.Retain > 0 }
+func (c TextOp) isInsert() bool { return c.Insert != "" }
+func (c TextOp) isDelete() bool { return c.Delete > 0 }
+
+// TextOperation is a sequence of components that spans the whole document (Mermaid content).
+type TextOperation []TextOp
+
+// Validate returns ErrOpInvalid if any component is empty or sets more than one field.
+func (o TextOperation) Validate() error {
+	for _, c := range o {
+		n := 0
+		if c.isRetain() {
+			n++
+		}
+		if c.isInsert() {
+			n++
+		}
+		if c.isDelete() {
+			n++
+		}
+		if n != 1 || c.Retain < 0 || c.Delete < 0 {
+			return ErrOpInvalid
+		}
+	}
+	return nil
+}
+
+// BaseLen returns the length of the document the operation applies to.
+func (o TextOperation) BaseLen() int {
+	n := 0
+	for _, c := range o {
+		n += c.Retain + c.Delete
+	}
+	return n
+}
+
+// Apply returns doc with the operation applied.
+func (o TextOperation) Apply(doc string) (string, error) {
+	if err := o.Validate(); err != nil {
+		return "", err
+	}
+	runes := []rune(doc)
+	if len(runes) != o.BaseLen() {
+		return "", ErrOpBaseLength
+	}
+	out := make([]rune, 0, len(runes))
+	pos := 0
+	for _, c := range o {
+		switch {
+		case c.isRetain():
+			out = append(out, runes[pos:pos+c.Retain]...)
+			pos += c.Retain
+		case c.isInsert():
+			out = append(out, []rune(c.Insert)...)
+		case c.isDelete():
+			pos += c.Delete
+		}
+	}
+	return string(out), nil
+}
+
+func (o *TextOperation) retain(n int) {
+	if n <= 0 {
+		return
+	}
+	if l := len(*o); l > 0 && (*o)[l-1].isRetain() {
+		(*o)[l-1].Retain += n
+		return
+	}
+	*o = append(*o, TextOp{Retain: n})
+}
+
+func (o *TextOperation) insert(s string) {
+	if s == "" {
+		return
+	}
+	if l := len(*o); l > 0 && (*o)[l-1].isInsert() {
+		(*o)[l-1].Insert += s
+		return
+	}
+	*o = append(*o, TextOp{Insert: s})
+}
+
+func (o *TextOperation) delete(n int) {
+	if n <= 0 {
+		return
+	}
+	if l := len(*o); l > 0 && (*o)[l-1].isDelete() {
+		(*o)[l-1].Delete += n
+		return
+	}
+	*o = append(*o, TextOp{Delete: n})
+}
+
+// TransformText transforms two concurrent operations a and b (same base document) into a' and b'
+// such that applying a then b' equals applying b then a'. On equal insert positions a goes first.
+func TransformText(a, b TextOperation) (TextOperation, TextOperation, error) {
+	if err := a.Validate(); err != nil {
+		return nil, nil, err
+	}
+	if err := b.Validate(); err != nil {
+		return nil, nil, err
+	}
+	if a.BaseLen() != b.BaseLen() {
+		return nil, nil, ErrOpBaseLength
+	}
+	var ap, bp TextOperation
+	ops1 := append(TextOperation(nil), a...)
+	ops2 := append(TextOperation(nil), b...)
+	i, j := 0, 0
+	for i < len(ops1) || j < len(ops2) {
+		if i < len(ops1) && ops1[i].isInsert() {
+			ap.insert(ops1[i].Insert)
+			bp.retain(utf8.RuneCountInString(ops1[i].Insert))
+			i++
+			continue
+		}
+		if j < len(ops2) && ops2[j].isInsert() {
+			ap.retain(utf8.RuneCountInString(ops2[j].Insert))
+			bp.insert(ops2[j].Insert)
+			j++
+			continue
+		}
+		if i >= len(ops1) || j >= len(ops2) {
+			return nil, nil, ErrOpBaseLength
+		}
+		c1, c2 := &ops1[i], &ops2[j]
+		n1 := c1.Retain + c1.Delete
+		n2 := c2.Retain + c2.Delete
+		m := min(n1, n2)
+		switch {
+		case c1.isRetain() && c2.isRetain():
+			ap.retain(m)
+			bp.retain(m)
+		case c1.isDelete() && c2.isRetain():
+			ap.delete(m)
+		case c1.isRetain() && c2.isDelete():
+			bp.delete(m)
+		}
+		// delete/delete: both sides already removed the range; nothing to emit.
+		consume(c1, m)
+		consume(c2, m)
+		if c1.Retain == 0 && c1.Delete == 0 {
+			i++
+		}
+		if c2.Retain == 0 && c2.Delete == 0 {
+			j++
+		}
+	}
+	return ap, bp, nil
+}
+
+func consume(c *TextOp, n int) {
+	if c.Retain > 0 {
+		c.Retain -= n
+	} else {
+		c.Delete -= n
+	}
+}
+
+// diffText returns an operation that turns from into to: a retain of the common prefix and suffix
+// around one delete and one insert.
+func diffText(from, to string) TextOperation {
+	a, b := []rune(from), []rune(to)
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	var op TextOperation
+	op.retain(prefix)
+	op.delete(len(a) - prefix - suffix)
+	op.insert(string(b[prefix : len(b)-suffix]))
+	op.retain(suffix)
+	return op
+}
@@ -0,0 +1,114 @@
+package realtime
+
+import (
+	"math"
+	"testing"
+
+	"github.com/devenock/d_weaver/internal/realtime/crdt"
+)
+
+func TestTextOperation_Apply(t *testing.T) {
+	op := TextOperation{{Retain: 6}, {Insert: "TD"}, {Delete: 2}}
+	got, err := op.Apply("graph LR")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "graph TD" {
+		t.Errorf("Apply = %q, want %q", got, "graph TD")
+	}
+	if _, err := op.Apply("graph"); err != ErrOpBaseLength {
+		t.Errorf("err = %v, want ErrOpBaseLength", err)
+	}
+}
+
+func TestTransformText_Converges(t *testing.T) {
+	doc := "A-->B"
+	a := TextOperation{{Retain: 1}, {Insert: "1"}, {Retain: 4}} // A1-->B
+	b := TextOperation{{Retain: 4}, {Delete: 1}, {Insert: "C"}} // A-->C
+	ap, bp, err := TransformText(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	left, _ := a.Apply(doc)
+	left, err = bp.Apply(left)
+	if err != nil {
+		t.Fatal(err)
+	}
+	right, _ := b.Apply(doc)
+	right, err = ap.Apply(right)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if left != right || left != "A1-->C" {
+		t.Errorf("diverged: %q vs %q", left, right)
+	}
+}
+
+func TestDocument_ApplyTextConcurrent(t *testing.T) {
+	d, _ := newDocument("ab", "flowchart", nil, serverSite)
+	if _, rev, err := d.applyText(0, TextOperation{{Insert: "x"}, {Retain: 2}}); err != nil || rev != 1 {
+		t.Fatalf("rev = %d, err = %v", rev, err)
+	}
+	// Second client still at revision 0 appends at the end.
+	if _, _, err := d.applyText(0, TextOperation{{Retain: 2}, {Insert: "y"}}); err != nil {
+		t.Fatal(err)
+	}
+	if d.content() != "xaby" {
+		t.Errorf("content = %q, want %q", d.content(), "xaby")
+	}
+}
+
+func TestDocument_ApplyCanvas(t *testing.T) {
+	d, err := newDocument(`{"version":"5.3.0","objects":[{"id":"a","type":"rect"}]}`, "whiteboard", nil, serverSite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops := []CanvasOp{
+		{Op: CanvasOpModify, ID: "a", Object: []byte(`{"left":10}`)},
+		{Op: CanvasOpAdd, ID: "b", Object: []byte(`{"type":"circle"}`)},
+		{Op: CanvasOpRemove, ID: "missing"},
+	}
+	applied, _, rev, err := d.applyCanvas(ops)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != 2 || rev != 1 {
+		t.Errorf("applied = %d, rev = %d", len(applied), rev)
+	}
+	want := `{"objects":[{"id":"a","left":10,"type":"rect"},{"id":"b","type":"circle"}],"version":"5.3.0"}`
+	if got := d.content(); got != want {
+		t.Errorf("content = %s", got)
+	}
+}
+
+func TestDocument_MergeClientUpdates(t *testing.T) {
+	d, err := newDocument(`{"version":"5.3.0","objects":[{"id":"a","type":"rect"}]}`, "whiteboard", nil, serverSite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	overflow := []crdt.Update{{Op: crdt.OpSet, ID: "a", Value: []byte(`{"type":"rect","left":1}`), Clock: crdt.Clock{Counter: math.MaxUint64, Site: "zzz"}}}
+	if _, _, err := d.mergeClientUpdates(overflow, "client:test"); err != crdt.ErrClockSkew {
+		t.Fatalf("err = %v, want clock skew", err)
+	}
+	offline := []crdt.Update{{Op: crdt.OpSet, ID: "a", Value: []byte(`{"type":"rect","left":2}`), Clock: crdt.Clock{Counter: 7, Site: "zzz"}}}
+	won, rev, err := d.mergeClientUpdates(offline, "client:test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(won) != 1 || won[0].Clock != (crdt.Clock{Counter: 7, Site: "client:test"}) || rev != 1 {
+		t.Errorf("won = %+v at revision %d, want the update stamped with the client site", won, rev)
+	}
+	if offline[0].Clock.Site != "zzz" {
+		t.Error("stamping modified the caller's updates")
+	}
+}
+
+func TestDiffText(t *testing.T) {
+	cases := [][2]string{{"graph LR", "graph TD"}, {"", "A-->B"}, {"A-->B", ""}, {"A-->B", "A-->B"}, {"héllo", "hello wörld"}}
+	for _, c := range cases {
+		got, err := diffText(c[0], c[1]).Apply(c[0])
+		if err != nil || got != c[1] {
+			t.Errorf("diffText(%q, %q) applies to %q, %v", c[0], c[1], got, err)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package realtime
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Slow-consumer policies: what happens when a client has more than the maximum lag of frames queued.
+const (
+	PolicyDropOldest = "drop_oldest" // discard the oldest queued frame
+	PolicyCoalesce   = "coalesce"    // keep only the newest cursor per user, then discard the oldest frame
+	PolicyDisconnect = "disconnect"  // close the connection with 1008 (resume replays what it missed)
+)
+
+const defaultMaxLag = 256
+
+// pushResult says what happened to a frame pushed to an outbox.
+type pushResult int
+
+const (
+	pushQueued    pushResult = iota
+	pushCoalesced            // replaced a queued frame with the same coalesce key
+	pushDropped              // queued after discarding the oldest frame
+	pushOverflow             // not queued: the client lagged past the maximum (disconnect policy, reported once)
+	pushClosed               // not queued: the outbox is closed
+)
+
+// outbox is a client's queue of frames waiting for the write pump.
+type outbox struct {
+	mu       sync.Mutex
+	frames   [][]byte
+	keys     []string // coalesce key per queued frame ("" if the frame cannot be coalesced)
+	maxLag   int
+	policy   string
+	closed   bool
+	overflow bool
+	ready    chan struct{} // signalled when frames are queued or the outbox closes
+}
+
+func newOutbox(maxLag int, policy string) *outbox {
+	if maxLag <= 0 {
+		maxLag = defaultMaxLag
+	}
+	return &outbox{maxLag: maxLag, policy: policy, ready: make(chan struct{}, 1)}
+}
+
+// push queues payload. key groups frames that supersede each other (cursor updates per user) under the
+// coalesce policy.
+func (o *outbox) push(payload []byte, key string) pushResult {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed || o.overflow {
+		return pushClosed
+	}
+	result := pushQueued
+	if o.policy == PolicyCoalesce && key != "" {
+		for i := len(o.keys) - 1; i >= 0; i-- {
+			if o.keys[i] == key {
+				o.frames = append(o.frames[:i], o.frames[i+1:]...)
+				o.keys = append(o.keys[:i], o.keys[i+1:]...)
+				result = pushCoalesced
+				break
+			}
+		}
+	}
+	if len(o.frames) >= o.maxLag {
+		if o.policy == PolicyDisconnect {
+			o.overflow = true
+			return pushOverflow
+		}
+		o.frames = o.frames[1:]
+		o.keys = o.keys[1:]
+		result = pushDropped
+	}
+	o.frames = append(o.frames, payload)
+	o.keys = append(o.keys, key)
+	o.signal()
+	return result
+}
+
+// take removes and returns the queued frames, and whether the outbox is closed.
+func (o *outbox) take() ([][]byte, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	frames := o.frames
+	o.frames, o.keys = nil, nil
+	return frames, o.closed
+}
+
+// pending returns how many frames are queued.
+func (o *outbox) pending() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.frames)
+}
+
+// close stops the outbox; queued frames are still handed to the write pump.
+func (o *outbox) close() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if !o.closed {
+		o.closed = true
+		o.signal()
+	}
+}
+
+func (o *outbox) signal() {
+	select {
+	case o.ready <- struct{}{}:
+	default:
+	}
+}
+
+// roomStats counts slow-consumer events in a room (or in the whole hub).
+type roomStats struct {
+	dropped      atomic.Uint64
+	coalesced    atomic.Uint64
+	disconnected atomic.Uint64
+}
+
+func (s *roomStats) record(result pushResult) {
+	switch result {
+	case pushDropped:
+		s.dropped.Add(1)
+	case pushCoalesced:
+		s.coalesced.Add(1)
+	case pushOverflow:
+		s.disconnected.Add(1)
+	}
+}
@@ -0,0 +1,51 @@
+package realtime
+
+import (
+	"testing"
+
+	"github.com/devenock/d_weaver/config"
+	"github.com/google/uuid"
+)
+
+func TestOutbox_Policies(t *testing.T) {
+	drop := newOutbox(2, PolicyDropOldest)
+	drop.push([]byte("1"), "")
+	drop.push([]byte("2"), "")
+	if r := drop.push([]byte("3"), ""); r != pushDropped {
+		t.Errorf("drop_oldest full push = %v, want dropped", r)
+	}
+	if frames, _ := drop.take(); len(frames) != 2 || string(frames[0]) != "2" {
+		t.Errorf("drop_oldest kept %q, want [2 3]", frames)
+	}
+
+	co := newOutbox(3, PolicyCoalesce)
+	co.push([]byte("a1"), "cursor:a")
+	co.push([]byte("op"), "")
+	if r := co.push([]byte("a2"), "cursor:a"); r != pushCoalesced {
+		t.Errorf("coalesce push = %v, want coalesced", r)
+	}
+	if frames, _ := co.take(); len(frames) != 2 || string(frames[0]) != "op" || string(frames[1]) != "a2" {
+		t.Errorf("coalesce kept %q, want [op a2]", frames)
+	}
+
+	dc := newOutbox(1, PolicyDisconnect)
+	dc.push([]byte("1"), "")
+	if r := dc.push([]byte("2"), ""); r != pushOverflow {
+		t.Errorf("disconnect full push = %v, want overflow", r)
+	}
+	if r := dc.push([]byte("3"), ""); r != pushClosed {
+		t.Errorf("push after overflow = %v, want closed", r)
+	}
+}
+
+func TestHub_StatsPerRoom(t *testing.T) {
+	hub := NewHub(nil, nil, nil, config.RealtimeConfig{}, nil)
+	quiet, busy := uuid.New(), uuid.New()
+	hub.Register(newTestClient(hub, quiet))
+	hub.Register(newTestClient(hub, busy))
+	hub.Register(newTestClient(hub, busy))
+	stats := hub.Stats()
+	if len(stats.Rooms) != 2 || stats.Rooms[0].DiagramID != busy || stats.Rooms[0].Clients != 2 || stats.Rooms[0].Pending <= stats.Rooms[1].Pending {
+		t.Errorf("rooms = %+v, want the busier room first", stats.Rooms)
+	}
+}
@@ -0,0 +1,191 @@
+package realtime
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/devenock/d_weaver/internal/common"
+	"github.com/devenock/d_weaver/internal/realtime/crdt"
+)
+
+// ProtocolV1 is the Sec-WebSocket-Protocol value of the current message protocol. Clients that send no
+// subprotocol are served v1; clients that offer only unknown versions are refused before the upgrade.
+const ProtocolV1 = "dweaver.v1"
+
+// Subprotocols lists the supported protocol versions, preferred first.
+var Subprotocols = []string{ProtocolV1}
+
+// Error codes carried by error frames (alongside common.CodeForbidden and common.CodeInternalError).
+const (
+	ErrCodeBadMessage    = "bad_message"         // not JSON, wrong field types, or fields the type does not carry
+	ErrCodeUnknownType   = "unknown_type"        // type is not a client message type of this protocol version
+	ErrCodeInvalidOp     = "invalid_op"          // edit does not apply to the document; a snapshot follows
+	ErrCodeStaleRevision = "stale_revision"      // base revision is too old to transform; a snapshot follows
+	ErrCodeRateLimited   = "rate_limit_exceeded" // chat or reaction sent faster than the per-connection limit
+)
+
+// Message is the envelope of every frame (client <-> server). Which fields a type carries is declared in
+// clientMessageTypes and serverMessageTypes; desc tags document the fields in the generated schema.
+type Message struct {
+	Type         string          `json:"type" desc:"Message type"`
+	ID           string          `json:"id,omitempty" desc:"Client-chosen message id, echoed by the ack or error frame that answers it"`
+	UserID       string          `json:"user_id,omitempty" desc:"User the event is about"`
+	Email        string          `json:"email,omitempty" desc:"Email of that user"`
+	Position     json.RawMessage `json:"position,omitempty" desc:"Cursor position (opaque JSON chosen by the client)"`
+	Users        []UserPresence  `json:"users,omitempty" desc:"Users in the room on every replica"`
+	Revision     int             `json:"revision,omitempty" desc:"Document revision (on client edits: the last revision the client has seen)"`
+	Ops          TextOperation   `json:"ops,omitempty" desc:"Mermaid text operation: retain/insert/delete components counted in Unicode code points"`
+	CanvasOps    []CanvasOp      `json:"canvas_ops,omitempty" desc:"Object-level Fabric canvas operations"`
+	Updates      []crdt.Update   `json:"updates,omitempty" desc:"Canvas CRDT updates (LWW value and z-order registers with Lamport clocks)"`
+	Content      string          `json:"content,omitempty" desc:"Full document content (Mermaid text or Fabric canvas JSON)"`
+	DiagramType  string          `json:"diagram_type,omitempty" desc:"Diagram type; whiteboard and visual are Fabric canvases, others Mermaid"`
+	Permission   string          `json:"permission,omitempty" desc:"The client's access: view, comment or edit"`
+	Code         string          `json:"code,omitempty" desc:"Stable error code"`
+	Error        string          `json:"error,omitempty" desc:"User-facing error message"`
+	Seq          uint64          `json:"seq,omitempty" desc:"Room sequence number; increases with every frame the room delivers on this replica"`
+	ConnID       string          `json:"conn_id,omitempty" desc:"Connection id, needed to resume after a reconnect"`
+	Epoch        string          `json:"epoch,omitempty" desc:"Room instance; sequence numbers are only comparable within one epoch"`
+	Selection    []string        `json:"selection,omitempty" desc:"Selected element ids (Mermaid node ids or canvas object ids); absent means nothing selected"`
+	Viewport     *Viewport       `json:"viewport,omitempty" desc:"Zoom and pan of the user's view"`
+	Following    string          `json:"following,omitempty" desc:"Id of the user being followed"`
+	Text         string          `json:"text,omitempty" desc:"Chat message text (at most 2000 characters)"`
+	SentAt       string          `json:"sent_at,omitempty" desc:"When the server received the chat message (RFC 3339)"`
+	Emoji        string          `json:"emoji,omitempty" desc:"Reaction emoji (at most 32 bytes)"`
+	Chat         []ChatEntry     `json:"chat,omitempty" desc:"Recent chat messages in the room, oldest first"`
+	RetryAfterMs int             `json:"retry_after_ms,omitempty" desc:"How long to wait before reconnecting, in milliseconds"`
+	SavedAt      string          `json:"saved_at,omitempty" desc:"When the room content was last saved by the server (RFC 3339)"`
+}
+
+// UserPresence is a connection in the room (for presence broadcasts), with what it is looking at.
+type UserPresence struct {
+	UserID    string          `json:"user_id"`
+	Email     string          `json:"email,omitempty"`
+	Position  json.RawMessage `json:"position,omitempty"`
+	Selection []string        `json:"selection,omitempty"`
+	Viewport  *Viewport       `json:"viewport,omitempty"`
+	Following string          `json:"following,omitempty"`
+}
+
+// MessageType declares one message type of the protocol: the Message fields (JSON names) it carries
+// besides type and id, and which of those must be present.
+type MessageType struct {
+	Type        string
+	Description string
+	Fields      []string
+	Required    []string
+}
+
+// clientMessageTypes are the frames a client may send. Every client frame may carry an id; edits are
+// always answered by an ack or error, other frames only when they carry an id.
+var clientMessageTypes = []MessageType{
+	{Type: "cursor", Description: "Broadcast the sender's cursor to the room.", Fields: []string{"position"}, Required: []string{"position"}},
+	{Type: "selection", Description: "Broadcast the element ids the sender has selected (empty to clear). Throttled per connection; the latest selection is always delivered.", Fields: []string{"selection"}, Required: []string{"selection"}},
+	{Type: "viewport", Description: "Broadcast the sender's zoom and pan (zoom > 0). Throttled per connection; the latest viewport is always delivered.", Fields: []string{"viewport"}, Required: []string{"viewport"}},
+	{Type: "follow", Description: "Follow another user's viewport (e.g. a presenter); the room is told who follows whom.", Fields: []string{"following"}, Required: []string{"following"}},
+	{Type: "unfollow", Description: "Stop following."},
+	{Type: "chat", Description: "Send a chat message to the room (comment access required; rate limited per connection). Not saved as a comment.", Fields: []string{"text"}, Required: []string{"text"}},
+	{Type: "reaction", Description: "Send an ephemeral reaction, optionally at a position (rate limited per connection).", Fields: []string{"emoji", "position"}, Required: []string{"emoji"}},
+	{Type: "save_transcript", Description: "Save the room's chat history as a comment on the diagram, authored by the sender (comment access required)."},
+	{Type: "text_op", Description: "Edit Mermaid content. The server transforms the op against concurrent ops and acks with the new revision.", Fields: []string{"revision", "ops"}, Required: []string{"ops"}},
+	{Type: "canvas_op", Description: "Edit a Fabric canvas by object id; acked with the new revision and the server-stamped CRDT updates.", Fields: []string{"canvas_ops"}, Required: []string{"canvas_ops"}},
+	{Type: "crdt_update", Description: "Merge canvas CRDT updates (e.g. edits made offline); the server stamps their clock site with the connection's own, and refuses clocks too far ahead of the canvas.", Fields: []string{"updates"}, Required: []string{"updates"}},
+	{Type: "snapshot", Description: "Replace the whole document with content (Mermaid text or Fabric canvas JSON) based on revision, which must be the current one. The server diffs it into the document, autosaves it and sends the others a snapshot; acked with the new revision.", Fields: []string{"revision", "content"}, Required: []string{"revision", "content"}},
+	{Type: "resume", Description: "After reconnecting, replay what the previous connection (conn_id, epoch from its welcome) missed after seq. Answered by the missed frames and an ack, or by resync and a snapshot.", Fields: []string{"seq", "conn_id", "epoch"}, Required: []string{"seq", "conn_id", "epoch"}},
+}
+
+// serverMessageTypes are the frames the server sends.
+var serverMessageTypes = []MessageType{
+	{Type: "welcome", Description: "First frame of a connection: its id, the room epoch and the sequence number the join snapshot is current as of.", Fields: []string{"conn_id", "epoch", "seq"}, Required: []string{"conn_id", "epoch"}},
+	{Type: "snapshot", Description: "Current document as of seq; sent on join, whenever the client must resync, and when another user (user_id) replaced the whole document.", Fields: []string{"user_id", "diagram_type", "content", "revision", "updates", "seq"}, Required: []string{"diagram_type"}},
+	{Type: "saved", Description: "The server persisted the document as of revision (autosave, or the last client leaving).", Fields: []string{"revision", "saved_at", "seq"}, Required: []string{"saved_at"}},
+	{Type: "resync", Description: "A resume could not be served from the replay buffer; reset to the snapshot that follows.", Fields: []string{"seq"}},
+	{Type: "permission", Description: "The client's access; sent on join and when it changes.", Fields: []string{"permission"}, Required: []string{"permission"}},
+	{Type: "presence", Description: "Everyone in the room with their cursor, selection, viewport and who they follow, and when the room was last saved; sent on join.", Fields: []string{"users", "saved_at"}},
+	{Type: "join", Description: "A user joined the room.", Fields: []string{"user_id", "email", "seq"}, Required: []string{"user_id"}},
+	{Type: "leave", Description: "A user left the room.", Fields: []string{"user_id", "seq"}, Required: []string{"user_id"}},
+	{Type: "cursor", Description: "Another user's cursor moved.", Fields: []string{"user_id", "position", "seq"}, Required: []string{"user_id"}},
+	{Type: "selection", Description: "Another user's selection changed.", Fields: []string{"user_id", "selection", "seq"}, Required: []string{"user_id"}},
+	{Type: "viewport", Description: "Another user's viewport changed; followers of that user should match it.", Fields: []string{"user_id", "viewport", "seq"}, Required: []string{"user_id", "viewport"}},
+	{Type: "follow", Description: "A user started following another user.", Fields: []string{"user_id", "following", "seq"}, Required: []string{"user_id", "following"}},
+	{Type: "unfollow", Description: "A user stopped following, or the user they followed left.", Fields: []string{"user_id", "seq"}, Required: []string{"user_id"}},
+	{Type: "chat", Description: "A chat message, including the sender's own (stamped by the server).", Fields: []string{"user_id", "email", "text", "sent_at", "seq"}, Required: []string{"user_id", "text", "sent_at"}},
+	{Type: "chat_history", Description: "Recent chat in the room; sent on join when there is any.", Fields: []string{"chat"}, Required: []string{"chat"}},
+	{Type: "reaction", Description: "Another user reacted.", Fields: []string{"user_id", "emoji", "position", "seq"}, Required: []string{"user_id", "emoji"}},
+	{Type: "text_op", Description: "Another user's Mermaid edit, already transformed; apply it and move to revision.", Fields: []string{"user_id", "revision", "ops", "seq"}, Required: []string{"user_id", "ops"}},
+	{Type: "canvas_op", Description: "Another user's canvas edit and the CRDT updates it produced.", Fields: []string{"user_id", "revision", "canvas_ops", "updates", "seq"}, Required: []string{"user_id"}},
+	{Type: "crdt_update", Description: "Canvas CRDT updates another user merged that won.", Fields: []string{"user_id", "revision", "updates", "seq"}, Required: []string{"user_id"}},
+	{Type: "ack", Description: "The client message with this id was applied; edits carry the new revision (canvas_op and crdt_update also the server-stamped updates).", Fields: []string{"revision", "updates", "seq"}},
+	{Type: "error", Description: "The client message with this id was rejected.", Fields: []string{"code", "error"}, Required: []string{"code", "error"}},
+	{Type: "server_restart", Description: "The server is shutting down; a 1012 close frame follows. Reconnect (and resume) after retry_after_ms, which is jittered per client.", Fields: []string{"retry_after_ms"}, Required: []string{"retry_after_ms"}},
+}
+
+var clientRegistry = indexMessageTypes(clientMessageTypes)
+
+func indexMessageTypes(types []MessageType) map[string]*MessageType {
+	m := make(map[string]*MessageType, len(types))
+	for i := range types {
+		m[types[i].Type] = &types[i]
+	}
+	return m
+}
+
+// protocolError rejects a client frame; it is sent back as an error frame.
+type protocolError struct {
+	code    string
+	message string
+}
+
+func (e *protocolError) Error() string { return e.message }
+
+// decodeClientMessage parses a client frame and checks it against its registered type. On error the
+// returned message still carries the id (when it could be read) so the error frame can echo it.
+func decodeClientMessage(raw []byte) (*Message, *protocolError) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return &Message{}, &protocolError{ErrCodeBadMessage, "Message is not a JSON object."}
+	}
+	var head struct {
+		Type string `json:"type"`
+		ID   string `json:"id"`
+	}
+	_ = json.Unmarshal(raw, &head)
+	msg := &Message{Type: head.Type, ID: head.ID}
+	mt := clientRegistry[head.Type]
+	if mt == nil {
+		return msg, &protocolError{ErrCodeUnknownType, fmt.Sprintf("Unknown message type %q for protocol %s.", head.Type, ProtocolV1)}
+	}
+	allowed := map[string]bool{"type": true, "id": true}
+	for _, f := range mt.Fields {
+		allowed[f] = true
+	}
+	for name := range fields {
+		if !allowed[name] {
+			return msg, &protocolError{ErrCodeBadMessage, fmt.Sprintf("Field %q is not part of a %s message.", name, mt.Type)}
+		}
+	}
+	for _, name := range mt.Required {
+		if _, ok := fields[name]; !ok {
+			return msg, &protocolError{ErrCodeBadMessage, fmt.Sprintf("A %s message requires %q.", mt.Type, name)}
+		}
+	}
+	if err := json.Unmarshal(raw, msg); err != nil {
+		return msg, &protocolError{ErrCodeBadMessage, "Invalid field: " + err.Error()}
+	}
+	return msg, nil
+}
+
+// opErrorCode maps a document edit error to its error frame code.
+func opErrorCode(err error) string {
+	if err == ErrStaleRevision {
+		return ErrCodeStaleRevision
+	}
+	return ErrCodeInvalidOp
+}
+
+// errNoDocument answers edits when the room document could not be loaded.
+var errNoDocument = &protocolError{common.CodeInternalError, "Diagram content is not available."}
+
+// forbiddenError answers edits from clients without edit access.
+func forbiddenError(msgType string) *protocolError {
+	return &protocolError{common.CodeForbidden, msgType + " requires edit access to this diagram."}
+}
@@ -0,0 +1,54 @@
+package realtime
+
+import (
+	"testing"
+)
+
+func TestDecodeClientMessage(t *testing.T) {
+	cases := []struct {
+		raw  string
+		code string
+	}{
+		{`{"type":"text_op","id":"1","revision":3,"ops":[{"retain":1}]}`, ""},
+		{`{"type":"cursor","position":{"x":1}}`, ""},
+		{`not json`, ErrCodeBadMessage},
+		{`{"type":"paint","id":"2"}`, ErrCodeUnknownType},
+		{`{"type":"welcome","id":"3"}`, ErrCodeUnknownType},
+		{`{"type":"snapshot","id":"7","content":"graph TD"}`, ErrCodeBadMessage},
+		{`{"type":"text_op","id":"4","ops":[],"content":"x"}`, ErrCodeBadMessage},
+		{`{"type":"canvas_op","id":"5"}`, ErrCodeBadMessage},
+		{`{"type":"text_op","id":"6","revision":"3","ops":[]}`, ErrCodeBadMessage},
+	}
+	for _, tc := range cases {
+		msg, perr := decodeClientMessage([]byte(tc.raw))
+		got := ""
+		if perr != nil {
+			got = perr.code
+		}
+		if got != tc.code {
+			t.Errorf("decode %s: code %q, want %q", tc.raw, got, tc.code)
+		}
+		if perr != nil && tc.raw != "not json" && msg.ID == "" {
+			t.Errorf("decode %s: id not kept for the error frame", tc.raw)
+		}
+	}
+}
+
+func TestSchema_CoversRegistry(t *testing.T) {
+	fields := messageFields()
+	for _, types := range [][]MessageType{clientMessageTypes, serverMessageTypes} {
+		for _, mt := range types {
+			for _, f := range append(mt.Fields, mt.Required...) {
+				if _, ok := fields[f]; !ok {
+					t.Errorf("%s: field %q is not a Message field", mt.Type, f)
+				}
+			}
+		}
+	}
+	schemas := Schema()["components"].(map[string]interface{})["schemas"].(map[string]interface{})
+	for _, name := range []string{"ClientTextOp", "ServerAck", "ServerError", "ClientMessage", "ServerMessage"} {
+		if _, ok := schemas[name]; !ok {
+			t.Errorf("schema %s missing", name)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package realtime
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// publishQueueLimit bounds the frames waiting to be published for one room; more are dropped (other
+// nodes then resync from a later snapshot) rather than held in memory while the backend is down.
+const publishQueueLimit = 4096
+
+// publisher sends one room's frames to the backend in the order they were queued, so edits sequenced
+// under the room lock reach other nodes in that order without the lock being held during the I/O.
+type publisher struct {
+	queue    [][]byte
+	dropping bool // the queue is full; logged once until it drains
+}
+
+// publish queues payload for diagramID's publisher, starting one if none is running.
+func (h *Hub) publish(diagramID uuid.UUID, payload []byte) {
+	h.pubMu.Lock()
+	p := h.publishers[diagramID]
+	start := p == nil
+	if start {
+		p = &publisher{}
+		h.publishers[diagramID] = p
+	}
+	if len(p.queue) >= publishQueueLimit {
+		warn := !p.dropping
+		p.dropping = true
+		h.pubMu.Unlock()
+		if warn && h.log != nil {
+			h.log.Warn().Str("diagram_id", diagramID.String()).Msg("realtime: publish queue full, dropping frames")
+		}
+		return
+	}
+	p.queue = append(p.queue, payload)
+	h.pubMu.Unlock()
+	if start {
+		go h.runPublisher(diagramID, p)
+	}
+}
+
+// runPublisher publishes p's frames until its queue is empty, then removes it; the next frame for the
+// room starts a new one.
+func (h *Hub) runPublisher(diagramID uuid.UUID, p *publisher) {
+	for {
+		h.pubMu.Lock()
+		if len(p.queue) == 0 {
+			delete(h.publishers, diagramID)
+			h.pubMu.Unlock()
+			return
+		}
+		payload := p.queue[0]
+		p.queue[0] = nil
+		p.queue = p.queue[1:]
+		if len(p.queue) == 0 {
+			p.dropping = false
+		}
+		h.pubMu.Unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+		err := h.backend.Publish(ctx, diagramID, payload)
+		cancel()
+		if err != nil && h.log != nil {
+			h.log.Warn().Err(err).Str("diagram_id", diagramID.String()).Msg("realtime: publish failed")
+		}
+	}
+}
+
+// waitPublished waits until every queued frame was published or ctx is done.
+func (h *Hub) waitPublished(ctx context.Context) {
+	h.waitPublishers(ctx, func() bool { return len(h.publishers) == 0 })
+}
+
+// waitRoomPublished waits until the frames queued for diagramID were published or ctx is done.
+func (h *Hub) waitRoomPublished(ctx context.Context, diagramID uuid.UUID) {
+	h.waitPublishers(ctx, func() bool { return h.publishers[diagramID] == nil })
+}
+
+// waitPublishers polls idle, under pubMu, until it holds or ctx is done.
+func (h *Hub) waitPublishers(ctx context.Context, idle func() bool) {
+	ticker := time.NewTicker(drainPoll)
+	defer ticker.Stop()
+	for {
+		h.pubMu.Lock()
+		done := idle()
+		h.pubMu.Unlock()
+		if done {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// subscribeRoom starts receiving the messages other nodes publish to a room just opened on this node.
+func (h *Hub) subscribeRoom(diagramID uuid.UUID) {
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	if err := h.backend.SubscribeRoom(ctx, diagramID); err != nil && h.log != nil {
+		h.log.Warn().Err(err).Str("diagram_id", diagramID.String()).Msg("realtime: subscribe to room failed")
+	}
+}
+
+// roomDropped stops receiving the messages of a room this node dropped and, if this node ordered its
+// text ops, hands that role over.
+func (h *Hub) roomDropped(diagramID uuid.UUID, sequencer bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	if err := h.backend.UnsubscribeRoom(ctx, diagramID); err != nil && h.log != nil {
+		h.log.Warn().Err(err).Str("diagram_id", diagramID.String()).Msg("realtime: unsubscribe from room failed")
+	}
+	if sequencer {
+		go h.releaseSequencer(diagramID)
+	}
+}
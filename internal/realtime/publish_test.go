@@ -0,0 +1,115 @@
+package realtime
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/devenock/d_weaver/config"
+	"github.com/google/uuid"
+)
+
+// heldBackend records published frames; while held, Publish blocks until release is closed.
+type heldBackend struct {
+	*MemoryBackend
+	release chan struct{}
+	mu      sync.Mutex
+	held    bool
+	frames  []Message
+}
+
+func (b *heldBackend) Publish(ctx context.Context, diagramID uuid.UUID, payload []byte) error {
+	b.mu.Lock()
+	held := b.held
+	b.mu.Unlock()
+	if held {
+		<-b.release
+	}
+	var msg Message
+	_ = json.Unmarshal(payload, &msg)
+	b.mu.Lock()
+	b.frames = append(b.frames, msg)
+	b.mu.Unlock()
+	return nil
+}
+
+func TestHub_PublishesOffTheRoomLockInOrder(t *testing.T) {
+	backend := &heldBackend{MemoryBackend: NewMemoryBackend(), release: make(chan struct{})}
+	store := &memoryStore{diagramType: "flowchart", content: "graph LR"}
+	hub := NewHub(store, nil, backend, config.RealtimeConfig{}, nil)
+	diagramID := uuid.New()
+	a := newTestClient(hub, diagramID)
+	hub.Register(a)
+	hub.waitPublished(context.Background())
+
+	backend.mu.Lock()
+	backend.held, backend.frames = true, nil
+	backend.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		hub.ApplyTextOp(a, "1", 0, TextOperation{{Retain: 8}, {Insert: "\n  A"}})
+		hub.ApplyTextOp(a, "2", 1, TextOperation{{Retain: 12}, {Insert: "-->B"}})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("edits blocked on a stalled backend publish")
+	}
+
+	close(backend.release)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	hub.waitPublished(ctx)
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+	if len(backend.frames) != 2 || backend.frames[0].Revision != 1 || backend.frames[1].Revision != 2 {
+		t.Errorf("published = %+v, want text ops 1 and 2 in order", backend.frames)
+	}
+}
+
+// subscriptionBackend counts room subscriptions.
+type subscriptionBackend struct {
+	*MemoryBackend
+	mu           sync.Mutex
+	subscribed   int
+	unsubscribed int
+}
+
+func (b *subscriptionBackend) SubscribeRoom(ctx context.Context, diagramID uuid.UUID) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subscribed++
+	return nil
+}
+
+func (b *subscriptionBackend) UnsubscribeRoom(ctx context.Context, diagramID uuid.UUID) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.unsubscribed++
+	return nil
+}
+
+func TestHub_SubscribesWhileRoomIsOpen(t *testing.T) {
+	backend := &subscriptionBackend{MemoryBackend: NewMemoryBackend()}
+	hub := NewHub(nil, nil, backend, config.RealtimeConfig{}, nil)
+	diagramID := uuid.New()
+	a, b := newTestClient(hub, diagramID), newTestClient(hub, diagramID)
+	hub.Register(a)
+	hub.Register(b)
+	hub.Unregister(a)
+	backend.mu.Lock()
+	if backend.subscribed != 1 || backend.unsubscribed != 0 {
+		t.Errorf("with a client left: %d subscribed, %d unsubscribed; want 1 and 0", backend.subscribed, backend.unsubscribed)
+	}
+	backend.mu.Unlock()
+
+	hub.Unregister(b)
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+	if backend.unsubscribed != 1 {
+		t.Errorf("after the room was dropped: %d unsubscribed, want 1", backend.unsubscribed)
+	}
+}
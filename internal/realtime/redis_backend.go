@@ -0,0 +1,244 @@
+package realtime
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/devenock/d_weaver/pkg/logger"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	redisRoomChannelPrefix = "dweaver:realtime:room:"
+	redisPresenceKeyPrefix = "dweaver:realtime:presence:"
+	redisSequencerPrefix   = "dweaver:realtime:sequencer:"
+	// presenceTTL is how long a node's presence entries survive without a refresh (e.g. after a crash).
+	presenceTTL = 60 * time.Second
+	// sequencerTTL is how long a sequencer claim survives without a renewal; hubs renew every heartbeat.
+	sequencerTTL = 2 * sessionHeartbeat
+)
+
+// claimSequencerScript renews the claim when this node (ARGV[1]) holds it, else takes it when free.
+var claimSequencerScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	redis.call("PEXPIRE", KEYS[1], ARGV[2])
+	return 1
+end
+if redis.call("SET", KEYS[1], ARGV[1], "NX", "PX", ARGV[2]) then
+	return 1
+end
+return 0`)
+
+// releaseSequencerScript deletes the claim only when this node (ARGV[1]) holds it.
+var releaseSequencerScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+
+// redisEnvelope wraps a room message with the publishing node so nodes can skip their own messages.
+type redisEnvelope struct {
+	Node    string          `json:"node"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// redisPresenceEntry is one connection in a room's presence hash.
+type redisPresenceEntry struct {
+	User      UserPresence `json:"user"`
+	Node      string       `json:"node"`
+	ExpiresAt int64        `json:"expires_at"` // unix seconds
+}
+
+type localPresence struct {
+	diagramID uuid.UUID
+	user      UserPresence
+}
+
+// RedisBackend publishes room messages on one Redis channel per diagram and keeps presence in a
+// Redis hash per diagram, so clients on different API replicas share rooms. A node subscribes only to
+// the channels of rooms it has open.
+type RedisBackend struct {
+	client *redis.Client
+	node   string
+	log    logger.Logger
+	pubsub *redis.PubSub // connects on the first room subscription
+
+	mu    sync.Mutex
+	local map[string]localPresence // connID -> entry this node owns (refreshed until Leave)
+
+	subMu sync.Mutex
+	rooms map[uuid.UUID]int // diagramID -> SubscribeRoom calls not yet matched by UnsubscribeRoom
+}
+
+// NewRedisBackend returns a Backend using the given client. client must not be nil; log may be nil.
+func NewRedisBackend(client *redis.Client, log logger.Logger) *RedisBackend {
+	return &RedisBackend{
+		client: client,
+		node:   uuid.New().String(),
+		log:    log,
+		pubsub: client.Subscribe(context.Background()),
+		local:  make(map[string]localPresence),
+		rooms:  make(map[uuid.UUID]int),
+	}
+}
+
+func roomChannel(diagramID uuid.UUID) string {
+	return redisRoomChannelPrefix + diagramID.String()
+}
+
+func presenceKey(diagramID uuid.UUID) string {
+	return redisPresenceKeyPrefix + diagramID.String()
+}
+
+func sequencerKey(diagramID uuid.UUID) string {
+	return redisSequencerPrefix + diagramID.String()
+}
+
+// Publish sends the payload on the diagram's channel.
+func (b *RedisBackend) Publish(ctx context.Context, diagramID uuid.UUID, payload []byte) error {
+	data, err := json.Marshal(redisEnvelope{Node: b.node, Payload: payload})
+	if err != nil {
+		return err
+	}
+	return b.client.Publish(ctx, roomChannel(diagramID), data).Err()
+}
+
+// Subscribe delivers messages from other nodes on the subscribed room channels until ctx is done, then
+// closes the subscription. It also keeps this node's presence entries alive.
+func (b *RedisBackend) Subscribe(ctx context.Context, deliver func(diagramID uuid.UUID, payload []byte)) {
+	defer b.pubsub.Close()
+	ch := b.pubsub.Channel()
+	refresh := time.NewTicker(presenceTTL / 3)
+	defer refresh.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-refresh.C:
+			b.refreshPresence(ctx)
+		case msg, ok := <-ch:
+			if !ok {
+				return
+			}
+			diagramID, err := uuid.Parse(strings.TrimPrefix(msg.Channel, redisRoomChannelPrefix))
+			if err != nil {
+				continue
+			}
+			var env redisEnvelope
+			if err := json.Unmarshal([]byte(msg.Payload), &env); err != nil || env.Node == b.node {
+				continue
+			}
+			deliver(diagramID, env.Payload)
+		}
+	}
+}
+
+// SubscribeRoom subscribes to the diagram's channel unless this node already is. A failed SUBSCRIBE is
+// retried when the subscription reconnects.
+func (b *RedisBackend) SubscribeRoom(ctx context.Context, diagramID uuid.UUID) error {
+	b.subMu.Lock()
+	defer b.subMu.Unlock()
+	b.rooms[diagramID]++
+	if b.rooms[diagramID] != 1 {
+		return nil
+	}
+	return b.pubsub.Subscribe(ctx, roomChannel(diagramID))
+}
+
+// UnsubscribeRoom unsubscribes from the diagram's channel once no SubscribeRoom call is left unmatched.
+func (b *RedisBackend) UnsubscribeRoom(ctx context.Context, diagramID uuid.UUID) error {
+	b.subMu.Lock()
+	defer b.subMu.Unlock()
+	b.rooms[diagramID]--
+	if b.rooms[diagramID] != 0 {
+		return nil
+	}
+	delete(b.rooms, diagramID)
+	return b.pubsub.Unsubscribe(ctx, roomChannel(diagramID))
+}
+
+// Join adds the connection to the diagram's presence hash.
+func (b *RedisBackend) Join(ctx context.Context, diagramID uuid.UUID, connID string, p UserPresence) error {
+	b.mu.Lock()
+	b.local[connID] = localPresence{diagramID: diagramID, user: p}
+	b.mu.Unlock()
+	return b.writePresence(ctx, diagramID, connID, p)
+}
+
+// Leave removes the connection from the diagram's presence hash.
+func (b *RedisBackend) Leave(ctx context.Context, diagramID uuid.UUID, connID string) error {
+	b.mu.Lock()
+	delete(b.local, connID)
+	b.mu.Unlock()
+	return b.client.HDel(ctx, presenceKey(diagramID), connID).Err()
+}
+
+// Presence returns live entries from every node and prunes expired ones.
+func (b *RedisBackend) Presence(ctx context.Context, diagramID uuid.UUID) ([]UserPresence, error) {
+	key := presenceKey(diagramID)
+	all, err := b.client.HGetAll(ctx, key).Result()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().Unix()
+	users := make([]UserPresence, 0, len(all))
+	var stale []string
+	for connID, raw := range all {
+		var e redisPresenceEntry
+		if err := json.Unmarshal([]byte(raw), &e); err != nil || e.ExpiresAt < now {
+			stale = append(stale, connID)
+			continue
+		}
+		users = append(users, e.User)
+	}
+	if len(stale) > 0 {
+		_ = b.client.HDel(ctx, key, stale...).Err()
+	}
+	return users, nil
+}
+
+// ClaimSequencer takes or renews the room's sequencer key for this node.
+func (b *RedisBackend) ClaimSequencer(ctx context.Context, diagramID uuid.UUID) (bool, error) {
+	held, err := claimSequencerScript.Run(ctx, b.client, []string{sequencerKey(diagramID)}, b.node, sequencerTTL.Milliseconds()).Int()
+	if err != nil {
+		return false, err
+	}
+	return held == 1, nil
+}
+
+// ReleaseSequencer deletes the room's sequencer key if this node holds it.
+func (b *RedisBackend) ReleaseSequencer(ctx context.Context, diagramID uuid.UUID) error {
+	return releaseSequencerScript.Run(ctx, b.client, []string{sequencerKey(diagramID)}, b.node).Err()
+}
+
+func (b *RedisBackend) writePresence(ctx context.Context, diagramID uuid.UUID, connID string, p UserPresence) error {
+	data, err := json.Marshal(redisPresenceEntry{User: p, Node: b.node, ExpiresAt: time.Now().Add(presenceTTL).Unix()})
+	if err != nil {
+		return err
+	}
+	key := presenceKey(diagramID)
+	if err := b.client.HSet(ctx, key, connID, data).Err(); err != nil {
+		return err
+	}
+	return b.client.Expire(ctx, key, presenceTTL).Err()
+}
+
+func (b *RedisBackend) refreshPresence(ctx context.Context) {
+	b.mu.Lock()
+	entries := make(map[string]localPresence, len(b.local))
+	for connID, lp := range b.local {
+		entries[connID] = lp
+	}
+	b.mu.Unlock()
+	for connID, lp := range entries {
+		if err := b.writePresence(ctx, lp.diagramID, connID, lp.user); err != nil && b.log != nil {
+			b.log.Warn().Err(err).Str("diagram_id", lp.diagramID.String()).Msg("realtime: refresh presence failed")
+		}
+	}
+}
+
+var _ Backend = (*RedisBackend)(nil)
@@ -0,0 +1,49 @@
+package realtime
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const redisTicketKeyPrefix = "dweaver:realtime:ticket:"
+
+// RedisTicketStore keeps tickets in Redis so a ticket issued by one replica can be redeemed on another.
+type RedisTicketStore struct {
+	client *redis.Client
+}
+
+// NewRedisTicketStore returns a TicketStore using the given client. client must not be nil.
+func NewRedisTicketStore(client *redis.Client) *RedisTicketStore {
+	return &RedisTicketStore{client: client}
+}
+
+// Put stores the ticket with a Redis expiry of ttl.
+func (s *RedisTicketStore) Put(ctx context.Context, id string, t Ticket, ttl time.Duration) error {
+	data, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	return s.client.Set(ctx, redisTicketKeyPrefix+id, data, ttl).Err()
+}
+
+// Take redeems the ticket with GETDEL so two sockets can never share it.
+func (s *RedisTicketStore) Take(ctx context.Context, id string) (*Ticket, error) {
+	data, err := s.client.GetDel(ctx, redisTicketKeyPrefix+id).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var t Ticket
+	if err := json.Unmarshal(data, &t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+var _ TicketStore = (*RedisTicketStore)(nil)
@@ -0,0 +1,84 @@
+package realtime
+
+import (
+	"encoding/json"
+
+	"github.com/google/uuid"
+)
+
+// replayBufferSize bounds how many recent frames each room keeps for clients resuming after a reconnect.
+const replayBufferSize = 512
+
+// replayEntry is a sequenced frame as delivered on this node.
+type replayEntry struct {
+	seq     uint64
+	payload []byte
+	origin  string // connection the room event was not sent to (its sender); "" if none
+	target  string // only connection the frame was sent to (acks); "" for room events
+}
+
+// sequence assigns the next room sequence number to msg, records it for replay and returns the
+// encoded frame. Caller holds r.replayMu.
+func (r *room) sequence(msg *Message, origin, target string) ([]byte, error) {
+	r.seq++
+	msg.Seq = r.seq
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	r.replay = append(r.replay, replayEntry{seq: r.seq, payload: payload, origin: origin, target: target})
+	if len(r.replay) > replayBufferSize {
+		r.replay = append([]replayEntry(nil), r.replay[len(r.replay)-replayBufferSize:]...)
+	}
+	return payload, nil
+}
+
+// sendAck sequences an ack for c so a resumed connection can recover acks its predecessor missed.
+// Caller holds r.mu.
+func (h *Hub) sendAck(c *Client, r *room, msg *Message) {
+	r.replayMu.Lock()
+	defer r.replayMu.Unlock()
+	payload, err := r.sequence(msg, "", c.id)
+	if err != nil {
+		return
+	}
+	c.Send(payload)
+}
+
+// Resume replays to c what its previous connection (connID, in room epoch) missed after seq, up to
+// the point c joined; later frames reach c live. When the gap is no longer buffered, or the room was
+// recreated (e.g. the client reconnected to another replica), c is told to resync and sent a snapshot.
+func (h *Hub) Resume(c *Client, id string, seq uint64, connID, epoch string) {
+	r := h.roomOf(c.diagramID)
+	if r == nil {
+		h.sendError(c, id, errNoDocument)
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.replayMu.Lock()
+	defer r.replayMu.Unlock()
+	if epoch != r.epoch || seq > c.joinSeq || (seq < c.joinSeq && (len(r.replay) == 0 || r.replay[0].seq > seq+1)) {
+		c.Send(mustMarshal(&Message{Type: "resync", ID: id, Seq: r.seq}))
+		if r.doc != nil {
+			c.Send(mustMarshal(&Message{Type: "snapshot", DiagramType: r.doc.diagramType, Content: r.doc.content(), Revision: r.doc.revision, Updates: r.doc.updateLog(), Seq: r.seq}))
+		}
+		return
+	}
+	for _, e := range r.replay {
+		if e.seq <= seq || e.seq > c.joinSeq || e.origin == connID || (e.target != "" && e.target != connID) {
+			continue
+		}
+		c.Send(e.payload)
+	}
+	c.Send(mustMarshal(&Message{Type: "ack", ID: id, Seq: c.joinSeq}))
+}
+
+func mustMarshal(msg *Message) []byte {
+	payload, _ := json.Marshal(msg)
+	return payload
+}
+
+func newRoom() *room {
+	return &room{clients: make(map[*Client]struct{}), epoch: uuid.New().String()}
+}
@@ -0,0 +1,70 @@
+package realtime
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/devenock/d_weaver/config"
+	"github.com/google/uuid"
+)
+
+func newTestClient(hub *Hub, diagramID uuid.UUID) *Client {
+	return &Client{hub: hub, id: uuid.New().String(), out: hub.newOutbox(), diagramID: diagramID, userID: uuid.New()}
+}
+
+// drain returns the frames queued for c.
+func drain(t *testing.T, c *Client) []Message {
+	frames, _ := c.out.take()
+	out := make([]Message, len(frames))
+	for i, raw := range frames {
+		if err := json.Unmarshal(raw, &out[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return out
+}
+
+func TestHub_Resume(t *testing.T) {
+	hub := NewHub(nil, nil, nil, config.RealtimeConfig{}, nil)
+	diagramID := uuid.New()
+	a, b := newTestClient(hub, diagramID), newTestClient(hub, diagramID)
+	hub.Register(a)
+	hub.Register(b)
+	frames := drain(t, a)
+	welcome := frames[0]
+	if welcome.Type != "welcome" || welcome.ConnID != a.id {
+		t.Fatalf("first frame = %+v, want welcome", welcome)
+	}
+	lastSeen := frames[len(frames)-1].Seq // b's join
+
+	hub.Unregister(a)
+	hub.BroadcastCursor(b, json.RawMessage(`{"x":1}`))
+	hub.BroadcastCursor(b, json.RawMessage(`{"x":2}`))
+
+	again := newTestClient(hub, diagramID)
+	again.userID = a.userID
+	hub.Register(again)
+	drain(t, again)
+	hub.BroadcastCursor(b, json.RawMessage(`{"x":3}`)) // after joining: delivered live, not replayed
+	drain(t, again)
+
+	hub.Resume(again, "r1", lastSeen, a.id, welcome.Epoch)
+	var cursors []string
+	frames = drain(t, again)
+	for _, m := range frames {
+		if m.Type == "cursor" {
+			cursors = append(cursors, string(m.Position))
+		}
+	}
+	if len(cursors) != 2 || cursors[0] != `{"x":1}` || cursors[1] != `{"x":2}` {
+		t.Errorf("replayed cursors = %v, want x:1 and x:2", cursors)
+	}
+	if last := frames[len(frames)-1]; last.Type != "ack" || last.ID != "r1" {
+		t.Errorf("last frame = %+v, want ack r1", last)
+	}
+
+	hub.Resume(again, "r2", lastSeen, a.id, "other-epoch")
+	if frames := drain(t, again); len(frames) == 0 || frames[0].Type != "resync" || frames[0].ID != "r2" {
+		t.Errorf("resume across epochs = %+v, want resync", frames)
+	}
+}
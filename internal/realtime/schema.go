@@ -0,0 +1,243 @@
+package realtime
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// protocolDescription is the prose part of the generated schema; message shapes come from the registry.
+var protocolDescription = `Upgrade to WebSocket for real-time collaboration on a diagram.
+Auth: query param ` + "`?ticket=<ticket>`" + ` from POST /api/v1/realtime/tickets (single use, 30 seconds, bound to the user,
+diagram and client IP; forwarded IPs count only from server.trusted_proxies), header
+` + "`Authorization: Bearer <access_token>`" + `, the access_token cookie, or query param ` + "`?token=<access_token>`" + ` unless disabled
+with REALTIME_ALLOW_QUERY_TOKEN=false. Browsers may only connect from the CORS origins.
+Protocol: offer ` + "`Sec-WebSocket-Protocol: " + ProtocolV1 + "`" + `. Connections without a subprotocol are served ` + ProtocolV1 + `;
+connections offering only unknown versions are refused with 400.
+Frames are JSON objects with a ` + "`type`" + ` (see ClientMessage and ServerMessage). A client frame may carry an ` + "`id`" + `;
+edits (text_op, canvas_op, crdt_update) are always answered by one ` + "`ack`" + ` or ` + "`error`" + ` frame echoing it, other frames
+only when they carry an id. Unknown types, malformed JSON and fields a type does not carry are answered with an error frame.
+Edits that cannot be applied are answered with an error frame and a fresh snapshot to resync from.
+Reconnect: the first frame of a connection is welcome (conn_id, room epoch, seq). Room frames and acks carry increasing
+sequence numbers and the last ` + fmt.Sprint(replayBufferSize) + ` are kept per room. After reconnecting, send resume with the
+previous connection's conn_id and epoch and the last seq it saw to receive what it missed (then an ack); if that is no longer
+buffered, or the room was recreated or lives on another replica, the server answers resync and a snapshot to reset to.
+Slow clients: when more than realtime.slow_consumer_max_lag frames are queued for a client the server drops the oldest,
+coalesces cursor frames per user, or closes the socket with 1008 (realtime.slow_consumer_policy); resume to catch up.
+Mermaid content is edited with text operations (ot.js style) transformed against concurrent ops. Whiteboard and visual
+diagrams (Fabric canvas JSON) are edited by object id and merged through a CRDT (per-object last-writer-wins value and
+z-order registers, Lamport clocks); the compacted update log is stored in diagram_crdt_states.
+The server persists room content once edits pause for realtime.autosave_debounce_ms (default 2000), at the latest
+realtime.snapshot_interval_seconds (default 10) after the first unsaved edit while editing continues, and when the last
+client leaves; every save is announced with a saved frame (revision, saved_at).
+Permissions: edit is the diagram owner and workspace owners/admins, comment is workspace members, view is workspace viewers
+and visitors of public diagrams. Edits need edit access (error code forbidden). When a workspace role changes a new
+permission frame is sent; a client that lost access is disconnected with close code 1008.
+Scaling: with REDIS_URL set rooms span API replicas over Redis pub/sub (a replica subscribes to a diagram's channel
+while the room is open on it) and presence lists users on every replica. One
+replica per diagram (claimed in Redis, taken over when it leaves) orders Mermaid text ops; the others forward their clients'
+edits to it and resync their clients with resync and a snapshot when they miss one of its ops.
+Presence is persisted to collaboration_sessions (join, cursor at most every 5s, 30s heartbeat, removed on leave, stale rows
+expire after 2 minutes) and readable via GET /api/v1/diagrams/{id}/presence and GET /api/v1/workspaces/{id}/presence.`
+
+// Schema returns the OpenAPI 3.0 document of the collaboration socket. Message schemas are generated
+// from Message and the message type registries, so they always match what the server accepts and sends.
+func Schema() map[string]interface{} {
+	schemas := map[string]interface{}{}
+	client := addMessageSchemas(schemas, "Client", clientMessageTypes, true)
+	server := addMessageSchemas(schemas, "Server", serverMessageTypes, false)
+	schemas["ClientMessage"] = oneOf(client)
+	schemas["ServerMessage"] = oneOf(server)
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":       "DWeaver Real-time API",
+			"description": "WebSocket collaboration for diagrams. Connect to /ws/collaboration/:diagramId with auth.",
+			"version":     ProtocolV1,
+		},
+		"servers": []interface{}{map[string]interface{}{"url": "/", "description": "API root (WebSocket path is absolute)"}},
+		"tags":    []interface{}{map[string]interface{}{"name": "realtime", "description": "WebSocket collaboration"}},
+		"paths": map[string]interface{}{
+			"/ws/collaboration/{diagramId}": map[string]interface{}{
+				"get": map[string]interface{}{
+					"tags":        []string{"realtime"},
+					"summary":     "WebSocket collaboration",
+					"description": protocolDescription,
+					"operationId": "wsCollaboration",
+					"parameters": []interface{}{
+						map[string]interface{}{"name": "diagramId", "in": "path", "required": true, "schema": map[string]interface{}{"type": "string", "format": "uuid"}},
+						map[string]interface{}{"name": "ticket", "in": "query", "required": false, "description": "Single-use ticket from POST /api/v1/realtime/tickets", "schema": map[string]interface{}{"type": "string"}},
+						map[string]interface{}{"name": "token", "in": "query", "required": false, "description": "JWT access token (alternative to Authorization header; can be disabled)", "schema": map[string]interface{}{"type": "string"}},
+						map[string]interface{}{"name": "Sec-WebSocket-Protocol", "in": "header", "required": false, "description": "Protocol version", "schema": map[string]interface{}{"type": "string", "enum": Subprotocols}},
+					},
+					"responses": map[string]interface{}{
+						"101": map[string]interface{}{"description": "Switching Protocols (WebSocket); frames are ClientMessage and ServerMessage"},
+						"400": map[string]interface{}{"description": "Invalid diagram ID or unsupported protocol version"},
+						"401": map[string]interface{}{"description": "Missing or invalid token or ticket"},
+						"403": map[string]interface{}{"description": "No access to diagram, or origin not allowed"},
+						"404": map[string]interface{}{"description": "Diagram not found"},
+					},
+				},
+			},
+			"/api/v1/realtime/tickets": map[string]interface{}{
+				"post": map[string]interface{}{
+					"tags":        []string{"realtime"},
+					"summary":     "Issue a WebSocket ticket",
+					"description": "Returns a single-use ticket, valid for 30 seconds, for opening /ws/collaboration/{diagramId} from the same client IP. Requires Authorization: Bearer.",
+					"operationId": "createRealtimeTicket",
+					"requestBody": map[string]interface{}{
+						"required": true,
+						"content": map[string]interface{}{"application/json": map[string]interface{}{"schema": map[string]interface{}{
+							"type":       "object",
+							"required":   []string{"diagram_id"},
+							"properties": map[string]interface{}{"diagram_id": map[string]interface{}{"type": "string", "format": "uuid"}},
+						}}},
+					},
+					"responses": map[string]interface{}{
+						"201": map[string]interface{}{
+							"description": "Ticket issued",
+							"content": map[string]interface{}{"application/json": map[string]interface{}{"schema": map[string]interface{}{
+								"type": "object",
+								"properties": map[string]interface{}{"data": map[string]interface{}{
+									"type": "object",
+									"properties": map[string]interface{}{
+										"ticket":     map[string]interface{}{"type": "string"},
+										"expires_at": map[string]interface{}{"type": "string", "format": "date-time"},
+									},
+								}},
+							}}},
+						},
+						"400": map[string]interface{}{"description": "Missing or invalid diagram_id"},
+						"401": map[string]interface{}{"description": "Missing or invalid token"},
+						"403": map[string]interface{}{"description": "No access to diagram"},
+						"404": map[string]interface{}{"description": "Diagram not found"},
+					},
+				},
+			},
+		},
+		"components": map[string]interface{}{"schemas": schemas},
+	}
+}
+
+// ServeSchema writes the generated realtime OpenAPI 3.0 spec (JSON).
+func ServeSchema(c *gin.Context) {
+	c.JSON(http.StatusOK, Schema())
+}
+
+// addMessageSchemas adds one schema per message type (named prefix + CamelCase type) and returns their names.
+func addMessageSchemas(schemas map[string]interface{}, prefix string, types []MessageType, fromClient bool) []string {
+	fieldTypes := messageFields()
+	names := make([]string, 0, len(types))
+	for _, mt := range types {
+		props := map[string]interface{}{
+			"type": map[string]interface{}{"type": "string", "enum": []string{mt.Type}},
+		}
+		required := append([]string{"type"}, mt.Required...)
+		if fromClient || mt.Type == "ack" || mt.Type == "error" {
+			props["id"] = fieldTypes["id"]
+		}
+		for _, f := range mt.Fields {
+			props[f] = fieldTypes[f]
+		}
+		name := prefix + camel(mt.Type)
+		schemas[name] = map[string]interface{}{
+			"type":                 "object",
+			"description":          mt.Description,
+			"properties":           props,
+			"required":             required,
+			"additionalProperties": false,
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+func oneOf(names []string) map[string]interface{} {
+	refs := make([]interface{}, len(names))
+	for i, n := range names {
+		refs[i] = map[string]interface{}{"$ref": "#/components/schemas/" + n}
+	}
+	return map[string]interface{}{"oneOf": refs, "discriminator": map[string]interface{}{"propertyName": "type"}}
+}
+
+// messageFields returns the schema of each Message field by JSON name, described by its desc tag.
+func messageFields() map[string]map[string]interface{} {
+	t := reflect.TypeOf(Message{})
+	out := make(map[string]map[string]interface{}, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		s := typeSchema(f.Type)
+		if d := f.Tag.Get("desc"); d != "" {
+			s["description"] = d
+		}
+		out[jsonName(f)] = s
+	}
+	return out
+}
+
+var rawMessageType = reflect.TypeOf(json.RawMessage{})
+
+// typeSchema maps a Go type to its JSON schema (the subset used by Message).
+func typeSchema(t reflect.Type) map[string]interface{} {
+	if t == rawMessageType {
+		return map[string]interface{}{}
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": typeSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": typeSchema(t.Elem())}
+	case reflect.Ptr:
+		return typeSchema(t.Elem())
+	case reflect.Struct:
+		props := map[string]interface{}{}
+		var required []string
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" || jsonName(f) == "-" {
+				continue
+			}
+			props[jsonName(f)] = typeSchema(f.Type)
+			if !strings.Contains(f.Tag.Get("json"), "omitempty") {
+				required = append(required, jsonName(f))
+			}
+		}
+		s := map[string]interface{}{"type": "object", "properties": props}
+		if len(required) > 0 {
+			s["required"] = required
+		}
+		return s
+	}
+	return map[string]interface{}{}
+}
+
+func jsonName(f reflect.StructField) string {
+	name := strings.Split(f.Tag.Get("json"), ",")[0]
+	if name == "" {
+		return f.Name
+	}
+	return name
+}
+
+// camel turns a snake_case message type into CamelCase (text_op -> TextOp).
+func camel(s string) string {
+	parts := strings.Split(s, "_")
+	for i, p := range parts {
+		if p != "" {
+			parts[i] = strings.ToUpper(p[:1]) + p[1:]
+		}
+	}
+	return strings.Join(parts, "")
+}
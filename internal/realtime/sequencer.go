@@ -0,0 +1,223 @@
+package realtime
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/google/uuid"
+)
+
+// Mermaid text ops are ordered by one node per room, the sequencer (claimed through the backend). Other
+// nodes forward their clients' ops to it as text_op_request and apply only the text_ops it publishes, in
+// revision order; on a gap they ask it for a snapshot (sync_request) and resync their clients. Canvas
+// rooms need no sequencer: their CRDT merges converge in any order.
+
+// errResyncing answers text edits on a node whose copy of the document is waiting for the sequencer.
+var errResyncing = &protocolError{ErrCodeStaleRevision, "The document is resyncing; a snapshot follows."}
+
+// nodeMessageTypes are exchanged between nodes only and never relayed to clients.
+var nodeMessageTypes = map[string]bool{
+	"text_op_request":    true, // a client's op for the sequencer (id and conn_id identify the sender)
+	"text_op_rejected":   true, // the sequencer could not apply a forwarded op (code, error)
+	"sync_request":       true, // a node wants the sequencer's document
+	"sequencer_released": true, // the sequencer dropped the room; nodes still in it claim it
+	"content_replaced":   true, // content was saved outside the socket (see ContentReplaced)
+}
+
+// isTextRoom reports whether the room holds a Mermaid document, whose ops need a sequencer. Caller holds r.mu.
+func (r *room) isTextRoom() bool {
+	return r.doc != nil && !r.doc.isCanvas()
+}
+
+// claimSequencer claims or renews the room's sequencer role for this node and adopts the result.
+func (h *Hub) claimSequencer(diagramID uuid.UUID) {
+	r := h.roomOf(diagramID)
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	text := r.isTextRoom()
+	r.mu.Unlock()
+	if !text {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	held, err := h.backend.ClaimSequencer(ctx, diagramID)
+	if err != nil {
+		if h.log != nil {
+			h.log.Warn().Err(err).Str("diagram_id", diagramID.String()).Msg("realtime: claim sequencer failed")
+		}
+		return
+	}
+	r.mu.Lock()
+	if h.roomOf(diagramID) == r {
+		h.setSequencer(diagramID, r, held)
+	}
+	r.mu.Unlock()
+}
+
+// setSequencer records whether this node orders the room's text ops. A node taking over publishes its
+// document so the others line up with its revisions; a node that is not the sequencer asks it for its
+// document until it has one. Caller holds r.mu.
+func (h *Hub) setSequencer(diagramID uuid.UUID, r *room, held bool) {
+	switch {
+	case held && !r.sequencer:
+		r.sequencer, r.synced = true, true
+		h.publishDocument(diagramID, r)
+	case !held && r.sequencer:
+		r.sequencer = false
+		h.lostSync(diagramID, r)
+	case !held && !r.synced:
+		h.lostSync(diagramID, r)
+	}
+}
+
+// lostSync marks this node's copy of the document as out of step and asks the sequencer for its
+// document. Caller holds r.mu.
+func (h *Hub) lostSync(diagramID uuid.UUID, r *room) {
+	r.synced = false
+	h.publish(diagramID, mustMarshal(&Message{Type: "sync_request"}))
+}
+
+// publishDocument sends the room document to the other nodes only. Caller holds r.mu.
+func (h *Hub) publishDocument(diagramID uuid.UUID, r *room) {
+	h.publish(diagramID, mustMarshal(&Message{Type: "snapshot", DiagramType: r.doc.diagramType, Content: r.doc.content(), Revision: r.doc.revision}))
+}
+
+// forwardTextOp sends c's op, based on revision, to the sequencer; c is acked once the sequencer's
+// text_op comes back. Caller holds r.mu.
+func (h *Hub) forwardTextOp(c *Client, r *room, id string, revision int, op TextOperation) {
+	if !r.synced {
+		h.sendError(c, id, errResyncing)
+		return
+	}
+	h.publish(c.diagramID, mustMarshal(&Message{Type: "text_op_request", ID: id, ConnID: c.id, UserID: c.userID.String(), Revision: revision, Ops: op}))
+}
+
+// deliverRemoteText handles a text sequencing message from another node and reports whether msg was
+// one. Caller holds r.mu and r is a text room.
+func (h *Hub) deliverRemoteText(diagramID uuid.UUID, r *room, msg *Message) bool {
+	switch msg.Type {
+	case "text_op_request":
+		if r.sequencer {
+			h.applyForwardedTextOp(diagramID, r, msg)
+		}
+	case "text_op":
+		// A sequencer ignores ops ordered elsewhere: a node that wrongly still claims the room
+		// finds out on its next renewal and resyncs.
+		if r.sequencer || !r.synced || msg.Revision <= r.doc.revision {
+			return true
+		}
+		if msg.Revision != r.doc.revision+1 {
+			h.lostSync(diagramID, r)
+			return true
+		}
+		if _, _, err := r.doc.applyText(r.doc.revision, msg.Ops); err != nil {
+			h.lostSync(diagramID, r)
+			return true
+		}
+		origin := r.client(msg.ConnID)
+		id := msg.ID
+		msg.ID, msg.ConnID = "", ""
+		h.deliverLocal(diagramID, msg, origin)
+		if origin != nil {
+			h.sendAck(origin, r, &Message{Type: "ack", ID: id, Revision: msg.Revision})
+		}
+	case "text_op_rejected":
+		if c := r.client(msg.ConnID); c != nil {
+			h.sendError(c, msg.ID, &protocolError{msg.Code, msg.Error})
+			h.sendSnapshotTo(c, r)
+		}
+	case "snapshot":
+		if r.sequencer {
+			return true
+		}
+		if msg.Revision == r.doc.revision && msg.Content == r.doc.content() {
+			r.synced = true
+			return true
+		}
+		inOrder := r.synced && msg.Revision == r.doc.revision+1
+		r.doc.reset(msg.Content, nil, msg.Revision)
+		r.synced = true
+		if !inOrder {
+			h.deliverLocal(diagramID, &Message{Type: "resync"}, nil)
+		}
+		h.deliverLocal(diagramID, msg, nil)
+	case "sync_request":
+		if r.sequencer {
+			h.publishDocument(diagramID, r)
+		}
+	case "sequencer_released":
+		go h.claimSequencer(diagramID)
+	default:
+		return false
+	}
+	return true
+}
+
+// applyForwardedTextOp applies an op another node forwarded, like ApplyTextOp does for local clients:
+// this node's clients get the text_op, the other nodes get it with the sender's id and conn_id so its
+// node can ack it. Caller holds r.mu and is the sequencer.
+func (h *Hub) applyForwardedTextOp(diagramID uuid.UUID, r *room, msg *Message) {
+	applied, rev, err := r.doc.applyText(msg.Revision, msg.Ops)
+	if err != nil {
+		h.publish(diagramID, mustMarshal(&Message{Type: "text_op_rejected", ID: msg.ID, ConnID: msg.ConnID, Code: opErrorCode(err), Error: err.Error()}))
+		return
+	}
+	if userID, err := uuid.Parse(msg.UserID); err == nil {
+		r.markDirty(userID)
+	}
+	h.publish(diagramID, mustMarshal(&Message{Type: "text_op", ID: msg.ID, ConnID: msg.ConnID, UserID: msg.UserID, Revision: rev, Ops: applied}))
+	h.deliverLocal(diagramID, &Message{Type: "text_op", UserID: msg.UserID, Revision: rev, Ops: applied}, nil)
+}
+
+// client returns the room's client with connection id connID, or nil. Caller holds r.mu.
+func (r *room) client(connID string) *Client {
+	if connID == "" {
+		return nil
+	}
+	for c := range r.clients {
+		if c.id == connID {
+			return c
+		}
+	}
+	return nil
+}
+
+// releaseSequencer gives up the claim on a room this node dropped, once the room's queued frames are
+// published, and tells the nodes still in it to claim it.
+func (h *Hub) releaseSequencer(diagramID uuid.UUID) {
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	h.waitRoomPublished(ctx, diagramID)
+	if h.roomOf(diagramID) != nil {
+		return // reopened here meanwhile; the new room keeps the claim
+	}
+	if err := h.backend.ReleaseSequencer(ctx, diagramID); err != nil {
+		if h.log != nil {
+			h.log.Warn().Err(err).Str("diagram_id", diagramID.String()).Msg("realtime: release sequencer failed")
+		}
+		return
+	}
+	payload, err := json.Marshal(Message{Type: "sequencer_released"})
+	if err != nil {
+		return
+	}
+	if err := h.backend.Publish(ctx, diagramID, payload); err != nil && h.log != nil {
+		h.log.Warn().Err(err).Str("diagram_id", diagramID.String()).Msg("realtime: publish sequencer release failed")
+	}
+}
+
+// renewSequencers renews or re-claims the sequencer role of every text room on this node.
+func (h *Hub) renewSequencers() {
+	h.mu.RLock()
+	ids := make([]uuid.UUID, 0, len(h.rooms))
+	for id := range h.rooms {
+		ids = append(ids, id)
+	}
+	h.mu.RUnlock()
+	for _, id := range ids {
+		h.claimSequencer(id)
+	}
+}
@@ -0,0 +1,190 @@
+package realtime
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/devenock/d_weaver/config"
+	"github.com/google/uuid"
+)
+
+// cluster links hubs in one process: a node's Publish is delivered to every other node before it
+// returns, and the first node to claim a room's sequencer keeps it until it releases it.
+type cluster struct {
+	mu         sync.Mutex
+	nodes      []*clusterNode
+	sequencers map[uuid.UUID]*clusterNode
+}
+
+type clusterNode struct {
+	*MemoryBackend
+	cluster *cluster
+	hub     *Hub
+}
+
+func (c *cluster) join(store DiagramStore) *Hub {
+	n := &clusterNode{MemoryBackend: NewMemoryBackend(), cluster: c}
+	n.hub = NewHub(store, nil, n, config.RealtimeConfig{}, nil)
+	c.mu.Lock()
+	c.nodes = append(c.nodes, n)
+	c.mu.Unlock()
+	return n.hub
+}
+
+func (n *clusterNode) Publish(ctx context.Context, diagramID uuid.UUID, payload []byte) error {
+	n.cluster.mu.Lock()
+	nodes := append([]*clusterNode(nil), n.cluster.nodes...)
+	n.cluster.mu.Unlock()
+	for _, other := range nodes {
+		if other != n {
+			other.hub.deliverRemote(diagramID, payload)
+		}
+	}
+	return nil
+}
+
+func (n *clusterNode) ClaimSequencer(ctx context.Context, diagramID uuid.UUID) (bool, error) {
+	n.cluster.mu.Lock()
+	defer n.cluster.mu.Unlock()
+	if n.cluster.sequencers == nil {
+		n.cluster.sequencers = make(map[uuid.UUID]*clusterNode)
+	}
+	if n.cluster.sequencers[diagramID] == nil {
+		n.cluster.sequencers[diagramID] = n
+	}
+	return n.cluster.sequencers[diagramID] == n, nil
+}
+
+func (n *clusterNode) ReleaseSequencer(ctx context.Context, diagramID uuid.UUID) error {
+	n.cluster.mu.Lock()
+	defer n.cluster.mu.Unlock()
+	if n.cluster.sequencers[diagramID] == n {
+		delete(n.cluster.sequencers, diagramID)
+	}
+	return nil
+}
+
+// settle waits until no node has frames left to publish, i.e. every message was delivered.
+func (c *cluster) settle(t *testing.T) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		idle := true
+		for _, n := range c.nodes {
+			n.hub.pubMu.Lock()
+			idle = idle && len(n.hub.publishers) == 0
+			n.hub.pubMu.Unlock()
+		}
+		if idle {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("cluster did not settle")
+}
+
+func TestHub_TextOpsSequencedAcrossNodes(t *testing.T) {
+	c := &cluster{}
+	store := &memoryStore{diagramType: "flowchart", content: "graph LR"}
+	hubA, hubB := c.join(store), c.join(store)
+	diagramID := uuid.New()
+	a, b := newTestClient(hubA, diagramID), newTestClient(hubB, diagramID)
+	hubA.Register(a)
+	hubB.Register(b)
+	c.settle(t)
+	drain(t, a)
+	if frames := drain(t, b); len(framesOfType(frames, "resync")) != 0 {
+		t.Fatalf("joining an unchanged room resynced: %+v", frames)
+	}
+
+	// Concurrent edits on both nodes, both based on revision 0.
+	hubA.ApplyTextOp(a, "a1", 0, TextOperation{{Retain: 8}, {Insert: "\n  A"}})
+	hubB.ApplyTextOp(b, "b1", 0, TextOperation{{Insert: "%% x\n"}, {Retain: 8}})
+	c.settle(t)
+
+	want := "%% x\ngraph LR\n  A"
+	for name, h := range map[string]*Hub{"A": hubA, "B": hubB} {
+		r := h.roomOf(diagramID)
+		if got := r.doc.content(); got != want || r.doc.revision != 2 {
+			t.Errorf("node %s document = %q at revision %d, want %q at 2", name, got, r.doc.revision, want)
+		}
+	}
+	if acks := framesOfType(drain(t, b), "ack"); len(acks) != 1 || acks[0].ID != "b1" || acks[0].Revision != 2 {
+		t.Errorf("forwarded op acks = %+v, want b1 at revision 2", acks)
+	}
+	if ops := framesOfType(drain(t, a), "text_op"); len(ops) != 1 || ops[0].ID != "" || ops[0].ConnID != "" {
+		t.Errorf("text ops relayed to a = %+v, want b's op without its id", ops)
+	}
+	if saved := hubB.roomOf(diagramID); saved.dirty {
+		t.Error("a node that is not the sequencer marked the room dirty")
+	}
+}
+
+func TestHub_TextOpGapResyncs(t *testing.T) {
+	c := &cluster{}
+	store := &memoryStore{diagramType: "flowchart", content: "graph LR"}
+	hubA, hubB := c.join(store), c.join(store)
+	diagramID := uuid.New()
+	a, b := newTestClient(hubA, diagramID), newTestClient(hubB, diagramID)
+	hubA.Register(a)
+	hubB.Register(b)
+	c.settle(t)
+	drain(t, b)
+
+	// b misses revision 1, then sees revision 2.
+	r := hubA.roomOf(diagramID)
+	r.mu.Lock()
+	_, _, _ = r.doc.applyText(0, TextOperation{{Retain: 8}, {Insert: " A"}})
+	r.mu.Unlock()
+	hubA.ApplyTextOp(a, "a2", 1, TextOperation{{Retain: 10}, {Insert: " B"}})
+	c.settle(t)
+
+	frames := drain(t, b)
+	if ops := framesOfType(frames, "text_op"); len(ops) != 0 {
+		t.Errorf("relayed %+v after a gap, want no text ops", ops)
+	}
+	snaps := framesOfType(frames, "snapshot")
+	if len(framesOfType(frames, "resync")) != 1 || len(snaps) != 1 || snaps[0].Content != "graph LR A B" || snaps[0].Revision != 2 {
+		t.Errorf("frames after a gap = %+v, want resync and the sequencer's snapshot", frames)
+	}
+	if got := hubB.roomOf(diagramID).doc.content(); got != "graph LR A B" {
+		t.Errorf("node B document = %q after resync", got)
+	}
+}
+
+func TestHub_SequencerHandOver(t *testing.T) {
+	c := &cluster{}
+	store := &memoryStore{diagramType: "flowchart", content: "graph LR"}
+	hubA, hubB := c.join(store), c.join(store)
+	diagramID := uuid.New()
+	a, b := newTestClient(hubA, diagramID), newTestClient(hubB, diagramID)
+	hubA.Register(a)
+	hubB.Register(b)
+	c.settle(t)
+
+	hubA.Unregister(a)
+	deadline := time.Now().Add(time.Second)
+	for !isSequencer(hubB, diagramID) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if !isSequencer(hubB, diagramID) {
+		t.Fatal("the remaining node did not take over the room")
+	}
+	drain(t, b)
+	hubB.ApplyTextOp(b, "b1", 0, TextOperation{{Retain: 8}, {Insert: " A"}})
+	if acks := framesOfType(drain(t, b), "ack"); len(acks) != 1 || acks[0].Revision != 1 {
+		t.Errorf("acks after hand-over = %+v", acks)
+	}
+}
+
+func isSequencer(h *Hub, diagramID uuid.UUID) bool {
+	r := h.roomOf(diagramID)
+	if r == nil {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.sequencer
+}
@@ -0,0 +1,103 @@
+package realtime
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// Clients are told to reconnect after a random delay in this range so they do not all hit the
+	// remaining replicas at once.
+	restartRetryMin = 1 * time.Second
+	restartRetryMax = 5 * time.Second
+	// drainPoll is how often Shutdown checks whether every client has gone.
+	drainPoll = 50 * time.Millisecond
+)
+
+// Closing reports whether Shutdown has started; new sockets are refused from then on.
+func (h *Hub) Closing() bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.closing
+}
+
+// Shutdown drains the hub before the process exits: every client is sent server_restart with a
+// reconnect hint followed by a 1012 (service restart) close frame, Shutdown waits for the clients to
+// go (closing any left when ctx is done) and then persists unsaved room snapshots.
+// http.Server.Shutdown does not track hijacked connections, so call this first.
+func (h *Hub) Shutdown(ctx context.Context) error {
+	h.mu.Lock()
+	h.closing = true
+	var clients []*Client
+	for _, r := range h.rooms {
+		for c := range r.clients {
+			clients = append(clients, c)
+		}
+	}
+	h.mu.Unlock()
+
+	for _, c := range clients {
+		h.sendRestart(c)
+	}
+	if h.log != nil {
+		h.log.Info().Int("clients", len(clients)).Msg("realtime: draining collaboration sockets")
+	}
+
+	ticker := time.NewTicker(drainPoll)
+	defer ticker.Stop()
+	for h.clientCount() > 0 {
+		select {
+		case <-ctx.Done():
+			h.closeRemaining()
+			h.flush(context.Background())
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	h.flush(ctx)
+	// Other nodes still get the last edits and the final saved frames.
+	h.waitPublished(ctx)
+	return nil
+}
+
+// sendRestart queues server_restart and then a service-restart close frame; the write pump sends
+// both and stops, and the client's reply to the close ends its read pump.
+func (h *Hub) sendRestart(c *Client) {
+	retry := restartRetryMin + time.Duration(rand.Int63n(int64(restartRetryMax-restartRetryMin)))
+	h.sendTo(c, &Message{Type: "server_restart", RetryAfterMs: int(retry / time.Millisecond)})
+	c.mu.Lock()
+	c.closeFrame = websocket.FormatCloseMessage(websocket.CloseServiceRestart, "server restarting")
+	c.mu.Unlock()
+	c.closeSend()
+}
+
+func (h *Hub) clientCount() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	n := 0
+	for _, r := range h.rooms {
+		n += len(r.clients)
+	}
+	return n
+}
+
+// closeRemaining closes the connections of clients that did not answer the close frame in time.
+func (h *Hub) closeRemaining() {
+	h.mu.RLock()
+	var clients []*Client
+	for _, r := range h.rooms {
+		for c := range r.clients {
+			clients = append(clients, c)
+		}
+	}
+	h.mu.RUnlock()
+	for _, c := range clients {
+		_ = c.conn.Close()
+	}
+	if len(clients) > 0 && h.log != nil {
+		h.log.Warn().Int("clients", len(clients)).Msg("realtime: closed sockets that did not drain in time")
+	}
+}
@@ -0,0 +1,65 @@
+package realtime
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/devenock/d_weaver/config"
+	"github.com/google/uuid"
+)
+
+func TestHub_ShutdownDrainsClients(t *testing.T) {
+	hub := NewHub(nil, nil, nil, config.RealtimeConfig{}, nil)
+	diagramID := uuid.New()
+	c := newTestClient(hub, diagramID)
+	hub.Register(c)
+	drain(t, c)
+
+	done := make(chan error, 1)
+	go func() { done <- hub.Shutdown(context.Background()) }()
+	var frames [][]byte
+	closed := false
+	for deadline := time.Now().Add(time.Second); !closed && time.Now().Before(deadline); {
+		var more [][]byte
+		more, closed = c.out.take()
+		frames = append(frames, more...)
+		time.Sleep(time.Millisecond)
+	}
+	if len(frames) != 1 || !closed {
+		t.Fatalf("got %d frames (closed=%v), want server_restart then close", len(frames), closed)
+	}
+	var restart Message
+	if err := json.Unmarshal(frames[0], &restart); err != nil {
+		t.Fatal(err)
+	}
+	if restart.Type != "server_restart" || restart.RetryAfterMs < int(restartRetryMin/time.Millisecond) {
+		t.Errorf("frame = %+v, want server_restart with a reconnect hint", restart)
+	}
+	if code := int(c.closeFrame[0])<<8 | int(c.closeFrame[1]); code != 1012 {
+		t.Errorf("close code = %d, want 1012", code)
+	}
+
+	late := newTestClient(hub, diagramID)
+	hub.Register(late)
+	if msgs := drain(t, late); len(msgs) != 1 || msgs[0].Type != "server_restart" {
+		t.Errorf("client joining during shutdown got %+v, want only server_restart", msgs)
+	}
+	hub.Unregister(late)
+
+	select {
+	case <-done:
+		t.Fatal("Shutdown returned before the client left")
+	case <-time.After(2 * drainPoll):
+	}
+	hub.Unregister(c)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Shutdown = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Shutdown did not return after the last client left")
+	}
+}
@@ -0,0 +1,91 @@
+package realtime
+
+import (
+	"sort"
+
+	"github.com/devenock/d_weaver/internal/common"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// RoomStats is the backpressure state of one room on this node.
+type RoomStats struct {
+	DiagramID    uuid.UUID `json:"diagram_id"`
+	Clients      int       `json:"clients"`
+	Pending      int       `json:"pending"` // frames queued across the room's clients
+	Dropped      uint64    `json:"dropped"`
+	Coalesced    uint64    `json:"coalesced"`
+	Disconnected uint64    `json:"disconnected"`
+}
+
+// HubStats is the backpressure state of this node's hub. It names the diagrams being edited, so it is
+// served on the internal listener only.
+type HubStats struct {
+	Policy       string      `json:"slow_consumer_policy"`
+	MaxLag       int         `json:"slow_consumer_max_lag"`
+	Rooms        []RoomStats `json:"rooms"` // busiest (most pending) first
+	Dropped      uint64      `json:"dropped"`
+	Coalesced    uint64      `json:"coalesced"`
+	Disconnected uint64      `json:"disconnected"`
+}
+
+// newOutbox returns a client outbox configured with the hub's slow-consumer policy.
+func (h *Hub) newOutbox() *outbox {
+	return newOutbox(h.maxLag, h.slowPolicy)
+}
+
+// Stats returns per-room and total slow-consumer counters. Totals count since start; room counters
+// reset when a room is dropped after its last client leaves.
+func (h *Hub) Stats() HubStats {
+	out := HubStats{
+		Policy:       h.slowPolicy,
+		MaxLag:       h.maxLag,
+		Rooms:        []RoomStats{},
+		Dropped:      h.totals.dropped.Load(),
+		Coalesced:    h.totals.coalesced.Load(),
+		Disconnected: h.totals.disconnected.Load(),
+	}
+	h.mu.RLock()
+	for id, r := range h.rooms {
+		rs := RoomStats{
+			DiagramID:    id,
+			Clients:      len(r.clients),
+			Dropped:      r.stats.dropped.Load(),
+			Coalesced:    r.stats.coalesced.Load(),
+			Disconnected: r.stats.disconnected.Load(),
+		}
+		for c := range r.clients {
+			rs.Pending += c.out.pending()
+		}
+		out.Rooms = append(out.Rooms, rs)
+	}
+	h.mu.RUnlock()
+	sort.Slice(out.Rooms, func(i, j int) bool { return out.Rooms[i].Pending > out.Rooms[j].Pending })
+	return out
+}
+
+// logStats logs rooms whose slow-consumer counters moved since the last call.
+func (h *Hub) logStats() {
+	if h.log == nil {
+		return
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for id, r := range h.rooms {
+		dropped, coalesced, disconnected := r.stats.dropped.Load(), r.stats.coalesced.Load(), r.stats.disconnected.Load()
+		if dropped == r.loggedDropped && coalesced == r.loggedCoalesced && disconnected == r.loggedDisconnected {
+			continue
+		}
+		h.log.Warn().Str("diagram_id", id.String()).
+			Uint64("dropped", dropped-r.loggedDropped).
+			Uint64("coalesced", coalesced-r.loggedCoalesced).
+			Uint64("disconnected", disconnected-r.loggedDisconnected).
+			Msg("realtime: slow consumers in room")
+		r.loggedDropped, r.loggedCoalesced, r.loggedDisconnected = dropped, coalesced, disconnected
+	}
+}
+
+// Stats serves the hub's slow-consumer counters for this node.
+func (h *Handler) Stats(c *gin.Context) {
+	common.WriteOK(c, h.hub.Stats())
+}
@@ -0,0 +1,87 @@
+package realtime
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// TicketTTL is how long a WebSocket ticket stays redeemable.
+const TicketTTL = 30 * time.Second
+
+// Ticket is a single-use credential for opening one collaboration socket. It is bound to the user,
+// the diagram and the client IP it was issued to, so a leaked ticket is useless elsewhere.
+type Ticket struct {
+	UserID    uuid.UUID `json:"user_id"`
+	Email     string    `json:"email"`
+	DiagramID uuid.UUID `json:"diagram_id"`
+	ClientIP  string    `json:"client_ip"`
+}
+
+// TicketStore keeps issued tickets until they are redeemed or expire.
+type TicketStore interface {
+	// Put stores the ticket under id for ttl.
+	Put(ctx context.Context, id string, t Ticket, ttl time.Duration) error
+	// Take returns and deletes the ticket in one step; (nil, nil) when it is unknown or expired.
+	Take(ctx context.Context, id string) (*Ticket, error)
+}
+
+// newTicketID returns a random URL-safe ticket id.
+func newTicketID() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+type memoryTicket struct {
+	ticket    Ticket
+	expiresAt time.Time
+}
+
+// MemoryTicketStore is the single-node TicketStore (default when REDIS_URL is unset).
+type MemoryTicketStore struct {
+	mu      sync.Mutex
+	tickets map[string]memoryTicket
+}
+
+// NewMemoryTicketStore returns an in-process ticket store.
+func NewMemoryTicketStore() *MemoryTicketStore {
+	return &MemoryTicketStore{tickets: make(map[string]memoryTicket)}
+}
+
+// Put stores the ticket and prunes expired ones.
+func (s *MemoryTicketStore) Put(ctx context.Context, id string, t Ticket, ttl time.Duration) error {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, e := range s.tickets {
+		if now.After(e.expiresAt) {
+			delete(s.tickets, k)
+		}
+	}
+	s.tickets[id] = memoryTicket{ticket: t, expiresAt: now.Add(ttl)}
+	return nil
+}
+
+// Take redeems the ticket.
+func (s *MemoryTicketStore) Take(ctx context.Context, id string) (*Ticket, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.tickets[id]
+	if !ok {
+		return nil, nil
+	}
+	delete(s.tickets, id)
+	if time.Now().After(e.expiresAt) {
+		return nil, nil
+	}
+	return &e.ticket, nil
+}
+
+var _ TicketStore = (*MemoryTicketStore)(nil)
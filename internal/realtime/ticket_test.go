@@ -0,0 +1,103 @@
+package realtime
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/devenock/d_weaver/config"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+func TestMemoryTicketStore_SingleUseAndExpiry(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryTicketStore()
+	want := Ticket{UserID: uuid.New(), DiagramID: uuid.New(), ClientIP: "10.0.0.1"}
+	_ = s.Put(ctx, "a", want, time.Minute)
+	got, err := s.Take(ctx, "a")
+	if err != nil || got == nil || *got != want {
+		t.Fatalf("Take = %+v, %v; want %+v", got, err, want)
+	}
+	if again, _ := s.Take(ctx, "a"); again != nil {
+		t.Error("ticket redeemed twice")
+	}
+	_ = s.Put(ctx, "b", want, -time.Second)
+	if expired, _ := s.Take(ctx, "b"); expired != nil {
+		t.Error("expired ticket redeemed")
+	}
+}
+
+func TestHandler_TicketBoundToDiagramAndIP(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := NewMemoryTicketStore()
+	h := NewHandler(nil, nil, nil, store, config.RealtimeConfig{}, nil)
+	diagramID := uuid.New()
+	ticket := Ticket{UserID: uuid.New(), DiagramID: diagramID, ClientIP: "192.0.2.1"}
+
+	cases := []struct {
+		name      string
+		diagramID uuid.UUID
+		remote    string
+		forwarded string // X-Forwarded-For
+		ok        bool
+	}{
+		{"other diagram", uuid.New(), "192.0.2.1:1234", "", false},
+		{"other ip", diagramID, "198.51.100.7:1234", "", false},
+		{"match", diagramID, "192.0.2.1:1234", "", true},
+		{"spoofed forward", diagramID, "198.51.100.7:1234", "192.0.2.1", false},
+		{"trusted proxy", diagramID, "10.0.0.1:1234", "192.0.2.1", true},
+	}
+	for _, tc := range cases {
+		_ = store.Put(context.Background(), "t", ticket, time.Minute)
+		w := httptest.NewRecorder()
+		c, engine := gin.CreateTestContext(w)
+		if err := engine.SetTrustedProxies([]string{"10.0.0.1"}); err != nil {
+			t.Fatal(err)
+		}
+		c.Request = httptest.NewRequest(http.MethodGet, "/ws/collaboration/x?ticket=t", nil)
+		c.Request.RemoteAddr = tc.remote
+		if tc.forwarded != "" {
+			c.Request.Header.Set("X-Forwarded-For", tc.forwarded)
+		}
+		userID, _, ok := h.authenticate(c, tc.diagramID)
+		if ok != tc.ok {
+			t.Errorf("%s: ok = %v, want %v (status %d)", tc.name, ok, tc.ok, w.Code)
+		}
+		if ok && userID != ticket.UserID {
+			t.Errorf("%s: user = %s, want %s", tc.name, userID, ticket.UserID)
+		}
+	}
+}
+
+func TestHandler_QueryTokenDisabled(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	h := NewHandler(nil, nil, nil, NewMemoryTicketStore(), config.RealtimeConfig{AllowQueryToken: false}, nil)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, "/ws/collaboration/x?token=abc", nil)
+	if _, _, ok := h.authenticate(c, uuid.New()); ok || w.Code != http.StatusUnauthorized {
+		t.Errorf("query token accepted with allow_query_token=false (ok=%v, status %d)", ok, w.Code)
+	}
+}
+
+func TestHandler_CheckOrigin(t *testing.T) {
+	h := NewHandler(nil, nil, nil, nil, config.RealtimeConfig{}, []string{"https://app.example.com/"})
+	cases := map[string]bool{
+		"":                         true, // non-browser client
+		"https://app.example.com":  true,
+		"https://API.example.com":  true, // same host as the request
+		"https://evil.example.com": false,
+	}
+	for origin, want := range cases {
+		r := httptest.NewRequest(http.MethodGet, "http://api.example.com/ws/collaboration/x", nil)
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		if got := h.checkOrigin(r); got != want {
+			t.Errorf("checkOrigin(%q) = %v, want %v", origin, got, want)
+		}
+	}
+}
@@ -16,6 +16,13 @@ type InvitationEmailSender interface {
 	SendWorkspaceInvitation(toEmail, workspaceName, inviterEmail, joinLink string) error
 }
 
+// MembershipObserver is notified after a member's role changes or they are removed, e.g. so open
+// collaboration sockets can be re-checked. Optional.
+type MembershipObserver interface {
+	MemberRoleChanged(workspaceID, userID uuid.UUID, role model.Role)
+	MemberRemoved(workspaceID, userID uuid.UUID)
+}
+
 // Repository is the workspace persistence interface.
 type Repository interface {
 	Create(ctx context.Context, name, description, color string, tags []string, createdBy uuid.UUID) (*model.Workspace, error)
@@ -40,6 +47,7 @@ type Service struct {
 	invitationSender    InvitationEmailSender
 	invitationBaseURL   string
 	log                 logger.Logger // optional; when set, invitation email send failures are logged
+	observer            MembershipObserver // optional
 }
 
 // New returns a workspace service using the given repository.
@@ -54,6 +62,11 @@ func NewWithInvitationEmail(repo Repository, sender InvitationEmailSender, baseU
 	return &Service{repo: repo, invitationSender: sender, invitationBaseURL: baseURL, log: log}
 }
 
+// SetMembershipObserver registers o to be notified of role changes and removals.
+func (s *Service) SetMembershipObserver(o MembershipObserver) {
+	s.observer = o
+}
+
 // EnsureMember returns the member record or ErrForbidden if user is not a member.
 func (s *Service) EnsureMember(ctx context.Context, workspaceID, userID uuid.UUID) (*model.WorkspaceMember, error) {
 	m, err := s.repo.GetMember(ctx, workspaceID, userID)
@@ -249,6 +262,9 @@ func (s *Service) UpdateMemberRole(ctx context.Context, workspaceID, actorUserID
 	if !ok {
 		return nil, common.NewDomainError(common.CodeNotFound, "Member not found.", nil)
 	}
+	if s.observer != nil {
+		s.observer.MemberRoleChanged(workspaceID, targetUserID, role)
+	}
 	updated, err := s.repo.GetMember(ctx, workspaceID, targetUserID)
 	if err != nil || updated == nil {
 		return nil, common.NewDomainError(common.CodeInternalError, "Failed to get updated member.", err)
@@ -286,6 +302,9 @@ func (s *Service) RemoveMember(ctx context.Context, workspaceID, actorUserID, ta
 	if !ok {
 		return common.NewDomainError(common.CodeNotFound, "Member not found.", nil)
 	}
+	if s.observer != nil {
+		s.observer.MemberRemoved(workspaceID, targetUserID)
+	}
 	return nil
 }
 
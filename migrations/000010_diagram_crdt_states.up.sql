@@ -0,0 +1,7 @@
+-- DIAGRAM_CRDT_STATES: compacted CRDT update log for whiteboard/visual diagrams edited over the collaboration socket.
+-- The merged canvas itself is stored in diagrams.content.
+CREATE TABLE IF NOT EXISTS diagram_crdt_states (
+    diagram_id UUID PRIMARY KEY REFERENCES diagrams(id) ON DELETE CASCADE,
+    update_log JSONB NOT NULL DEFAULT '[]',
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
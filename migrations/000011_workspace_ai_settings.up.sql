@@ -0,0 +1,10 @@
+-- WORKSPACE_AI_SETTINGS (per-workspace AI provider override; absent row = server default)
+CREATE TABLE IF NOT EXISTS workspace_ai_settings (
+    workspace_id UUID PRIMARY KEY REFERENCES workspaces(id) ON DELETE CASCADE,
+    provider VARCHAR(50) NOT NULL,
+    model VARCHAR(255),
+    base_url TEXT,
+    api_key TEXT,
+    updated_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
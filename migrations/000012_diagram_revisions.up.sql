@@ -0,0 +1,11 @@
+-- DIAGRAM_REVISIONS (content a diagram was given by a whole-document change, e.g. an applied AI edit)
+CREATE TABLE IF NOT EXISTS diagram_revisions (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    diagram_id UUID NOT NULL REFERENCES diagrams(id) ON DELETE CASCADE,
+    user_id UUID REFERENCES users(id) ON DELETE SET NULL,
+    source VARCHAR(50) NOT NULL,
+    content TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_diagram_revisions_diagram_created ON diagram_revisions(diagram_id, created_at DESC);
@@ -0,0 +1,9 @@
+-- WORKSPACE_AI_STYLE_GUIDES (per-workspace conventions added to AI generate and edit prompts)
+CREATE TABLE IF NOT EXISTS workspace_ai_style_guides (
+    workspace_id UUID PRIMARY KEY REFERENCES workspaces(id) ON DELETE CASCADE,
+    direction VARCHAR(2),
+    naming TEXT,
+    instructions TEXT,
+    updated_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
@@ -0,0 +1,36 @@
+-- AI_JOBS (batch diagram generation into a workspace; private to the user who submitted it)
+CREATE TABLE IF NOT EXISTS ai_jobs (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    workspace_id UUID NOT NULL REFERENCES workspaces(id) ON DELETE CASCADE,
+    diagram_type VARCHAR(50),
+    status VARCHAR(20) NOT NULL DEFAULT 'pending',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    finished_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_ai_jobs_user_created ON ai_jobs(user_id, created_at DESC);
+
+-- AI_JOB_ITEMS (one description of a job; claimed by workers with FOR UPDATE SKIP LOCKED)
+CREATE TABLE IF NOT EXISTS ai_job_items (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    job_id UUID NOT NULL REFERENCES ai_jobs(id) ON DELETE CASCADE,
+    position INT NOT NULL,
+    title VARCHAR(255) NOT NULL,
+    description TEXT NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending',
+    diagram_id UUID REFERENCES diagrams(id) ON DELETE SET NULL,
+    conversation_id UUID REFERENCES ai_conversations(id) ON DELETE SET NULL,
+    attempts INT NOT NULL DEFAULT 0,
+    cached BOOLEAN NOT NULL DEFAULT FALSE,
+    error_code VARCHAR(50),
+    error_message TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    started_at TIMESTAMPTZ,
+    finished_at TIMESTAMPTZ,
+    UNIQUE (job_id, position)
+);
+
+CREATE INDEX IF NOT EXISTS idx_ai_job_items_pending ON ai_job_items(created_at, position) WHERE status = 'pending';
+CREATE INDEX IF NOT EXISTS idx_ai_job_items_running ON ai_job_items(started_at) WHERE status = 'running';